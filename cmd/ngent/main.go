@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -12,8 +13,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,6 +26,7 @@ import (
 	claudeagent "github.com/beyond5959/ngent/internal/agents/claude"
 	codexagent "github.com/beyond5959/ngent/internal/agents/codex"
 	cursoragent "github.com/beyond5959/ngent/internal/agents/cursor"
+	echoagent "github.com/beyond5959/ngent/internal/agents/echo"
 	geminiagent "github.com/beyond5959/ngent/internal/agents/gemini"
 	kimiagent "github.com/beyond5959/ngent/internal/agents/kimi"
 	opencodeagent "github.com/beyond5959/ngent/internal/agents/opencode"
@@ -61,13 +65,89 @@ func main() {
 	portFlag := flag.Int("port", 8686, "server listen port (1-65535)")
 	allowPublic := flag.Bool("allow-public", false, "allow listening on public interfaces (default false for loopback-only)")
 	debugFlag := flag.Bool("debug", false, "enable verbose debug logs, including ACP request/response payloads on stderr")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file; together with --tls-key serves HTTPS instead of plain HTTP")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for --tls-cert")
+	tlsRedirectPort := flag.Int("tls-redirect-port", 0, "optional plain HTTP port that redirects to HTTPS when TLS is enabled (0 disables)")
+	httpReadHeaderTimeout := flag.Duration("http-read-header-timeout", 10*time.Second, "maximum duration for reading request headers; guards against slow-header (slowloris) clients")
+	httpMaxHeaderBytes := flag.Int("http-max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers in bytes; 65536 is plenty for public deployments")
+	httpReadTimeout := flag.Duration("http-read-timeout", 0, "maximum duration for reading an entire request including the body (0 = no limit)")
+	httpWriteTimeout := flag.Duration("http-write-timeout", 0, "maximum duration for writing a non-streaming response (0 = no limit; SSE streams are exempt)")
+	httpIdleTimeout := flag.Duration("http-idle-timeout", 2*time.Minute, "maximum time an idle keep-alive connection stays open (0 = use --http-read-timeout)")
 	authToken := flag.String("auth-token", "", "optional bearer token for /v1/* endpoints")
+	adminToken := flag.String("admin-token", "", "optional elevated bearer token that enables /v1/admin/* endpoints")
 	dataPath := flag.String("data-path", defaultDataPath, "data directory for sqlite and uploaded attachments")
 	contextRecentTurns := flag.Int("context-recent-turns", 10, "number of recent user+assistant turns injected into each prompt")
 	contextMaxChars := flag.Int("context-max-chars", 20000, "maximum character budget for injected context prompt")
 	compactMaxChars := flag.Int("compact-max-chars", 4000, "maximum summary characters produced by compact endpoint")
+	compactContextMaxChars := flag.Int("compact-context-max-chars", 0, "maximum character budget for the prompt sent by the compact endpoint (0 = same as --context-max-chars)")
+	compactWait := flag.Duration("compact-wait", 0, "how long /compact waits for running turns on the thread to finish before returning 409 (0 = fail immediately)")
+	compactEmptyThreads := flag.Bool("compact-empty-threads", false, "run /compact even on threads with no summary and no visible turns (by default such requests are skipped without calling the agent)")
+	contextUserLabel := flag.String("context-user-label", "User", "role label for user messages in injected context")
+	contextAssistantLabel := flag.String("context-assistant-label", "Assistant", "role label for assistant messages in injected context")
+	contextFirstTurnPassthrough := flag.Bool("context-first-turn-passthrough", true, "send a thread's first turn input verbatim without the context wrapper (keeps slash-commands intact)")
+	contextScanTurns := flag.Int("context-scan-turns", 0, "maximum recent turns read to fill the context window when incomplete turns are skipped (0 = 5x context-recent-turns)")
+	contextSkipIncompleteTurns := flag.Bool("context-skip-incomplete-turns", false, "exclude failed, cancelled, and empty-response turns from injected context")
 	agentIdleTTL := flag.Duration("agent-idle-ttl", 5*time.Minute, "idle TTL before closing cached thread agent provider")
+	agentMaxLifetime := flag.Duration("agent-max-lifetime", 0, "maximum age of a cached thread agent provider before it is restarted at the next turn boundary (0 = unlimited)")
 	shutdownGraceTimeout := flag.Duration("shutdown-grace-timeout", 8*time.Second, "graceful shutdown timeout for active turns")
+	shutdownProgressInterval := flag.Duration("shutdown-progress-interval", defaultShutdownProgressInterval, "how often graceful shutdown logs shutdown.drain_progress while waiting for active turns")
+	sandboxHomeAgents := flag.String("sandbox-home-agents", "", "comma-separated agent ids to run with an isolated temporary HOME (supported: opencode)")
+	agentHandshakeTimeout := flag.Duration("agent-handshake-timeout", 60*time.Second, "maximum wait for each initialize, authenticate, session/new, or session/load reply of a stdio agent before the call fails (0 = bounded only by the turn; session/prompt is never bounded)")
+	sessionMetadataAgents := flag.String("session-metadata-agents", "", "comma-separated agent ids that receive thread title, systemPrompt, and metadata as _meta in ACP session/new (not supported: codex, claude)")
+	checkDB := flag.Bool("check-db", false, "run sqlite integrity and foreign key checks on the database, then exit (nonzero when problems are found)")
+	migrationTimeout := flag.Duration("migration-timeout", 2*time.Minute, "maximum time one attempt of the startup database migrations may take before it is abandoned (0 = no limit)")
+	migrationRetries := flag.Int("migration-retries", 2, "how many times failed or timed-out startup database migrations are retried before startup fails")
+	dbRotateDaily := flag.Bool("db-rotate-daily", false, "store data in a per-day sqlite file (ngent-YYYY-MM-DD.db) and switch to a new file after local midnight")
+	persistRawStopReasons := flag.Bool("persist-raw-stop-reasons", false, "store the stop reason exactly as the agent reported it and return it as rawStopReason in history")
+	persistPrompts := flag.Bool("persist-prompts", false, "store the exact injected prompt of each turn and return it as promptText in history (prompts contain thread history)")
+	maxDeltaRate := flag.Int("max-delta-rate", 0, "maximum message_delta SSE events per second per turn; faster deltas are coalesced without dropping text (0 = unlimited)")
+	emitTurnAccepted := flag.Bool("emit-turn-accepted", false, "send a turn_accepted SSE event before the agent is resolved; later start failures arrive as an SSE error event on the 200 stream")
+	emitTurnSteps := flag.Bool("emit-turn-steps", false, "tag turn events with stepId and phase (thinking, planning, tool_request, tool_result, answer) so clients can group them into steps")
+	recordDeltaOffsets := flag.Bool("record-delta-offsets", false, "add offsetMs (time since turn start, microsecond precision) to message_delta and reasoning_delta events")
+	emitTurnContext := flag.Bool("emit-turn-context", false, "record a turn_context event with agent, model, cwd, and context size/truncation at the start of each turn (prompt included only with --persist-prompts)")
+	emitEmptyResponse := flag.Bool("emit-empty-response", false, "record an empty_response event and set emptyResponse on turn_completed when a turn completes without any message text")
+	emitTurnSummary := flag.Bool("emit-turn-summary", false, "send a turn_summary SSE event with delta/char counts and duration after turn_completed")
+	enableDebugEndpoints := flag.Bool("enable-debug-endpoints", false, "allow debugging aids that expose injected prompts (e.g. ?debugPrompt=true on turns)")
+	disabledEndpointsFlag := flag.String("disabled-endpoints", "", `comma-separated /v1 endpoints to turn off with 403 FORBIDDEN, by logical name or "METHOD name", e.g. "compact,history,DELETE thread"`)
+	streamReplayEvents := flag.Int("stream-replay-events", 0, "replay up to N persisted events of a thread's earlier turns at the start of each turn stream (max 500, 0 = off)")
+	auditStreams := flag.Bool("audit-streams", false, "record stream_opened/stream_closed events (clientId, duration, bytes) in turn history for every SSE turn stream")
+	exposeAgentStderr := flag.Bool("expose-agent-stderr", false, "include the stderr tail of an agent that exited during startup in the turn error event (always logged)")
+	routeHints := flag.Bool("route-hints", true, "list valid thread subresources or known /v1 collections in NOT_FOUND responses for unknown /v1 paths")
+	htmlErrorPages := flag.Bool("html-error-pages", false, "serve HTML error pages for non-/v1 paths when the Accept header prefers text/html (/v1 stays JSON)")
+	webhookSecret := flag.String("webhook-secret", "", "HMAC secret that enables callbackUrl turn delivery (empty disables webhooks)")
+	webhookAllowedHosts := flag.String("webhook-allowed-hosts", "", "comma-separated callback hostnames allowed to resolve to loopback/private addresses")
+	maxPermissionCommandChars := flag.Int("max-permission-command-chars", 4096, "maximum characters of a provider-reported permission command/approval forwarded in permission events; longer values are truncated")
+	maxGlobalPendingPermissions := flag.Int("max-global-pending-permissions", 0, "maximum permission requests waiting across all turns; extra requests are auto-declined (0 = unlimited)")
+	maxPendingPermissions := flag.Int("max-pending-permissions", 64, "maximum permission requests one turn may have waiting; extra requests are auto-declined")
+	historyIncludeEvents := flag.Bool("history-include-events", false, "return turn events in history when includeEvents is not given (can make history responses much larger)")
+	historyIncludeInternal := flag.Bool("history-include-internal", false, "return internal compaction turns in history when includeInternal is not given")
+	maxCWDBytes := flag.Int("max-cwd-bytes", 4096, "maximum length in bytes of a new thread's cwd; longer paths get 400 INVALID_ARGUMENT")
+	maxCWDDepth := flag.Int("max-cwd-depth", 128, "maximum number of path components in a new thread's cwd; deeper paths get 400 INVALID_ARGUMENT")
+	maxThreadList := flag.Int("max-thread-list", 500, "maximum threads returned by GET /v1/threads; the response sets truncated when more exist")
+	maxTurnsPerThread := flag.Int("max-turns-per-thread", 0, "maximum non-internal turns one thread may hold; further turns get 409 CONFLICT (0 = unlimited)")
+	maxClientStoredBytes := flag.Int64("max-client-stored-bytes", 0, "maximum request+response text bytes one X-Client-ID may store across turns before new turns get 429 QUOTA_EXCEEDED (0 = unlimited)")
+	storeClientMetadata := flag.Bool("store-client-metadata", false, "store a record per X-Client-ID (first User-Agent, X-Client-Name, X-Client-Metadata) for GET /v1/clients/me")
+	maxTurnsPerClient := flag.Int("max-turns-per-client", 0, "maximum concurrently active turns per X-Client-ID across its threads (0 = unlimited)")
+	turnRetryAttempts := flag.Int("turn-retry-attempts", 1, "total attempts for a user turn whose agent fails transiently before producing output (1 disables retries)")
+	turnRetryBackoff := flag.Duration("turn-retry-backoff", 500*time.Millisecond, "delay before the first turn retry; doubles for each further retry")
+	defaultAgentOptionsFlag := flag.String("default-agent-options", "", `optional JSON map of agent id to agentOptions inherited by new threads, e.g. {"codex":{"modelId":"gpt-5"}}`)
+	stripInvalidInput := flag.Bool("strip-invalid-input", false, "drop invalid UTF-8 sequences and NUL bytes from turn input instead of rejecting the turn with 400 INVALID_ARGUMENT")
+	strictModelIDs := flag.Bool("strict-model-ids", false, "reject thread creation and agentOptions updates whose modelId is malformed or not among the agent's known models with 400 INVALID_ARGUMENT (by default such values fall back to the default model)")
+	canonicalAgentOptionKeys := flag.Bool("canonical-agent-option-keys", false, "rewrite known agentOptions keys sent in another casing (e.g. ModelId) to modelId, configOverrides, or sessionId; unknown keys are kept verbatim")
+	agentInitializeParamsFlag := flag.String("agent-initialize-params", "", `optional JSON map of agent id to ACP initialize param overrides for stdio agents (gemini, kimi, qwen, blackbox, opencode, cursor), e.g. {"gemini":{"clientCapabilities":{"fs":{"readTextFile":true}}}}`)
+	enableEchoAgent := flag.Bool("enable-echo-agent", false, `register the in-process ACP echo agent as agent id "echo" for protocol testing (prompts starting with "permission:" request approval first)`)
+	agentFileSystem := flag.Bool("agent-fs", false, `serve ACP fs read/write requests inside the thread cwd for threads whose agentOptions set "fileSystemAccess" to "read" or "write"`)
+	agentCWDRulesFlag := flag.String("agent-cwd-rules", "", `optional JSON map of agent id to extra cwd checks for new threads, e.g. {"gemini":{"maxDepth":12,"maxLength":200,"forbiddenChars":" #"}}`)
+	agentCapabilitiesFlag := flag.String("agent-capabilities", "", `optional JSON map of agent id to disabled operations, e.g. {"codex":{"disableCompact":true}}`)
+	dbQueueDepth := flag.Int("db-queue-depth", 0, "max concurrent GET /v1 requests waiting on the database; excess reads fail with 503 after --db-queue-timeout (0 = unlimited)")
+	maxAgentProcesses := flag.Int("max-agent-processes", 0, "maximum concurrently running agent subprocesses across all turns (0 = unlimited)")
+	maxTurnDeadline := flag.Duration("max-turn-deadline", time.Hour, "upper bound for the X-Turn-Deadline a client may request for one turn; longer values are clamped")
+	eventCompactionAfter := flag.Duration("event-compaction-after", 0, "collapse message_delta events of turns finished this long ago into one event (0 = off, minimum 1m)")
+	agentProcessWait := flag.Duration("agent-process-wait", 10*time.Second, "how long a turn waits for a free agent subprocess slot before failing with BUSY")
+	dbQueueTimeout := flag.Duration("db-queue-timeout", 2*time.Second, "how long a read waits for a database queue slot before failing with 503")
+	agentNamesFlag := flag.String("agent-names", "", `optional JSON map of agent id to display name shown in /v1/agents and agent lifecycle logs, e.g. {"codex":"Team Codex"}`)
+	webUIHeadersFlag := flag.String("webui-headers", "", `optional JSON map of response headers for the web UI merged over its security defaults; an empty value removes a default, e.g. {"Content-Security-Policy":"default-src 'self'","X-Frame-Options":""}`)
+	costRatesFlag := flag.String("cost-rates", "", `optional JSON map of agent id to token prices, e.g. {"codex":{"promptPerMillion":1.25,"completionPerMillion":10}}`)
 	flag.Parse()
 
 	logLevel := observability.LevelInfo
@@ -107,6 +187,70 @@ func main() {
 		logger.Error("startup.invalid_shutdown_grace_timeout", "value", shutdownGraceTimeout.String())
 		os.Exit(1)
 	}
+	if *httpReadHeaderTimeout <= 0 || *httpReadTimeout < 0 || *httpWriteTimeout < 0 || *httpIdleTimeout < 0 {
+		logger.Error("startup.invalid_http_timeouts",
+			"readHeaderTimeout", httpReadHeaderTimeout.String(),
+			"readTimeout", httpReadTimeout.String(),
+			"writeTimeout", httpWriteTimeout.String(),
+			"idleTimeout", httpIdleTimeout.String(),
+		)
+		os.Exit(1)
+	}
+	if *httpMaxHeaderBytes <= 0 {
+		logger.Error("startup.invalid_http_max_header_bytes", "value", *httpMaxHeaderBytes)
+		os.Exit(1)
+	}
+	sandboxHome, err := parseSandboxHomeAgents(*sandboxHomeAgents)
+	if err != nil {
+		logger.Error("startup.invalid_sandbox_home_agents", "error", err.Error(), "value", *sandboxHomeAgents)
+		os.Exit(1)
+	}
+	agentCallTimeouts := handshakeCallTimeouts(*agentHandshakeTimeout)
+	sessionMetadata, err := parseSessionMetadataAgents(*sessionMetadataAgents)
+	if err != nil {
+		logger.Error("startup.invalid_session_metadata_agents", "error", err.Error(), "value", *sessionMetadataAgents)
+		os.Exit(1)
+	}
+	disabledEndpoints := splitCommaList(*disabledEndpointsFlag)
+	if err := httpapi.ValidateDisabledEndpoints(disabledEndpoints); err != nil {
+		logger.Error("startup.invalid_disabled_endpoints", "error", err.Error(), "value", *disabledEndpointsFlag)
+		os.Exit(1)
+	}
+	costRates, err := parseCostRates(*costRatesFlag)
+	if err != nil {
+		logger.Error("startup.invalid_cost_rates", "error", err.Error())
+		os.Exit(1)
+	}
+	agentNames, err := parseAgentNames(*agentNamesFlag)
+	if err != nil {
+		logger.Error("startup.invalid_agent_names", "error", err.Error())
+		os.Exit(1)
+	}
+	webUIHeaders, err := parseWebUIHeaders(*webUIHeadersFlag)
+	if err != nil {
+		logger.Error("startup.invalid_webui_headers", "error", err.Error())
+		os.Exit(1)
+	}
+	agentInitializeParams, err := parseAgentInitializeParams(*agentInitializeParamsFlag)
+	if err != nil {
+		logger.Error("startup.invalid_agent_initialize_params", "error", err.Error())
+		os.Exit(1)
+	}
+	agentCapabilities, err := parseAgentCapabilities(*agentCapabilitiesFlag)
+	if err != nil {
+		logger.Error("startup.invalid_agent_capabilities", "error", err.Error())
+		os.Exit(1)
+	}
+	cwdValidators, err := parseAgentCWDRules(*agentCWDRulesFlag)
+	if err != nil {
+		logger.Error("startup.invalid_agent_cwd_rules", "error", err.Error())
+		os.Exit(1)
+	}
+	defaultAgentOptions, err := parseDefaultAgentOptions(*defaultAgentOptionsFlag)
+	if err != nil {
+		logger.Error("startup.invalid_default_agent_options", "error", err.Error())
+		os.Exit(1)
+	}
 
 	codexAvailable := codexPreflightErr == nil
 	opencodeAvailable := opencodePreflightErr == nil
@@ -137,6 +281,18 @@ func main() {
 		claudeAvailable,
 		cursorAvailable,
 	)
+	if *enableEchoAgent {
+		agents = append(agents, httpapi.AgentInfo{
+			ID:     agentimpl.AgentIDEcho,
+			Name:   "Echo (ACP test agent)",
+			Status: "available",
+		})
+	}
+	for i := range agents {
+		if name, ok := agentNames[agents[i].ID]; ok {
+			agents[i].Name = name
+		}
+	}
 	allowedAgentIDs := agentIDsFromInfos(agents)
 
 	listenAddr, port, err := resolveListenAddr(*portFlag, *allowPublic)
@@ -144,6 +300,16 @@ func main() {
 		logger.Error("startup.invalid_listen", "error", err.Error(), "port", *portFlag, "allowPublic", *allowPublic)
 		os.Exit(1)
 	}
+	tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey)
+	if err != nil {
+		logger.Error("startup.invalid_tls", "error", err.Error(), "certFile", *tlsCert, "keyFile", *tlsKey)
+		os.Exit(1)
+	}
+	redirectAddr, err := resolveTLSRedirectAddr(listenAddr, port, *tlsRedirectPort, tlsConfig != nil)
+	if err != nil {
+		logger.Error("startup.invalid_tls_redirect", "error", err.Error(), "port", *tlsRedirectPort)
+		os.Exit(1)
+	}
 
 	allowedRoots, err := resolveAllowedRoots()
 	if err != nil {
@@ -155,15 +321,59 @@ func main() {
 		logger.Error("startup.invalid_data_path", "error", err.Error(), "dataPath", *dataPath)
 		os.Exit(1)
 	}
-	dbPath := filepath.Join(filepath.Clean(*dataPath), "ngent.db")
+	baseDBPath := filepath.Join(filepath.Clean(*dataPath), "ngent.db")
+	dbPath := baseDBPath
+	if *dbRotateDaily {
+		dbPath = storage.DatedPath(baseDBPath, time.Now())
+	}
+
+	if *checkDB {
+		// Inspect the database as it is on disk: opening it through New would
+		// migrate it before the check runs.
+		store, err := storage.OpenReadOnly(dbPath)
+		if err != nil {
+			logger.Error("check_db.failed", "error", err.Error(), "dbPath", dbPath)
+			os.Exit(1)
+		}
+		problems, err := store.IntegrityCheck(context.Background())
+		_ = store.Close()
+		if err != nil {
+			logger.Error("check_db.failed", "error", err.Error(), "dbPath", dbPath)
+			os.Exit(1)
+		}
+		for _, problem := range problems {
+			logger.Error("check_db.problem", "problem", problem, "dbPath", dbPath)
+		}
+		if len(problems) > 0 {
+			logger.Error("check_db.corrupt", "problems", len(problems), "dbPath", dbPath)
+			os.Exit(1)
+		}
+		logger.Info("check_db.ok", "dbPath", dbPath)
+		os.Exit(0)
+	}
 
-	store, err := storage.New(dbPath)
+	storeOptions := []storage.Option{
+		storage.WithMigrationTimeout(*migrationTimeout),
+		storage.WithMigrationRetries(*migrationRetries),
+	}
+	store, err := storage.New(dbPath, storeOptions...)
 	if err != nil {
 		logger.Error("startup.storage_open_failed", "error", err.Error(), "dbPath", dbPath)
 		os.Exit(1)
 	}
+	if err := store.Ping(context.Background()); err != nil {
+		_ = store.Close()
+		logger.Error("startup.storage_ping_failed", "error", err.Error(), "dbPath", dbPath)
+		os.Exit(1)
+	}
+	rotator := &dailyStoreRotator{
+		basePath: baseDBPath,
+		options:  storeOptions,
+		logger:   logger,
+		current:  store,
+	}
 	defer func() {
-		if closeErr := store.Close(); closeErr != nil {
+		if closeErr := rotator.close(); closeErr != nil {
 			logger.Error("shutdown.storage_close_failed", "error", closeErr.Error())
 		}
 	}()
@@ -171,6 +381,7 @@ func main() {
 	turnController := runtime.NewTurnController()
 	handler := httpapi.New(httpapi.Config{
 		AuthToken:       *authToken,
+		AdminToken:      *adminToken,
 		DataDir:         *dataPath,
 		Agents:          agents,
 		AllowedAgentIDs: allowedAgentIDs,
@@ -181,6 +392,15 @@ func main() {
 			modelID := extractModelID(thread.AgentOptionsJSON)
 			sessionID := extractSessionID(thread.AgentOptionsJSON)
 			configOverrides := extractConfigOverrides(thread.AgentOptionsJSON)
+			fileSystemAccess := ""
+			if *agentFileSystem {
+				fileSystemAccess = httpapi.ThreadFileSystemAccess(thread.AgentOptionsJSON)
+			}
+			initializeParams := withFileSystemCapabilities(agentInitializeParams[thread.AgentID], fileSystemAccess)
+			var sessionMeta map[string]any
+			if sessionMetadata[thread.AgentID] {
+				sessionMeta = threadSessionMeta(thread)
+			}
 			switch thread.AgentID {
 			case agentimpl.AgentIDCodex:
 				return codexagent.New(codexagent.Config{
@@ -193,38 +413,54 @@ func main() {
 				})
 			case agentimpl.AgentIDOpencode:
 				return opencodeagent.New(opencodeagent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					SandboxHome:      sandboxHome[agentimpl.AgentIDOpencode],
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
 				})
 			case agentimpl.AgentIDGemini:
 				return geminiagent.New(geminiagent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
 				})
 			case agentimpl.AgentIDKimi:
 				return kimiagent.New(kimiagent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
 				})
 			case agentimpl.AgentIDQwen:
 				return qwenagent.New(qwenagent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
 				})
 			case agentimpl.AgentIDBlackbox:
 				return blackboxagent.New(blackboxagent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
 				})
 			case agentimpl.AgentIDClaude:
 				return claudeagent.New(claudeagent.Config{
@@ -236,10 +472,20 @@ func main() {
 				})
 			case agentimpl.AgentIDCursor:
 				return cursoragent.New(cursoragent.Config{
-					Dir:             thread.CWD,
-					ModelID:         modelID,
-					SessionID:       sessionID,
-					ConfigOverrides: configOverrides,
+					Dir:              thread.CWD,
+					ModelID:          modelID,
+					SessionID:        sessionID,
+					ConfigOverrides:  configOverrides,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
+					CallTimeouts:     agentCallTimeouts,
+				})
+			case agentimpl.AgentIDEcho:
+				return echoagent.New(echoagent.Config{
+					Dir:              thread.CWD,
+					SessionID:        sessionID,
+					InitializeParams: initializeParams,
+					SessionMeta:      sessionMeta,
 				})
 			default:
 				return nil, fmt.Errorf("unsupported thread agent %q", thread.AgentID)
@@ -268,42 +514,107 @@ func main() {
 				if geminiPreflightErr != nil {
 					return nil, geminiPreflightErr
 				}
-				return geminiagent.DiscoverModels(ctx, geminiagent.Config{Dir: modelDiscoveryDir})
+				return geminiagent.DiscoverModels(ctx, geminiagent.Config{Dir: modelDiscoveryDir, CallTimeouts: agentCallTimeouts})
 			case agentimpl.AgentIDKimi:
 				if kimiPreflightErr != nil {
 					return nil, kimiPreflightErr
 				}
-				return kimiagent.DiscoverModels(ctx, kimiagent.Config{Dir: modelDiscoveryDir})
+				return kimiagent.DiscoverModels(ctx, kimiagent.Config{Dir: modelDiscoveryDir, CallTimeouts: agentCallTimeouts})
 			case agentimpl.AgentIDQwen:
 				if qwenPreflightErr != nil {
 					return nil, qwenPreflightErr
 				}
-				return qwenagent.DiscoverModels(ctx, qwenagent.Config{Dir: modelDiscoveryDir})
+				return qwenagent.DiscoverModels(ctx, qwenagent.Config{Dir: modelDiscoveryDir, CallTimeouts: agentCallTimeouts})
 			case agentimpl.AgentIDBlackbox:
 				if blackboxPreflightErr != nil {
 					return nil, blackboxPreflightErr
 				}
-				return blackboxagent.DiscoverModels(ctx, blackboxagent.Config{Dir: modelDiscoveryDir})
+				return blackboxagent.DiscoverModels(ctx, blackboxagent.Config{Dir: modelDiscoveryDir, CallTimeouts: agentCallTimeouts})
 			case agentimpl.AgentIDOpencode:
 				if opencodePreflightErr != nil {
 					return nil, opencodePreflightErr
 				}
-				return opencodeagent.DiscoverModels(ctx, opencodeagent.Config{Dir: modelDiscoveryDir})
+				return opencodeagent.DiscoverModels(ctx, opencodeagent.Config{
+					Dir:          modelDiscoveryDir,
+					SandboxHome:  sandboxHome[agentimpl.AgentIDOpencode],
+					CallTimeouts: agentCallTimeouts,
+				})
 			case agentimpl.AgentIDCursor:
 				if cursorPreflightErr != nil {
 					return nil, cursorPreflightErr
 				}
-				return cursoragent.DiscoverModels(ctx, cursoragent.Config{Dir: modelDiscoveryDir})
+				return cursoragent.DiscoverModels(ctx, cursoragent.Config{Dir: modelDiscoveryDir, CallTimeouts: agentCallTimeouts})
+			case agentimpl.AgentIDEcho:
+				return echoagent.DiscoverModels(ctx, echoagent.Config{Dir: modelDiscoveryDir})
 			default:
 				return nil, fmt.Errorf("unsupported agent %q", agentID)
 			}
 		},
-		ContextRecentTurns: *contextRecentTurns,
-		ContextMaxChars:    *contextMaxChars,
-		CompactMaxChars:    *compactMaxChars,
-		AgentIdleTTL:       *agentIdleTTL,
-		Logger:             logger,
-		FrontendHandler:    webui.Handler(),
+		ContextRecentTurns:         *contextRecentTurns,
+		ContextMaxChars:            *contextMaxChars,
+		CompactMaxChars:            *compactMaxChars,
+		CompactContextMaxChars:     *compactContextMaxChars,
+		ContextSkipIncompleteTurns: *contextSkipIncompleteTurns,
+		ContextScanTurns:           *contextScanTurns,
+		EnableAgentFileSystem:      *agentFileSystem,
+		FirstTurnPassthrough:       contextFirstTurnPassthrough,
+		RouteHints:                 routeHints,
+		HTMLErrorPages:             *htmlErrorPages,
+		CompactEmptyThreads:        *compactEmptyThreads,
+		StrictModelIDs:             *strictModelIDs,
+		CanonicalAgentOptionKeys:   *canonicalAgentOptionKeys,
+		StripInvalidInput:          *stripInvalidInput,
+		DisabledEndpoints:          disabledEndpoints,
+		ExposeAgentStderr:          *exposeAgentStderr,
+		CompactWaitForActiveTurn:   *compactWait,
+		ContextUserLabel:           *contextUserLabel,
+		ContextAssistantLabel:      *contextAssistantLabel,
+		AgentIdleTTL:               *agentIdleTTL,
+		AgentMaxLifetime:           *agentMaxLifetime,
+		CostRates:                  costRates,
+		AgentCapabilities:          agentCapabilities,
+		CWDValidators:              cwdValidators,
+		DBQueueDepth:               *dbQueueDepth,
+		DBQueueTimeout:             *dbQueueTimeout,
+		MaxAgentProcesses:          *maxAgentProcesses,
+		AgentProcessWait:           *agentProcessWait,
+		EventCompactionAfter:       *eventCompactionAfter,
+		MaxTurnDeadline:            *maxTurnDeadline,
+		DefaultAgentOptions:        defaultAgentOptions,
+		MaxActiveTurnsPerClient:    *maxTurnsPerClient,
+		MaxClientStoredBytes:       *maxClientStoredBytes,
+		MaxTurnsPerThread:          *maxTurnsPerThread,
+		StoreClientMetadata:        *storeClientMetadata,
+		MaxThreadList:              *maxThreadList,
+		MaxCWDBytes:                *maxCWDBytes,
+		MaxCWDDepth:                *maxCWDDepth,
+		MaxPendingPermissions:      *maxPendingPermissions,
+		MaxPermissionCommandChars:  *maxPermissionCommandChars,
+		EnableDebugEndpoints:       *enableDebugEndpoints,
+		EmitTurnSummary:            *emitTurnSummary,
+		EmitEmptyResponse:          *emitEmptyResponse,
+		EmitTurnContext:            *emitTurnContext,
+		EmitTurnSteps:              *emitTurnSteps,
+		RecordDeltaOffsets:         *recordDeltaOffsets,
+		StreamReplayEvents:         *streamReplayEvents,
+		AuditStreams:               *auditStreams,
+		EmitTurnAccepted:           *emitTurnAccepted,
+		MaxDeltaRate:               *maxDeltaRate,
+		PersistPrompts:             *persistPrompts,
+		PersistRawStopReasons:      *persistRawStopReasons,
+		WebhookSecret:              *webhookSecret,
+		WebhookAllowedHosts:        splitCommaList(*webhookAllowedHosts),
+		Logger:                     logger,
+		FrontendHandler:            webui.HandlerWithHeaders(webUIHeaders),
+		HistoryDefaults: httpapi.HistoryDefaults{
+			IncludeEvents:   *historyIncludeEvents,
+			IncludeInternal: *historyIncludeInternal,
+		},
+		MaxGlobalPendingPermissions: *maxGlobalPendingPermissions,
+		TurnRetry: httpapi.TurnRetryPolicy{
+			MaxAttempts: *turnRetryAttempts,
+			Backoff:     *turnRetryBackoff,
+		},
 	})
 	defer func() {
 		if closeErr := handler.Close(); closeErr != nil {
@@ -316,23 +627,54 @@ func main() {
 		}
 	}()
 
-	srv := &http.Server{
-		Addr:              listenAddr,
-		Handler:           handler,
-		ReadHeaderTimeout: 10 * time.Second,
+	rotator.swapper = handler
+
+	limits := httpServerLimits{
+		ReadHeaderTimeout: *httpReadHeaderTimeout,
+		ReadTimeout:       *httpReadTimeout,
+		WriteTimeout:      *httpWriteTimeout,
+		IdleTimeout:       *httpIdleTimeout,
+		MaxHeaderBytes:    *httpMaxHeaderBytes,
+	}
+	srv := newHTTPServer(listenAddr, handler, limits)
+	srv.TLSConfig = tlsConfig
+	var redirectSrv *http.Server
+	if redirectAddr != "" {
+		redirectSrv = newHTTPServer(redirectAddr, httpsRedirectHandler(port), limits)
 	}
 
-	printStartupBanner(os.Stderr, port, agents, listenAddr)
+	printStartupBanner(os.Stderr, port, agents, listenAddr, tlsConfig != nil)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if *dbRotateDaily {
+		go rotator.run(ctx)
+	}
+
 	go func() {
 		<-ctx.Done()
-		gracefulShutdown(context.Background(), logger, srv, turnController, *shutdownGraceTimeout)
+		if redirectSrv != nil {
+			_ = redirectSrv.Close()
+		}
+		gracefulShutdown(context.Background(), logger, srv, turnController, *shutdownGraceTimeout, *shutdownProgressInterval)
 	}()
 
-	err = srv.ListenAndServe()
+	if redirectSrv != nil {
+		go func() {
+			logger.Info("server.tls_redirect_listening", "addr", redirectSrv.Addr)
+			if serveErr := redirectSrv.ListenAndServe(); serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+				logger.Error("server.tls_redirect_failed", "error", serveErr.Error())
+			}
+		}()
+	}
+
+	if tlsConfig != nil {
+		// Certificates are already loaded into srv.TLSConfig.
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Error("server.listen_failed", "error", err.Error())
 		os.Exit(1)
@@ -369,6 +711,23 @@ func extractSessionID(agentOptionsJSON string) string {
 	return strings.TrimSpace(opts.SessionID)
 }
 
+// withFileSystemCapabilities advertises the fs capabilities matching access
+// on top of the operator initialize overrides. Empty access leaves params
+// unchanged, so agents keep the fail-closed defaults.
+func withFileSystemCapabilities(params map[string]any, access string) map[string]any {
+	if access == "" {
+		return params
+	}
+	return agentutil.MergeInitializeParams(params, map[string]any{
+		"clientCapabilities": map[string]any{
+			"fs": map[string]any{
+				"readTextFile":  true,
+				"writeTextFile": access == "write",
+			},
+		},
+	})
+}
+
 func extractConfigOverrides(agentOptionsJSON string) map[string]string {
 	var opts struct {
 		ConfigOverrides map[string]any `json:"configOverrides"`
@@ -482,6 +841,345 @@ func resolveListenAddr(port int, allowPublic bool) (string, int, error) {
 	return listenAddr, port, nil
 }
 
+// httpServerLimits holds the connection hardening knobs applied to every
+// listener.
+type httpServerLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// newHTTPServer builds an http.Server with the given limits. Requests whose
+// headers exceed MaxHeaderBytes are rejected with 431 by net/http.
+func newHTTPServer(addr string, handler http.Handler, limits httpServerLimits) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+	}
+}
+
+// loadTLSConfig loads the --tls-cert/--tls-key pair. It returns nil when
+// neither is set so the server keeps serving plain HTTP.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	certFile = strings.TrimSpace(certFile)
+	keyFile = strings.TrimSpace(keyFile)
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// resolveTLSRedirectAddr returns the listen address of the plain HTTP
+// redirect listener, or "" when it is disabled.
+func resolveTLSRedirectAddr(listenAddr string, port, redirectPort int, tlsEnabled bool) (string, error) {
+	if redirectPort == 0 {
+		return "", nil
+	}
+	if !tlsEnabled {
+		return "", errors.New("--tls-redirect-port requires --tls-cert and --tls-key")
+	}
+	if redirectPort < 1 || redirectPort > 65535 {
+		return "", fmt.Errorf("invalid redirect port %d: must be between 1 and 65535", redirectPort)
+	}
+	if redirectPort == port {
+		return "", fmt.Errorf("redirect port %d must differ from the HTTPS port", redirectPort)
+	}
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", fmt.Errorf("split listen addr: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(redirectPort)), nil
+}
+
+// httpsRedirectHandler permanently redirects every request to the same host
+// and path on the HTTPS port.
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(httpsPort)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// parseSandboxHomeAgents parses the --sandbox-home-agents flag into a set of
+// agent IDs. Only providers that implement HOME isolation are accepted.
+func parseSandboxHomeAgents(raw string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		agentID := strings.ToLower(strings.TrimSpace(part))
+		if agentID == "" {
+			continue
+		}
+		switch agentID {
+		case agentimpl.AgentIDOpencode:
+			result[agentID] = true
+		default:
+			return nil, fmt.Errorf("agent %q does not support sandboxed HOME", agentID)
+		}
+	}
+	return result, nil
+}
+
+// parseSessionMetadataAgents parses the --session-metadata-agents flag into a
+// set of agent IDs. The embedded codex and claude providers have no ACP
+// session/new to carry _meta and are rejected.
+func parseSessionMetadataAgents(raw string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, agentID := range splitCommaList(raw) {
+		agentID = strings.ToLower(agentID)
+		switch agentID {
+		case agentimpl.AgentIDOpencode, agentimpl.AgentIDGemini, agentimpl.AgentIDKimi,
+			agentimpl.AgentIDQwen, agentimpl.AgentIDBlackbox, agentimpl.AgentIDCursor, agentimpl.AgentIDEcho:
+			result[agentID] = true
+		default:
+			return nil, fmt.Errorf("agent %q does not support session metadata", agentID)
+		}
+	}
+	return result, nil
+}
+
+// handshakeCallTimeouts bounds the ACP setup calls of stdio agents by
+// timeout, leaving session/prompt to the turn context. A non-positive
+// timeout returns nil.
+func handshakeCallTimeouts(timeout time.Duration) map[string]time.Duration {
+	if timeout <= 0 {
+		return nil
+	}
+	return map[string]time.Duration{
+		"initialize":   timeout,
+		"authenticate": timeout,
+		"session/new":  timeout,
+		"session/load": timeout,
+	}
+}
+
+// threadSessionMeta builds the session/new _meta for thread: its id and title
+// plus the optional agentOptions.systemPrompt string and agentOptions.metadata
+// object, all under the "ngent" key. Blank values are left out.
+func threadSessionMeta(thread storage.Thread) map[string]any {
+	info := map[string]any{"threadId": thread.ThreadID}
+	if title := strings.TrimSpace(thread.Title); title != "" {
+		info["title"] = title
+	}
+	var opts struct {
+		SystemPrompt string         `json:"systemPrompt"`
+		Metadata     map[string]any `json:"metadata"`
+	}
+	if strings.TrimSpace(thread.AgentOptionsJSON) != "" {
+		_ = json.Unmarshal([]byte(thread.AgentOptionsJSON), &opts)
+	}
+	if prompt := strings.TrimSpace(opts.SystemPrompt); prompt != "" {
+		info["systemPrompt"] = prompt
+	}
+	if len(opts.Metadata) > 0 {
+		info["metadata"] = opts.Metadata
+	}
+	return map[string]any{"ngent": info}
+}
+
+// splitCommaList splits a comma-separated flag value, dropping empty items.
+func splitCommaList(raw string) []string {
+	var items []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
+
+// parseCostRates parses the --cost-rates flag. An empty value disables cost
+// estimates; negative prices are rejected.
+func parseCostRates(raw string) (map[string]httpapi.CostRate, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]httpapi.CostRate
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode cost rates: %w", err)
+	}
+	result := make(map[string]httpapi.CostRate, len(decoded))
+	for agentID, rate := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if agentID == "" {
+			return nil, fmt.Errorf("cost rates contain an empty agent id")
+		}
+		if rate.PromptPerMillion < 0 || rate.CompletionPerMillion < 0 {
+			return nil, fmt.Errorf("cost rate for agent %q must not be negative", agentID)
+		}
+		result[agentID] = rate
+	}
+	return result, nil
+}
+
+// parseAgentNames parses the --agent-names flag. Keys must be known agent
+// ids and names must be non-blank.
+func parseAgentNames(raw string) (map[string]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode agent names: %w", err)
+	}
+	knownIDs := append(agentimpl.AllAgentIDs(), agentimpl.AgentIDEcho)
+	names := make(map[string]string, len(decoded))
+	for agentID, name := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if !slices.Contains(knownIDs, agentID) {
+			return nil, fmt.Errorf("unknown agent %q", agentID)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("agent %q: display name must not be blank", agentID)
+		}
+		names[agentID] = name
+	}
+	return names, nil
+}
+
+// parseWebUIHeaders parses the --webui-headers flag. Header names must be
+// HTTP tokens and values must not contain control characters; an empty value
+// drops a default header.
+func parseWebUIHeaders(raw string) (map[string]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode web UI headers: %w", err)
+	}
+	for name, value := range decoded {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+		}) >= 0 {
+			return nil, fmt.Errorf("web UI header name %q is invalid", name)
+		}
+		if strings.IndexFunc(value, func(r rune) bool { return (r < ' ' && r != '\t') || r == 0x7f }) >= 0 {
+			return nil, fmt.Errorf("web UI header %q has an invalid value", name)
+		}
+	}
+	return decoded, nil
+}
+
+// parseAgentCapabilities parses the --agent-capabilities flag. An empty value
+// allows every operation for every agent.
+func parseAgentCapabilities(raw string) (map[string]httpapi.AgentCapabilities, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]httpapi.AgentCapabilities
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode agent capabilities: %w", err)
+	}
+	result := make(map[string]httpapi.AgentCapabilities, len(decoded))
+	for agentID, capabilities := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if agentID == "" {
+			return nil, fmt.Errorf("agent capabilities contain an empty agent id")
+		}
+		result[agentID] = capabilities
+	}
+	return result, nil
+}
+
+// parseAgentCWDRules parses the --agent-cwd-rules flag into per-agent cwd
+// validators. An empty value adds no checks.
+func parseAgentCWDRules(raw string) (map[string]httpapi.CWDValidator, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]httpapi.CWDRules
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode agent cwd rules: %w", err)
+	}
+	result := make(map[string]httpapi.CWDValidator, len(decoded))
+	for agentID, rules := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if agentID == "" {
+			return nil, fmt.Errorf("agent cwd rules contain an empty agent id")
+		}
+		if rules.MaxDepth < 0 || rules.MaxLength < 0 {
+			return nil, fmt.Errorf("agent cwd rules for %q: limits must not be negative", agentID)
+		}
+		result[agentID] = rules.Validate
+	}
+	return result, nil
+}
+
+// parseAgentInitializeParams parses the --agent-initialize-params flag: a
+// JSON object mapping agent id to ACP initialize param overrides.
+func parseAgentInitializeParams(raw string) (map[string]map[string]any, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]map[string]any
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode agent initialize params: %w", err)
+	}
+	result := make(map[string]map[string]any, len(decoded))
+	for agentID, params := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if agentID == "" {
+			return nil, fmt.Errorf("agent initialize params contain an empty agent id")
+		}
+		if err := agentutil.ValidateInitializeParams(params); err != nil {
+			return nil, fmt.Errorf("agent %q: %w", agentID, err)
+		}
+		result[agentID] = params
+	}
+	return result, nil
+}
+
+// parseDefaultAgentOptions parses the --default-agent-options flag: a JSON
+// object mapping agent id to an agentOptions object.
+func parseDefaultAgentOptions(raw string) (map[string]map[string]any, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var decoded map[string]map[string]any
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return nil, fmt.Errorf("decode default agent options: %w", err)
+	}
+	result := make(map[string]map[string]any, len(decoded))
+	for agentID, options := range decoded {
+		agentID = strings.ToLower(strings.TrimSpace(agentID))
+		if agentID == "" {
+			return nil, fmt.Errorf("default agent options contain an empty agent id")
+		}
+		result[agentID] = options
+	}
+	return result, nil
+}
+
 func logStartupPreflight(logger *observability.Logger, event string, err error) {
 	if logger == nil || err == nil {
 		return
@@ -498,6 +1196,7 @@ func gracefulShutdown(
 	srv *http.Server,
 	turns *runtime.TurnController,
 	timeout time.Duration,
+	progressEvery time.Duration,
 ) {
 	if baseCtx == nil {
 		baseCtx = context.Background()
@@ -508,6 +1207,9 @@ func gracefulShutdown(
 	if timeout <= 0 {
 		timeout = 8 * time.Second
 	}
+	if progressEvery <= 0 {
+		progressEvery = defaultShutdownProgressInterval
+	}
 
 	activeAtStart := 0
 	if turns != nil {
@@ -520,34 +1222,187 @@ func gracefulShutdown(
 
 	shutdownCtx, cancel := context.WithTimeout(baseCtx, timeout)
 	defer cancel()
-	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.Canceled) {
-		logger.Warn("shutdown.http_server", "error", err.Error())
-	}
+	// Streaming turns keep their connections open, so srv.Shutdown usually
+	// returns only once they end. Run it alongside the drain below so
+	// progress is logged while it waits.
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Warn("shutdown.http_server", "error", err.Error())
+		}
+	}()
+	defer func() { <-httpDone }()
 
 	if turns == nil {
 		return
 	}
 
-	if err := turns.WaitForIdle(shutdownCtx); err == nil {
+	if err := waitForIdleWithProgress(shutdownCtx, logger, turns, progressEvery); err == nil {
 		logger.Info("shutdown.turns_drained")
 		return
 	}
 
+	remaining := turns.ActiveTurnIDs()
 	cancelled := turns.CancelAll()
 	logger.Warn("shutdown.force_cancel_turns",
 		"cancelledCount", cancelled,
+		"turnIds", strings.Join(remaining, ","),
 		"activeTurnsAfterCancel", turns.ActiveCount(),
 	)
 
 	forceCtx, forceCancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer forceCancel()
 	if err := turns.WaitForIdle(forceCtx); err != nil {
-		logger.Warn("shutdown.turns_not_fully_drained", "error", err.Error(), "activeTurns", turns.ActiveCount())
+		logger.Warn("shutdown.turns_not_fully_drained",
+			"error", err.Error(),
+			"activeTurns", turns.ActiveCount(),
+			"turnIds", strings.Join(turns.ActiveTurnIDs(), ","),
+		)
 		return
 	}
 	logger.Info("shutdown.turns_drained_after_force_cancel")
 }
 
+// waitForIdleWithProgress waits like WaitForIdle and logs
+// shutdown.drain_progress every interval while turns are still active.
+func waitForIdleWithProgress(ctx context.Context, logger *observability.Logger, turns *runtime.TurnController, interval time.Duration) error {
+	startedAt := time.Now()
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, interval)
+		err := turns.WaitForIdle(waitCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger.Info("shutdown.drain_progress",
+			"activeTurns", turns.ActiveCount(),
+			"elapsed", time.Since(startedAt).Round(time.Millisecond).String(),
+		)
+	}
+}
+
+// storeSwapper is the part of the HTTP handler used by daily store rotation.
+type storeSwapper interface {
+	SwapStore(ctx context.Context, next httpapi.ThreadStore) (httpapi.ThreadStore, error)
+}
+
+const (
+	defaultStoreRotateRetry    = time.Minute
+	defaultStoreRotateSwapWait = 30 * time.Second
+
+	defaultShutdownProgressInterval = time.Second
+)
+
+// dailyStoreRotator switches the server to a date-stamped sqlite file after
+// each local midnight. The swap waits for in-flight requests (including
+// streaming turns) to finish; if they do not drain in time the old store is
+// kept and the swap is retried later.
+type dailyStoreRotator struct {
+	basePath string
+	options  []storage.Option
+	swapper  storeSwapper
+	logger   *observability.Logger
+	now      func() time.Time
+	retry    time.Duration
+	swapWait time.Duration
+
+	mu      sync.Mutex
+	current *storage.Store
+}
+
+func (r *dailyStoreRotator) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *dailyStoreRotator) run(ctx context.Context) {
+	retry := r.retry
+	if retry <= 0 {
+		retry = defaultStoreRotateRetry
+	}
+	for {
+		now := r.clock()
+		wait := nextLocalMidnight(now).Sub(now)
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if r.rotate(ctx) {
+				break
+			}
+			wait = retry
+		}
+	}
+}
+
+// rotate opens the store for the current day and swaps it in. It reports
+// whether the server is now on the current day's file.
+func (r *dailyStoreRotator) rotate(ctx context.Context) bool {
+	path := storage.DatedPath(r.basePath, r.clock())
+	r.mu.Lock()
+	current := r.current
+	r.mu.Unlock()
+	if current != nil && current.Path() == path {
+		return true
+	}
+
+	next, err := storage.New(path, r.options...)
+	if err != nil {
+		r.logger.Warn("storage.rotate_open_failed", "error", err.Error(), "dbPath", path)
+		return false
+	}
+	swapWait := r.swapWait
+	if swapWait <= 0 {
+		swapWait = defaultStoreRotateSwapWait
+	}
+	swapCtx, cancel := context.WithTimeout(ctx, swapWait)
+	_, err = r.swapper.SwapStore(swapCtx, next)
+	cancel()
+	if err != nil {
+		_ = next.Close()
+		r.logger.Warn("storage.rotate_deferred", "error", err.Error(), "dbPath", path)
+		return false
+	}
+
+	r.mu.Lock()
+	previous := r.current
+	r.current = next
+	r.mu.Unlock()
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			r.logger.Warn("storage.rotate_close_previous_failed", "error", err.Error(), "dbPath", previous.Path())
+		}
+	}
+	r.logger.Info("storage.rotated", "dbPath", path)
+	return true
+}
+
+func (r *dailyStoreRotator) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+func nextLocalMidnight(now time.Time) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+}
+
 func resolveAllowedRoots() ([]string, error) {
 	root := filepath.Clean(string(filepath.Separator))
 	if !filepath.IsAbs(root) {
@@ -607,7 +1462,7 @@ func startupBannerSupportsANSI(out io.Writer) bool {
 // getLANURL returns the LAN-accessible URL for the given listen address.
 // It returns the URL and true if the server is listening on a LAN-accessible interface.
 // It returns empty string and false for loopback-only binds.
-func getLANURL(listenAddr string) (string, bool) {
+func getLANURL(listenAddr string, scheme string) (string, bool) {
 	host, port, err := net.SplitHostPort(strings.TrimSpace(listenAddr))
 	if err != nil {
 		return "", false
@@ -631,12 +1486,12 @@ func getLANURL(listenAddr string) (string, bool) {
 		lanIP = host
 	}
 
-	url := "http://" + net.JoinHostPort(lanIP, port) + "/"
+	url := scheme + "://" + net.JoinHostPort(lanIP, port) + "/"
 	return url, true
 }
 
 // printStartupBanner prints a beautiful startup banner with server info.
-func printStartupBanner(out io.Writer, port int, agents []httpapi.AgentInfo, listenAddr string) {
+func printStartupBanner(out io.Writer, port int, agents []httpapi.AgentInfo, listenAddr string, tlsEnabled bool) {
 	if out == nil {
 		return
 	}
@@ -645,9 +1500,13 @@ func printStartupBanner(out io.Writer, port int, agents []httpapi.AgentInfo, lis
 	_, _ = fmt.Fprintln(out)
 
 	// Server info box
-	lanURL, isLAN := getLANURL(listenAddr)
+	scheme := "http"
+	if tlsEnabled {
+		scheme = "https"
+	}
+	lanURL, isLAN := getLANURL(listenAddr, scheme)
 	mode := "Local"
-	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+	url := fmt.Sprintf("%s://127.0.0.1:%d/", scheme, port)
 	if isLAN {
 		mode = "LAN"
 		url = lanURL
@@ -3,9 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,8 +23,11 @@ import (
 	"testing"
 	"time"
 
+	echoagent "github.com/beyond5959/ngent/internal/agents/echo"
+	"github.com/beyond5959/ngent/internal/httpapi"
 	"github.com/beyond5959/ngent/internal/observability"
 	"github.com/beyond5959/ngent/internal/runtime"
+	"github.com/beyond5959/ngent/internal/storage"
 )
 
 func TestResolveListenAddr(t *testing.T) {
@@ -254,7 +267,7 @@ func TestGracefulShutdownForceCancelsTurns(t *testing.T) {
 	}
 
 	logger := observability.NewLoggerWithWriter(io.Discard, observability.LevelInfo)
-	gracefulShutdown(context.Background(), logger, &http.Server{}, controller, 50*time.Millisecond)
+	gracefulShutdown(context.Background(), logger, &http.Server{}, controller, 50*time.Millisecond, 0)
 
 	select {
 	case <-cancelled:
@@ -263,8 +276,70 @@ func TestGracefulShutdownForceCancelsTurns(t *testing.T) {
 	}
 }
 
+func TestGracefulShutdownLogsDrainProgress(t *testing.T) {
+	controller := runtime.NewTurnController()
+	if err := controller.Activate("th-1", "ses-1", "tu-1", func() {}); err != nil {
+		t.Fatalf("Activate() unexpected error: %v", err)
+	}
+	releaseTimer := time.AfterFunc(250*time.Millisecond, func() { controller.Release("th-1", "ses-1", "tu-1") })
+	defer releaseTimer.Stop()
+
+	var buf bytes.Buffer
+	logger := observability.NewLoggerWithWriter(&buf, observability.LevelInfo)
+	gracefulShutdown(context.Background(), logger, &http.Server{}, controller, 2*time.Second, 50*time.Millisecond)
+
+	logs := buf.String()
+	if !strings.Contains(logs, "shutdown.drain_progress") {
+		t.Fatalf("logs missing shutdown.drain_progress:\n%s", logs)
+	}
+	if !strings.Contains(logs, "activeTurns") || !strings.Contains(logs, "elapsed") {
+		t.Fatalf("drain progress log missing activeTurns/elapsed:\n%s", logs)
+	}
+	if !strings.Contains(logs, "shutdown.turns_drained") || strings.Contains(logs, "shutdown.force_cancel_turns") {
+		t.Fatalf("expected drained shutdown without force cancel:\n%s", logs)
+	}
+}
+
+func TestGracefulShutdownLogsProgressWhileStreamsAreOpen(t *testing.T) {
+	controller := runtime.NewTurnController()
+	if err := controller.Activate("th-1", "ses-1", "tu-1", func() {}); err != nil {
+		t.Fatalf("Activate() unexpected error: %v", err)
+	}
+
+	// A streaming handler holds its connection until the turn ends, which
+	// keeps srv.Shutdown from returning.
+	streaming := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(streaming)
+		_ = controller.WaitForIdle(context.Background())
+	}))
+	defer srv.Close()
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-streaming
+
+	releaseTimer := time.AfterFunc(300*time.Millisecond, func() { controller.Release("th-1", "ses-1", "tu-1") })
+	defer releaseTimer.Stop()
+
+	var buf bytes.Buffer
+	logger := observability.NewLoggerWithWriter(&buf, observability.LevelInfo)
+	gracefulShutdown(context.Background(), logger, srv.Config, controller, 5*time.Second, 50*time.Millisecond)
+
+	logs := buf.String()
+	if !strings.Contains(logs, "shutdown.drain_progress") {
+		t.Fatalf("logs missing shutdown.drain_progress while the stream was open:\n%s", logs)
+	}
+	if !strings.Contains(logs, "shutdown.turns_drained") || strings.Contains(logs, "shutdown.force_cancel_turns") {
+		t.Fatalf("expected drained shutdown without force cancel:\n%s", logs)
+	}
+}
+
 func TestGetLANURLReturnsFalseForLoopback(t *testing.T) {
-	url, ok := getLANURL("127.0.0.1:8686")
+	url, ok := getLANURL("127.0.0.1:8686", "http")
 	if ok {
 		t.Fatalf("getLANURL should return false for loopback")
 	}
@@ -307,3 +382,403 @@ func TestRenderStartupLogoWithANSI(t *testing.T) {
 		t.Fatalf("renderStartupLogo(true) missing ANSI reset suffix: %q", got)
 	}
 }
+
+func TestParseSandboxHomeAgents(t *testing.T) {
+	got, err := parseSandboxHomeAgents(" OpenCode , ")
+	if err != nil {
+		t.Fatalf("parseSandboxHomeAgents: %v", err)
+	}
+	if !got["opencode"] || len(got) != 1 {
+		t.Fatalf("parseSandboxHomeAgents = %v, want only opencode", got)
+	}
+
+	if _, err := parseSandboxHomeAgents("codex"); err == nil {
+		t.Fatalf("parseSandboxHomeAgents(codex) error = nil, want non-nil")
+	}
+}
+
+func TestParseSessionMetadataAgents(t *testing.T) {
+	got, err := parseSessionMetadataAgents(" Echo , gemini,")
+	if err != nil {
+		t.Fatalf("parseSessionMetadataAgents: %v", err)
+	}
+	if !got["echo"] || !got["gemini"] || len(got) != 2 {
+		t.Fatalf("parseSessionMetadataAgents = %v, want echo and gemini", got)
+	}
+
+	if _, err := parseSessionMetadataAgents("claude"); err == nil {
+		t.Fatalf("parseSessionMetadataAgents(claude) error = nil, want non-nil")
+	}
+}
+
+func TestParseAgentNames(t *testing.T) {
+	got, err := parseAgentNames(` {" Codex ":" Team Codex ","echo":"Echo"} `)
+	if err != nil {
+		t.Fatalf("parseAgentNames: %v", err)
+	}
+	if got["codex"] != "Team Codex" || got["echo"] != "Echo" || len(got) != 2 {
+		t.Fatalf("parseAgentNames = %v, want codex and echo names", got)
+	}
+
+	for _, raw := range []string{`{"unknown":"X"}`, `{"codex":"  "}`, `not json`} {
+		if _, err := parseAgentNames(raw); err == nil {
+			t.Fatalf("parseAgentNames(%s) error = nil, want non-nil", raw)
+		}
+	}
+}
+
+func TestThreadSessionMetaReachesEchoAgent(t *testing.T) {
+	thread := storage.Thread{
+		ThreadID:         "th_meta",
+		AgentID:          "echo",
+		CWD:              t.TempDir(),
+		Title:            " Billing ",
+		AgentOptionsJSON: `{"systemPrompt":"Use Go.","metadata":{"project":"billing"},"modelId":"m"}`,
+	}
+	client, err := echoagent.New(echoagent.Config{Dir: thread.CWD, SessionMeta: threadSessionMeta(thread)})
+	if err != nil {
+		t.Fatalf("echo.New: %v", err)
+	}
+	var out strings.Builder
+	if _, err := client.Stream(context.Background(), echoagent.SessionMetaPrompt, func(delta string) error {
+		out.WriteString(delta)
+		return nil
+	}); err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	want := `{"ngent":{"metadata":{"project":"billing"},"systemPrompt":"Use Go.","threadId":"th_meta","title":"Billing"}}`
+	if got := out.String(); got != want {
+		t.Fatalf("agent saw _meta %s, want %s", got, want)
+	}
+}
+
+type fakeStoreSwapper struct {
+	err     error
+	swapped []httpapi.ThreadStore
+}
+
+func (f *fakeStoreSwapper) SwapStore(ctx context.Context, next httpapi.ThreadStore) (httpapi.ThreadStore, error) {
+	_ = ctx
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.swapped = append(f.swapped, next)
+	return nil, nil
+}
+
+func TestDailyStoreRotatorRotate(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "ngent.db")
+	day1 := time.Date(2026, 2, 28, 23, 59, 0, 0, time.Local)
+	day2 := day1.Add(2 * time.Minute)
+
+	initial, err := storage.New(storage.DatedPath(basePath, day1))
+	if err != nil {
+		t.Fatalf("storage.New(day1): %v", err)
+	}
+	swapper := &fakeStoreSwapper{err: errors.New("requests still in flight")}
+	now := day1
+	rotator := &dailyStoreRotator{
+		basePath: basePath,
+		swapper:  swapper,
+		logger:   observability.NewLoggerWithWriter(io.Discard, observability.LevelInfo),
+		now:      func() time.Time { return now },
+		current:  initial,
+	}
+	defer func() { _ = rotator.close() }()
+
+	if !rotator.rotate(context.Background()) {
+		t.Fatalf("rotate() on the same day should be a no-op success")
+	}
+
+	now = day2
+	if rotator.rotate(context.Background()) {
+		t.Fatalf("rotate() should report failure when swap is refused")
+	}
+	if rotator.current != initial {
+		t.Fatalf("rotator switched stores despite failed swap")
+	}
+	if err := initial.Ping(context.Background()); err != nil {
+		t.Fatalf("initial store closed after failed swap: %v", err)
+	}
+
+	swapper.err = nil
+	if !rotator.rotate(context.Background()) {
+		t.Fatalf("rotate() after drain should succeed")
+	}
+	wantPath := filepath.Join(filepath.Dir(basePath), "ngent-2026-03-01.db")
+	if got := rotator.current.Path(); got != wantPath {
+		t.Fatalf("rotated path = %q, want %q", got, wantPath)
+	}
+	if len(swapper.swapped) != 1 || swapper.swapped[0] != rotator.current {
+		t.Fatalf("swapped stores = %v, want the new current store", swapper.swapped)
+	}
+	if err := initial.Ping(context.Background()); err == nil {
+		t.Fatalf("previous store should be closed after rotation")
+	}
+}
+
+func TestNextLocalMidnight(t *testing.T) {
+	now := time.Date(2026, 12, 31, 13, 45, 0, 0, time.Local)
+	want := time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)
+	if got := nextLocalMidnight(now); !got.Equal(want) {
+		t.Fatalf("nextLocalMidnight() = %v, want %v", got, want)
+	}
+}
+
+func TestParseCostRates(t *testing.T) {
+	got, err := parseCostRates(` {"Codex":{"promptPerMillion":2,"completionPerMillion":8}} `)
+	if err != nil {
+		t.Fatalf("parseCostRates: %v", err)
+	}
+	if rate := got["codex"]; rate.PromptPerMillion != 2 || rate.CompletionPerMillion != 8 {
+		t.Fatalf("parseCostRates codex = %+v, want prompt=2 completion=8", rate)
+	}
+
+	if got, err := parseCostRates(""); err != nil || got != nil {
+		t.Fatalf("parseCostRates(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parseCostRates(`{"codex":{"promptPerMillion":-1}}`); err == nil {
+		t.Fatalf("parseCostRates(negative) error = nil, want non-nil")
+	}
+	if _, err := parseCostRates(`not-json`); err == nil {
+		t.Fatalf("parseCostRates(invalid) error = nil, want non-nil")
+	}
+}
+
+func TestParseWebUIHeaders(t *testing.T) {
+	got, err := parseWebUIHeaders(` {"Content-Security-Policy":"default-src 'self'","X-Frame-Options":""} `)
+	if err != nil {
+		t.Fatalf("parseWebUIHeaders: %v", err)
+	}
+	if got["Content-Security-Policy"] != "default-src 'self'" || got["X-Frame-Options"] != "" {
+		t.Fatalf("parseWebUIHeaders = %v, want CSP override and empty X-Frame-Options", got)
+	}
+
+	if got, err := parseWebUIHeaders(""); err != nil || got != nil {
+		t.Fatalf("parseWebUIHeaders(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	for _, raw := range []string{`not-json`, `{"Bad Name":"x"}`, `{"X-Test":"a\r\nInjected: 1"}`} {
+		if _, err := parseWebUIHeaders(raw); err == nil {
+			t.Fatalf("parseWebUIHeaders(%s) error = nil, want non-nil", raw)
+		}
+	}
+}
+
+func TestParseAgentCapabilities(t *testing.T) {
+	got, err := parseAgentCapabilities(` {"Codex":{"disableCompact":true}} `)
+	if err != nil {
+		t.Fatalf("parseAgentCapabilities: %v", err)
+	}
+	if !got["codex"].DisableCompact {
+		t.Fatalf("parseAgentCapabilities codex = %+v, want DisableCompact", got["codex"])
+	}
+
+	if got, err := parseAgentCapabilities(""); err != nil || got != nil {
+		t.Fatalf("parseAgentCapabilities(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parseAgentCapabilities(`{" ":{}}`); err == nil {
+		t.Fatalf("parseAgentCapabilities(empty id) error = nil, want non-nil")
+	}
+}
+
+func TestParseAgentCWDRules(t *testing.T) {
+	got, err := parseAgentCWDRules(` {"Gemini":{"maxDepth":2,"forbiddenChars":"#"}} `)
+	if err != nil {
+		t.Fatalf("parseAgentCWDRules: %v", err)
+	}
+	validate := got["gemini"]
+	if validate == nil {
+		t.Fatalf("parseAgentCWDRules = %v, want gemini validator", got)
+	}
+	if err := validate("/srv/app"); err != nil {
+		t.Fatalf("validate(/srv/app) = %v, want nil", err)
+	}
+	if err := validate("/srv/app/deep"); err == nil {
+		t.Fatalf("validate(too deep) = nil, want error")
+	}
+	if err := validate("/srv/a#b"); err == nil {
+		t.Fatalf("validate(forbidden char) = nil, want error")
+	}
+
+	if got, err := parseAgentCWDRules(""); err != nil || got != nil {
+		t.Fatalf("parseAgentCWDRules(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parseAgentCWDRules(`{"gemini":{"maxDepth":-1}}`); err == nil {
+		t.Fatalf("parseAgentCWDRules(negative) error = nil, want non-nil")
+	}
+}
+
+func TestParseAgentInitializeParams(t *testing.T) {
+	got, err := parseAgentInitializeParams(` {"Gemini":{"clientCapabilities":{"fs":{"readTextFile":true}}}} `)
+	if err != nil {
+		t.Fatalf("parseAgentInitializeParams: %v", err)
+	}
+	if _, ok := got["gemini"]["clientCapabilities"]; !ok {
+		t.Fatalf("parseAgentInitializeParams gemini = %v, want clientCapabilities", got["gemini"])
+	}
+
+	if got, err := parseAgentInitializeParams(""); err != nil || got != nil {
+		t.Fatalf("parseAgentInitializeParams(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parseAgentInitializeParams(`{"gemini":{"protocolVersion":"v1"}}`); err == nil {
+		t.Fatalf("parseAgentInitializeParams(invalid protocolVersion) error = nil, want non-nil")
+	}
+}
+
+func TestParseDefaultAgentOptions(t *testing.T) {
+	got, err := parseDefaultAgentOptions(` {"Codex":{"modelId":"gpt-5","configOverrides":{"effort":"low"}}} `)
+	if err != nil {
+		t.Fatalf("parseDefaultAgentOptions: %v", err)
+	}
+	if got["codex"]["modelId"] != "gpt-5" {
+		t.Fatalf("parseDefaultAgentOptions codex = %v, want modelId gpt-5", got["codex"])
+	}
+
+	if got, err := parseDefaultAgentOptions(""); err != nil || got != nil {
+		t.Fatalf("parseDefaultAgentOptions(\"\") = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parseDefaultAgentOptions(`{"codex":"gpt-5"}`); err == nil {
+		t.Fatalf("parseDefaultAgentOptions(non-object) error = nil, want non-nil")
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	if cfg, err := loadTLSConfig("", ""); err != nil || cfg != nil {
+		t.Fatalf("loadTLSConfig(\"\", \"\") = %v, %v; want nil, nil", cfg, err)
+	}
+	if _, err := loadTLSConfig("cert.pem", ""); err == nil {
+		t.Fatalf("loadTLSConfig(cert only) error = nil, want non-nil")
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	cfg, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Fatalf("len(Certificates) = %d, want 1", len(cfg.Certificates))
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("MinVersion = %#x, want TLS 1.2", cfg.MinVersion)
+	}
+
+	if _, err := loadTLSConfig(certFile, certFile); err == nil {
+		t.Fatalf("loadTLSConfig(cert as key) error = nil, want non-nil")
+	}
+}
+
+func TestResolveTLSRedirectAddr(t *testing.T) {
+	if addr, err := resolveTLSRedirectAddr("0.0.0.0:8443", 8443, 0, true); err != nil || addr != "" {
+		t.Fatalf("disabled redirect = %q, %v; want empty", addr, err)
+	}
+	if _, err := resolveTLSRedirectAddr("0.0.0.0:8443", 8443, 8080, false); err == nil {
+		t.Fatalf("redirect without TLS error = nil, want non-nil")
+	}
+	if _, err := resolveTLSRedirectAddr("0.0.0.0:8443", 8443, 8443, true); err == nil {
+		t.Fatalf("redirect on HTTPS port error = nil, want non-nil")
+	}
+	addr, err := resolveTLSRedirectAddr("0.0.0.0:8443", 8443, 8080, true)
+	if err != nil {
+		t.Fatalf("resolveTLSRedirectAddr: %v", err)
+	}
+	if addr != "0.0.0.0:8080" {
+		t.Fatalf("redirect addr = %q, want %q", addr, "0.0.0.0:8080")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://192.168.1.10:8080/v1/agents?x=1", nil)
+	rec := httptest.NewRecorder()
+	httpsRedirectHandler(8443).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusPermanentRedirect)
+	}
+	if got, want := rec.Header().Get("Location"), "https://192.168.1.10:8443/v1/agents?x=1"; got != want {
+		t.Fatalf("Location = %q, want %q", got, want)
+	}
+}
+
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewHTTPServerRejectsOversizedHeaders(t *testing.T) {
+	srv := newHTTPServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), httpServerLimits{ReadHeaderTimeout: time.Second, MaxHeaderBytes: 1024})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	url := "http://" + ln.Addr().String() + "/"
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("X-Padding", strings.Repeat("a", 64<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("oversized request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("oversized status = %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("normal request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("normal status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestWithFileSystemCapabilities(t *testing.T) {
+	base := map[string]any{"clientInfo": map[string]any{"name": "custom"}}
+	if got := withFileSystemCapabilities(base, ""); len(got) != 1 {
+		t.Fatalf("withFileSystemCapabilities(no access) = %v, want base unchanged", got)
+	}
+	got := withFileSystemCapabilities(base, "read")
+	fs := got["clientCapabilities"].(map[string]any)["fs"].(map[string]any)
+	if fs["readTextFile"] != true || fs["writeTextFile"] != false {
+		t.Fatalf("read access fs = %v, want read only", fs)
+	}
+	if got["clientInfo"] == nil {
+		t.Fatalf("withFileSystemCapabilities dropped clientInfo: %v", got)
+	}
+}
@@ -2,6 +2,7 @@ package acp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -16,11 +17,13 @@ import (
 	"time"
 
 	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/agents/acpcli"
 	"github.com/beyond5959/ngent/internal/observability"
 )
 
 const (
 	jsonRPCVersion   = "2.0"
+	parseError       = -32700
 	methodNotFound   = -32601
 	internalRPCError = -32603
 )
@@ -32,6 +35,12 @@ type Config struct {
 	Dir     string
 	Env     []string
 	Name    string
+	// SandboxHome, when set, runs each agent process with an isolated
+	// temporary HOME seeded with the listed credential files.
+	SandboxHome *acpcli.SandboxHome
+	// PermissionReply selects the session/request_permission reply schema.
+	// The zero value replies with {"outcome":"approved|declined|cancelled"}.
+	PermissionReply agents.PermissionReplyAdapter
 }
 
 // Client talks to one ACP agent process over stdio JSON-RPC.
@@ -41,6 +50,9 @@ type Client struct {
 	dir     string
 	env     []string
 	name    string
+
+	sandboxHome     *acpcli.SandboxHome
+	permissionReply agents.PermissionReplyAdapter
 }
 
 var _ agents.Streamer = (*Client)(nil)
@@ -64,12 +76,21 @@ func New(cfg Config) (*Client, error) {
 	env := make([]string, len(cfg.Env))
 	copy(env, cfg.Env)
 
+	var sandboxHome *acpcli.SandboxHome
+	if cfg.SandboxHome != nil {
+		copied := *cfg.SandboxHome
+		copied.SeedFiles = append([]string(nil), cfg.SandboxHome.SeedFiles...)
+		sandboxHome = &copied
+	}
+
 	return &Client{
-		command: command,
-		args:    args,
-		dir:     strings.TrimSpace(cfg.Dir),
-		env:     env,
-		name:    name,
+		command:         command,
+		args:            args,
+		dir:             strings.TrimSpace(cfg.Dir),
+		env:             env,
+		name:            name,
+		sandboxHome:     sandboxHome,
+		permissionReply: cfg.PermissionReply,
 	}, nil
 }
 
@@ -108,6 +129,17 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 	if len(c.env) > 0 {
 		cmd.Env = append(os.Environ(), c.env...)
 	}
+	if c.sandboxHome != nil {
+		home, removeHome, err := acpcli.PrepareSandboxHome(*c.sandboxHome)
+		if err != nil {
+			return agents.StopReasonEndTurn, fmt.Errorf("acp: %w", err)
+		}
+		defer removeHome()
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = acpcli.SandboxHomeEnv(cmd.Env, home)
+	}
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -122,6 +154,11 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 		return agents.StopReasonEndTurn, fmt.Errorf("acp: open stderr pipe: %w", err)
 	}
 
+	releaseSlot, err := agents.AcquireProcessSlot(ctx)
+	if err != nil {
+		return agents.StopReasonEndTurn, fmt.Errorf("acp: start agent process: %w", err)
+	}
+	defer releaseSlot()
 	if err := cmd.Start(); err != nil {
 		return agents.StopReasonEndTurn, fmt.Errorf("acp: start agent process: %w", err)
 	}
@@ -175,6 +212,8 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 				return agents.NotifyMessageContent(ctx, *update.MessageContent)
 			}
 			return nil
+		case agents.ACPUpdateTypeThoughtMessageChunk:
+			return agents.NotifyReasoningDelta(ctx, update.Delta)
 		case agents.ACPUpdateTypePlan:
 			if handler, ok := agents.PlanHandlerFromContext(ctx); ok {
 				return handler(ctx, update.PlanEntries)
@@ -204,20 +243,31 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 	if promptContent == nil {
 		promptContent = []map[string]any{}
 	}
-	promptResult, err := conn.Call(ctx, "session/prompt", map[string]any{
+	// Send session/cancel as soon as ctx ends, then give the agent
+	// CancelGrace to answer session/prompt before tearing it down.
+	stopCancelWatch := context.AfterFunc(ctx, func() {
+		c.sendSessionCancel(conn, sessionID)
+	})
+	defer stopCancelWatch()
+	promptCtx, stopPrompt := agents.WithCancelGrace(ctx, agents.CancelGrace)
+	defer stopPrompt()
+
+	promptResult, err := conn.Call(promptCtx, "session/prompt", map[string]any{
 		"sessionId": sessionID,
 		"prompt":    promptContent,
 	})
 	if err != nil {
 		if ctx.Err() != nil {
-			c.sendSessionCancel(conn, sessionID)
+			_ = agents.NotifyCancelForced(ctx)
 			return agents.StopReasonCancelled, nil
 		}
 		return agents.StopReasonEndTurn, fmt.Errorf("acp: session/prompt failed: %w", err)
 	}
 
+	_ = agents.NotifyACPPromptUsage(ctx, promptResult)
+	_ = agents.NotifyACPPromptStopReason(ctx, promptResult)
 	reason := parseStopReason(promptResult)
-	if reason == "cancelled" {
+	if ctx.Err() != nil || reason == "cancelled" {
 		return agents.StopReasonCancelled, nil
 	}
 	return agents.StopReasonEndTurn, nil
@@ -231,27 +281,30 @@ func (c *Client) handlePermissionRequest(ctx context.Context, conn *rpcConn, msg
 		}
 	}
 
+	var advertised struct {
+		Options []agents.PermissionOption `json:"options"`
+	}
+	_ = json.Unmarshal(msg.Params, &advertised)
+
 	req := agents.PermissionRequest{
 		RequestID: idToString(msg.ID),
 		Approval:  stringValue(rawParams, "approval"),
 		Command:   stringValue(rawParams, "command"),
+		Options:   advertised.Options,
 		RawParams: rawParams,
 	}
 
-	outcome := agents.PermissionOutcomeDeclined
+	resp := agents.PermissionResponse{Outcome: agents.PermissionOutcomeDeclined}
+	var handlerErr error
 	if handler, ok := agents.PermissionHandlerFromContext(ctx); ok {
-		resp, err := handler(ctx, req)
-		if err == nil {
-			switch resp.Outcome {
-			case agents.PermissionOutcomeApproved, agents.PermissionOutcomeDeclined, agents.PermissionOutcomeCancelled:
-				outcome = resp.Outcome
-			}
-		}
+		resp, handlerErr = handler(ctx, req)
 	}
 
-	return conn.ReplyResult(msg.ID, map[string]any{
-		"outcome": string(outcome),
-	})
+	reply, err := c.permissionReply.Encode(resp, handlerErr, req.Options)
+	if err != nil {
+		return conn.ReplyError(msg.ID, internalRPCError, "encode permission reply")
+	}
+	return conn.ReplyResult(msg.ID, reply)
 }
 
 func (c *Client) sendSessionCancel(conn *rpcConn, sessionID string) {
@@ -452,14 +505,24 @@ func (c *rpcConn) readLoop() {
 }
 
 func (c *rpcConn) consumeLine(line []byte) error {
-	line = []byte(strings.TrimSpace(string(line)))
+	line = bytes.TrimSpace(line)
 	if len(line) == 0 {
 		return nil
 	}
+	// Agents may interleave log lines or banners with JSON-RPC frames on
+	// stdout. Skip anything that is not a JSON object instead of closing the
+	// connection.
+	start := bytes.IndexByte(line, '{')
+	if start < 0 {
+		return nil
+	}
+	line = line[start:]
 
 	var msg rpcMessage
 	if err := json.Unmarshal(line, &msg); err != nil {
-		return fmt.Errorf("acp: decode rpc line: %w", err)
+		observability.LogACPDecodeError(c.prefix, line, err)
+		c.failUndecodableResponse(line, err)
+		return nil
 	}
 	observability.LogACPMessage(c.prefix, "inbound", msg)
 
@@ -508,6 +571,26 @@ func (c *rpcConn) dispatchResponse(msg rpcMessage) error {
 	return nil
 }
 
+// failUndecodableResponse fails the pending call a malformed response was
+// meant for, when its id can still be read, so the caller does not wait
+// forever for a reply that was already sent.
+func (c *rpcConn) failUndecodableResponse(line []byte, decodeErr error) {
+	var probe struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if err := json.Unmarshal(line, &probe); err != nil || len(probe.ID) == 0 || probe.Method != "" {
+		return
+	}
+	_ = c.dispatchResponse(rpcMessage{
+		ID: probe.ID,
+		Error: &rpcError{
+			Code:    parseError,
+			Message: fmt.Sprintf("undecodable response: %v", decodeErr),
+		},
+	})
+}
+
 func (c *rpcConn) removePending(idKey string) {
 	c.pendingMu.Lock()
 	delete(c.pending, idKey)
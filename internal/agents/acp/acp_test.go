@@ -0,0 +1,102 @@
+package acp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/observability"
+)
+
+func TestRPCConnSkipsInterleavedLogLines(t *testing.T) {
+	reqReaderPipe, reqWriterPipe := io.Pipe()
+	respReaderPipe, respWriterPipe := io.Pipe()
+
+	conn := newRPCConn(reqWriterPipe, respReaderPipe, "acp-test")
+	t.Cleanup(func() {
+		conn.Close()
+		_ = reqReaderPipe.Close()
+		_ = reqWriterPipe.Close()
+		_ = respReaderPipe.Close()
+		_ = respWriterPipe.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "initialize", map[string]any{})
+		done <- err
+	}()
+
+	if _, err := bufio.NewReader(reqReaderPipe).ReadBytes('\n'); err != nil {
+		t.Fatalf("read initialize request: %v", err)
+	}
+
+	lines := []string{
+		"Checking credentials...",
+		"DEBUG {cache: warm}",
+		`INFO {"jsonrpc":"2.0","id":1,"result":{"ok":true}}`,
+	}
+	for _, line := range lines {
+		if _, err := respWriterPipe.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("write line %q: %v", line, err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Call() error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for initialize response")
+	}
+}
+
+func TestRPCConnFailsCallOnUndecodableResponse(t *testing.T) {
+	var buf bytes.Buffer
+	observability.ConfigureACPDebug(observability.NewLoggerWithWriter(&buf, observability.LevelInfo), false)
+	t.Cleanup(func() {
+		observability.ConfigureACPDebug(nil, false)
+	})
+
+	reqReaderPipe, reqWriterPipe := io.Pipe()
+	respReaderPipe, respWriterPipe := io.Pipe()
+
+	conn := newRPCConn(reqWriterPipe, respReaderPipe, "acp-test")
+	t.Cleanup(func() {
+		conn.Close()
+		_ = reqReaderPipe.Close()
+		_ = reqWriterPipe.Close()
+		_ = respReaderPipe.Close()
+		_ = respWriterPipe.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "initialize", map[string]any{})
+		done <- err
+	}()
+
+	if _, err := bufio.NewReader(reqReaderPipe).ReadBytes('\n'); err != nil {
+		t.Fatalf("read initialize request: %v", err)
+	}
+	if _, err := respWriterPipe.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":"boom"}` + "\n")); err != nil {
+		t.Fatalf("write malformed response: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "undecodable response") {
+			t.Fatalf("Call() error = %v, want undecodable response error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the malformed response to fail the call")
+	}
+	if got := buf.String(); !strings.Contains(got, "acp.decode_failed") || !strings.Contains(got, "component=acp-test") {
+		t.Fatalf("log output = %q, want acp.decode_failed for acp-test", got)
+	}
+}
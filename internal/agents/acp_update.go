@@ -38,6 +38,7 @@ type ACPUpdate struct {
 	Type           string
 	Role           string
 	Delta          string
+	DeltaMetadata  DeltaMetadata
 	MessageID      string
 	Timestamp      string
 	PlanEntries    []PlanEntry
@@ -104,6 +105,13 @@ func ParseACPUpdate(raw json.RawMessage) (ACPUpdate, error) {
 		}, nil
 	case ACPUpdateTypeAgentMessageChunk, ACPUpdateTypeUserMessageChunk, ACPUpdateTypeThoughtMessageChunk, acpUpdateTypeAgentThoughtChunk:
 		delta, isText, rawContent, hasContent, err := parseACPUpdateMessageContent(payload.Update.Content)
+		var deltaMetadata DeltaMetadata
+		if isText {
+			var record map[string]any
+			if json.Unmarshal(rawContent, &record) == nil {
+				deltaMetadata = parseACPDeltaMetadata(record)
+			}
+		}
 		if err != nil {
 			return ACPUpdate{}, err
 		}
@@ -116,9 +124,10 @@ func ParseACPUpdate(raw json.RawMessage) (ACPUpdate, error) {
 			role = "user"
 		}
 		update := ACPUpdate{
-			Type:  normalizedType,
-			Role:  role,
-			Delta: delta,
+			Type:          normalizedType,
+			Role:          role,
+			Delta:         delta,
+			DeltaMetadata: deltaMetadata,
 			MessageID: normalizeACPUpdateString(
 				payload.Update.MessageID,
 				payload.MessageID,
@@ -132,6 +141,15 @@ func ParseACPUpdate(raw json.RawMessage) (ACPUpdate, error) {
 				acpUpdateMetaString(payload.Meta, "timestamp"),
 			),
 		}
+		if normalizedType == ACPUpdateTypeAgentMessageChunk {
+			if reasoning, ok := parseACPReasoningContent(rawContent); ok {
+				update.Type = ACPUpdateTypeThoughtMessageChunk
+				update.Role = ""
+				update.Delta = reasoning
+				update.DeltaMetadata = DeltaMetadata{}
+				return update, nil
+			}
+		}
 		if !isText && hasContent && normalizedType == ACPUpdateTypeAgentMessageChunk {
 			update.MessageContent = &ACPMessageContent{
 				Content:    rawContent,
@@ -260,6 +278,37 @@ func parseACPUpdateMessageContent(raw json.RawMessage) (string, bool, json.RawMe
 	return "", false, cloneACPUpdateJSON(raw), true, nil
 }
 
+// parseACPReasoningContent detects reasoning blocks that some providers send
+// inside agent_message_chunk instead of agent_thought_chunk: opencode
+// "reasoning" parts, "thinking" blocks, and gemini text parts flagged with
+// "thought": true. Other content types stay ordinary message content.
+func parseACPReasoningContent(raw json.RawMessage) (string, bool) {
+	if len(raw) == 0 {
+		return "", false
+	}
+	var record map[string]any
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return "", false
+	}
+
+	contentType, _ := record["type"].(string)
+	text, _ := record["text"].(string)
+	switch strings.TrimSpace(contentType) {
+	case "reasoning":
+		return text, true
+	case "thinking":
+		if thinking, ok := record["thinking"].(string); ok {
+			return thinking, true
+		}
+		return text, true
+	case "text", "":
+		if thought, _ := record["thought"].(bool); thought {
+			return text, true
+		}
+	}
+	return "", false
+}
+
 func acpUpdateMetaString(values map[string]any, key string) string {
 	if len(values) == 0 {
 		return ""
@@ -204,6 +204,47 @@ func TestParseACPUpdateAgentThoughtChunkAlias(t *testing.T) {
 	}
 }
 
+func TestParseACPUpdateAgentMessageChunkReasoningContent(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "opencode reasoning part", content: `{"type":"reasoning","text":"plan first"}`, want: "plan first"},
+		{name: "thinking block", content: `{"type":"thinking","thinking":"weigh options"}`, want: "weigh options"},
+		{name: "gemini thought text", content: `{"type":"text","text":"check files","thought":true}`, want: "check files"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := json.RawMessage(`{"update":{"sessionUpdate":"agent_message_chunk","content":` + tc.content + `}}`)
+			update, err := ParseACPUpdate(raw)
+			if err != nil {
+				t.Fatalf("ParseACPUpdate() error = %v", err)
+			}
+			if update.Type != ACPUpdateTypeThoughtMessageChunk {
+				t.Fatalf("update.Type = %q, want %q", update.Type, ACPUpdateTypeThoughtMessageChunk)
+			}
+			if update.Delta != tc.want {
+				t.Fatalf("update.Delta = %q, want %q", update.Delta, tc.want)
+			}
+			if update.MessageContent != nil {
+				t.Fatalf("update.MessageContent = %+v, want nil", update.MessageContent)
+			}
+		})
+	}
+
+	raw := json.RawMessage(`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"answer","thought":false}}}`)
+	update, err := ParseACPUpdate(raw)
+	if err != nil {
+		t.Fatalf("ParseACPUpdate() error = %v", err)
+	}
+	if update.Type != ACPUpdateTypeMessageChunk || update.Delta != "answer" {
+		t.Fatalf("plain text update = (%q, %q), want message chunk %q", update.Type, update.Delta, "answer")
+	}
+}
+
 func TestParseACPUpdateAgentMessageChunkKeepsNonTextContent(t *testing.T) {
 	t.Parallel()
 
@@ -112,11 +112,20 @@ func DiscoverModelsWithClient[T ModelDiscoverer](
 
 // SessionNewParams returns ACP session/new params for providers that only need cwd and optional model selection.
 func SessionNewParams(dir string) func(string) map[string]any {
+	return SessionNewParamsWithMeta(dir, nil)
+}
+
+// SessionNewParamsWithMeta is SessionNewParams plus an ACP _meta object; an
+// empty meta is omitted.
+func SessionNewParamsWithMeta(dir string, meta map[string]any) func(string) map[string]any {
 	return func(modelID string) map[string]any {
 		params := map[string]any{
 			"cwd":        strings.TrimSpace(dir),
 			"mcpServers": []any{},
 		}
+		if len(meta) > 0 {
+			params["_meta"] = meta
+		}
 		modelID = strings.TrimSpace(modelID)
 		if modelID != "" {
 			params["model"] = modelID
@@ -354,15 +363,16 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 		}
 	}
 
-	if c.hooks.HandlePermissionRequest != nil {
-		permHandler, hasPermHandler := agents.PermissionHandlerFromContext(streamCtx)
-		conn.SetRequestHandler(func(method string, params json.RawMessage) (json.RawMessage, error) {
-			if method != "session/request_permission" {
-				return nil, &acpstdio.RPCError{Code: acpstdio.MethodNotFound, Message: "method not found"}
-			}
-			return c.hooks.HandlePermissionRequest(streamCtx, params, permHandler, hasPermHandler)
-		})
-	}
+	permHandler, hasPermHandler := agents.PermissionHandlerFromContext(streamCtx)
+	conn.SetRequestHandler(func(method string, params json.RawMessage) (json.RawMessage, error) {
+		if agents.IsACPFileSystemMethod(method) {
+			return agents.HandleACPFileSystemRequest(streamCtx, method, params)
+		}
+		if method != "session/request_permission" || c.hooks.HandlePermissionRequest == nil {
+			return nil, &acpstdio.RPCError{Code: acpstdio.MethodNotFound, Message: "method not found"}
+		}
+		return c.hooks.HandlePermissionRequest(streamCtx, params, permHandler, hasPermHandler)
+	})
 
 	stopCancelWatch := make(chan struct{})
 	defer close(stopCancelWatch)
@@ -376,18 +386,27 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 		}()
 	}
 
+	// After a cancel, keep waiting briefly for the agent to answer
+	// session/prompt; only an unanswered cancel is reported as forced.
+	grace := agents.CancelGrace
+	if c.hooks.Cancel == nil {
+		grace = 0
+	}
+	promptCtx, stopPrompt := agents.WithCancelGrace(ctx, grace)
+	defer stopPrompt()
+
 	markPromptStarted()
-	promptResult, err := conn.Call(ctx, "session/prompt", c.hooks.PromptParams(sessionID, prompt, modelID))
+	promptResult, err := conn.Call(promptCtx, "session/prompt", c.hooks.PromptParams(sessionID, prompt, modelID))
 	if err != nil {
 		if ctx.Err() != nil {
-			if c.hooks.Cancel != nil {
-				c.hooks.Cancel(conn, sessionID)
-			}
+			_ = agents.NotifyCancelForced(ctx)
 			return agents.StopReasonCancelled, nil
 		}
 		return agents.StopReasonEndTurn, fmt.Errorf("%s: session/prompt: %w", c.nameForError(), err)
 	}
-	if acpstdio.ParseStopReason(promptResult) == "cancelled" {
+	_ = agents.NotifyACPPromptUsage(ctx, promptResult)
+	_ = agents.NotifyACPPromptStopReason(ctx, promptResult)
+	if ctx.Err() != nil || acpstdio.ParseStopReason(promptResult) == "cancelled" {
 		return agents.StopReasonCancelled, nil
 	}
 	return agents.StopReasonEndTurn, nil
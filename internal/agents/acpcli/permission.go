@@ -2,7 +2,8 @@ package acpcli
 
 import (
 	"encoding/json"
-	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents"
 )
 
 // PermissionOption describes one selectable permission option from an ACP provider.
@@ -12,48 +13,23 @@ type PermissionOption struct {
 	Kind     string `json:"kind"`
 }
 
+// SelectedOptionReply is the ACP-standard permission reply adapter used by the
+// shared CLI providers.
+var SelectedOptionReply = agents.PermissionReplyAdapter{
+	Format: agents.PermissionReplySelectedOption,
+}
+
 // BuildSelectedPermissionResponse returns a selected permission outcome response.
 func BuildSelectedPermissionResponse(optionID string) (json.RawMessage, error) {
-	return json.Marshal(map[string]any{
-		"outcome": map[string]any{
-			"outcome":  "selected",
-			"optionId": strings.TrimSpace(optionID),
-		},
-	})
+	return agents.EncodeSelectedPermissionReply(optionID)
 }
 
 // BuildCancelledPermissionResponse returns a cancelled permission outcome response.
 func BuildCancelledPermissionResponse() (json.RawMessage, error) {
-	return json.Marshal(map[string]any{
-		"outcome": map[string]any{
-			"outcome": "cancelled",
-		},
-	})
+	return agents.EncodeCancelledPermissionReply()
 }
 
 // PickPermissionOptionID returns the first matching optionId for the preferred kinds.
 func PickPermissionOptionID(options []PermissionOption, preferredKinds ...string) string {
-	for _, kind := range preferredKinds {
-		normalizedKind := normalizePermissionKind(kind)
-		if normalizedKind == "" {
-			continue
-		}
-		for _, option := range options {
-			if strings.TrimSpace(option.OptionID) == "" {
-				continue
-			}
-			if normalizePermissionKind(option.Kind) == normalizedKind ||
-				normalizePermissionKind(option.OptionID) == normalizedKind {
-				return strings.TrimSpace(option.OptionID)
-			}
-		}
-	}
-	return ""
-}
-
-func normalizePermissionKind(value string) string {
-	normalized := strings.ToLower(strings.TrimSpace(value))
-	normalized = strings.ReplaceAll(normalized, "-", "_")
-	normalized = strings.ReplaceAll(normalized, " ", "_")
-	return normalized
+	return agents.PickPermissionOptionID(toAgentPermissionOptions(options), preferredKinds...)
 }
@@ -3,7 +3,6 @@ package acpcli
 import (
 	"context"
 	"encoding/json"
-	"strings"
 	"time"
 
 	"github.com/beyond5959/ngent/internal/agents"
@@ -22,48 +21,19 @@ func StructuredPermissionRequestHandler(
 	) (json.RawMessage, error) {
 		req, err := ParsePermissionRequestPayload(params)
 		if err != nil {
-			return buildDeclinedPermissionResponse(nil)
+			return SelectedOptionReply.Encode(agents.PermissionResponse{}, err, nil)
 		}
+		options := toAgentPermissionOptions(req.Options)
 		if !hasHandler {
-			return buildDeclinedPermissionResponse(req.Options)
+			return SelectedOptionReply.Encode(agents.PermissionResponse{Outcome: agents.PermissionOutcomeDeclined}, nil, options)
 		}
 
 		permCtx, cancel := permissionContext(ctx, timeout)
 		defer cancel()
 
 		resp, err := handler(permCtx, req.ToAgentPermissionRequest())
-		if err != nil {
-			return buildDeclinedPermissionResponse(req.Options)
-		}
-		if optionID := strings.TrimSpace(resp.SelectedOptionID); optionID != "" {
-			return BuildSelectedPermissionResponse(optionID)
-		}
-
-		switch resp.Outcome {
-		case agents.PermissionOutcomeApproved:
-			return buildApprovedPermissionResponse(req.Options)
-		case agents.PermissionOutcomeCancelled:
-			return BuildCancelledPermissionResponse()
-		default:
-			return buildDeclinedPermissionResponse(req.Options)
-		}
-	}
-}
-
-func buildApprovedPermissionResponse(options []PermissionOption) (json.RawMessage, error) {
-	optionID := PickPermissionOptionID(options, "allow_once", "allow_always")
-	if optionID == "" {
-		return buildDeclinedPermissionResponse(options)
-	}
-	return BuildSelectedPermissionResponse(optionID)
-}
-
-func buildDeclinedPermissionResponse(options []PermissionOption) (json.RawMessage, error) {
-	optionID := PickPermissionOptionID(options, "reject_once", "reject_always")
-	if optionID == "" {
-		return BuildCancelledPermissionResponse()
+		return SelectedOptionReply.Encode(resp, err, options)
 	}
-	return BuildSelectedPermissionResponse(optionID)
 }
 
 func permissionContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
@@ -3,16 +3,25 @@ package acpcli
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/beyond5959/ngent/internal/agents"
 	"github.com/beyond5959/ngent/internal/agents/acpstdio"
 )
 
+// processExitGrace is how long stdout stays readable after the provider
+// process exits, and how long an exit is waited on once stdio has closed.
+const processExitGrace = 500 * time.Millisecond
+
+// stderrTailBytes is how much trailing stderr is kept for startup failures.
+const stderrTailBytes = 4 << 10
+
 // ProcessConfig describes one provider process launch.
 type ProcessConfig struct {
 	Command          string
@@ -21,6 +30,9 @@ type ProcessConfig struct {
 	Env              []string
 	ConnOptions      acpstdio.ConnOptions
 	InitializeParams map[string]any
+	// SandboxHome, when set, runs the process against an isolated temporary
+	// HOME that is removed again on cleanup.
+	SandboxHome *SandboxHome
 }
 
 // OpenProcess starts one ACP CLI process, performs initialize, and returns the connection.
@@ -41,30 +53,67 @@ func OpenProcess(
 		cmd.Env = append([]string(nil), cfg.Env...)
 	}
 
+	removeHome := func() {}
+	if cfg.SandboxHome != nil {
+		home, cleanupHome, err := PrepareSandboxHome(*cfg.SandboxHome)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		removeHome = cleanupHome
+		cmd.Env = SandboxHomeEnv(cmd.Env, home)
+	}
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
+		removeHome()
 		return nil, nil, nil, errorsf("open stdin pipe: %w", err)
 	}
-	stdout, err := cmd.StdoutPipe()
+	// Use a plain os.Pipe for stdout: cmd.StdoutPipe is closed by cmd.Wait as
+	// soon as the process exits, which can drop a final response the peer
+	// wrote just before exiting. This read end stays open until EOF.
+	stdout, stdoutWriter, err := os.Pipe()
 	if err != nil {
+		removeHome()
 		return nil, nil, nil, errorsf("open stdout pipe: %w", err)
 	}
-	stderr, err := cmd.StderrPipe()
+	cmd.Stdout = stdoutWriter
+	// Keep only the stderr tail so an early exit can be explained. WaitDelay
+	// stops a child that inherited stderr from holding cmd.Wait open.
+	stderr := &tailWriter{limit: stderrTailBytes}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = processExitGrace
+	releaseSlot, err := agents.AcquireProcessSlot(ctx)
 	if err != nil {
-		return nil, nil, nil, errorsf("open stderr pipe: %w", err)
+		_ = stdout.Close()
+		_ = stdoutWriter.Close()
+		removeHome()
+		return nil, nil, nil, errorsf("start process: %w", err)
 	}
 	if err := cmd.Start(); err != nil {
+		releaseSlot()
+		_ = stdout.Close()
+		_ = stdoutWriter.Close()
+		removeHome()
 		return nil, nil, nil, errorsf("start process: %w", err)
 	}
-
-	errCh := make(chan error, 1)
-	go func() { _, _ = io.Copy(io.Discard, stderr) }()
-	go func() { errCh <- cmd.Wait() }()
+	_ = stdoutWriter.Close()
 
 	conn := acpstdio.NewConnWithOptions(stdin, stdout, cfg.ConnOptions)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+		// Let the reader drain output written just before exit, then close in
+		// case a child process inherited stdout and keeps it open.
+		time.AfterFunc(processExitGrace, conn.Close)
+	}()
+	var cleanupOnce sync.Once
 	cleanup := func() {
-		conn.Close()
-		acpstdio.TerminateProcess(cmd, errCh, 2*time.Second)
+		cleanupOnce.Do(func() {
+			conn.Close()
+			acpstdio.TerminateProcess(cmd, errCh, 2*time.Second)
+			releaseSlot()
+			removeHome()
+		})
 	}
 
 	initParams := cfg.InitializeParams
@@ -73,12 +122,70 @@ func OpenProcess(
 	}
 	initResult, err := conn.Call(ctx, "initialize", initParams)
 	if err != nil {
+		err = classifyInitializeError(ctx, err, errCh, stderr)
 		cleanup()
 		return nil, nil, nil, errorsf("initialize: %w", err)
 	}
 	return conn, cleanup, initResult, nil
 }
 
+// classifyInitializeError tells a failed initialize apart: a context error is
+// left as is (timeout or cancel), as is a per-call timeout, a JSON-RPC error or non-ACP output becomes
+// agents.ErrAgentProtocol, and a process that exited becomes an
+// agents.ExitError carrying its exit code and stderr tail.
+func classifyInitializeError(ctx context.Context, err error, errCh chan error, stderr *tailWriter) error {
+	if ctx.Err() != nil || errors.Is(err, acpstdio.ErrCallTimeout) {
+		return err
+	}
+	var (
+		rpcErr    *acpstdio.RPCError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	if errors.As(err, &rpcErr) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return fmt.Errorf("%w: %w", agents.ErrAgentProtocol, err)
+	}
+	// The connection usually closes a moment before cmd.Wait returns.
+	timer := time.NewTimer(processExitGrace)
+	defer timer.Stop()
+	select {
+	case waitErr := <-errCh:
+		// Put the result back for TerminateProcess in cleanup.
+		errCh <- waitErr
+		code := 0
+		var exitErr *exec.ExitError
+		if errors.As(waitErr, &exitErr) {
+			code = exitErr.ExitCode()
+		}
+		return &agents.ExitError{Code: code, Stderr: stderr.String(), Err: waitErr}
+	case <-timer.C:
+		return err
+	}
+}
+
+// tailWriter keeps the last limit bytes written to it.
+type tailWriter struct {
+	mu    sync.Mutex
+	limit int
+	buf   []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.limit; over > 0 {
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.buf)
+}
+
 // WrapOpenError adds provider/purpose context to one process startup error.
 func WrapOpenError(provider string, purpose OpenPurpose, err error) error {
 	if err == nil {
@@ -0,0 +1,153 @@
+package acpcli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+)
+
+// writeFakeAgent writes an executable shell script standing in for an ACP
+// agent binary.
+func writeFakeAgent(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake-agent")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile(fake agent): %v", err)
+	}
+	return path
+}
+
+func openFakeAgent(t *testing.T, ctx context.Context, script string) error {
+	t.Helper()
+	conn, cleanup, _, err := OpenProcess(ctx, ProcessConfig{Command: writeFakeAgent(t, script)})
+	if err == nil {
+		_ = conn
+		cleanup()
+		t.Fatal("OpenProcess() error = nil, want initialize failure")
+	}
+	return err
+}
+
+func TestOpenProcessReportsAgentExitDuringInitialize(t *testing.T) {
+	err := openFakeAgent(t, context.Background(), "echo 'missing API key' >&2\nexit 3")
+
+	var exitErr *agents.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("OpenProcess() error = %v, want *agents.ExitError", err)
+	}
+	if exitErr.Code != 3 {
+		t.Fatalf("exit code = %d, want 3", exitErr.Code)
+	}
+	if got := agents.StderrTail(err); got != "missing API key" {
+		t.Fatalf("stderr tail = %q, want %q", got, "missing API key")
+	}
+	if strings.Contains(err.Error(), "missing API key") {
+		t.Fatalf("error text %q leaks stderr", err.Error())
+	}
+	if !strings.Contains(err.Error(), "exited with code 3") {
+		t.Fatalf("error text = %q, want exit code", err.Error())
+	}
+}
+
+func TestOpenProcessReportsProtocolErrorDuringInitialize(t *testing.T) {
+	for name, script := range map[string]string{
+		"rpc error": `read line
+echo '{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"unsupported client"}}'
+cat >/dev/null`,
+		"not json": "read line\necho 'hello, I am not ACP'\ncat >/dev/null",
+	} {
+		err := openFakeAgent(t, context.Background(), script)
+		if !errors.Is(err, agents.ErrAgentProtocol) {
+			t.Fatalf("%s: OpenProcess() error = %v, want agents.ErrAgentProtocol", name, err)
+		}
+	}
+}
+
+func TestOpenProcessReportsTimeoutDuringInitialize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := openFakeAgent(t, ctx, "cat >/dev/null")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("OpenProcess() error = %v, want context.DeadlineExceeded", err)
+	}
+	var exitErr *agents.ExitError
+	if errors.As(err, &exitErr) || errors.Is(err, agents.ErrAgentProtocol) {
+		t.Fatalf("OpenProcess() error = %v, want a plain timeout", err)
+	}
+}
+
+func TestOpenProcessFailsFastOnInitializeCallTimeout(t *testing.T) {
+	// The turn context is generous; only the per-call timeout may fire.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	startedAt := time.Now()
+	conn, cleanup, _, err := OpenProcess(ctx, ProcessConfig{
+		Command: writeFakeAgent(t, "cat >/dev/null"),
+		ConnOptions: acpstdio.ConnOptions{
+			CallTimeouts: map[string]time.Duration{"initialize": 100 * time.Millisecond},
+		},
+	})
+	if err == nil {
+		_ = conn
+		cleanup()
+		t.Fatal("OpenProcess() error = nil, want initialize timeout")
+	}
+	if !errors.Is(err, acpstdio.ErrCallTimeout) {
+		t.Fatalf("OpenProcess() error = %v, want acpstdio.ErrCallTimeout", err)
+	}
+	if !strings.Contains(err.Error(), "initialize") {
+		t.Fatalf("error text = %q, want the stalled method", err.Error())
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Fatalf("OpenProcess() took %s, want it bounded by the call timeout", elapsed)
+	}
+}
+
+func TestOpenProcessReadsResponseWrittenJustBeforeExit(t *testing.T) {
+	// A large response is still sitting in the pipe when the process exits.
+	padding := strings.Repeat("x", 48<<10)
+	script := `read line
+echo '{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":1,"padding":"` + padding + `"}}'
+exit 0`
+	for i := 0; i < 20; i++ {
+		conn, cleanup, result, err := OpenProcess(context.Background(), ProcessConfig{Command: writeFakeAgent(t, script)})
+		if err != nil {
+			t.Fatalf("attempt %d: OpenProcess() error = %v, want initialize result", i, err)
+		}
+		_ = conn
+		cleanup()
+		if !strings.Contains(string(result), `"protocolVersion":1`) {
+			t.Fatalf("attempt %d: initialize result = %s", i, result)
+		}
+	}
+}
+
+func TestOpenProcessReportsExitWhenChildKeepsStdoutOpen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := openFakeAgent(t, ctx, "read line\nsleep 10 &\nexit 4")
+
+	var exitErr *agents.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("OpenProcess() error = %v, want *agents.ExitError", err)
+	}
+	if exitErr.Code != 4 {
+		t.Fatalf("exit code = %d, want 4", exitErr.Code)
+	}
+}
+
+func TestTailWriterKeepsLastBytes(t *testing.T) {
+	w := &tailWriter{limit: 5}
+	_, _ = w.Write([]byte("abc"))
+	_, _ = w.Write([]byte("defgh"))
+	if got := w.String(); got != "defgh" {
+		t.Fatalf("tail = %q, want %q", got, "defgh")
+	}
+}
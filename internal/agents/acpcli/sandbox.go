@@ -0,0 +1,101 @@
+package acpcli
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxHome describes one isolated HOME directory for a provider process.
+//
+// Some agent CLIs print interactive auth prompts or first-run banners to stdout
+// when they find an unexpected local config, which corrupts the JSON-RPC stream.
+// Running them against a throwaway HOME seeded with only the credential files
+// they need keeps the protocol channel clean without touching the user's real
+// config directories.
+type SandboxHome struct {
+	// Prefix names the temporary directory (defaults to "acp-home").
+	Prefix string
+	// SeedFiles lists paths relative to the user's real home directory that are
+	// copied into the sandbox. Missing files are skipped.
+	SeedFiles []string
+}
+
+// PrepareSandboxHome creates one temporary HOME directory and copies the
+// configured seed files into it. The returned cleanup removes the directory.
+func PrepareSandboxHome(cfg SandboxHome) (string, func(), error) {
+	prefix := strings.TrimSpace(cfg.Prefix)
+	if prefix == "" {
+		prefix = "acp-home"
+	}
+	home, err := os.MkdirTemp("", prefix+"-*")
+	if err != nil {
+		return "", nil, errorsf("create sandbox home: %w", err)
+	}
+	cleanup := func() { _ = os.RemoveAll(home) }
+
+	userHome, _ := os.UserHomeDir()
+	for _, rel := range cfg.SeedFiles {
+		rel = filepath.Clean(strings.TrimSpace(rel))
+		if rel == "." || rel == "" || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			cleanup()
+			return "", nil, errorsf("sandbox seed file %q must be relative to home", rel)
+		}
+		if userHome == "" {
+			continue
+		}
+		dst := filepath.Join(home, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			cleanup()
+			return "", nil, errorsf("create sandbox seed dir: %w", err)
+		}
+		if err := copyFile(filepath.Join(userHome, rel), dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			cleanup()
+			return "", nil, errorsf("copy sandbox seed file %q: %w", rel, err)
+		}
+	}
+	return home, cleanup, nil
+}
+
+// SandboxHomeEnv points HOME and the XDG base directories at home.
+func SandboxHomeEnv(env []string, home string) []string {
+	env = SetEnv(env, "HOME", home)
+	env = SetEnv(env, "XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	env = SetEnv(env, "XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+	env = SetEnv(env, "XDG_STATE_HOME", filepath.Join(home, ".local", "state"))
+	env = SetEnv(env, "XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	return env
+}
+
+// SetEnv sets KEY=value in env, replacing an existing entry if present.
+func SetEnv(env []string, key, value string) []string {
+	prefix := key + "="
+	result := make([]string, len(env))
+	copy(result, env)
+	for i, entry := range result {
+		if strings.HasPrefix(entry, prefix) {
+			result[i] = prefix + value
+			return result
+		}
+	}
+	return append(result, prefix+value)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,100 @@
+package acpcli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareSandboxHomeCopiesOnlySeedFiles(t *testing.T) {
+	userHome := t.TempDir()
+	t.Setenv("HOME", userHome)
+
+	authPath := filepath.Join(userHome, ".local", "share", "agent", "auth.json")
+	if err := os.MkdirAll(filepath.Dir(authPath), 0o700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(authPath, []byte(`{"token":"x"}`), 0o600); err != nil {
+		t.Fatalf("WriteFile(auth): %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(userHome, "other.txt"), []byte("private"), 0o600); err != nil {
+		t.Fatalf("WriteFile(other): %v", err)
+	}
+
+	home, cleanup, err := PrepareSandboxHome(SandboxHome{
+		Prefix:    "test-home",
+		SeedFiles: []string{".local/share/agent/auth.json", ".config/agent/missing.json"},
+	})
+	if err != nil {
+		t.Fatalf("PrepareSandboxHome: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(home, ".local", "share", "agent", "auth.json"))
+	if err != nil {
+		t.Fatalf("ReadFile(seeded auth): %v", err)
+	}
+	if got, want := string(data), `{"token":"x"}`; got != want {
+		t.Fatalf("seeded auth = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(home, "other.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Stat(other.txt) err = %v, want not exist", err)
+	}
+
+	cleanup()
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Fatalf("Stat(home) after cleanup err = %v, want not exist", err)
+	}
+}
+
+func TestPrepareSandboxHomeRejectsEscapingSeedFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, seed := range []string{"../secret", "..", "/etc/passwd"} {
+		if _, _, err := PrepareSandboxHome(SandboxHome{SeedFiles: []string{seed}}); err == nil {
+			t.Fatalf("PrepareSandboxHome(%q) error = nil, want non-nil", seed)
+		}
+	}
+}
+
+func TestPrepareSandboxHomeAcceptsDotDotPrefixedNames(t *testing.T) {
+	userHome := t.TempDir()
+	t.Setenv("HOME", userHome)
+	if err := os.WriteFile(filepath.Join(userHome, "..foo"), []byte("seed"), 0o600); err != nil {
+		t.Fatalf("WriteFile(..foo): %v", err)
+	}
+
+	home, cleanup, err := PrepareSandboxHome(SandboxHome{SeedFiles: []string{"..foo"}})
+	if err != nil {
+		t.Fatalf("PrepareSandboxHome(..foo): %v", err)
+	}
+	defer cleanup()
+
+	data, err := os.ReadFile(filepath.Join(home, "..foo"))
+	if err != nil {
+		t.Fatalf("ReadFile(seeded ..foo): %v", err)
+	}
+	if string(data) != "seed" {
+		t.Fatalf("seeded ..foo = %q, want %q", data, "seed")
+	}
+}
+
+func TestSandboxHomeEnvOverridesHomeAndXDG(t *testing.T) {
+	env := SandboxHomeEnv([]string{"HOME=/real", "PATH=/bin"}, "/sandbox")
+
+	want := map[string]string{
+		"HOME":            "/sandbox",
+		"XDG_CONFIG_HOME": filepath.Join("/sandbox", ".config"),
+		"XDG_DATA_HOME":   filepath.Join("/sandbox", ".local", "share"),
+		"PATH":            "/bin",
+	}
+	got := make(map[string]string)
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		got[key] = value
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/beyond5959/ngent/internal/observability"
 )
@@ -22,6 +23,7 @@ const (
 	// MethodNotFound is the JSON-RPC method-not-found error code.
 	MethodNotFound = -32601
 	internalError  = -32603
+	parseError     = -32700
 )
 
 // Message is one JSON-RPC 2.0 message.
@@ -34,6 +36,10 @@ type Message struct {
 	Error   *RPCError       `json:"error,omitempty"`
 }
 
+// ErrCallTimeout reports a request that got no response within its
+// ConnOptions.CallTimeouts entry.
+var ErrCallTimeout = errors.New("call timed out")
+
 // RPCError is one JSON-RPC error object.
 type RPCError struct {
 	Code    int    `json:"code"`
@@ -44,8 +50,14 @@ func (e *RPCError) Error() string { return e.Message }
 
 // ConnOptions configures ACP stdio transport behavior.
 type ConnOptions struct {
-	Prefix           string
+	Prefix string
+	// AllowStdoutNoise skips stdout lines that are not JSON-RPC frames (log
+	// output, banners, auth hints) instead of closing the connection.
 	AllowStdoutNoise bool
+	// CallTimeouts bounds how long Call waits for a response, by method
+	// (e.g. "initialize"). Methods without a positive entry wait as long as
+	// the caller's context allows.
+	CallTimeouts map[string]time.Duration
 }
 
 // Conn is a newline-delimited JSON-RPC stdio connection.
@@ -119,6 +131,11 @@ func (c *Conn) Call(ctx context.Context, method string, params any) (json.RawMes
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	if timeout := c.opts.CallTimeouts[method]; timeout > 0 {
+		callCtx, cancel := context.WithTimeoutCause(ctx, timeout, ErrCallTimeout)
+		defer cancel()
+		ctx = callCtx
+	}
 
 	paramsJSON, err := json.Marshal(params)
 	if err != nil {
@@ -150,18 +167,18 @@ func (c *Conn) Call(ctx context.Context, method string, params any) (json.RawMes
 
 	select {
 	case <-c.done:
-		if e := c.doneError(); e != nil && !errors.Is(e, io.EOF) {
-			return nil, e
-		}
-		return nil, errors.New(c.prefix + ": connection closed")
+		return nil, c.closedError()
 	case <-ctx.Done():
+		if cause := context.Cause(ctx); errors.Is(cause, ErrCallTimeout) {
+			return nil, c.errf("%s: %w after %s", method, cause, c.opts.CallTimeouts[method])
+		}
 		return nil, ctx.Err()
 	case resp, ok := <-respCh:
 		if !ok {
-			return nil, errors.New(c.prefix + ": connection closed")
+			return nil, c.closedError()
 		}
 		if resp.Error != nil {
-			return nil, c.errf("rpc %s error (%d): %s", method, resp.Error.Code, resp.Error.Message)
+			return nil, c.errf("rpc %s error (%d): %w", method, resp.Error.Code, resp.Error)
 		}
 		return resp.Result, nil
 	}
@@ -235,22 +252,21 @@ func (c *Conn) consume(line []byte) error {
 
 	var msg Message
 	if err := json.Unmarshal(line, &msg); err != nil {
+		if c.opts.AllowStdoutNoise {
+			// Log lines such as "INFO {config loaded}" contain braces but are
+			// not JSON-RPC frames; log and drop them instead of tearing down
+			// the connection.
+			observability.LogACPDecodeError(c.prefix, line, err)
+			c.failUndecodableResponse(line, err)
+			return nil
+		}
 		return c.errf("decode rpc line: %w", err)
 	}
 	observability.LogACPMessage(c.prefix, "inbound", msg)
 
 	// Response: has id, no method.
 	if msg.Method == "" && len(msg.ID) > 0 {
-		key := string(msg.ID)
-		c.pendingMu.Lock()
-		ch, ok := c.pending[key]
-		if ok {
-			delete(c.pending, key)
-		}
-		c.pendingMu.Unlock()
-		if ok {
-			ch <- msg
-		}
+		c.dispatchResponse(msg)
 		return nil
 	}
 
@@ -310,6 +326,39 @@ func (c *Conn) consume(line []byte) error {
 	return nil
 }
 
+func (c *Conn) dispatchResponse(msg Message) {
+	key := string(msg.ID)
+	c.pendingMu.Lock()
+	ch, ok := c.pending[key]
+	if ok {
+		delete(c.pending, key)
+	}
+	c.pendingMu.Unlock()
+	if ok {
+		ch <- msg
+	}
+}
+
+// failUndecodableResponse fails the pending call a malformed response was
+// meant for, when its id can still be read, so the caller does not wait
+// forever for a reply that was already sent.
+func (c *Conn) failUndecodableResponse(line []byte, decodeErr error) {
+	var probe struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if err := json.Unmarshal(line, &probe); err != nil || len(probe.ID) == 0 || probe.Method != "" {
+		return
+	}
+	c.dispatchResponse(Message{
+		ID: probe.ID,
+		Error: &RPCError{
+			Code:    parseError,
+			Message: fmt.Sprintf("undecodable response: %v", decodeErr),
+		},
+	})
+}
+
 func (c *Conn) closeWithErr(err error) {
 	c.closeOnce.Do(func() {
 		_ = c.stdin.Close()
@@ -336,6 +385,15 @@ func (c *Conn) doneError() error {
 	return c.doneErr
 }
 
+// closedError reports why the connection closed, or a generic error when
+// the peer simply went away.
+func (c *Conn) closedError() error {
+	if e := c.doneError(); e != nil && !errors.Is(e, io.EOF) {
+		return e
+	}
+	return errors.New(c.prefix + ": connection closed")
+}
+
 func (c *Conn) errf(format string, args ...any) error {
 	return fmt.Errorf(c.prefix+": "+format, args...)
 }
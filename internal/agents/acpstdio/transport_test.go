@@ -169,6 +169,125 @@ func TestConnAllowStdoutNoiseSkipsNonJSONAndParsesPrefixedJSON(t *testing.T) {
 	}
 }
 
+func TestConnAllowStdoutNoiseSkipsInterleavedLogLinesWithBraces(t *testing.T) {
+	reqReaderPipe, reqWriterPipe := io.Pipe()
+	respReaderPipe, respWriterPipe := io.Pipe()
+
+	conn := NewConnWithOptions(reqWriterPipe, respReaderPipe, ConnOptions{
+		Prefix:           "acpstdio-noise-test",
+		AllowStdoutNoise: true,
+	})
+	t.Cleanup(func() {
+		conn.Close()
+		_ = reqReaderPipe.Close()
+		_ = reqWriterPipe.Close()
+		_ = respReaderPipe.Close()
+		_ = respWriterPipe.Close()
+	})
+
+	notified := make(chan string, 1)
+	conn.SetNotificationHandler(func(msg Message) error {
+		notified <- msg.Method
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "session/prompt", map[string]any{})
+		done <- err
+	}()
+
+	reqReader := bufio.NewReader(reqReaderPipe)
+	_ = readMessage(t, reqReader)
+
+	lines := []string{
+		"[opencode] loading plugins {count: 3}",
+		`{"jsonrpc":"2.0","method":"session/update","params":{}}`,
+		"WARN {not json",
+		"",
+		`{"jsonrpc":"2.0","id":1,"result":{"stopReason":"end_turn"}}`,
+	}
+	for _, line := range lines {
+		if _, err := respWriterPipe.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("write line %q: %v", line, err)
+		}
+	}
+
+	if err := waitErr(t, done); err != nil {
+		t.Fatalf("Call() error = %v, want nil", err)
+	}
+	select {
+	case method := <-notified:
+		if method != "session/update" {
+			t.Fatalf("notification method = %q, want %q", method, "session/update")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for interleaved notification")
+	}
+}
+
+func TestConnAllowStdoutNoiseFailsCallOnUndecodableResponse(t *testing.T) {
+	var logBuf bytes.Buffer
+	observability.ConfigureACPDebug(observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo), false)
+	t.Cleanup(func() {
+		observability.ConfigureACPDebug(nil, false)
+	})
+
+	reqReaderPipe, reqWriterPipe := io.Pipe()
+	respReaderPipe, respWriterPipe := io.Pipe()
+
+	conn := NewConnWithOptions(reqWriterPipe, respReaderPipe, ConnOptions{
+		Prefix:           "acpstdio-noise-test",
+		AllowStdoutNoise: true,
+	})
+	t.Cleanup(func() {
+		conn.Close()
+		_ = reqReaderPipe.Close()
+		_ = reqWriterPipe.Close()
+		_ = respReaderPipe.Close()
+		_ = respWriterPipe.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "initialize", map[string]any{})
+		done <- err
+	}()
+
+	_ = readMessage(t, bufio.NewReader(reqReaderPipe))
+	if _, err := respWriterPipe.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":"boom"}` + "\n")); err != nil {
+		t.Fatalf("write malformed response: %v", err)
+	}
+
+	err := waitErr(t, done)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != parseError || !strings.Contains(err.Error(), "undecodable response") {
+		t.Fatalf("Call() error = %v, want undecodable response RPC error", err)
+	}
+	if got := logBuf.String(); !strings.Contains(got, "acp.decode_failed") || !strings.Contains(got, "component=acpstdio-noise-test") {
+		t.Fatalf("log = %q, want acp.decode_failed for the component", got)
+	}
+}
+
+func TestConnWithoutNoiseToleranceClosesOnInvalidJSON(t *testing.T) {
+	conn, reqReader, respWriter := newTestConn(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "initialize", map[string]any{})
+		done <- err
+	}()
+
+	_ = readMessage(t, reqReader)
+	if _, err := respWriter.Write([]byte("not json\n")); err != nil {
+		t.Fatalf("write invalid line: %v", err)
+	}
+
+	if err := waitErr(t, done); err == nil {
+		t.Fatalf("Call() error = nil, want non-nil")
+	}
+}
+
 func TestConnDebugLogsInboundAndOutboundMessages(t *testing.T) {
 	var logBuf bytes.Buffer
 	logger := observability.NewLoggerWithWriter(&logBuf, observability.LevelDebug)
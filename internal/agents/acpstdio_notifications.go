@@ -36,6 +36,9 @@ func NewACPNotificationHandler(
 		switch update.Type {
 		case ACPUpdateTypeMessageChunk:
 			if update.Delta != "" && onDelta != nil {
+				if err := NotifyDeltaMetadata(ctx, update.DeltaMetadata); err != nil {
+					return err
+				}
 				return onDelta(update.Delta)
 			}
 			if update.MessageContent != nil {
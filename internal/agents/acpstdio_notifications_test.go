@@ -44,6 +44,78 @@ func TestNewACPNotificationHandlerRoutesThoughtChunksToReasoningHandler(t *testi
 	}
 }
 
+func TestNewACPNotificationHandlerSplitsReasoningPartsFromAnswer(t *testing.T) {
+	t.Parallel()
+
+	var answer string
+	var reasoning string
+	ctx := WithReasoningHandler(context.Background(), func(ctx context.Context, delta string) error {
+		_ = ctx
+		reasoning += delta
+		return nil
+	})
+
+	handler, markPromptStarted := NewACPNotificationHandler(ctx, func(delta string) error {
+		answer += delta
+		return nil
+	})
+	markPromptStarted()
+
+	for _, raw := range []string{
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"reasoning","text":"look "}}}`,
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"Hello"}}}`,
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"around","thought":true}}}`,
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":" world"}}}`,
+	} {
+		if err := handler("session/update", json.RawMessage(raw)); err != nil {
+			t.Fatalf("handler() error = %v", err)
+		}
+	}
+
+	if answer != "Hello world" {
+		t.Fatalf("answer = %q, want %q", answer, "Hello world")
+	}
+	if reasoning != "look around" {
+		t.Fatalf("reasoning = %q, want %q", reasoning, "look around")
+	}
+}
+
+func TestNewACPNotificationHandlerReportsDeltaMetadataBeforeDelta(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	ctx := WithDeltaMetadataHandler(context.Background(), func(ctx context.Context, meta DeltaMetadata) error {
+		_ = ctx
+		events = append(events, "meta:"+meta.ContentType+"/"+meta.Lang)
+		return nil
+	})
+
+	handler, markPromptStarted := NewACPNotificationHandler(ctx, func(delta string) error {
+		events = append(events, "delta:"+delta)
+		return nil
+	})
+	markPromptStarted()
+
+	for _, raw := range []string{
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"fmt.Println()","mimeType":"text/x-go","_meta":{"language":"go"}}}}`,
+		`{"update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"plain"}}}`,
+	} {
+		if err := handler("session/update", json.RawMessage(raw)); err != nil {
+			t.Fatalf("handler() error = %v", err)
+		}
+	}
+
+	want := []string{"meta:text/x-go/go", "delta:fmt.Println()", "delta:plain"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+	}
+}
+
 func TestNewACPNotificationHandlerRoutesToolCallsToToolCallHandler(t *testing.T) {
 	t.Parallel()
 
@@ -1,6 +1,33 @@
 package agents
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrTransient marks a stream failure that happened before the agent did any
+// visible work and is safe to retry. Providers wrap it with %w; the HTTP turn
+// retry policy only retries errors that match it by default.
+var ErrTransient = errors.New("agents: transient failure")
+
+type callerRetriesContextKey struct{}
+
+// WithCallerRetries marks ctx as belonging to a caller that retries
+// ErrTransient failures itself. Providers with their own restart loop then
+// fail fast with ErrTransient instead of retrying, so attempts do not
+// multiply across layers.
+func WithCallerRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callerRetriesContextKey{}, true)
+}
+
+// CallerRetries reports whether ctx was marked by WithCallerRetries.
+func CallerRetries(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	retries, _ := ctx.Value(callerRetriesContextKey{}).(bool)
+	return retries
+}
 
 // StopReason represents why a streamed turn stopped.
 type StopReason string
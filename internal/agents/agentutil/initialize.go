@@ -0,0 +1,105 @@
+package agentutil
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MergeInitializeParams returns base with overrides applied. Nested objects
+// are merged key by key, a nil override value removes the key, and any other
+// value replaces it. Neither input is modified.
+func MergeInitializeParams(base, overrides map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = cloneInitializeValue(value)
+	}
+	for key, value := range overrides {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		overrideObject, overrideIsObject := value.(map[string]any)
+		baseObject, baseIsObject := merged[key].(map[string]any)
+		if overrideIsObject && baseIsObject {
+			merged[key] = MergeInitializeParams(baseObject, overrideObject)
+			continue
+		}
+		merged[key] = cloneInitializeValue(value)
+	}
+	return merged
+}
+
+// ValidateInitializeParams checks operator-supplied initialize overrides:
+// protocolVersion must be a positive integer, clientInfo and
+// clientCapabilities must be objects, and fs capabilities must be booleans.
+func ValidateInitializeParams(params map[string]any) error {
+	for key, value := range params {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("initialize params contain an empty key")
+		}
+		if value == nil {
+			continue
+		}
+		switch key {
+		case "protocolVersion":
+			if !isPositiveInteger(value) {
+				return fmt.Errorf("initialize param protocolVersion must be a positive integer")
+			}
+		case "clientInfo":
+			if _, ok := value.(map[string]any); !ok {
+				return fmt.Errorf("initialize param clientInfo must be an object")
+			}
+		case "clientCapabilities":
+			capabilities, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("initialize param clientCapabilities must be an object")
+			}
+			if err := validateFSCapabilities(capabilities["fs"]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateFSCapabilities(value any) error {
+	if value == nil {
+		return nil
+	}
+	fs, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("initialize param clientCapabilities.fs must be an object")
+	}
+	for name, flag := range fs {
+		if _, ok := flag.(bool); !ok {
+			return fmt.Errorf("initialize param clientCapabilities.fs.%s must be a boolean", name)
+		}
+	}
+	return nil
+}
+
+func isPositiveInteger(value any) bool {
+	switch v := value.(type) {
+	case int:
+		return v > 0
+	case int64:
+		return v > 0
+	case float64:
+		return v > 0 && v == math.Trunc(v)
+	default:
+		return false
+	}
+}
+
+func cloneInitializeValue(value any) any {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+	cloned := make(map[string]any, len(object))
+	for key, nested := range object {
+		cloned[key] = cloneInitializeValue(nested)
+	}
+	return cloned
+}
@@ -0,0 +1,70 @@
+package agentutil_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/beyond5959/ngent/internal/agents/agentutil"
+)
+
+func TestMergeInitializeParams(t *testing.T) {
+	base := map[string]any{
+		"protocolVersion": 1,
+		"clientCapabilities": map[string]any{
+			"fs": map[string]any{
+				"readTextFile":  false,
+				"writeTextFile": false,
+			},
+		},
+		"clientInfo": map[string]any{"name": "ngent"},
+	}
+	merged := agentutil.MergeInitializeParams(base, map[string]any{
+		"clientCapabilities": map[string]any{
+			"fs":       map[string]any{"readTextFile": true},
+			"terminal": true,
+		},
+		"clientInfo": nil,
+	})
+
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		t.Fatalf("json.Marshal(merged): %v", err)
+	}
+	want := `{"clientCapabilities":{"fs":{"readTextFile":true,"writeTextFile":false},"terminal":true},"protocolVersion":1}`
+	if got := string(encoded); got != want {
+		t.Fatalf("merged = %s, want %s", got, want)
+	}
+
+	fs := base["clientCapabilities"].(map[string]any)["fs"].(map[string]any)
+	if fs["readTextFile"] != false {
+		t.Fatalf("base was modified: fs = %v", fs)
+	}
+}
+
+func TestValidateInitializeParams(t *testing.T) {
+	valid := []map[string]any{
+		nil,
+		{"protocolVersion": float64(1)},
+		{"clientCapabilities": map[string]any{"fs": map[string]any{"readTextFile": true}}},
+		{"clientInfo": nil},
+	}
+	for _, params := range valid {
+		if err := agentutil.ValidateInitializeParams(params); err != nil {
+			t.Fatalf("ValidateInitializeParams(%v) = %v, want nil", params, err)
+		}
+	}
+
+	invalid := []map[string]any{
+		{"": true},
+		{"protocolVersion": "1"},
+		{"protocolVersion": float64(1.5)},
+		{"clientInfo": "ngent"},
+		{"clientCapabilities": true},
+		{"clientCapabilities": map[string]any{"fs": map[string]any{"readTextFile": "yes"}}},
+	}
+	for _, params := range invalid {
+		if err := agentutil.ValidateInitializeParams(params); err == nil {
+			t.Fatalf("ValidateInitializeParams(%v) = nil, want error", params)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package agentutil
 
 import (
+	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/beyond5959/ngent/internal/agents"
 	"github.com/beyond5959/ngent/internal/agents/acpmodel"
@@ -15,6 +17,22 @@ type Config struct {
 	ModelID         string
 	SessionID       string
 	ConfigOverrides map[string]string
+	// SandboxHome opts the provider into running with an isolated temporary
+	// HOME. Providers that do not support isolation ignore it.
+	SandboxHome bool
+	// InitializeParams overrides or extends the ACP initialize params of
+	// stdio providers, e.g. {"clientCapabilities":{"fs":{"readTextFile":true}}}.
+	// See MergeInitializeParams for the merge rules.
+	InitializeParams map[string]any
+	// SessionMeta is sent as the _meta field of ACP session/new so the agent
+	// starts with thread context. Nil omits the field; providers without an
+	// ACP session/new ignore it.
+	SessionMeta map[string]any
+	// CallTimeouts bounds single ACP requests of stdio providers by method,
+	// e.g. {"initialize": 30 * time.Second}, so a hung handshake fails with
+	// acpstdio.ErrCallTimeout instead of waiting out the turn. Methods
+	// without an entry only follow the caller's context.
+	CallTimeouts map[string]time.Duration
 }
 
 // State stores the common mutable provider state shared by built-in agents.
@@ -33,6 +51,9 @@ func NewState(provider string, cfg Config) (*State, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := ValidateInitializeParams(cfg.InitializeParams); err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.TrimSpace(provider), err)
+	}
 	return &State{
 		dir:             dir,
 		modelID:         strings.TrimSpace(cfg.ModelID),
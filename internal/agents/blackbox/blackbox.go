@@ -34,8 +34,8 @@ var _ agents.SlashCommandsProvider = (*Client)(nil)
 // New constructs a BLACKBOX AI ACP client.
 func New(cfg Config) (*Client, error) {
 	base, err := acpcli.New(agents.AgentIDBlackbox, cfg, acpcli.Hooks{
-		OpenConn:                openConn(cfg.Dir),
-		SessionNewParams:        acpcli.SessionNewParams(cfg.Dir),
+		OpenConn:                openConn(cfg.Dir, agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams), cfg.CallTimeouts),
+		SessionNewParams:        acpcli.SessionNewParamsWithMeta(cfg.Dir, cfg.SessionMeta),
 		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
 		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
 		PromptParams:            promptParams,
@@ -54,7 +54,7 @@ func Preflight() error {
 	return agentutil.PreflightBinary(agents.AgentIDBlackbox)
 }
 
-func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+func openConn(dir string, initParams map[string]any, callTimeouts map[string]time.Duration) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
 	return func(
 		ctx context.Context,
 		req acpcli.OpenConnRequest,
@@ -72,8 +72,9 @@ func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstd
 			ConnOptions: acpstdio.ConnOptions{
 				Prefix:           agents.AgentIDBlackbox,
 				AllowStdoutNoise: true,
+				CallTimeouts:     callTimeouts,
 			},
-			InitializeParams: initializeParams(),
+			InitializeParams: initParams,
 		})
 		if err != nil {
 			return nil, nil, nil, acpcli.WrapOpenError(agents.AgentIDBlackbox, req.Purpose, err)
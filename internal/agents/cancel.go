@@ -0,0 +1,64 @@
+package agents
+
+import (
+	"context"
+	"time"
+)
+
+// CancelGrace is how long providers wait for session/prompt to answer
+// session/cancel before tearing the agent process down.
+const CancelGrace = 2 * time.Second
+
+// WithCancelGrace returns a context that stays live for grace after ctx is
+// done, so a provider can still read the agent's reply to session/cancel.
+// The returned stop func releases it early.
+func WithCancelGrace(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopAfter := context.AfterFunc(ctx, func() {
+		if grace <= 0 {
+			cancel()
+			return
+		}
+		timer := time.AfterFunc(grace, cancel)
+		context.AfterFunc(graceCtx, func() { timer.Stop() })
+	})
+	return graceCtx, func() {
+		stopAfter()
+		cancel()
+	}
+}
+
+// CancelForcedHandler is told that the provider gave up waiting for the
+// agent to acknowledge a cancel and tore the process down instead.
+type CancelForcedHandler func(ctx context.Context) error
+
+type cancelForcedHandlerContextKey struct{}
+
+// WithCancelForcedHandler binds one per-turn forced-cancel callback to context.
+func WithCancelForcedHandler(ctx context.Context, handler CancelForcedHandler) context.Context {
+	if handler == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cancelForcedHandlerContextKey{}, handler)
+}
+
+// CancelForcedHandlerFromContext gets the forced-cancel callback from context, if present.
+func CancelForcedHandlerFromContext(ctx context.Context) (CancelForcedHandler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	handler, ok := ctx.Value(cancelForcedHandlerContextKey{}).(CancelForcedHandler)
+	if !ok || handler == nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// NotifyCancelForced reports an unacknowledged cancel to the active callback.
+func NotifyCancelForced(ctx context.Context) error {
+	handler, ok := CancelForcedHandlerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return handler(ctx)
+}
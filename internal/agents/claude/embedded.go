@@ -396,6 +396,8 @@ func (c *Client) streamOnce(
 			if parseErr != nil {
 				return agents.StopReasonEndTurn, parseErr
 			}
+			_ = agents.NotifyACPPromptUsage(ctx, result.response.Result)
+			_ = agents.NotifyACPPromptStopReason(ctx, result.response.Result)
 			if stopReason == "cancelled" {
 				return agents.StopReasonCancelled, nil
 			}
@@ -467,6 +469,12 @@ func (c *Client) handleUpdate(
 				}
 			}
 			return nil
+		case agents.ACPUpdateTypeThoughtMessageChunk:
+			if err := agents.NotifyReasoningDelta(ctx, update.Delta); err != nil {
+				c.sendSessionCancel(runtime, c.currentSessionID())
+				return err
+			}
+			return nil
 		case agents.ACPUpdateTypePlan:
 			handler, ok := agents.PlanHandlerFromContext(ctx)
 			if !ok {
@@ -537,13 +545,7 @@ func (c *Client) handlePermissionRequest(
 
 	outcome := agents.PermissionOutcomeDeclined
 	if handler, ok := agents.PermissionHandlerFromContext(ctx); ok {
-		resp, err := handler(ctx, request)
-		if err == nil {
-			switch resp.Outcome {
-			case agents.PermissionOutcomeApproved, agents.PermissionOutcomeDeclined, agents.PermissionOutcomeCancelled:
-				outcome = resp.Outcome
-			}
-		}
+		outcome = agents.ResolvePermissionOutcome(handler(ctx, request))
 	}
 
 	respondCtx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
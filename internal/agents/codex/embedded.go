@@ -55,8 +55,15 @@ type Config struct {
 	RuntimeConfig   codexacp.RuntimeConfig
 	StartTimeout    time.Duration
 	RequestTimeout  time.Duration
+	// RejectConcurrentPrompts makes a Stream call that overlaps another one on
+	// the same Client fail with ErrPromptInFlight instead of waiting for it.
+	RejectConcurrentPrompts bool
 }
 
+// ErrPromptInFlight is returned when RejectConcurrentPrompts is set and a
+// session/prompt is already running on the Client.
+var ErrPromptInFlight = errors.New("codex: another prompt is already in flight on this client")
+
 // Client streams turn output through one in-process codex-acp runtime.
 type Client struct {
 	*agentutil.State
@@ -71,6 +78,11 @@ type Client struct {
 	mu     sync.Mutex
 	closed bool
 
+	// promptSlot serializes StreamPrompt: the embedded runtime keeps one
+	// session per Client and overlapping session/prompt calls corrupt it.
+	promptSlot     chan struct{}
+	rejectOverlaps bool
+
 	runtime          *codexacp.EmbeddedRuntime
 	sessionID        string
 	runtimeSessionID string
@@ -191,6 +203,8 @@ func New(cfg Config) (*Client, error) {
 		runtimeConfig:  runtimeCfg,
 		startTimeout:   startTimeout,
 		requestTimeout: requestTimeout,
+		promptSlot:     make(chan struct{}, 1),
+		rejectOverlaps: cfg.RejectConcurrentPrompts,
 	}, nil
 }
 
@@ -385,9 +399,28 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	if c.rejectOverlaps {
+		select {
+		case c.promptSlot <- struct{}{}:
+		default:
+			return agents.StopReasonEndTurn, ErrPromptInFlight
+		}
+	} else {
+		select {
+		case c.promptSlot <- struct{}{}:
+		case <-ctx.Done():
+			return agents.StopReasonCancelled, nil
+		}
+	}
+	defer func() { <-c.promptSlot }()
 	prompt = agents.NormalizePrompt(prompt)
 
-	const maxAttempts = 2
+	// A crashed turn/start is retried once on a fresh runtime, unless the
+	// caller retries transient failures itself.
+	maxAttempts := 2
+	if agents.CallerRetries(ctx) {
+		maxAttempts = 1
+	}
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		runtime, sessionID, stableSessionID, err := c.ensureInitialized(ctx)
 		if err != nil {
@@ -427,11 +460,14 @@ func (c *Client) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta
 			}
 			return stopReason, nil
 		}
-		if !isRetryableTurnStartError(streamErr) || attempt == maxAttempts {
+		if !isRetryableTurnStartError(streamErr) {
 			return stopReason, streamErr
 		}
 
 		c.resetRuntime()
+		if attempt == maxAttempts {
+			return stopReason, fmt.Errorf("%w (%w)", streamErr, agents.ErrTransient)
+		}
 	}
 
 	return agents.StopReasonEndTurn, errors.New("codex: retry loop exited unexpectedly")
@@ -541,6 +577,8 @@ func (c *Client) streamOnce(
 				stopDrainTimer()
 				return agents.StopReasonEndTurn, parseErr
 			}
+			_ = agents.NotifyACPPromptUsage(ctx, result.response.Result)
+			_ = agents.NotifyACPPromptStopReason(ctx, result.response.Result)
 			if stopReason == "cancelled" {
 				finalStopReason = agents.StopReasonCancelled
 			} else {
@@ -584,12 +622,27 @@ func (c *Client) streamOnce(
 	}
 }
 
+// isRetryableTurnStartError reports whether err is the app-server's
+// session/prompt failure for a turn that crashed while starting.
 func isRetryableTurnStartError(err error) bool {
-	if err == nil {
+	var rpcErr *rpcError
+	if !errors.As(err, &rpcErr) {
 		return false
 	}
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "session/prompt rpc error code=-32000 message=turn/start failed")
+	return rpcErr.method == methodSessionPrompt &&
+		rpcErr.code == -32000 &&
+		strings.HasPrefix(strings.ToLower(rpcErr.message), "turn/start failed")
+}
+
+// rpcError is a JSON-RPC error response to one clientRequest.
+type rpcError struct {
+	method  string
+	code    int
+	message string
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("codex: %s rpc error code=%d message=%s", e.method, e.code, e.message)
 }
 
 func (c *Client) resetRuntime() {
@@ -762,13 +815,7 @@ func (c *Client) handlePermissionRequest(
 
 	outcome := agents.PermissionOutcomeDeclined
 	if handler, ok := agents.PermissionHandlerFromContext(ctx); ok {
-		resp, err := handler(ctx, request)
-		if err == nil {
-			switch resp.Outcome {
-			case agents.PermissionOutcomeApproved, agents.PermissionOutcomeDeclined, agents.PermissionOutcomeCancelled:
-				outcome = resp.Outcome
-			}
-		}
+		outcome = agents.ResolvePermissionOutcome(handler(ctx, request))
 	}
 
 	respondCtx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
@@ -1151,12 +1198,11 @@ func (c *Client) clientRequest(
 	}
 	observability.LogACPMessage(c.Name(), "inbound", response)
 	if response.Error != nil {
-		return codexacp.RPCMessage{}, fmt.Errorf(
-			"codex: %s rpc error code=%d message=%s",
-			method,
-			response.Error.Code,
-			strings.TrimSpace(response.Error.Message),
-		)
+		return codexacp.RPCMessage{}, &rpcError{
+			method:  method,
+			code:    response.Error.Code,
+			message: strings.TrimSpace(response.Error.Message),
+		}
 	}
 	return response, nil
 }
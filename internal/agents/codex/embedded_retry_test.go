@@ -0,0 +1,26 @@
+package codex
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsRetryableTurnStartError(t *testing.T) {
+	crashed := &rpcError{method: methodSessionPrompt, code: -32000, message: "turn/start failed: app-server exited"}
+	cases := map[string]struct {
+		err  error
+		want bool
+	}{
+		"wrapped crash":  {err: fmt.Errorf("codex: session/prompt failed: %w", crashed), want: true},
+		"other method":   {err: &rpcError{method: "session/new", code: -32000, message: "turn/start failed"}, want: false},
+		"other code":     {err: &rpcError{method: methodSessionPrompt, code: -32603, message: "turn/start failed"}, want: false},
+		"lookalike text": {err: errors.New(crashed.Error()), want: false},
+		"nil":            {err: nil, want: false},
+	}
+	for name, tc := range cases {
+		if got := isRetryableTurnStartError(tc.err); got != tc.want {
+			t.Fatalf("%s: isRetryableTurnStartError(%v) = %v, want %v", name, tc.err, got, tc.want)
+		}
+	}
+}
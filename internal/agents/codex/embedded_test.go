@@ -142,6 +142,56 @@ func TestStreamCapturesReasoningTextDeltas(t *testing.T) {
 	}
 }
 
+func TestConcurrentStreamsOnOneClientAreSerialized(t *testing.T) {
+	client := newFakeCodexClient(t)
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var baseline strings.Builder
+	if _, err := client.Stream(ctx, "serialization probe", func(delta string) error {
+		baseline.WriteString(delta)
+		return nil
+	}); err != nil {
+		t.Fatalf("baseline Stream(): %v", err)
+	}
+	if baseline.Len() == 0 {
+		t.Fatalf("baseline Stream() produced no output")
+	}
+
+	type result struct {
+		answer     string
+		stopReason agents.StopReason
+		err        error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var answer strings.Builder
+			stopReason, err := client.Stream(ctx, "serialization probe", func(delta string) error {
+				answer.WriteString(delta)
+				return nil
+			})
+			results <- result{answer: answer.String(), stopReason: stopReason, err: err}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		got := <-results
+		if got.err != nil {
+			t.Fatalf("concurrent Stream() error = %v", got.err)
+		}
+		if got.stopReason != agents.StopReasonEndTurn {
+			t.Fatalf("concurrent StopReason = %q, want %q", got.stopReason, agents.StopReasonEndTurn)
+		}
+		if got.answer != baseline.String() {
+			t.Fatalf("concurrent answer = %q, want uncorrupted %q", got.answer, baseline.String())
+		}
+	}
+}
+
 func TestSlashCommandsAfterConfigOptionsInit(t *testing.T) {
 	client := newFakeCodexClient(t)
 	defer func() {
@@ -10,6 +10,10 @@ const (
 	AgentIDQwen     = "qwen"
 	AgentIDGemini   = "gemini"
 	AgentIDBlackbox = "blackbox"
+
+	// AgentIDEcho is the in-process ACP echo agent used for protocol testing.
+	// It is opt-in and not part of AllAgentIDs.
+	AgentIDEcho = "echo"
 )
 
 // AllAgentIDs returns all supported agent IDs.
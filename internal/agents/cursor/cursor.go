@@ -45,12 +45,12 @@ var _ agents.SlashCommandsProvider = (*Client)(nil)
 // New constructs a Cursor ACP client.
 func New(cfg Config) (*Client, error) {
 	base, err := acpcli.New(agents.AgentIDCursor, cfg, acpcli.Hooks{
-		OpenConn:                openConn(cfg.Dir),
-		SessionNewParams:        sessionNewParams(cfg.Dir),
+		OpenConn:                openConn(cfg.Dir, agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams), cfg.CallTimeouts),
+		SessionNewParams:        sessionNewParams(cfg.Dir, cfg.SessionMeta),
 		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
 		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
 		PromptParams:            promptParams,
-		DiscoverModelsParams:    sessionNewParams(cfg.Dir),
+		DiscoverModelsParams:    sessionNewParams(cfg.Dir, nil),
 		PrepareConfigSession:    prepareConfigSession,
 		SelectSessionModel:      selectSessionModel,
 		HandlePermissionRequest: handlePermissionRequest,
@@ -78,7 +78,7 @@ func Preflight() error {
 	return fmt.Errorf("cursor binary not found in PATH (tried %s): %w", joinedCommandNames(), lastErr)
 }
 
-func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+func openConn(dir string, initParams map[string]any, callTimeouts map[string]time.Duration) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
 	return func(
 		ctx context.Context,
 		req acpcli.OpenConnRequest,
@@ -91,9 +91,10 @@ func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstd
 				Dir:     strings.TrimSpace(dir),
 				Env:     os.Environ(),
 				ConnOptions: acpstdio.ConnOptions{
-					Prefix: agents.AgentIDCursor,
+					Prefix:       agents.AgentIDCursor,
+					CallTimeouts: callTimeouts,
 				},
-				InitializeParams: initializeParams(),
+				InitializeParams: initParams,
 			})
 			if err != nil {
 				attemptErrors = append(attemptErrors, acpcli.WrapOpenError(
@@ -136,12 +137,16 @@ func initializeParams() map[string]any {
 	}
 }
 
-func sessionNewParams(dir string) func(string) map[string]any {
+func sessionNewParams(dir string, meta map[string]any) func(string) map[string]any {
 	return func(string) map[string]any {
-		return map[string]any{
+		params := map[string]any{
 			"cwd":        strings.TrimSpace(dir),
 			"mcpServers": []any{},
 		}
+		if len(meta) > 0 {
+			params["_meta"] = meta
+		}
+		return params
 	}
 }
 
@@ -0,0 +1,78 @@
+package agents
+
+import (
+	"context"
+	"strings"
+)
+
+// DeltaMetadata describes the content block one message delta came from.
+type DeltaMetadata struct {
+	// ContentType is the block MIME type or provider content kind, if any.
+	ContentType string
+	// Lang is the programming/markup language hint for code blocks, if any.
+	Lang string
+}
+
+// IsZero reports whether no metadata is present.
+func (m DeltaMetadata) IsZero() bool {
+	return m.ContentType == "" && m.Lang == ""
+}
+
+// DeltaMetadataHandler receives metadata for the message delta that the
+// provider delivers next through onDelta on the same goroutine.
+type DeltaMetadataHandler func(ctx context.Context, meta DeltaMetadata) error
+
+type deltaMetadataHandlerContextKey struct{}
+
+// WithDeltaMetadataHandler binds one per-turn delta metadata callback to context.
+func WithDeltaMetadataHandler(ctx context.Context, handler DeltaMetadataHandler) context.Context {
+	if handler == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, deltaMetadataHandlerContextKey{}, handler)
+}
+
+// DeltaMetadataHandlerFromContext gets delta metadata callback from context, if present.
+func DeltaMetadataHandlerFromContext(ctx context.Context) (DeltaMetadataHandler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	handler, ok := ctx.Value(deltaMetadataHandlerContextKey{}).(DeltaMetadataHandler)
+	if !ok || handler == nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// NotifyDeltaMetadata reports metadata for the next message delta to the active callback.
+func NotifyDeltaMetadata(ctx context.Context, meta DeltaMetadata) error {
+	handler, ok := DeltaMetadataHandlerFromContext(ctx)
+	if !ok || meta.IsZero() {
+		return nil
+	}
+	return handler(ctx, meta)
+}
+
+// parseACPDeltaMetadata reads optional content-type and language hints from
+// one ACP text content block. Providers spell these differently, so the block
+// fields win over _meta and the first non-empty alias is used.
+func parseACPDeltaMetadata(record map[string]any) DeltaMetadata {
+	meta, _ := record["_meta"].(map[string]any)
+	return DeltaMetadata{
+		ContentType: firstACPRecordString(record, meta, "mimeType", "contentType"),
+		Lang:        firstACPRecordString(record, meta, "language", "lang"),
+	}
+}
+
+func firstACPRecordString(record, meta map[string]any, keys ...string) string {
+	for _, source := range []map[string]any{record, meta} {
+		for _, key := range keys {
+			if value, ok := source[key].(string); ok {
+				if value = strings.TrimSpace(value); value != "" {
+					return value
+				}
+			}
+		}
+	}
+	return ""
+}
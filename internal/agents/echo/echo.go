@@ -0,0 +1,114 @@
+// Package echo is a built-in ACP agent that runs in-process and echoes each
+// prompt back. It drives the same acpcli path as the stdio providers
+// (initialize, session/new, session/prompt, session/update, permission
+// requests, cancel) without spawning a subprocess, for integration tests and
+// local protocol debugging.
+package echo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/agents/acpcli"
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+	"github.com/beyond5959/ngent/internal/agents/agentutil"
+)
+
+// Config configures the in-process echo agent.
+type Config = agentutil.Config
+
+// Client opens one in-process echo ACP peer per ACP operation.
+type Client struct {
+	*acpcli.Client
+}
+
+var _ agents.Streamer = (*Client)(nil)
+var _ agents.ConfigOptionManager = (*Client)(nil)
+
+// New constructs an echo ACP client.
+func New(cfg Config) (*Client, error) {
+	base, err := acpcli.New(agents.AgentIDEcho, cfg, acpcli.Hooks{
+		OpenConn:                openConn(agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams)),
+		SessionNewParams:        acpcli.SessionNewParamsWithMeta(cfg.Dir, cfg.SessionMeta),
+		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
+		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
+		PromptParams:            promptParams,
+		HandlePermissionRequest: acpcli.StructuredPermissionRequestHandler(0),
+		Cancel:                  cancelWithNotify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Client: base}, nil
+}
+
+// DiscoverModels starts one ACP session/new handshake and returns model
+// options. The echo agent advertises none.
+func DiscoverModels(ctx context.Context, cfg Config) ([]agents.ModelOption, error) {
+	return acpcli.DiscoverModelsWithClient(ctx, func() (*Client, error) {
+		return New(cfg)
+	})
+}
+
+func openConn(initParams map[string]any) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+	return func(
+		ctx context.Context,
+		req acpcli.OpenConnRequest,
+	) (*acpstdio.Conn, func(), json.RawMessage, error) {
+		clientReader, serverWriter := io.Pipe()
+		serverReader, clientWriter := io.Pipe()
+		go newServer(serverReader, serverWriter).serve()
+
+		conn := acpstdio.NewConnWithOptions(clientWriter, clientReader, acpstdio.ConnOptions{
+			Prefix: agents.AgentIDEcho,
+		})
+		cleanup := func() {
+			conn.Close()
+			_ = clientWriter.Close()
+			_ = clientReader.Close()
+		}
+
+		initResult, err := conn.Call(ctx, "initialize", initParams)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, acpcli.WrapOpenError(agents.AgentIDEcho, req.Purpose, err)
+		}
+		return conn, cleanup, initResult, nil
+	}
+}
+
+func initializeParams() map[string]any {
+	return map[string]any{
+		"protocolVersion": 1,
+		"clientCapabilities": map[string]any{
+			"fs": map[string]any{
+				"readTextFile":  false,
+				"writeTextFile": false,
+			},
+		},
+	}
+}
+
+func promptParams(sessionID string, prompt agents.Prompt, _ string) map[string]any {
+	return acpcli.ACPPromptParams(sessionID, prompt)
+}
+
+func cancelWithNotify(conn *acpstdio.Conn, sessionID string) {
+	if conn == nil {
+		return
+	}
+	conn.Notify("session/cancel", map[string]any{
+		"sessionId": strings.TrimSpace(sessionID),
+	})
+}
+
+// Name returns the provider identifier.
+func (c *Client) Name() string {
+	if c == nil || c.Client == nil {
+		return agents.AgentIDEcho
+	}
+	return c.Client.Name()
+}
@@ -0,0 +1,135 @@
+package echo
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/agents"
+)
+
+func TestStreamEchoesPrompt(t *testing.T) {
+	client, err := New(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var out strings.Builder
+	stopReason, err := client.Stream(context.Background(), "hello echo", func(delta string) error {
+		out.WriteString(delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if stopReason != agents.StopReasonEndTurn {
+		t.Fatalf("stopReason = %q, want %q", stopReason, agents.StopReasonEndTurn)
+	}
+	if got := out.String(); got != "hello echo" {
+		t.Fatalf("output = %q, want %q", got, "hello echo")
+	}
+}
+
+func TestStreamPermissionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    agents.PermissionResponse
+		handler bool
+		want    string
+	}{
+		{name: "approved", resp: agents.PermissionResponse{Outcome: agents.PermissionOutcomeApproved}, handler: true, want: "[permission approved] rm -rf build"},
+		{name: "declined", resp: agents.PermissionResponse{Outcome: agents.PermissionOutcomeDeclined}, handler: true, want: "[permission declined] rm -rf build"},
+		{name: "no handler", want: "[permission declined] rm -rf build"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := New(Config{Dir: t.TempDir()})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			ctx := context.Background()
+			var gotReq agents.PermissionRequest
+			if tt.handler {
+				ctx = agents.WithPermissionHandler(ctx, func(_ context.Context, req agents.PermissionRequest) (agents.PermissionResponse, error) {
+					gotReq = req
+					return tt.resp, nil
+				})
+			}
+
+			var out strings.Builder
+			if _, err := client.Stream(ctx, PermissionPrefix+" rm -rf build", func(delta string) error {
+				out.WriteString(delta)
+				return nil
+			}); err != nil {
+				t.Fatalf("Stream: %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Fatalf("output = %q, want %q", got, tt.want)
+			}
+			if tt.handler && gotReq.Approval == "" {
+				t.Fatalf("permission request = %+v, want approval text", gotReq)
+			}
+		})
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	client, err := New(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan agents.StopReason, 1)
+	go func() {
+		stopReason, _ := client.Stream(ctx, strings.Repeat("x", 3000), func(string) error {
+			cancel()
+			return nil
+		})
+		done <- stopReason
+	}()
+
+	select {
+	case stopReason := <-done:
+		if stopReason != agents.StopReasonCancelled {
+			t.Fatalf("stopReason = %q, want %q", stopReason, agents.StopReasonCancelled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stream did not return after cancel")
+	}
+}
+
+func TestSessionMetaReachesAgent(t *testing.T) {
+	meta := map[string]any{
+		"ngent": map[string]any{"threadId": "th_1", "title": "Billing service"},
+	}
+	tests := []struct {
+		name string
+		meta map[string]any
+		want string
+	}{
+		{name: "with meta", meta: meta, want: `{"ngent":{"threadId":"th_1","title":"Billing service"}}`},
+		{name: "without meta", want: "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := New(Config{Dir: t.TempDir(), SessionMeta: tt.meta})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			var out strings.Builder
+			if _, err := client.Stream(context.Background(), SessionMetaPrompt, func(delta string) error {
+				out.WriteString(delta)
+				return nil
+			}); err != nil {
+				t.Fatalf("Stream: %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Fatalf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+)
+
+const (
+	// PermissionPrefix makes the echo agent ask for permission before it
+	// echoes. The rest of the first line is used as the tool-call title.
+	PermissionPrefix = "permission:"
+	// SessionMetaPrompt makes the echo agent reply with the JSON _meta it
+	// received in session/new, or "null" when there was none.
+	SessionMetaPrompt = "/session-meta"
+
+	defaultChunkSize = 3
+	chunkDelay       = 5 * time.Millisecond
+)
+
+// server is the in-process ACP agent behind one echo connection. It reads
+// newline-delimited JSON-RPC from in and writes to out, like an ACP CLI on
+// stdio. Prompts are served on their own goroutine so the agent can call
+// back into the client (session/request_permission) and still see
+// session/cancel while a prompt runs.
+type server struct {
+	in  io.ReadCloser
+	out io.WriteCloser
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	nextID      int64
+	nextSession int
+	pending     map[string]chan acpstdio.Message
+	cancels     map[string]context.CancelFunc
+	meta        map[string]json.RawMessage
+}
+
+func newServer(in io.ReadCloser, out io.WriteCloser) *server {
+	return &server{
+		in:      in,
+		out:     out,
+		pending: make(map[string]chan acpstdio.Message),
+		cancels: make(map[string]context.CancelFunc),
+		meta:    make(map[string]json.RawMessage),
+	}
+}
+
+// serve handles inbound messages until in reaches EOF.
+func (s *server) serve() {
+	defer s.shutdown()
+
+	reader := bufio.NewReader(s.in)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var msg acpstdio.Message
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr == nil {
+				s.dispatch(msg)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *server) shutdown() {
+	_ = s.out.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, cancel := range s.cancels {
+		cancel()
+		delete(s.cancels, id)
+	}
+	for id, ch := range s.pending {
+		close(ch)
+		delete(s.pending, id)
+	}
+}
+
+func (s *server) dispatch(msg acpstdio.Message) {
+	if msg.Method == "" && len(msg.ID) > 0 {
+		s.mu.Lock()
+		ch, ok := s.pending[string(msg.ID)]
+		delete(s.pending, string(msg.ID))
+		s.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+		return
+	}
+
+	switch msg.Method {
+	case "initialize":
+		s.reply(msg.ID, map[string]any{
+			"protocolVersion": 1,
+			"agentCapabilities": map[string]any{
+				"loadSession": false,
+			},
+			"agentInfo": map[string]any{"name": "echo"},
+		}, nil)
+	case "session/new":
+		s.mu.Lock()
+		s.nextSession++
+		sessionID := "echo-" + strconv.Itoa(s.nextSession)
+		var params struct {
+			Meta json.RawMessage `json:"_meta"`
+		}
+		_ = json.Unmarshal(msg.Params, &params)
+		s.meta[sessionID] = params.Meta
+		s.mu.Unlock()
+		s.reply(msg.ID, map[string]any{"sessionId": sessionID}, nil)
+	case "session/prompt":
+		go s.prompt(msg)
+	case "session/cancel":
+		s.cancel(sessionIDParam(msg.Params))
+		if len(msg.ID) > 0 {
+			s.reply(msg.ID, nil, nil)
+		}
+	default:
+		if len(msg.ID) > 0 {
+			s.reply(msg.ID, nil, &acpstdio.RPCError{Code: acpstdio.MethodNotFound, Message: "method not found"})
+		}
+	}
+}
+
+// prompt echoes the prompt text back as agent_message_chunk updates.
+func (s *server) prompt(msg acpstdio.Message) {
+	var params struct {
+		SessionID string `json:"sessionId"`
+		Prompt    []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"prompt"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		s.reply(msg.ID, nil, &acpstdio.RPCError{Code: -32602, Message: "invalid params"})
+		return
+	}
+	var text strings.Builder
+	for _, block := range params.Prompt {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.cancels[params.SessionID] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.cancels, params.SessionID)
+		s.mu.Unlock()
+		cancel()
+	}()
+
+	output := text.String()
+	if strings.TrimSpace(output) == SessionMetaPrompt {
+		s.mu.Lock()
+		meta := s.meta[params.SessionID]
+		s.mu.Unlock()
+		output = "null"
+		if len(meta) > 0 {
+			output = string(meta)
+		}
+	}
+	if rest, ok := strings.CutPrefix(output, PermissionPrefix); ok {
+		title, _, _ := strings.Cut(rest, "\n")
+		outcome, err := s.requestPermission(ctx, params.SessionID, strings.TrimSpace(title))
+		if err != nil {
+			s.reply(msg.ID, nil, &acpstdio.RPCError{Code: -32603, Message: err.Error()})
+			return
+		}
+		output = "[permission " + outcome + "] " + strings.TrimSpace(rest)
+	}
+
+	stopReason := "end_turn"
+	runes := []rune(output)
+	for start := 0; start < len(runes); start += defaultChunkSize {
+		end := min(start+defaultChunkSize, len(runes))
+		select {
+		case <-ctx.Done():
+			stopReason = "cancelled"
+		case <-time.After(chunkDelay):
+		}
+		if stopReason == "cancelled" {
+			break
+		}
+		s.notify("session/update", map[string]any{
+			"sessionId": params.SessionID,
+			"update": map[string]any{
+				"sessionUpdate": "agent_message_chunk",
+				"content":       map[string]any{"type": "text", "text": string(runes[start:end])},
+			},
+		})
+	}
+	if ctx.Err() != nil {
+		stopReason = "cancelled"
+	}
+	s.reply(msg.ID, map[string]any{"stopReason": stopReason}, nil)
+}
+
+// requestPermission asks the client to approve one echo "tool call" and
+// reports approved, declined, or cancelled.
+func (s *server) requestPermission(ctx context.Context, sessionID, title string) (string, error) {
+	if title == "" {
+		title = "echo"
+	}
+	result, err := s.call(ctx, "session/request_permission", map[string]any{
+		"sessionId": sessionID,
+		"toolCall": map[string]any{
+			"toolCallId": "echo-permission",
+			"title":      title,
+			"kind":       "execute",
+			"rawInput":   map[string]any{"command": title},
+		},
+		"options": []map[string]any{
+			{"optionId": "allow_once", "name": "Allow", "kind": "allow_once"},
+			{"optionId": "reject_once", "name": "Reject", "kind": "reject_once"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var reply struct {
+		Outcome struct {
+			Outcome  string `json:"outcome"`
+			OptionID string `json:"optionId"`
+		} `json:"outcome"`
+	}
+	if err := json.Unmarshal(result, &reply); err != nil {
+		return "", fmt.Errorf("decode permission reply: %w", err)
+	}
+	switch {
+	case reply.Outcome.Outcome == "cancelled":
+		return "cancelled", nil
+	case reply.Outcome.OptionID == "allow_once":
+		return "approved", nil
+	default:
+		return "declined", nil
+	}
+}
+
+func (s *server) cancel(sessionID string) {
+	s.mu.Lock()
+	cancel, ok := s.cancels[sessionID]
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (s *server) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan acpstdio.Message, 1)
+	s.mu.Lock()
+	s.nextID++
+	id := json.RawMessage(strconv.FormatInt(s.nextID, 10))
+	s.pending[string(id)] = ch
+	s.mu.Unlock()
+
+	if err := s.write(acpstdio.Message{JSONRPC: "2.0", ID: id, Method: method, Params: paramsJSON}); err != nil {
+		return nil, err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, io.EOF
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.pending, string(id))
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *server) notify(method string, params any) {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	_ = s.write(acpstdio.Message{JSONRPC: "2.0", Method: method, Params: paramsJSON})
+}
+
+func (s *server) reply(id json.RawMessage, result any, rpcErr *acpstdio.RPCError) {
+	msg := acpstdio.Message{JSONRPC: "2.0", ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			msg.Error = &acpstdio.RPCError{Code: -32603, Message: err.Error()}
+		} else {
+			msg.Result = resultJSON
+		}
+	}
+	_ = s.write(msg)
+}
+
+func (s *server) write(msg acpstdio.Message) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = s.out.Write(append(encoded, '\n'))
+	return err
+}
+
+func sessionIDParam(raw json.RawMessage) string {
+	var params struct {
+		SessionID string `json:"sessionId"`
+	}
+	_ = json.Unmarshal(raw, &params)
+	return params.SessionID
+}
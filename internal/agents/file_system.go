@@ -0,0 +1,107 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+)
+
+const (
+	// ACPMethodReadTextFile is the agent-to-client ACP request that reads a file.
+	ACPMethodReadTextFile = "fs/read_text_file"
+	// ACPMethodWriteTextFile is the agent-to-client ACP request that writes a file.
+	ACPMethodWriteTextFile = "fs/write_text_file"
+)
+
+// ReadTextFileRequest is one ACP fs/read_text_file request. Line is 1-based;
+// zero Line and Limit read the whole file.
+type ReadTextFileRequest struct {
+	SessionID string `json:"sessionId"`
+	Path      string `json:"path"`
+	Line      int    `json:"line,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// WriteTextFileRequest is one ACP fs/write_text_file request.
+type WriteTextFileRequest struct {
+	SessionID string `json:"sessionId"`
+	Path      string `json:"path"`
+	Content   string `json:"content"`
+}
+
+// FileSystemHandler serves agent file-system requests for the active turn.
+// Implementations decide which paths are reachable.
+type FileSystemHandler interface {
+	ReadTextFile(ctx context.Context, req ReadTextFileRequest) (string, error)
+	WriteTextFile(ctx context.Context, req WriteTextFileRequest) error
+}
+
+type fileSystemHandlerContextKey struct{}
+
+// WithFileSystemHandler binds one per-turn file-system handler to context.
+func WithFileSystemHandler(ctx context.Context, handler FileSystemHandler) context.Context {
+	if handler == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, fileSystemHandlerContextKey{}, handler)
+}
+
+// FileSystemHandlerFromContext gets the file-system handler from context, if present.
+func FileSystemHandlerFromContext(ctx context.Context) (FileSystemHandler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	handler, ok := ctx.Value(fileSystemHandlerContextKey{}).(FileSystemHandler)
+	if !ok || handler == nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// IsACPFileSystemMethod reports whether method is an ACP fs/* request.
+func IsACPFileSystemMethod(method string) bool {
+	return method == ACPMethodReadTextFile || method == ACPMethodWriteTextFile
+}
+
+// HandleACPFileSystemRequest serves one ACP fs/* request through the
+// context handler. Without a handler the request is rejected as an unknown
+// method, so file access stays off unless the turn opted in.
+func HandleACPFileSystemRequest(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	handler, ok := FileSystemHandlerFromContext(ctx)
+	if !ok {
+		return nil, &acpstdio.RPCError{Code: acpstdio.MethodNotFound, Message: "method not found"}
+	}
+
+	switch method {
+	case ACPMethodReadTextFile:
+		var req ReadTextFileRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("decode %s params: %w", method, err)
+		}
+		if strings.TrimSpace(req.Path) == "" {
+			return nil, fmt.Errorf("%s: path is required", method)
+		}
+		content, err := handler.ReadTextFile(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{"content": content})
+	case ACPMethodWriteTextFile:
+		var req WriteTextFileRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, fmt.Errorf("decode %s params: %w", method, err)
+		}
+		if strings.TrimSpace(req.Path) == "" {
+			return nil, fmt.Errorf("%s: path is required", method)
+		}
+		if err := handler.WriteTextFile(ctx, req); err != nil {
+			return nil, err
+		}
+		return json.RawMessage("null"), nil
+	default:
+		return nil, &acpstdio.RPCError{Code: acpstdio.MethodNotFound, Message: "method not found"}
+	}
+}
@@ -0,0 +1,64 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+)
+
+type recordingFileSystem struct {
+	read  ReadTextFileRequest
+	write WriteTextFileRequest
+}
+
+func (f *recordingFileSystem) ReadTextFile(_ context.Context, req ReadTextFileRequest) (string, error) {
+	f.read = req
+	return "hello\n", nil
+}
+
+func (f *recordingFileSystem) WriteTextFile(_ context.Context, req WriteTextFileRequest) error {
+	f.write = req
+	return nil
+}
+
+func TestHandleACPFileSystemRequestWithoutHandler(t *testing.T) {
+	_, err := HandleACPFileSystemRequest(context.Background(), ACPMethodReadTextFile, json.RawMessage(`{"path":"/tmp/a"}`))
+	var rpcErr *acpstdio.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != acpstdio.MethodNotFound {
+		t.Fatalf("HandleACPFileSystemRequest() error = %v, want method not found", err)
+	}
+}
+
+func TestHandleACPFileSystemRequestDispatches(t *testing.T) {
+	fs := &recordingFileSystem{}
+	ctx := WithFileSystemHandler(context.Background(), fs)
+
+	result, err := HandleACPFileSystemRequest(ctx, ACPMethodReadTextFile, json.RawMessage(`{"sessionId":"s1","path":"/w/a.txt","line":2,"limit":3}`))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got, want := string(result), `{"content":"hello\n"}`; got != want {
+		t.Fatalf("read result = %s, want %s", got, want)
+	}
+	if fs.read.Path != "/w/a.txt" || fs.read.Line != 2 || fs.read.Limit != 3 || fs.read.SessionID != "s1" {
+		t.Fatalf("read request = %+v", fs.read)
+	}
+
+	result, err = HandleACPFileSystemRequest(ctx, ACPMethodWriteTextFile, json.RawMessage(`{"path":"/w/b.txt","content":"x"}`))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if string(result) != "null" {
+		t.Fatalf("write result = %s, want null", result)
+	}
+	if fs.write.Path != "/w/b.txt" || fs.write.Content != "x" {
+		t.Fatalf("write request = %+v", fs.write)
+	}
+
+	if _, err := HandleACPFileSystemRequest(ctx, ACPMethodReadTextFile, json.RawMessage(`{"path":" "}`)); err == nil {
+		t.Fatalf("read with empty path error = nil, want non-nil")
+	}
+}
@@ -33,8 +33,8 @@ var _ agents.SlashCommandsProvider = (*Client)(nil)
 // New constructs a Gemini CLI ACP client.
 func New(cfg Config) (*Client, error) {
 	base, err := acpcli.New(agents.AgentIDGemini, cfg, acpcli.Hooks{
-		OpenConn:                openConn(cfg.Dir),
-		SessionNewParams:        acpcli.SessionNewParams(cfg.Dir),
+		OpenConn:                openConn(cfg.Dir, agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams), cfg.CallTimeouts),
+		SessionNewParams:        acpcli.SessionNewParamsWithMeta(cfg.Dir, cfg.SessionMeta),
 		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
 		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
 		PromptParams:            promptParams,
@@ -53,7 +53,7 @@ func Preflight() error {
 	return agentutil.PreflightBinary(agents.AgentIDGemini)
 }
 
-func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+func openConn(dir string, initParams map[string]any, callTimeouts map[string]time.Duration) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
 	return func(
 		ctx context.Context,
 		req acpcli.OpenConnRequest,
@@ -70,8 +70,9 @@ func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstd
 			ConnOptions: acpstdio.ConnOptions{
 				Prefix:           agents.AgentIDGemini,
 				AllowStdoutNoise: true,
+				CallTimeouts:     callTimeouts,
 			},
-			InitializeParams: initializeParams(),
+			InitializeParams: initParams,
 		})
 		if err != nil {
 			_ = os.RemoveAll(cliHome)
@@ -105,6 +106,17 @@ func promptParams(sessionID string, prompt agents.Prompt, modelID string) map[st
 	return params
 }
 
+// permissionReply answers Gemini permission requests with the ACP nested
+// selected-option schema. Gemini accepts canonical option IDs even when the
+// request options are not parsed, so they act as the fallback choice.
+var permissionReply = agents.PermissionReplyAdapter{
+	Format: agents.PermissionReplySelectedOption,
+	FallbackOptionIDs: map[agents.PermissionOutcome]string{
+		agents.PermissionOutcomeApproved: "allow_once",
+		agents.PermissionOutcomeDeclined: "reject_once",
+	},
+}
+
 func handlePermissionRequest(
 	ctx context.Context,
 	params json.RawMessage,
@@ -116,10 +128,10 @@ func handlePermissionRequest(
 		ToolCall  map[string]any `json:"toolCall"`
 	}
 	if err := json.Unmarshal(params, &req); err != nil {
-		return buildPermissionResponse("cancelled")
+		return permissionReply.Encode(agents.PermissionResponse{Outcome: agents.PermissionOutcomeCancelled}, nil, nil)
 	}
 	if !hasHandler {
-		return buildPermissionResponse("reject_once")
+		return permissionReply.Encode(agents.PermissionResponse{Outcome: agents.PermissionOutcomeDeclined}, nil, nil)
 	}
 
 	resp, err := handler(ctx, agents.PermissionRequest{
@@ -130,27 +142,10 @@ func handlePermissionRequest(
 			"toolCall":  req.ToolCall,
 		},
 	})
-	if err != nil {
-		return buildPermissionResponse("reject_once")
-	}
-	if optionID := strings.TrimSpace(resp.SelectedOptionID); optionID != "" {
-		return buildPermissionResponse(optionID)
-	}
-	switch resp.Outcome {
-	case agents.PermissionOutcomeApproved:
-		return buildPermissionResponse("allow_once")
-	case agents.PermissionOutcomeCancelled:
-		return buildPermissionResponse("cancelled")
-	default:
-		return buildPermissionResponse("reject_once")
-	}
-}
-
-func buildPermissionResponse(optionID string) (json.RawMessage, error) {
-	if strings.EqualFold(strings.TrimSpace(optionID), "cancelled") {
-		return acpcli.BuildCancelledPermissionResponse()
+	if err == nil && strings.EqualFold(strings.TrimSpace(resp.SelectedOptionID), "cancelled") {
+		resp = agents.PermissionResponse{Outcome: agents.PermissionOutcomeCancelled}
 	}
-	return acpcli.BuildSelectedPermissionResponse(optionID)
+	return permissionReply.Encode(resp, err, nil)
 }
 
 func extractToolString(toolCall map[string]any, key string) string {
@@ -267,24 +262,10 @@ func copyFile(src, dst string) error {
 	return err
 }
 
-// appendOrReplace sets KEY=value in env, replacing an existing entry if present.
-func appendOrReplace(env []string, key, value string) []string {
-	prefix := key + "="
-	result := make([]string, len(env))
-	copy(result, env)
-	for i, entry := range result {
-		if strings.HasPrefix(entry, prefix) {
-			result[i] = prefix + value
-			return result
-		}
-	}
-	return append(result, prefix+value)
-}
-
 func buildGeminiCLIEnv(cliHome string) []string {
-	env := appendOrReplace(os.Environ(), "GEMINI_CLI_HOME", cliHome)
+	env := acpcli.SetEnv(os.Environ(), "GEMINI_CLI_HOME", cliHome)
 	if value, ok := os.LookupEnv("GOOGLE_GEMINI_BASE_URL"); ok {
-		env = appendOrReplace(env, "GOOGLE_GEMINI_BASE_URL", value)
+		env = acpcli.SetEnv(env, "GOOGLE_GEMINI_BASE_URL", value)
 	}
 	return env
 }
@@ -2,9 +2,11 @@ package gemini_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -447,6 +449,87 @@ for line in sys.stdin:
 	}
 }
 
+func TestInitializeParamsFSCapabilityToggle(t *testing.T) {
+	python3, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not in PATH")
+	}
+
+	tmpDir := t.TempDir()
+	capturePath := filepath.Join(tmpDir, "initialize.json")
+	fakeScript := fmt.Sprintf(`#!%s
+import json
+import sys
+
+def send(obj):
+    sys.stdout.write(json.dumps(obj) + "\n")
+    sys.stdout.flush()
+
+for line in sys.stdin:
+    line = line.strip()
+    if not line:
+        continue
+    req = json.loads(line)
+    method = req.get("method", "")
+    rid = req.get("id")
+    if method == "initialize":
+        with open(%q, "w") as f:
+            json.dump(req.get("params", {}), f)
+        send({"jsonrpc":"2.0","id":rid,"result":{"protocolVersion":1,"agentCapabilities":{"loadSession":True}}})
+    elif method == "session/new":
+        send({"jsonrpc":"2.0","id":rid,"result":{"sessionId":"ses_fs","models":{"currentModelId":"m","availableModels":["m"]}}})
+`, python3, capturePath)
+	if err := os.WriteFile(filepath.Join(tmpDir, "gemini"), []byte(fakeScript), 0o755); err != nil {
+		t.Fatalf("write fake binary: %v", err)
+	}
+	t.Setenv("PATH", tmpDir+":"+os.Getenv("PATH"))
+
+	capturedFS := func(cfg gemini.Config) map[string]any {
+		t.Helper()
+		if _, err := gemini.DiscoverModels(context.Background(), cfg); err != nil {
+			t.Fatalf("DiscoverModels: %v", err)
+		}
+		raw, err := os.ReadFile(capturePath)
+		if err != nil {
+			t.Fatalf("read captured initialize params: %v", err)
+		}
+		var params struct {
+			ProtocolVersion    int `json:"protocolVersion"`
+			ClientCapabilities struct {
+				FS map[string]any `json:"fs"`
+			} `json:"clientCapabilities"`
+		}
+		if err := json.Unmarshal(raw, &params); err != nil {
+			t.Fatalf("decode captured initialize params: %v", err)
+		}
+		if params.ProtocolVersion != 1 {
+			t.Fatalf("protocolVersion = %d, want 1", params.ProtocolVersion)
+		}
+		return params.ClientCapabilities.FS
+	}
+
+	if fs := capturedFS(gemini.Config{Dir: tmpDir}); fs["readTextFile"] != false || fs["writeTextFile"] != false {
+		t.Fatalf("default fs capabilities = %v, want both false", fs)
+	}
+
+	fs := capturedFS(gemini.Config{
+		Dir: tmpDir,
+		InitializeParams: map[string]any{
+			"clientCapabilities": map[string]any{"fs": map[string]any{"readTextFile": true}},
+		},
+	})
+	if fs["readTextFile"] != true || fs["writeTextFile"] != false {
+		t.Fatalf("overridden fs capabilities = %v, want readTextFile only", fs)
+	}
+
+	if _, err := gemini.New(gemini.Config{
+		Dir:              tmpDir,
+		InitializeParams: map[string]any{"clientCapabilities": map[string]any{"fs": "all"}},
+	}); err == nil {
+		t.Fatalf("New(invalid fs capabilities) error = nil, want non-nil")
+	}
+}
+
 // TestGeminiE2ESmoke performs a real turn with the installed gemini binary.
 // Run with: E2E_GEMINI=1 go test ./internal/agents/gemini/ -run E2E -v -timeout 60s
 func TestGeminiE2ESmoke(t *testing.T) {
@@ -41,8 +41,8 @@ var _ agents.SlashCommandsProvider = (*Client)(nil)
 // New constructs a Kimi ACP client.
 func New(cfg Config) (*Client, error) {
 	base, err := acpcli.New(agents.AgentIDKimi, cfg, acpcli.Hooks{
-		OpenConn:                openConn(cfg.Dir),
-		SessionNewParams:        acpcli.SessionNewParams(cfg.Dir),
+		OpenConn:                openConn(cfg.Dir, agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams), cfg.CallTimeouts),
+		SessionNewParams:        acpcli.SessionNewParamsWithMeta(cfg.Dir, cfg.SessionMeta),
 		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
 		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
 		PromptParams:            promptParams,
@@ -98,7 +98,7 @@ func (c *Client) SetConfigOption(ctx context.Context, configID, value string) ([
 	return options, nil
 }
 
-func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+func openConn(dir string, initParams map[string]any, callTimeouts map[string]time.Duration) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
 	return func(
 		ctx context.Context,
 		req acpcli.OpenConnRequest,
@@ -117,9 +117,10 @@ func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstd
 				Dir:     strings.TrimSpace(dir),
 				Env:     os.Environ(),
 				ConnOptions: acpstdio.ConnOptions{
-					Prefix: agents.AgentIDKimi,
+					Prefix:       agents.AgentIDKimi,
+					CallTimeouts: callTimeouts,
 				},
-				InitializeParams: initializeParams(),
+				InitializeParams: initParams,
 			})
 			if err == nil {
 				return conn, cleanup, initResult, nil
@@ -21,6 +21,14 @@ const methodSessionSetModel = "session/set_model"
 
 var handlePermissionRequest = acpcli.StructuredPermissionRequestHandler(defaultPermissionTimeout)
 
+// sandboxSeedFiles lists the credential/config files copied into an isolated
+// HOME when Config.SandboxHome is enabled.
+var sandboxSeedFiles = []string{
+	".local/share/opencode/auth.json",
+	".config/opencode/opencode.json",
+	".config/opencode/opencode.jsonc",
+}
+
 // Config configures the OpenCode ACP stdio provider.
 type Config = agentutil.Config
 
@@ -38,8 +46,8 @@ var _ agents.SlashCommandsProvider = (*Client)(nil)
 // New constructs an OpenCode ACP client.
 func New(cfg Config) (*Client, error) {
 	base, err := acpcli.New(agents.AgentIDOpencode, cfg, acpcli.Hooks{
-		OpenConn:                openConn(cfg.Dir),
-		SessionNewParams:        acpcli.SessionNewParams(cfg.Dir),
+		OpenConn:                openConn(cfg.Dir, cfg.SandboxHome, agentutil.MergeInitializeParams(initializeParams(), cfg.InitializeParams), cfg.CallTimeouts),
+		SessionNewParams:        acpcli.SessionNewParamsWithMeta(cfg.Dir, cfg.SessionMeta),
 		SessionLoadParams:       acpcli.SessionLoadParams(cfg.Dir),
 		SessionListParams:       acpcli.SessionListParams(cfg.Dir),
 		PromptParams:            promptParams,
@@ -60,22 +68,31 @@ func Preflight() error {
 	return agentutil.PreflightBinary(agents.AgentIDOpencode)
 }
 
-func openConn(dir string) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
+func openConn(dir string, sandboxHome bool, initParams map[string]any, callTimeouts map[string]time.Duration) func(context.Context, acpcli.OpenConnRequest) (*acpstdio.Conn, func(), json.RawMessage, error) {
 	return func(
 		ctx context.Context,
 		req acpcli.OpenConnRequest,
 	) (*acpstdio.Conn, func(), json.RawMessage, error) {
 		args := []string{"acp", "--cwd", strings.TrimSpace(dir)}
-		conn, cleanup, initResult, err := acpcli.OpenProcess(ctx, acpcli.ProcessConfig{
+		processCfg := acpcli.ProcessConfig{
 			Command: agents.AgentIDOpencode,
 			Args:    args,
 			Dir:     strings.TrimSpace(dir),
 			Env:     os.Environ(),
 			ConnOptions: acpstdio.ConnOptions{
-				Prefix: agents.AgentIDOpencode,
+				Prefix:           agents.AgentIDOpencode,
+				AllowStdoutNoise: true,
+				CallTimeouts:     callTimeouts,
 			},
-			InitializeParams: initializeParams(),
-		})
+			InitializeParams: initParams,
+		}
+		if sandboxHome {
+			processCfg.SandboxHome = &acpcli.SandboxHome{
+				Prefix:    "opencode-home",
+				SeedFiles: sandboxSeedFiles,
+			}
+		}
+		conn, cleanup, initResult, err := acpcli.OpenProcess(ctx, processCfg)
 		if err != nil {
 			return nil, nil, nil, acpcli.WrapOpenError(agents.AgentIDOpencode, req.Purpose, err)
 		}
@@ -0,0 +1,142 @@
+package agents
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// PermissionReplyFormat identifies one wire schema used to answer an ACP
+// session/request_permission call.
+type PermissionReplyFormat string
+
+const (
+	// PermissionReplyOutcome replies with {"outcome":"approved|declined|cancelled"}.
+	// The generic acp transport and the embedded codex/claude runtimes use it.
+	PermissionReplyOutcome PermissionReplyFormat = "outcome"
+	// PermissionReplySelectedOption replies with the ACP-standard nested
+	// {"outcome":{"outcome":"selected","optionId":...}} shape, or
+	// {"outcome":{"outcome":"cancelled"}} when no option fits the decision.
+	PermissionReplySelectedOption PermissionReplyFormat = "selected_option"
+)
+
+var (
+	defaultApproveOptionKinds = []string{"allow_once", "allow_always"}
+	defaultDeclineOptionKinds = []string{"reject_once", "reject_always"}
+)
+
+// PermissionReplyAdapter maps neutral permission decisions onto one provider's
+// reply schema. The zero value encodes PermissionReplyOutcome.
+type PermissionReplyAdapter struct {
+	Format PermissionReplyFormat
+	// FallbackOptionIDs are literal optionIds sent for approved/declined
+	// decisions when the request advertised no matching option.
+	FallbackOptionIDs map[PermissionOutcome]string
+}
+
+// ResolvePermissionOutcome normalizes one handler result. Errors and unknown
+// outcomes resolve to declined so permissions stay fail-closed.
+func ResolvePermissionOutcome(resp PermissionResponse, err error) PermissionOutcome {
+	if err != nil {
+		return PermissionOutcomeDeclined
+	}
+	switch resp.Outcome {
+	case PermissionOutcomeApproved, PermissionOutcomeDeclined, PermissionOutcomeCancelled:
+		return resp.Outcome
+	default:
+		return PermissionOutcomeDeclined
+	}
+}
+
+// Encode returns the wire reply for one handler result. options are the
+// choices advertised by the provider in the originating request.
+func (a PermissionReplyAdapter) Encode(
+	resp PermissionResponse,
+	err error,
+	options []PermissionOption,
+) (json.RawMessage, error) {
+	outcome := ResolvePermissionOutcome(resp, err)
+	if a.Format != PermissionReplySelectedOption {
+		return json.Marshal(map[string]any{"outcome": string(outcome)})
+	}
+
+	if err == nil {
+		if optionID := strings.TrimSpace(resp.SelectedOptionID); optionID != "" {
+			return EncodeSelectedPermissionReply(optionID)
+		}
+	}
+	switch outcome {
+	case PermissionOutcomeApproved:
+		if optionID := a.pickOptionID(options, outcome, defaultApproveOptionKinds); optionID != "" {
+			return EncodeSelectedPermissionReply(optionID)
+		}
+		return a.encodeDeclined(options)
+	case PermissionOutcomeCancelled:
+		return EncodeCancelledPermissionReply()
+	default:
+		return a.encodeDeclined(options)
+	}
+}
+
+func (a PermissionReplyAdapter) encodeDeclined(options []PermissionOption) (json.RawMessage, error) {
+	if optionID := a.pickOptionID(options, PermissionOutcomeDeclined, defaultDeclineOptionKinds); optionID != "" {
+		return EncodeSelectedPermissionReply(optionID)
+	}
+	return EncodeCancelledPermissionReply()
+}
+
+func (a PermissionReplyAdapter) pickOptionID(
+	options []PermissionOption,
+	outcome PermissionOutcome,
+	kinds []string,
+) string {
+	if optionID := PickPermissionOptionID(options, kinds...); optionID != "" {
+		return optionID
+	}
+	return strings.TrimSpace(a.FallbackOptionIDs[outcome])
+}
+
+// EncodeSelectedPermissionReply returns the ACP "selected" reply for optionID.
+func EncodeSelectedPermissionReply(optionID string) (json.RawMessage, error) {
+	return json.Marshal(map[string]any{
+		"outcome": map[string]any{
+			"outcome":  "selected",
+			"optionId": strings.TrimSpace(optionID),
+		},
+	})
+}
+
+// EncodeCancelledPermissionReply returns the ACP "cancelled" reply.
+func EncodeCancelledPermissionReply() (json.RawMessage, error) {
+	return json.Marshal(map[string]any{
+		"outcome": map[string]any{
+			"outcome": "cancelled",
+		},
+	})
+}
+
+// PickPermissionOptionID returns the first matching optionId for the preferred kinds.
+func PickPermissionOptionID(options []PermissionOption, preferredKinds ...string) string {
+	for _, kind := range preferredKinds {
+		normalizedKind := normalizePermissionKind(kind)
+		if normalizedKind == "" {
+			continue
+		}
+		for _, option := range options {
+			if strings.TrimSpace(option.OptionID) == "" {
+				continue
+			}
+			if normalizePermissionKind(option.Kind) == normalizedKind ||
+				normalizePermissionKind(option.OptionID) == normalizedKind {
+				return strings.TrimSpace(option.OptionID)
+			}
+		}
+	}
+	return ""
+}
+
+func normalizePermissionKind(value string) string {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	normalized = strings.ReplaceAll(normalized, "-", "_")
+	normalized = strings.ReplaceAll(normalized, " ", "_")
+	return normalized
+}
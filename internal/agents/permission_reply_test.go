@@ -0,0 +1,122 @@
+package agents
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPermissionReplyAdapterEncode(t *testing.T) {
+	t.Parallel()
+
+	options := []PermissionOption{
+		{OptionID: "opt-allow", Kind: "allow_once"},
+		{OptionID: "opt-allow-always", Kind: "allow-always"},
+		{OptionID: "opt-reject", Kind: "reject_once"},
+	}
+	selected := PermissionReplyAdapter{Format: PermissionReplySelectedOption}
+	withFallback := PermissionReplyAdapter{
+		Format: PermissionReplySelectedOption,
+		FallbackOptionIDs: map[PermissionOutcome]string{
+			PermissionOutcomeApproved: "allow_once",
+			PermissionOutcomeDeclined: "reject_once",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		adapter PermissionReplyAdapter
+		resp    PermissionResponse
+		err     error
+		options []PermissionOption
+		want    string
+	}{
+		{
+			name:    "outcome approved",
+			adapter: PermissionReplyAdapter{},
+			resp:    PermissionResponse{Outcome: PermissionOutcomeApproved},
+			want:    `{"outcome":"approved"}`,
+		},
+		{
+			name:    "outcome unknown fails closed",
+			adapter: PermissionReplyAdapter{Format: PermissionReplyOutcome},
+			resp:    PermissionResponse{Outcome: "maybe"},
+			want:    `{"outcome":"declined"}`,
+		},
+		{
+			name:    "outcome handler error fails closed",
+			adapter: PermissionReplyAdapter{},
+			resp:    PermissionResponse{Outcome: PermissionOutcomeApproved},
+			err:     errors.New("timeout"),
+			want:    `{"outcome":"declined"}`,
+		},
+		{
+			name:    "selected explicit option wins",
+			adapter: selected,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeDeclined, SelectedOptionID: "opt-allow-always"},
+			options: options,
+			want:    `{"outcome":{"optionId":"opt-allow-always","outcome":"selected"}}`,
+		},
+		{
+			name:    "selected approved picks allow kind",
+			adapter: selected,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeApproved},
+			options: options,
+			want:    `{"outcome":{"optionId":"opt-allow","outcome":"selected"}}`,
+		},
+		{
+			name:    "selected declined picks reject kind",
+			adapter: selected,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeDeclined},
+			options: options,
+			want:    `{"outcome":{"optionId":"opt-reject","outcome":"selected"}}`,
+		},
+		{
+			name:    "selected approved without options cancels",
+			adapter: selected,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeApproved},
+			want:    `{"outcome":{"outcome":"cancelled"}}`,
+		},
+		{
+			name:    "selected cancelled",
+			adapter: selected,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeCancelled},
+			options: options,
+			want:    `{"outcome":{"outcome":"cancelled"}}`,
+		},
+		{
+			name:    "selected error ignores chosen option",
+			adapter: selected,
+			resp:    PermissionResponse{SelectedOptionID: "opt-allow"},
+			err:     errors.New("disconnected"),
+			options: options,
+			want:    `{"outcome":{"optionId":"opt-reject","outcome":"selected"}}`,
+		},
+		{
+			name:    "fallback approved",
+			adapter: withFallback,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeApproved},
+			want:    `{"outcome":{"optionId":"allow_once","outcome":"selected"}}`,
+		},
+		{
+			name:    "fallback declined",
+			adapter: withFallback,
+			resp:    PermissionResponse{Outcome: PermissionOutcomeDeclined},
+			want:    `{"outcome":{"optionId":"reject_once","outcome":"selected"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := tt.adapter.Encode(tt.resp, tt.err, tt.options)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Encode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
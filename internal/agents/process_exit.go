@@ -0,0 +1,39 @@
+package agents
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrAgentProtocol reports that an agent process answered initialize with a
+// JSON-RPC error or with output that is not ACP.
+var ErrAgentProtocol = errors.New("agents: agent protocol error")
+
+// ExitError reports that an agent process exited before initialize
+// completed. Stderr holds the tail of what the process wrote there; it is
+// kept out of Error because it may contain secrets.
+type ExitError struct {
+	// Code is the process exit code, or -1 when it was killed by a signal.
+	Code   int
+	Stderr string
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	if e.Code < 0 && e.Err != nil {
+		return "agent exited during initialize: " + e.Err.Error()
+	}
+	return fmt.Sprintf("agent exited with code %d during initialize", e.Code)
+}
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// StderrTail returns the trimmed stderr tail of an ExitError in err's chain.
+func StderrTail(err error) string {
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		return ""
+	}
+	return strings.TrimSpace(exitErr.Stderr)
+}
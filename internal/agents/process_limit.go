@@ -0,0 +1,96 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrProcessLimit reports that no agent subprocess slot became free in time.
+var ErrProcessLimit = errors.New("agents: agent process limit reached")
+
+// ProcessLimiter caps how many agent subprocesses run at once. Providers
+// that spawn a process per operation acquire a slot right before starting
+// the process and release it once the process is gone.
+type ProcessLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// NewProcessLimiter returns a limiter for limit concurrent processes that
+// waits up to wait for a free slot. It returns nil, meaning unlimited, when
+// limit is not positive.
+func NewProcessLimiter(limit int, wait time.Duration) *ProcessLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &ProcessLimiter{
+		slots: make(chan struct{}, limit),
+		wait:  max(wait, 0),
+	}
+}
+
+// Acquire takes one slot, waiting up to the limiter wait or until ctx ends.
+// The returned release func must be called exactly once.
+func (l *ProcessLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	if l.wait <= 0 {
+		return nil, fmt.Errorf("%w (%d running)", ErrProcessLimit, cap(l.slots))
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w (%d running)", ErrProcessLimit, cap(l.slots))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Limit reports the configured slot count; 0 means unlimited.
+func (l *ProcessLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots)
+}
+
+// InUse reports how many slots are currently held.
+func (l *ProcessLimiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+func (l *ProcessLimiter) release() { <-l.slots }
+
+type processLimiterContextKey struct{}
+
+// WithProcessLimiter binds the subprocess limiter to context.
+func WithProcessLimiter(ctx context.Context, limiter *ProcessLimiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, processLimiterContextKey{}, limiter)
+}
+
+// AcquireProcessSlot takes a slot from the context limiter, if any. Without a
+// limiter it returns a no-op release.
+func AcquireProcessSlot(ctx context.Context) (func(), error) {
+	if ctx == nil {
+		return func() {}, nil
+	}
+	limiter, _ := ctx.Value(processLimiterContextKey{}).(*ProcessLimiter)
+	return limiter.Acquire(ctx)
+}
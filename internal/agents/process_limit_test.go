@@ -0,0 +1,75 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessLimiterCapsConcurrentSlots(t *testing.T) {
+	limiter := NewProcessLimiter(2, time.Second)
+	ctx := WithProcessLimiter(context.Background(), limiter)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := AcquireProcessSlot(ctx)
+			if err != nil {
+				t.Errorf("AcquireProcessSlot: %v", err)
+				return
+			}
+			defer release()
+			current := running.Add(1)
+			for {
+				seen := peak.Load()
+				if current <= seen || peak.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > 2 {
+		t.Fatalf("peak concurrent slots = %d, want <= 2", got)
+	}
+	if limiter.InUse() != 0 {
+		t.Fatalf("InUse() = %d after all releases, want 0", limiter.InUse())
+	}
+}
+
+func TestProcessLimiterFailsWhenSaturated(t *testing.T) {
+	limiter := NewProcessLimiter(1, 20*time.Millisecond)
+	ctx := WithProcessLimiter(context.Background(), limiter)
+
+	release, err := AcquireProcessSlot(ctx)
+	if err != nil {
+		t.Fatalf("first AcquireProcessSlot: %v", err)
+	}
+	if _, err := AcquireProcessSlot(ctx); !errors.Is(err, ErrProcessLimit) {
+		t.Fatalf("saturated AcquireProcessSlot error = %v, want ErrProcessLimit", err)
+	}
+	release()
+	release, err = AcquireProcessSlot(ctx)
+	if err != nil {
+		t.Fatalf("AcquireProcessSlot after release: %v", err)
+	}
+	release()
+
+	if NewProcessLimiter(0, time.Second) != nil {
+		t.Fatalf("NewProcessLimiter(0) != nil, want unlimited")
+	}
+	noop, err := AcquireProcessSlot(context.Background())
+	if err != nil {
+		t.Fatalf("AcquireProcessSlot without limiter: %v", err)
+	}
+	noop()
+}
@@ -0,0 +1,51 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents/acpstdio"
+)
+
+// RawStopReasonHandler receives the stop reason exactly as the agent
+// reported it, before it is normalized to a StopReason.
+type RawStopReasonHandler func(ctx context.Context, reason string) error
+
+type rawStopReasonHandlerContextKey struct{}
+
+// WithRawStopReasonHandler binds one per-turn raw stop reason callback to context.
+func WithRawStopReasonHandler(ctx context.Context, handler RawStopReasonHandler) context.Context {
+	if handler == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rawStopReasonHandlerContextKey{}, handler)
+}
+
+// RawStopReasonHandlerFromContext gets the raw stop reason callback from context, if present.
+func RawStopReasonHandlerFromContext(ctx context.Context) (RawStopReasonHandler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	handler, ok := ctx.Value(rawStopReasonHandlerContextKey{}).(RawStopReasonHandler)
+	if !ok || handler == nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// NotifyRawStopReason reports one non-empty raw stop reason to the active callback.
+func NotifyRawStopReason(ctx context.Context, reason string) error {
+	handler, ok := RawStopReasonHandlerFromContext(ctx)
+	reason = strings.TrimSpace(reason)
+	if !ok || reason == "" {
+		return nil
+	}
+	return handler(ctx, reason)
+}
+
+// NotifyACPPromptStopReason reports the stopReason of one session/prompt
+// result to the active callback.
+func NotifyACPPromptStopReason(ctx context.Context, raw json.RawMessage) error {
+	return NotifyRawStopReason(ctx, acpstdio.ParseStopReason(raw))
+}
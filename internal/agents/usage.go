@@ -0,0 +1,93 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Usage is one token usage report for a prompt turn.
+type Usage struct {
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// UsageHandler receives token usage reported by the provider for the active turn.
+type UsageHandler func(ctx context.Context, usage Usage) error
+
+type usageHandlerContextKey struct{}
+
+// WithUsageHandler binds one per-turn usage callback to context.
+func WithUsageHandler(ctx context.Context, handler UsageHandler) context.Context {
+	if handler == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, usageHandlerContextKey{}, handler)
+}
+
+// UsageHandlerFromContext gets usage callback from context, if present.
+func UsageHandlerFromContext(ctx context.Context) (UsageHandler, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	handler, ok := ctx.Value(usageHandlerContextKey{}).(UsageHandler)
+	if !ok || handler == nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// NotifyUsage reports token usage to the active callback.
+func NotifyUsage(ctx context.Context, usage Usage) error {
+	handler, ok := UsageHandlerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return handler(ctx, usage)
+}
+
+// ParseACPPromptUsage extracts token usage from one session/prompt result.
+// Providers disagree on naming, so camelCase ACP fields (inputTokens /
+// outputTokens), OpenAI-style promptTokens / completionTokens, and snake_case
+// variants are all accepted, under "usage" or "_meta.usage".
+func ParseACPPromptUsage(raw json.RawMessage) (Usage, bool) {
+	if len(raw) == 0 {
+		return Usage{}, false
+	}
+	var payload struct {
+		Usage map[string]any `json:"usage"`
+		Meta  struct {
+			Usage map[string]any `json:"usage"`
+		} `json:"_meta"`
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return Usage{}, false
+	}
+	for _, record := range []map[string]any{payload.Usage, payload.Meta.Usage} {
+		prompt, hasPrompt := firstUsageCount(record, "inputTokens", "promptTokens", "input_tokens", "prompt_tokens")
+		completion, hasCompletion := firstUsageCount(record, "outputTokens", "completionTokens", "output_tokens", "completion_tokens")
+		if hasPrompt || hasCompletion {
+			return Usage{PromptTokens: prompt, CompletionTokens: completion}, true
+		}
+	}
+	return Usage{}, false
+}
+
+// NotifyACPPromptUsage parses usage from one session/prompt result and reports
+// it to the active callback when present.
+func NotifyACPPromptUsage(ctx context.Context, raw json.RawMessage) error {
+	usage, ok := ParseACPPromptUsage(raw)
+	if !ok {
+		return nil
+	}
+	return NotifyUsage(ctx, usage)
+}
+
+func firstUsageCount(record map[string]any, keys ...string) (int64, bool) {
+	for _, key := range keys {
+		value, ok := record[key].(float64)
+		if ok && value >= 0 {
+			return int64(value), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,51 @@
+package agents
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseACPPromptUsage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		raw  string
+		want Usage
+		ok   bool
+	}{
+		{
+			name: "acp camelCase",
+			raw:  `{"stopReason":"end_turn","usage":{"inputTokens":10,"outputTokens":4}}`,
+			want: Usage{PromptTokens: 10, CompletionTokens: 4},
+			ok:   true,
+		},
+		{
+			name: "openai style under meta",
+			raw:  `{"stopReason":"end_turn","_meta":{"usage":{"prompt_tokens":7,"completion_tokens":3}}}`,
+			want: Usage{PromptTokens: 7, CompletionTokens: 3},
+			ok:   true,
+		},
+		{
+			name: "completion only",
+			raw:  `{"usage":{"completionTokens":5}}`,
+			want: Usage{CompletionTokens: 5},
+			ok:   true,
+		},
+		{
+			name: "no usage",
+			raw:  `{"stopReason":"end_turn"}`,
+		},
+		{
+			name: "invalid json",
+			raw:  `{`,
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseACPPromptUsage(json.RawMessage(tt.raw))
+		if ok != tt.ok || got != tt.want {
+			t.Fatalf("%s: ParseACPPromptUsage() = %+v, %v; want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
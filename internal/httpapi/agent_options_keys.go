@@ -0,0 +1,55 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// canonicalAgentOptionKeys are the agentOptions keys the server itself reads,
+// in their documented casing.
+var canonicalAgentOptionKeys = []string{
+	"modelId",
+	"configOverrides",
+	"sessionId",
+}
+
+// errAgentOptionKeyConflict reports one known key sent under two casings.
+var errAgentOptionKeyConflict = errors.New("agentOptions key given in more than one casing")
+
+// canonicalizeAgentOptionKeys renames keys that match a known key
+// case-insensitively (ModelId, MODELID) to its documented casing. Unknown
+// keys are left as they are.
+func canonicalizeAgentOptionKeys(options map[string]any) error {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	seen := make(map[string]string, len(canonicalAgentOptionKeys))
+	for _, key := range keys {
+		canonical, ok := canonicalAgentOptionKey(key)
+		if !ok {
+			continue
+		}
+		if first, dup := seen[canonical]; dup {
+			return fmt.Errorf("%w: %q and %q", errAgentOptionKeyConflict, first, key)
+		}
+		seen[canonical] = key
+		if key != canonical {
+			options[canonical] = options[key]
+			delete(options, key)
+		}
+	}
+	return nil
+}
+
+func canonicalAgentOptionKey(key string) (string, bool) {
+	for _, canonical := range canonicalAgentOptionKeys {
+		if strings.EqualFold(key, canonical) {
+			return canonical, true
+		}
+	}
+	return "", false
+}
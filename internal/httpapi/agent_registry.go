@@ -0,0 +1,172 @@
+package httpapi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/storage"
+)
+
+// AgentConstructor builds the provider for one thread of a registered agent.
+type AgentConstructor func(thread storage.Thread) (agents.Streamer, error)
+
+// AgentRegistry maps agent ids to provider constructors and the status
+// advertised by /v1/agents. It is safe for concurrent use, so providers can
+// be enabled, disabled, or replaced while the server is running.
+type AgentRegistry struct {
+	mu      sync.RWMutex
+	order   []string
+	entries map[string]*agentRegistryEntry
+}
+
+type agentRegistryEntry struct {
+	info AgentInfo
+	// listed controls whether the agent appears in /v1/agents.
+	listed bool
+	// construct is nil for agents that are listed but cannot start threads.
+	construct AgentConstructor
+}
+
+// NewAgentRegistry returns an empty registry.
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{entries: make(map[string]*agentRegistryEntry)}
+}
+
+// AgentRegistryFromFactory adapts the func-based TurnAgentFactory: every id
+// in allowedIDs resolves through factory, and infos are listed as given.
+func AgentRegistryFromFactory(infos []AgentInfo, allowedIDs []string, factory TurnAgentFactory) *AgentRegistry {
+	registry := NewAgentRegistry()
+	for _, info := range infos {
+		registry.put(info, true, nil)
+	}
+	for _, agentID := range allowedIDs {
+		agentID = strings.TrimSpace(agentID)
+		if agentID == "" {
+			continue
+		}
+		info := AgentInfo{ID: agentID, Name: agentID, Status: "available"}
+		listed := false
+		if existing, ok := registry.entries[agentID]; ok {
+			info, listed = existing.info, existing.listed
+		}
+		registry.put(info, listed, AgentConstructor(factory))
+	}
+	return registry
+}
+
+// Register adds or replaces a listed agent. A nil construct lists the agent
+// without accepting new threads for it.
+func (r *AgentRegistry) Register(info AgentInfo, construct AgentConstructor) {
+	r.put(info, true, construct)
+}
+
+// Update swaps the constructor and status of a registered agent. Providers
+// already cached for existing threads keep running until they go idle.
+func (r *AgentRegistry) Update(agentID string, construct AgentConstructor, status string) error {
+	agentID = strings.TrimSpace(agentID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[agentID]
+	if !ok {
+		return fmt.Errorf("agent %q is not registered", agentID)
+	}
+	entry.construct = construct
+	if status = strings.TrimSpace(status); status != "" {
+		entry.info.Status = status
+	}
+	return nil
+}
+
+// Unregister removes an agent from the registry.
+func (r *AgentRegistry) Unregister(agentID string) {
+	agentID = strings.TrimSpace(agentID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[agentID]; !ok {
+		return
+	}
+	delete(r.entries, agentID)
+	for i, id := range r.order {
+		if id == agentID {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Lookup returns the constructor for agentID when it accepts new threads.
+func (r *AgentRegistry) Lookup(agentID string) (AgentConstructor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.entries[agentID]
+	if !ok || entry.construct == nil {
+		return nil, false
+	}
+	return entry.construct, true
+}
+
+// Agents returns the listed agents in registration order.
+func (r *AgentRegistry) Agents() []AgentInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	infos := make([]AgentInfo, 0, len(r.order))
+	for _, agentID := range r.order {
+		if entry := r.entries[agentID]; entry.listed {
+			infos = append(infos, entry.info)
+		}
+	}
+	return infos
+}
+
+// DisplayName returns the operator-facing name of agentID, falling back to
+// the id itself for unknown agents or agents without a name.
+func (r *AgentRegistry) DisplayName(agentID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if entry, ok := r.entries[agentID]; ok && strings.TrimSpace(entry.info.Name) != "" {
+		return entry.info.Name
+	}
+	return agentID
+}
+
+// TurnAgentFactory returns a factory that resolves providers through the
+// registry at call time.
+func (r *AgentRegistry) TurnAgentFactory() TurnAgentFactory {
+	return func(thread storage.Thread) (agents.Streamer, error) {
+		construct, ok := r.Lookup(thread.AgentID)
+		if !ok {
+			return nil, fmt.Errorf("unsupported thread agent %q", thread.AgentID)
+		}
+		return construct(thread)
+	}
+}
+
+// allowedIDs returns the sorted ids that accept new threads.
+func (r *AgentRegistry) allowedIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.entries))
+	for agentID, entry := range r.entries {
+		if entry.construct != nil {
+			ids = append(ids, agentID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *AgentRegistry) put(info AgentInfo, listed bool, construct AgentConstructor) {
+	info.ID = strings.TrimSpace(info.ID)
+	if info.ID == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[info.ID]; !ok {
+		r.order = append(r.order, info.ID)
+	}
+	r.entries[info.ID] = &agentRegistryEntry{info: info, listed: listed, construct: construct}
+}
@@ -0,0 +1,104 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/storage"
+)
+
+func TestAgentRegistryFromFactoryKeepsListingAndAllowList(t *testing.T) {
+	registry := AgentRegistryFromFactory(
+		[]AgentInfo{
+			{ID: "codex", Name: "Codex", Status: "available"},
+			{ID: "claude", Name: "Claude Code", Status: "unavailable"},
+		},
+		[]string{"codex", "hidden"},
+		func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return agents.NewFakeAgent(), nil
+		},
+	)
+
+	listed := registry.Agents()
+	if len(listed) != 2 || listed[0].ID != "codex" || listed[1].ID != "claude" {
+		t.Fatalf("Agents() = %+v, want codex then claude", listed)
+	}
+	for _, agentID := range []string{"codex", "hidden"} {
+		if _, ok := registry.Lookup(agentID); !ok {
+			t.Fatalf("Lookup(%q) = false, want true", agentID)
+		}
+	}
+	if _, ok := registry.Lookup("claude"); ok {
+		t.Fatalf("Lookup(claude) = true, want false for a listed-only agent")
+	}
+	if _, err := registry.TurnAgentFactory()(storage.Thread{AgentID: "claude"}); err == nil {
+		t.Fatalf("TurnAgentFactory(claude) error = nil, want unsupported agent error")
+	}
+}
+
+func TestAgentRegistryUpdateTogglesAgentAtRuntime(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	registry := h.AgentRegistry()
+
+	createClaudeThread := func() int {
+		t.Helper()
+		rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads", map[string]any{"agent": "claude", "cwd": root}, map[string]string{"X-Client-ID": "client-a"})
+		return rr.Code
+	}
+	claudeStatus := func() string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+		req.Header.Set("X-Client-ID", "client-a")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		var resp struct {
+			Agents []AgentInfo `json:"agents"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode /v1/agents: %v", err)
+		}
+		for _, agent := range resp.Agents {
+			if agent.ID == "claude" {
+				return agent.Status
+			}
+		}
+		return ""
+	}
+
+	if got := createClaudeThread(); got != http.StatusBadRequest {
+		t.Fatalf("create claude thread before enable = %d, want %d", got, http.StatusBadRequest)
+	}
+
+	err := registry.Update("claude", func(thread storage.Thread) (agents.Streamer, error) {
+		_ = thread
+		return agents.NewFakeAgent(), nil
+	}, "available")
+	if err != nil {
+		t.Fatalf("Update(claude): %v", err)
+	}
+	if got := claudeStatus(); got != "available" {
+		t.Fatalf("claude status after enable = %q, want available", got)
+	}
+	if got := createClaudeThread(); got != http.StatusOK {
+		t.Fatalf("create claude thread after enable = %d, want %d", got, http.StatusOK)
+	}
+
+	if err := registry.Update("claude", nil, "unavailable"); err != nil {
+		t.Fatalf("Update(claude, nil): %v", err)
+	}
+	if got := claudeStatus(); got != "unavailable" {
+		t.Fatalf("claude status after disable = %q, want unavailable", got)
+	}
+	if got := createClaudeThread(); got != http.StatusBadRequest {
+		t.Fatalf("create claude thread after disable = %d, want %d", got, http.StatusBadRequest)
+	}
+
+	if err := registry.Update("missing", nil, ""); err == nil {
+		t.Fatalf("Update(missing) error = nil, want non-nil")
+	}
+}
@@ -0,0 +1,21 @@
+package httpapi
+
+import "context"
+
+// codeQuotaExceeded rejects turns from a client whose stored turn text is at
+// or over Config.MaxClientStoredBytes.
+const codeQuotaExceeded = "QUOTA_EXCEEDED"
+
+// clientOverQuota reports the client's stored byte total and whether it has
+// reached maxClientStoredBytes. It never reports over quota when no limit is
+// configured.
+func (s *Server) clientOverQuota(ctx context.Context, clientID string) (int64, bool, error) {
+	if s.maxClientStoredBytes <= 0 {
+		return 0, false, nil
+	}
+	used, err := s.store.GetClientStoredBytes(ctx, clientID)
+	if err != nil {
+		return 0, false, err
+	}
+	return used, used >= s.maxClientStoredBytes, nil
+}
@@ -0,0 +1,114 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/storage"
+)
+
+const (
+	// clientNameHeader and clientMetadataHeader carry the optional display
+	// name and JSON object stored with Config.StoreClientMetadata.
+	clientNameHeader     = "X-Client-Name"
+	clientMetadataHeader = "X-Client-Metadata"
+
+	maxClientNameBytes     = 200
+	maxClientMetadataBytes = 4096
+)
+
+// recordClient stores the caller's client record. It writes an error and
+// returns false when the metadata headers are invalid or storage fails.
+func (s *Server) recordClient(w http.ResponseWriter, r *http.Request, clientID string) bool {
+	name := strings.TrimSpace(r.Header.Get(clientNameHeader))
+	if len(name) > maxClientNameBytes {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "client name is too long", map[string]any{
+			"header": clientNameHeader,
+			"limit":  maxClientNameBytes,
+		})
+		return false
+	}
+	metadataJSON := ""
+	if raw := strings.TrimSpace(r.Header.Get(clientMetadataHeader)); raw != "" {
+		var metadata map[string]any
+		if len(raw) > maxClientMetadataBytes || json.Unmarshal([]byte(raw), &metadata) != nil || metadata == nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "client metadata must be a JSON object", map[string]any{
+				"header": clientMetadataHeader,
+				"limit":  maxClientMetadataBytes,
+			})
+			return false
+		}
+		normalized, _ := json.Marshal(metadata)
+		metadataJSON = string(normalized)
+	}
+
+	if err := s.store.RecordClient(r.Context(), storage.RecordClientParams{
+		ClientID:     clientID,
+		DisplayName:  name,
+		UserAgent:    r.UserAgent(),
+		MetadataJSON: metadataJSON,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to record client", map[string]any{
+			"reason": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// handleClient serves GET /v1/clients/me. A caller may also name itself
+// explicitly; any other client id is refused so records stay private.
+func (s *Server) handleClient(w http.ResponseWriter, r *http.Request, clientID, target string) {
+	if target != "me" && target != clientID {
+		writeError(w, http.StatusForbidden, codeForbidden, "clients can only read their own record", map[string]any{
+			"clientId": target,
+		})
+		return
+	}
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	client := map[string]any{"clientId": clientID}
+	record, err := s.store.GetClientRecord(r.Context(), clientID)
+	switch {
+	case err == nil:
+		client["displayName"] = record.DisplayName
+		client["userAgent"] = record.UserAgent
+		client["metadata"] = json.RawMessage(record.MetadataJSON)
+		client["createdAt"] = record.CreatedAt.UTC().Format(time.RFC3339Nano)
+		client["lastSeenAt"] = record.LastSeenAt.UTC().Format(time.RFC3339Nano)
+	case !errors.Is(err, storage.ErrNotFound):
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to load client record", map[string]any{"reason": err.Error()})
+		return
+	}
+	storedBytes, err := s.store.GetClientStoredBytes(r.Context(), clientID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to load client usage", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"client": client,
+		"stats": map[string]any{
+			"storedBytes": storedBytes,
+			"storedLimit": s.maxClientStoredBytes,
+		},
+	})
+}
+
+func parseClientPath(path string) (clientID string, ok bool) {
+	const prefix = "/v1/clients/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	raw := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if raw == "" || strings.Contains(raw, "/") {
+		return "", false
+	}
+	return raw, true
+}
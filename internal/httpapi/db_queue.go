@@ -0,0 +1,131 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDBQueueTimeout = 2 * time.Second
+
+// dbQueue bounds how many read requests may be waiting on or using the single
+// SQLite connection at once. A request that cannot get a slot within timeout
+// is rejected, so overload shows up as fast 503s instead of growing latency.
+type dbQueue struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	acquired     atomic.Int64
+	rejected     atomic.Int64
+	waitNanos    atomic.Int64
+	maxWaitNanos atomic.Int64
+}
+
+// dbQueueStats is the wait-time metric reported by /healthz?verbose=true.
+type dbQueueStats struct {
+	Depth     int     `json:"depth"`
+	InUse     int     `json:"inUse"`
+	Acquired  int64   `json:"acquired"`
+	Rejected  int64   `json:"rejected"`
+	AvgWaitMS float64 `json:"avgWaitMs"`
+	MaxWaitMS float64 `json:"maxWaitMs"`
+}
+
+// newDBQueue returns nil, which disables the guard, when depth is not
+// positive.
+func newDBQueue(depth int, timeout time.Duration) *dbQueue {
+	if depth <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultDBQueueTimeout
+	}
+	return &dbQueue{
+		slots:   make(chan struct{}, depth),
+		timeout: timeout,
+	}
+}
+
+// acquire waits up to the queue timeout for a slot. On success it returns the
+// release func; it reports false when the queue stayed saturated or ctx ended.
+func (q *dbQueue) acquire(ctx context.Context) (func(), bool) {
+	startedAt := time.Now()
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		select {
+		case q.slots <- struct{}{}:
+		case <-timer.C:
+			q.rejected.Add(1)
+			return nil, false
+		case <-ctx.Done():
+			q.rejected.Add(1)
+			return nil, false
+		}
+	}
+
+	waited := int64(time.Since(startedAt))
+	q.acquired.Add(1)
+	q.waitNanos.Add(waited)
+	for {
+		current := q.maxWaitNanos.Load()
+		if waited <= current || q.maxWaitNanos.CompareAndSwap(current, waited) {
+			break
+		}
+	}
+	return func() { <-q.slots }, true
+}
+
+// dbQueuedThreadReads lists the thread subresources whose GET handlers only
+// read the store. Sessions, session history and slash commands may start an
+// agent, so they are left out rather than holding a slot while it runs.
+var dbQueuedThreadReads = map[string]bool{
+	"":               true,
+	"cost":           true,
+	"tags":           true,
+	"history":        true,
+	"config-options": true,
+}
+
+// isDBQueuedRead reports whether r is a GET served from the store alone and
+// so must take a dbQueue slot.
+func isDBQueuedRead(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	path := r.URL.Path
+	switch path {
+	case "/v1/stats", "/v1/recent-directories", "/v1/threads":
+		return true
+	}
+	if _, ok := parseAgentModelsPath(path); ok {
+		return true
+	}
+	if _, ok := parseClientPath(path); ok {
+		return true
+	}
+	if _, ok := parseAdminAgentThreadsPath(path); ok {
+		return true
+	}
+	if _, subresource, ok := parseThreadPath(path); ok {
+		return dbQueuedThreadReads[subresource]
+	}
+	return false
+}
+
+func (q *dbQueue) stats() dbQueueStats {
+	stats := dbQueueStats{
+		Depth:     cap(q.slots),
+		InUse:     len(q.slots),
+		Acquired:  q.acquired.Load(),
+		Rejected:  q.rejected.Load(),
+		MaxWaitMS: float64(q.maxWaitNanos.Load()) / float64(time.Millisecond),
+	}
+	if stats.Acquired > 0 {
+		stats.AvgWaitMS = float64(q.waitNanos.Load()) / float64(stats.Acquired) / float64(time.Millisecond)
+	}
+	return stats
+}
@@ -0,0 +1,133 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDBQueueRejectsReadsWhenSaturated(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	h.dbQueue = newDBQueue(1, 20*time.Millisecond)
+
+	release, ok := h.dbQueue.acquire(context.Background())
+	if !ok {
+		t.Fatalf("acquire() = false, want the only slot")
+	}
+
+	rr := performJSONRequest(t, h, http.MethodGet, "/v1/threads", nil, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("saturated GET status = %d, want %d; body=%s", rr.Code, http.StatusServiceUnavailable, rr.Body.String())
+	}
+	assertErrorCode(t, rr.Body.Bytes(), "BUSY")
+	if got := rr.Header().Get("Retry-After"); got == "" {
+		t.Fatalf("Retry-After header is empty")
+	}
+
+	release()
+	rr = performJSONRequest(t, h, http.MethodGet, "/v1/threads", nil, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET after release status = %d, want %d; body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	stats := h.dbQueue.stats()
+	if stats.Rejected != 1 || stats.Acquired != 2 || stats.InUse != 0 {
+		t.Fatalf("stats = %+v, want 1 rejected, 2 acquired, 0 in use", stats)
+	}
+}
+
+func TestDBQueueSkipsReadsThatDoNotOnlyHitTheStore(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	threadID := createThreadForClient(t, h, "client-a", root)
+	h.dbQueue = newDBQueue(1, 20*time.Millisecond)
+
+	release, ok := h.dbQueue.acquire(context.Background())
+	if !ok {
+		t.Fatalf("acquire() = false, want the only slot")
+	}
+	defer release()
+
+	for _, path := range []string{
+		"/v1/version",
+		"/v1/agents",
+		"/v1/threads/" + threadID + "/sessions",
+		"/v1/threads/" + threadID + "/slash-commands",
+	} {
+		rr := performJSONRequest(t, h, http.MethodGet, path, nil, map[string]string{"X-Client-ID": "client-a"})
+		if rr.Code == http.StatusServiceUnavailable {
+			t.Fatalf("GET %s waited on the saturated db queue; body=%s", path, rr.Body.String())
+		}
+	}
+
+	for _, path := range []string{
+		"/v1/threads/" + threadID,
+		"/v1/threads/" + threadID + "/history",
+		"/v1/agents/codex/models",
+	} {
+		rr := performJSONRequest(t, h, http.MethodGet, path, nil, map[string]string{"X-Client-ID": "client-a"})
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("GET %s status = %d, want %d", path, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestDBQueueLoadServesBurstWithinDepth(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.dbQueue = newDBQueue(2, 10*time.Second)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	const requests = 64
+	var wg sync.WaitGroup
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/threads/"+threadID+"/history", nil)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			req.Header.Set("X-Client-ID", "client-a")
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Fatalf("history status under load = %d, want %d", status, http.StatusOK)
+		}
+	}
+	stats := h.dbQueue.stats()
+	if stats.Acquired != requests || stats.Rejected != 0 {
+		t.Fatalf("stats = %+v, want %d acquired and none rejected", stats, requests)
+	}
+	if stats.Depth != 2 || stats.InUse != 0 {
+		t.Fatalf("stats depth/inUse = %d/%d, want 2/0", stats.Depth, stats.InUse)
+	}
+
+	rr := performJSONRequest(t, h, http.MethodGet, "/healthz?verbose=true", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("healthz status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, `"dbQueue"`) || !strings.Contains(body, `"avgWaitMs"`) {
+		t.Fatalf("healthz body = %s, want dbQueue stats", rr.Body.String())
+	}
+}
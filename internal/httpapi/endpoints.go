@@ -0,0 +1,94 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// endpointNames are the logical names Config.DisabledEndpoints accepts.
+// Thread subresources are named after their path segment; "thread" is
+// /v1/threads/{threadId} itself and "threads" the collection.
+var endpointNames = append([]string{
+	"agents",
+	"agent-models",
+	"version",
+	"stats",
+	"path-search",
+	"recent-directories",
+	"clients",
+	"threads",
+	"thread",
+	"permissions",
+	"turn-cancel",
+}, threadSubresources...)
+
+// ValidateDisabledEndpoints reports the first entry of a DisabledEndpoints
+// list that New would ignore.
+func ValidateDisabledEndpoints(entries []string) error {
+	for _, entry := range entries {
+		if _, err := parseDisabledEndpoint(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDisabledEndpoint normalizes one "name" or "METHOD name" entry into
+// its lookup key.
+func parseDisabledEndpoint(entry string) (string, error) {
+	fields := strings.Fields(entry)
+	var method, name string
+	switch len(fields) {
+	case 1:
+		name = fields[0]
+	case 2:
+		method, name = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return "", fmt.Errorf("disabled endpoint %q: want \"name\" or \"METHOD name\"", entry)
+	}
+	name = strings.ToLower(name)
+	if !slices.Contains(endpointNames, name) {
+		return "", fmt.Errorf("disabled endpoint %q: unknown endpoint %q (known: %s)", entry, name, strings.Join(endpointNames, ", "))
+	}
+	if method == "" {
+		return name, nil
+	}
+	return method + " " + name, nil
+}
+
+func buildDisabledEndpoints(entries []string) (map[string]struct{}, []error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	disabled := make(map[string]struct{}, len(entries))
+	var errs []error
+	for _, entry := range entries {
+		key, err := parseDisabledEndpoint(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		disabled[key] = struct{}{}
+	}
+	return disabled, errs
+}
+
+// rejectDisabledEndpoint writes 403 FORBIDDEN and returns true when the
+// operator disabled the named endpoint, for every method or for r.Method.
+func (s *Server) rejectDisabledEndpoint(w http.ResponseWriter, r *http.Request, name string) bool {
+	if len(s.disabledEndpoints) == 0 {
+		return false
+	}
+	_, all := s.disabledEndpoints[name]
+	_, byMethod := s.disabledEndpoints[r.Method+" "+name]
+	if !all && !byMethod {
+		return false
+	}
+	writeError(w, http.StatusForbidden, codeForbidden, "endpoint is disabled", map[string]any{
+		"endpoint": name,
+		"method":   r.Method,
+	})
+	return true
+}
@@ -0,0 +1,62 @@
+package httpapi
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// writeNegotiatedError writes an error for a non-/v1 path. With
+// HTMLErrorPages on and a request that prefers text/html over JSON, it
+// renders a small HTML page; otherwise it falls back to writeError. /v1
+// handlers must keep calling writeError so the API stays JSON-only.
+func (s *Server) writeNegotiatedError(w http.ResponseWriter, r *http.Request, statusCode int, code, message string, details map[string]any) {
+	if !s.htmlErrorPages || !prefersHTML(r.Header.Get("Accept")) {
+		writeError(w, statusCode, code, message, details)
+		return
+	}
+	title := fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head>\n<body><h1>%s</h1><p>%s</p><p><code>%s</code></p></body></html>\n",
+		html.EscapeString(title),
+		html.EscapeString(title),
+		html.EscapeString(message),
+		html.EscapeString(code),
+	)
+}
+
+// prefersHTML reports whether an Accept header ranks text/html above
+// application/json. Wildcards count toward both; a missing header means JSON.
+func prefersHTML(accept string) bool {
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/*":
+			htmlQ = max(htmlQ, q*0.99)
+		case "application/*":
+			jsonQ = max(jsonQ, q*0.99)
+		case "*/*":
+			htmlQ, jsonQ = max(htmlQ, q*0.98), max(jsonQ, q*0.98)
+		}
+	}
+	return htmlQ > 0 && htmlQ > jsonQ
+}
@@ -0,0 +1,44 @@
+package httpapi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// buildEventNames checks Config.EventNameMapping. Entries with a blank name
+// or a wire name containing a line break would break SSE framing, and two
+// event types sharing one wire name could not be told apart, so both are
+// dropped with an error.
+func buildEventNames(mapping map[string]string) (map[string]string, []error) {
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+	eventTypes := make([]string, 0, len(mapping))
+	for eventType := range mapping {
+		eventTypes = append(eventTypes, eventType)
+	}
+	slices.Sort(eventTypes)
+
+	names := make(map[string]string, len(mapping))
+	usedBy := make(map[string]string, len(mapping))
+	var errs []error
+	for _, eventType := range eventTypes {
+		wireName := mapping[eventType]
+		switch {
+		case strings.TrimSpace(eventType) == "":
+			errs = append(errs, fmt.Errorf("event name mapping: blank event type"))
+			continue
+		case strings.TrimSpace(wireName) == "" || strings.ContainsAny(wireName, "\r\n"):
+			errs = append(errs, fmt.Errorf("event name mapping %q: invalid wire name %q", eventType, wireName))
+			continue
+		}
+		if other, ok := usedBy[wireName]; ok {
+			errs = append(errs, fmt.Errorf("event name mapping %q: wire name %q already used by %q", eventType, wireName, other))
+			continue
+		}
+		usedBy[wireName] = eventType
+		names[eventType] = wireName
+	}
+	return names, errs
+}
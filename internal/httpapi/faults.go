@@ -0,0 +1,35 @@
+package httpapi
+
+import "context"
+
+// faultPoint names a spot in turn execution where a test can inject a
+// failure or a delay.
+type faultPoint string
+
+const (
+	// faultEventPersist runs before each turn event is appended to storage.
+	faultEventPersist faultPoint = "event_persist"
+	// faultAgentStream runs before each provider stream attempt; an error
+	// stands in for the provider failing the attempt.
+	faultAgentStream faultPoint = "agent_stream"
+	// faultStreamWrite runs before each event is written to the turn sink
+	// (SSE stream or webhook).
+	faultStreamWrite faultPoint = "stream_write"
+)
+
+// faultInjector lets tests make the server fail or stall at a faultPoint. It
+// is test-only: Server.faults is unexported and no Config field or flag sets
+// it, so only tests inside this package can enable injection.
+type faultInjector interface {
+	// inject runs at point. It may block, honouring ctx, to simulate delay;
+	// a non-nil error makes the operation at point fail with it.
+	inject(ctx context.Context, point faultPoint) error
+}
+
+// injectFault is a no-op unless a test installed a faultInjector.
+func (s *Server) injectFault(ctx context.Context, point faultPoint) error {
+	if s.faults == nil {
+		return nil
+	}
+	return s.faults.inject(ctx, point)
+}
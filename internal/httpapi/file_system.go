@@ -0,0 +1,173 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/observability"
+)
+
+const (
+	// fileSystemAccessRead lets the agent read files under the thread cwd.
+	fileSystemAccessRead = "read"
+	// fileSystemAccessWrite also lets the agent create and overwrite files.
+	fileSystemAccessWrite = "write"
+
+	maxAgentReadFileBytes = 8 << 20
+)
+
+var errAgentFileSystemDenied = errors.New("file system access denied")
+
+// ThreadFileSystemAccess returns the agentOptions.fileSystemAccess opt-in of
+// one thread, "read" or "write". Any other value grants nothing and yields "".
+// The agent factory uses it to advertise matching fs capabilities.
+func ThreadFileSystemAccess(agentOptionsJSON string) string {
+	if strings.TrimSpace(agentOptionsJSON) == "" {
+		return ""
+	}
+	var raw struct {
+		FileSystemAccess string `json:"fileSystemAccess"`
+	}
+	if err := json.Unmarshal([]byte(agentOptionsJSON), &raw); err != nil {
+		return ""
+	}
+	switch access := strings.ToLower(strings.TrimSpace(raw.FileSystemAccess)); access {
+	case fileSystemAccessRead, fileSystemAccessWrite:
+		return access
+	default:
+		return ""
+	}
+}
+
+// threadFileSystem serves ACP fs/* requests for one turn, confined to the
+// thread cwd. Symlinks are resolved before the containment check so a link
+// inside cwd cannot reach outside it.
+type threadFileSystem struct {
+	root       string
+	allowWrite bool
+	logger     *observability.Logger
+	threadID   string
+	turnID     string
+}
+
+func (f *threadFileSystem) ReadTextFile(_ context.Context, req agents.ReadTextFileRequest) (string, error) {
+	path, err := f.resolve(req.Path, false)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", req.Path)
+	}
+	if info.Size() > maxAgentReadFileBytes {
+		return "", fmt.Errorf("%s exceeds %d bytes", req.Path, maxAgentReadFileBytes)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f.logger.Info("agent.fs_read",
+		"threadId", f.threadID,
+		"turnId", f.turnID,
+		"path", path,
+	)
+	return sliceTextLines(string(data), req.Line, req.Limit), nil
+}
+
+func (f *threadFileSystem) WriteTextFile(_ context.Context, req agents.WriteTextFileRequest) error {
+	if !f.allowWrite {
+		f.logger.Warn("agent.fs_write_denied",
+			"threadId", f.threadID,
+			"turnId", f.turnID,
+			"path", req.Path,
+		)
+		return fmt.Errorf("%w: thread allows read-only access", errAgentFileSystemDenied)
+	}
+	path, err := f.resolve(req.Path, true)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(req.Content), 0o644); err != nil {
+		return err
+	}
+	f.logger.Info("agent.fs_write",
+		"threadId", f.threadID,
+		"turnId", f.turnID,
+		"path", path,
+		"bytes", len(req.Content),
+	)
+	return nil
+}
+
+// resolve maps an agent path to a real path under root. Relative paths are
+// taken relative to root. For writes the file may not exist yet, so only its
+// parent directory is resolved.
+func (f *threadFileSystem) resolve(rawPath string, forWrite bool) (string, error) {
+	path := strings.TrimSpace(rawPath)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(f.root, path)
+	}
+	path = filepath.Clean(path)
+
+	root, err := filepath.EvalSymlinks(f.root)
+	if err != nil {
+		return "", fmt.Errorf("resolve thread cwd: %w", err)
+	}
+
+	var resolved string
+	if forWrite {
+		parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+		resolved = filepath.Join(parent, filepath.Base(path))
+		if target, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = target
+		}
+	} else {
+		resolved, err = filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !isPathAllowed(resolved, []string{root}) {
+		f.logger.Warn("agent.fs_outside_cwd",
+			"threadId", f.threadID,
+			"turnId", f.turnID,
+			"path", rawPath,
+		)
+		return "", fmt.Errorf("%w: %s is outside the thread cwd", errAgentFileSystemDenied, rawPath)
+	}
+	return resolved, nil
+}
+
+// sliceTextLines returns limit lines starting at 1-based line; zero values
+// select from the start and to the end respectively.
+func sliceTextLines(content string, line, limit int) string {
+	if line <= 1 && limit <= 0 {
+		return content
+	}
+	lines := strings.SplitAfter(content, "\n")
+	start := 0
+	if line > 1 {
+		start = line - 1
+	}
+	if start >= len(lines) {
+		return ""
+	}
+	end := len(lines)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return strings.Join(lines[start:end], "")
+}
@@ -0,0 +1,89 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beyond5959/ngent/internal/agents"
+	"github.com/beyond5959/ngent/internal/observability"
+)
+
+func TestThreadFileSystemAccess(t *testing.T) {
+	cases := map[string]string{
+		``:                                  "",
+		`{"modelId":"m"}`:                   "",
+		`{"fileSystemAccess":"read"}`:       fileSystemAccessRead,
+		`{"fileSystemAccess":" WRITE "}`:    fileSystemAccessWrite,
+		`{"fileSystemAccess":"everything"}`: "",
+		`not-json`:                          "",
+	}
+	for raw, want := range cases {
+		if got := ThreadFileSystemAccess(raw); got != want {
+			t.Fatalf("ThreadFileSystemAccess(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestThreadFileSystemConfinedToCWD(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("one\ntwo\nthree\n"), 0o644); err != nil {
+		t.Fatalf("write a.txt: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write secret.txt: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	ctx := context.Background()
+	logger := observability.NewLoggerWithWriter(io.Discard, observability.LevelInfo)
+	readOnly := &threadFileSystem{root: root, logger: logger, threadID: "th", turnID: "tu"}
+
+	content, err := readOnly.ReadTextFile(ctx, agents.ReadTextFileRequest{Path: filepath.Join(root, "a.txt"), Line: 2, Limit: 1})
+	if err != nil {
+		t.Fatalf("read inside cwd: %v", err)
+	}
+	if content != "two\n" {
+		t.Fatalf("read content = %q, want %q", content, "two\n")
+	}
+	if content, err := readOnly.ReadTextFile(ctx, agents.ReadTextFileRequest{Path: "a.txt"}); err != nil || content != "one\ntwo\nthree\n" {
+		t.Fatalf("read relative = %q, %v", content, err)
+	}
+
+	denied := []string{
+		filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "..", filepath.Base(outside), "secret.txt"),
+		filepath.Join(root, "escape", "secret.txt"),
+	}
+	for _, path := range denied {
+		if _, err := readOnly.ReadTextFile(ctx, agents.ReadTextFileRequest{Path: path}); !errors.Is(err, errAgentFileSystemDenied) {
+			t.Fatalf("read %s error = %v, want access denied", path, err)
+		}
+	}
+
+	err = readOnly.WriteTextFile(ctx, agents.WriteTextFileRequest{Path: filepath.Join(root, "b.txt"), Content: "x"})
+	if !errors.Is(err, errAgentFileSystemDenied) {
+		t.Fatalf("read-only write error = %v, want access denied", err)
+	}
+
+	writable := &threadFileSystem{root: root, allowWrite: true, logger: logger}
+	if err := writable.WriteTextFile(ctx, agents.WriteTextFileRequest{Path: filepath.Join(root, "b.txt"), Content: "x"}); err != nil {
+		t.Fatalf("write inside cwd: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "b.txt")); err != nil || string(data) != "x" {
+		t.Fatalf("b.txt = %q, %v; want x", data, err)
+	}
+	err = writable.WriteTextFile(ctx, agents.WriteTextFileRequest{Path: filepath.Join(root, "escape", "new.txt"), Content: "x"})
+	if !errors.Is(err, errAgentFileSystemDenied) {
+		t.Fatalf("write through symlink error = %v, want access denied", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside cwd: stat err = %v", err)
+	}
+}
@@ -17,11 +17,17 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	goruntime "runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/beyond5959/ngent/internal/agents"
 	"github.com/beyond5959/ngent/internal/agents/acpmodel"
@@ -47,6 +53,7 @@ type ThreadStore interface {
 	UpdateThreadTitle(ctx context.Context, threadID, title string) error
 	UpdateThreadSummary(ctx context.Context, threadID, summary string) error
 	UpdateThreadAgentOptions(ctx context.Context, threadID, agentOptionsJSON string) error
+	UpdateThreadAgentState(ctx context.Context, threadID, agentOptionsJSON string) error
 	UpsertAgentConfigCatalog(ctx context.Context, params storage.UpsertAgentConfigCatalogParams) error
 	GetAgentConfigCatalog(ctx context.Context, agentID, modelID string) (storage.AgentConfigCatalog, error)
 	ListAgentConfigCatalogsByAgent(ctx context.Context, agentID string) ([]storage.AgentConfigCatalog, error)
@@ -56,16 +63,33 @@ type ThreadStore interface {
 	UpsertSessionTranscriptCache(ctx context.Context, params storage.UpsertSessionTranscriptCacheParams) error
 	GetSessionConfigCache(ctx context.Context, agentID, cwd, sessionID string) (storage.SessionConfigCache, error)
 	UpsertSessionConfigCache(ctx context.Context, params storage.UpsertSessionConfigCacheParams) error
-	ListThreads(ctx context.Context) ([]storage.Thread, error)
+	ListThreads(ctx context.Context, limit int) ([]storage.Thread, error)
+	ListThreadsByTag(ctx context.Context, tag string, limit int) ([]storage.Thread, error)
+	ListThreadsByAgent(ctx context.Context, agentID string, limit, offset int) ([]storage.Thread, error)
+	AddThreadTag(ctx context.Context, threadID, tag string) error
+	RemoveThreadTag(ctx context.Context, threadID, tag string) error
+	ListThreadTags(ctx context.Context, threadID string) ([]string, error)
 	CreateTurn(ctx context.Context, params storage.CreateTurnParams) (storage.Turn, error)
 	CreateTurnAttachments(ctx context.Context, params []storage.CreateTurnAttachmentParams) error
 	GetTurnAttachment(ctx context.Context, attachmentID string) (storage.TurnAttachment, error)
+	RecordClient(ctx context.Context, params storage.RecordClientParams) error
+	GetClientRecord(ctx context.Context, clientID string) (storage.ClientRecord, error)
+	GetClientStoredBytes(ctx context.Context, clientID string) (int64, error)
 	GetTurn(ctx context.Context, turnID string) (storage.Turn, error)
 	ListTurnsByThread(ctx context.Context, threadID string) ([]storage.Turn, error)
+	ListTurnPromptsByThread(ctx context.Context, threadID string) (map[string]string, error)
+	ListRecentTurnsByThread(ctx context.Context, threadID string, limit int, includeInternal bool) ([]storage.Turn, error)
+	CountTurnsByThread(ctx context.Context, threadID string, includeInternal bool) (int, error)
+	CountThreads(ctx context.Context) (int, error)
+	CountTurns(ctx context.Context, includeInternal bool) (int, error)
 	AppendEvent(ctx context.Context, turnID, eventType, dataJSON string) (storage.Event, error)
 	ListEventsByTurn(ctx context.Context, turnID string) ([]storage.Event, error)
 	FinalizeTurn(ctx context.Context, params storage.FinalizeTurnParams) error
+	CompactTurnEvents(ctx context.Context, completedBefore time.Time, limit int) (int, error)
 	ListRecentDirectories(ctx context.Context, clientID string, limit int) ([]string, error)
+	Ping(ctx context.Context) error
+	SchemaVersion(ctx context.Context) (int, error)
+	AppliedMigrationCount(ctx context.Context) (int, error)
 }
 
 // TurnAgentFactory resolves a per-turn agent provider from thread metadata.
@@ -74,9 +98,117 @@ type TurnAgentFactory func(thread storage.Thread) (agents.Streamer, error)
 // AgentModelsFactory resolves selectable model options for one agent.
 type AgentModelsFactory func(ctx context.Context, agentID string) ([]agents.ModelOption, error)
 
+// InputTransform rewrites one user text block before it is persisted and sent
+// to the agent. Returning an error rejects the turn with INVALID_ARGUMENT.
+type InputTransform func(ctx context.Context, thread storage.Thread, input string) (string, error)
+
+// EventDelivery controls where one turn event type goes. Event types without
+// an entry in Config.EventDelivery are both streamed and persisted.
+type EventDelivery struct {
+	// Stream sends the event to the live SSE client.
+	Stream bool
+	// Persist appends the event to the turn's history event log.
+	Persist bool
+}
+
+// CostRate is the price of one million tokens for one agent, in an
+// operator-chosen currency.
+type CostRate struct {
+	PromptPerMillion     float64 `json:"promptPerMillion"`
+	CompletionPerMillion float64 `json:"completionPerMillion"`
+}
+
+// AgentCapabilities restricts optional operations for one agent. The zero
+// value allows everything.
+type AgentCapabilities struct {
+	// DisableCompact rejects POST /v1/threads/{id}/compact for threads of the
+	// agent, since compaction runs a full agent turn.
+	DisableCompact bool `json:"disableCompact"`
+}
+
+// CWDValidator checks a new thread's cwd for one agent after the generic
+// cwd checks pass. A non-nil error rejects the thread with INVALID_ARGUMENT
+// and the error text as reason.
+type CWDValidator func(cwd string) error
+
+// CWDRules declares simple cwd limits for agents that misbehave on some
+// paths. Zero fields are not checked.
+type CWDRules struct {
+	// MaxDepth caps the number of path components below the filesystem root.
+	MaxDepth int `json:"maxDepth"`
+	// MaxLength caps the cwd length in bytes.
+	MaxLength int `json:"maxLength"`
+	// ForbiddenChars lists characters the cwd must not contain.
+	ForbiddenChars string `json:"forbiddenChars"`
+}
+
+// Validate implements CWDValidator.
+func (r CWDRules) Validate(cwd string) error {
+	if r.MaxLength > 0 && len(cwd) > r.MaxLength {
+		return fmt.Errorf("cwd is %d bytes long, limit is %d", len(cwd), r.MaxLength)
+	}
+	if r.MaxDepth > 0 {
+		depth := 0
+		for _, part := range strings.Split(filepath.ToSlash(cwd), "/") {
+			if part != "" && !strings.HasSuffix(part, ":") {
+				depth++
+			}
+		}
+		if depth > r.MaxDepth {
+			return fmt.Errorf("cwd is %d directories deep, limit is %d", depth, r.MaxDepth)
+		}
+	}
+	if r.ForbiddenChars != "" {
+		if i := strings.IndexAny(cwd, r.ForbiddenChars); i >= 0 {
+			char, _ := utf8.DecodeRuneInString(cwd[i:])
+			return fmt.Errorf("cwd contains forbidden character %q", char)
+		}
+	}
+	return nil
+}
+
+// TurnRetryPolicy controls how a user turn whose agent stream fails is retried
+// before the turn is marked failed. An attempt is only retried when it
+// produced no visible output (deltas, tool calls, permissions, plans).
+type TurnRetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first.
+	// Values <= 1 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the second attempt; it doubles for each
+	// further attempt. Default 500ms.
+	Backoff time.Duration
+	// Retryable classifies stream errors. Nil uses DefaultTurnRetryable.
+	Retryable func(err error) bool
+}
+
+// HistoryDefaults sets what GET /v1/threads/{id}/history returns when the
+// includeEvents / includeInternal query params are absent. An explicit
+// query param always wins.
+type HistoryDefaults struct {
+	// IncludeEvents returns every turn's events by default. Event lists can
+	// be much larger than the turns themselves.
+	IncludeEvents bool
+	// IncludeInternal returns internal (compaction) turns by default.
+	IncludeInternal bool
+}
+
+// DefaultTurnRetryable retries only errors providers mark as transient.
+func DefaultTurnRetryable(err error) bool {
+	return errors.Is(err, agents.ErrTransient)
+}
+
+// OutputTransform rewrites agent message text before it is streamed and
+// persisted. It must be idempotent: buffered text may be passed through it
+// more than once while waiting for the next delta.
+type OutputTransform func(ctx context.Context, thread storage.Thread, text string) string
+
 // Config controls HTTP API behavior.
 type Config struct {
-	AuthToken          string
+	AuthToken string
+	// AdminToken is the elevated bearer token for /v1/admin/* operational
+	// endpoints, which are not client-scoped. It is also accepted wherever
+	// AuthToken is. Empty disables the admin endpoints.
+	AdminToken         string
 	DataDir            string
 	Agents             []AgentInfo
 	AllowedAgentIDs    []string
@@ -87,59 +219,418 @@ type Config struct {
 	TurnAgentFactory   TurnAgentFactory
 	AgentModelsFactory AgentModelsFactory
 	AgentIdleTTL       time.Duration
+	// AgentMaxLifetime, if positive, reclaims a cached agent once it is this
+	// old even if it is never idle, so long-lived threads periodically get a
+	// fresh provider process. Reclamation waits for the active turn to end.
+	AgentMaxLifetime   time.Duration
 	Logger             *observability.Logger
 	ContextRecentTurns int
 	ContextMaxChars    int
 	CompactMaxChars    int
 	PermissionTimeout  time.Duration
+	// PermissionMaxAge bounds how long a pending permission may stay
+	// registered. The janitor declines and removes older entries, which only
+	// happens if a turn goroutine leaked. Default 2x PermissionTimeout.
+	PermissionMaxAge time.Duration
+	// MaxPendingPermissions caps how many permission requests one turn may
+	// have waiting at once. Further requests are declined immediately and
+	// reported as permission_auto_declined. Default 64.
+	MaxPendingPermissions int
+	// MaxGlobalPendingPermissions caps pending permission requests across
+	// all turns. Requests beyond it are declined without registering and
+	// reported as permission_auto_declined with reason
+	// too_many_pending_global. 0 means unlimited.
+	MaxGlobalPendingPermissions int
+	// MaxPermissionCommandChars caps the provider-reported command and
+	// approval text forwarded in permission events. Longer values are cut
+	// and end with a truncation marker. Default 4096.
+	MaxPermissionCommandChars int
+	// JanitorCloseConcurrency caps how many idle agents the janitor closes in
+	// parallel. Default 4.
+	JanitorCloseConcurrency int
+	// MaxThreadList caps how many threads GET /v1/threads returns; the
+	// response sets truncated when more exist. Default 500.
+	MaxThreadList int
+	// MaxCWDBytes / MaxCWDDepth cap the length in bytes and the number of
+	// path components of every new thread's cleaned cwd, before the
+	// per-agent CWDRules run; longer or deeper paths are rejected with
+	// 400 INVALID_ARGUMENT. Defaults 4096 bytes and 128 components.
+	MaxCWDBytes int
+	MaxCWDDepth int
+	// HistoryDefaults applies when history requests omit includeEvents or
+	// includeInternal. The zero value keeps both off.
+	HistoryDefaults HistoryDefaults
+	// AgentCloseTimeout bounds every Close of a cached thread agent (idle
+	// reclaim, thread delete, server shutdown). A Close that overruns is
+	// logged and left to finish in the background. Default 10s.
+	AgentCloseTimeout time.Duration
+	// MaxActiveTurnsPerClient caps how many turns one X-Client-ID may run at
+	// once across all of its threads. Further turns are rejected with
+	// 429 BUSY while other clients proceed. 0 means unlimited.
+	MaxActiveTurnsPerClient int
+	// MaxClientStoredBytes caps the request plus response text bytes one
+	// X-Client-ID may accumulate across its stored, finalized turns. Clients
+	// at or over the cap get 429 QUOTA_EXCEEDED for new turns; deleting
+	// threads frees quota again. 0 means unlimited.
+	MaxClientStoredBytes int64
+	// MaxTurnsPerThread caps how many turns one thread may hold. Internal
+	// turns (compaction) do not count. New turns on a thread at the cap get
+	// 409 CONFLICT with a hint to continue in a new thread. 0 means
+	// unlimited.
+	MaxTurnsPerThread int
+	// StoreClientMetadata records each X-Client-ID with the User-Agent of its
+	// first request plus the optional X-Client-Name and X-Client-Metadata
+	// (JSON object) headers, for GET /v1/clients/me. Off by default because
+	// it adds a write to every /v1 request.
+	StoreClientMetadata bool
+	// ContextSkipIncompleteTurns drops failed/cancelled turns and turns with an
+	// empty response from the injected [Recent Turns] window.
+	ContextSkipIncompleteTurns bool
+	// ContextScanTurns caps how many of a thread's newest non-internal turns
+	// are read to fill the [Recent Turns] window. Turns dropped by
+	// ContextSkipIncompleteTurns count toward it, so the window may come up
+	// short on threads with many incomplete turns. Default 5x
+	// ContextRecentTurns; never below ContextRecentTurns.
+	ContextScanTurns int
+	// CompactContextMaxChars is the character budget of the prompt sent to
+	// the agent by /compact, so summarization can see more history than a
+	// normal turn's ContextMaxChars allows. Default ContextMaxChars.
+	CompactContextMaxChars int
+	// EnableAgentFileSystem serves ACP fs/read_text_file and
+	// fs/write_text_file requests for threads whose agentOptions opt in with
+	// fileSystemAccess "read" or "write". Access is confined to the thread
+	// cwd. Off by default, in which case agents get method-not-found.
+	EnableAgentFileSystem bool
+	// FirstTurnPassthrough sends the raw input of a thread's first turn
+	// (no summary, no recent turns) without the context wrapper, so
+	// slash-commands reach the agent verbatim. Nil means true; set false to
+	// always render the framed prompt.
+	FirstTurnPassthrough *bool
+	// RouteHints adds the valid thread subresources or known /v1 collections
+	// to NOT_FOUND responses for unknown /v1 paths, so developers can
+	// discover the API. Nil means true; set false to keep 404s bare.
+	RouteHints *bool
+	// HTMLErrorPages renders errors for non-/v1 paths (such as the 404 for
+	// an unknown path when no FrontendHandler is set) as HTML when the
+	// request's Accept header prefers text/html over JSON. /v1 responses
+	// stay JSON. Off by default.
+	HTMLErrorPages bool
+	// CompactWaitForActiveTurn lets /compact wait up to this long for the
+	// thread's running turns to finish instead of failing with 409 CONFLICT
+	// right away. 0 keeps the immediate conflict.
+	CompactWaitForActiveTurn time.Duration
+	// CompactEmptyThreads runs /compact even on threads with no summary and
+	// no visible turns. Off by default: such requests return the empty
+	// summary with a note and never call the agent.
+	CompactEmptyThreads bool
+	// StrictModelIDs rejects thread creation and agentOptions updates whose
+	// modelId is not a non-blank string or is not among the agent's known
+	// models. Off by default: a bad modelId silently falls back to the
+	// agent's default model.
+	StrictModelIDs bool
+	// CanonicalAgentOptionKeys rewrites agentOptions keys that match a key
+	// the server reads (modelId, configOverrides, sessionId) in another
+	// casing, such as ModelId, to the documented casing before the options
+	// are validated and stored. Sending one key in two casings is rejected.
+	// Unknown keys are kept verbatim. Off by default.
+	CanonicalAgentOptionKeys bool
+	// StripInvalidInput drops invalid UTF-8 sequences and NUL bytes from turn
+	// input instead of rejecting the turn with 400 INVALID_ARGUMENT.
+	StripInvalidInput bool
+	// DisabledEndpoints turns /v1 endpoints off by logical name, e.g.
+	// "compact", "history", or "DELETE thread" for one method only. Disabled
+	// endpoints answer 403 FORBIDDEN. Check entries with
+	// ValidateDisabledEndpoints; New logs and ignores invalid ones.
+	DisabledEndpoints []string
+	// ExposeAgentStderr adds the stderr tail of an agent process that exited
+	// during startup to the turn's error event. Off by default because agent
+	// stderr may contain paths or credentials; the tail is always logged.
+	ExposeAgentStderr bool
+	// ContextUserLabel / ContextAssistantLabel override the "User" and
+	// "Assistant" role markers in injected recent turns.
+	ContextUserLabel      string
+	ContextAssistantLabel string
+	// ContextSummaryHeader, ContextRecentTurnsHeader, and
+	// ContextCurrentInputHeader override the injected section header lines.
+	ContextSummaryHeader      string
+	ContextRecentTurnsHeader  string
+	ContextCurrentInputHeader string
+	// InputTransform, if non-nil, is applied to every text block of a turn
+	// input before context injection (e.g. redaction or templating).
+	InputTransform InputTransform
+	// OutputTransform, if non-nil, is applied to message deltas of user turns
+	// before they are streamed or persisted (e.g. secret redaction).
+	OutputTransform OutputTransform
+	// OutputTransformHoldBack is how many trailing characters are withheld
+	// from each delta so a pattern split across deltas can still be matched.
+	// Matches longer than this may leak their prefix. Default 0 (per delta).
+	OutputTransformHoldBack int
+	// PersistPrompts stores the exact injected prompt of each user turn and
+	// returns it as promptText in history. Off by default because prompts
+	// embed thread history and summaries.
+	PersistPrompts bool
+	// PersistRawStopReasons stores the stop reason exactly as the agent
+	// reported it (for example "max_tokens" or "refusal") next to the
+	// normalized one and returns it as rawStopReason in history.
+	PersistRawStopReasons bool
+	// MaxDeltaRate caps message_delta events per second for one turn.
+	// Faster deltas are coalesced into the next emitted event, so no text is
+	// dropped. 0 means unlimited.
+	MaxDeltaRate int
+	// EventDelivery overrides, per SSE event type, whether turn events are
+	// streamed live, persisted to history, or both.
+	EventDelivery map[string]EventDelivery
+	// EventNameMapping renames event types on the turn SSE stream, e.g.
+	// {"message_delta":"message.delta"}. History, webhooks, and payload
+	// "type" fields keep the canonical names. Entries with a blank name, a
+	// line break, or a wire name used twice are logged and ignored.
+	EventNameMapping map[string]string
+	// SSEFlushEvery / SSEFlushInterval batch turn stream flushes: buffered
+	// events are flushed every N events or after the interval, whichever comes
+	// first. turn_started, permission_required, error, and turn_completed are
+	// always flushed immediately. Zero values flush every event.
+	SSEFlushEvery    int
+	SSEFlushInterval time.Duration
+	// EmitTurnSummary streams a turn_summary event after turn_completed with
+	// aggregated stats (delta count, characters, duration, final status).
+	// Off by default so existing clients see an unchanged event sequence.
+	EmitTurnSummary bool
+	// EmitEmptyResponse marks turns that complete without any message text:
+	// an empty_response event is recorded before turn_completed, which gains
+	// emptyResponse=true, so clients can tell "agent said nothing" from a
+	// lost stream. Off by default.
+	EmitEmptyResponse bool
+	// EmitTurnAccepted opens the SSE stream and sends turn_accepted before
+	// the agent is resolved, so clients see a live stream while a slow agent
+	// starts. Failures after that point arrive as an SSE error event on the
+	// 200 stream instead of an HTTP error status. Off by default.
+	EmitTurnAccepted bool
+	// EmitTurnContext records a turn_context event right after turn_started
+	// with non-sensitive turn metadata (agent, model, cwd, context size,
+	// truncation), so history explains what the agent was given. The
+	// injected prompt itself is included only when PersistPrompts is on.
+	EmitTurnContext bool
+	// EmitTurnSteps tags turn events with stepId and phase (thinking,
+	// planning, tool_request, tool_result, answer) so clients can group a
+	// long turn into steps. Event types are unchanged. Off by default.
+	EmitTurnSteps bool
+	// RecordDeltaOffsets adds offsetMs to every message_delta and
+	// reasoning_delta payload, streamed and persisted: the time since the
+	// turn started, taken from the monotonic clock with microsecond
+	// precision, so clients can reconstruct streaming cadence more precisely
+	// than event createdAt allows. Off by default.
+	RecordDeltaOffsets bool
+	// StreamReplayEvents replays up to this many persisted events of the
+	// thread's earlier turns as replay events at the start of every turn
+	// stream, before turn_started. Capped at 500; 0 disables replay.
+	StreamReplayEvents int
+	// AuditStreams records stream_opened and stream_closed events in each
+	// streamed turn's history, with the watching clientId and, on close, the
+	// stream duration and bytes sent. Together with the permission events
+	// this leaves a record of who watched which turn. Off by default.
+	AuditStreams bool
+	// EnableDebugEndpoints allows debugging aids that expose prompt content,
+	// such as ?debugPrompt=true on the turns endpoint. Off by default because
+	// injected prompts contain thread history.
+	EnableDebugEndpoints bool
+	// WebhookSecret enables per-turn callbackUrl delivery: turn events are
+	// POSTed to the callback, signed with HMAC-SHA256 using this secret.
+	// Empty disables webhook turns.
+	WebhookSecret string
+	// WebhookAllowedHosts lists callback hostnames that may resolve to
+	// loopback or private addresses. All other callbacks must resolve to
+	// public addresses.
+	WebhookAllowedHosts []string
+	// TurnRetry retries user turns whose agent stream fails transiently.
+	// The zero value disables retries.
+	TurnRetry TurnRetryPolicy
+	// DefaultAgentOptions maps agent id to agentOptions that new threads of
+	// that agent inherit. Client-provided options win on conflicts; nested
+	// objects such as configOverrides are merged key by key.
+	DefaultAgentOptions map[string]map[string]any
+	// CostRates maps agent id to token prices used by the thread cost
+	// endpoint. Agents without a rate report usage without a cost estimate.
+	CostRates map[string]CostRate
+	// AgentCapabilities maps agent id to operations disabled for that agent.
+	// Agents without an entry allow every operation.
+	AgentCapabilities map[string]AgentCapabilities
+	// CWDValidators maps agent id to extra cwd checks run when a thread of
+	// that agent is created. Agents without an entry get no extra checks.
+	CWDValidators map[string]CWDValidator
 	// FrontendHandler, if non-nil, is served for any request that does not
-	// match /healthz or /v1/*. Intended for the embedded web UI.
+	// match /healthz, /readyz, or /v1/*. Intended for the embedded web UI.
 	FrontendHandler http.Handler
+	// AgentRegistry, if non-nil, supplies agents and their constructors and
+	// may be updated at runtime. It replaces Agents, AllowedAgentIDs, Agent,
+	// and TurnAgentFactory, which otherwise build a fixed registry.
+	AgentRegistry *AgentRegistry
+	// DBQueueDepth bounds how many GET /v1/* requests may wait on or use the
+	// database at once; further reads wait up to DBQueueTimeout (default 2s)
+	// and then fail with 503 BUSY. Turn streams and writes are not queued.
+	// 0 disables the guard.
+	DBQueueDepth   int
+	DBQueueTimeout time.Duration
+	// MaxAgentProcesses caps how many agent subprocesses turns may run at
+	// once across all threads. A turn that cannot get a slot within
+	// AgentProcessWait fails with a BUSY error event. 0 means unlimited.
+	MaxAgentProcesses int
+	AgentProcessWait  time.Duration
+	// MaxTurnDeadline caps the X-Turn-Deadline a client may request for one
+	// turn; longer deadlines are clamped to it. Default 1h.
+	MaxTurnDeadline time.Duration
+	// EventCompactionAfter enables background compaction of finished turns:
+	// once a turn has been terminal this long, its message_delta events are
+	// replaced by one aggregated message_delta. Other events are kept. Values
+	// below one minute are raised to it so a client still reading a just
+	// finished turn never sees its events rewritten. 0 disables compaction.
+	EventCompactionAfter time.Duration
 }
 
 // Server serves the HTTP API.
 type Server struct {
-	authToken          string
+	// authToken holds the current bearer token (string); it can be rotated
+	// at runtime through POST /v1/admin/auth-token.
+	authToken          atomic.Value
+	adminToken         string
 	dataDir            string
-	agents             []AgentInfo
+	agentRegistry      *AgentRegistry
 	allowedRoots       []string
 	store              ThreadStore
-	allowedAgent       map[string]struct{}
+	storeGate          sync.RWMutex
 	turns              *runtime.TurnController
 	turnAgentFactory   TurnAgentFactory
 	agentModelsFactory AgentModelsFactory
 	agentIdleTTL       time.Duration
+	agentMaxLifetime   time.Duration
+	agentCloseTimeout  time.Duration
+	janitorCloseLimit  int
 	logger             *observability.Logger
 	contextRecentTurns int
+	contextScanTurns   int
 	contextMaxChars    int
 	compactMaxChars    int
 	permissionTimeout  time.Duration
+	permissionMaxAge   time.Duration
 	frontendHandler    http.Handler
 
-	permissionsMu sync.Mutex
-	permissions   map[string]*pendingPermission
-	permissionSeq uint64
+	contextSkipIncompleteTurns bool
+	compactContextMaxChars     int
+	enableAgentFileSystem      bool
+	firstTurnPassthrough       bool
+	compactEmptyThreads        bool
+	strictModelIDs             bool
+	canonicalAgentOptionKeys   bool
+	stripInvalidInput          bool
+	disabledEndpoints          map[string]struct{}
+	exposeAgentStderr          bool
+	compactActivateWait        time.Duration
+	routeHints                 bool
+	htmlErrorPages             bool
+	contextLabels              contextPromptLabels
+	inputTransform             InputTransform
+	outputTransform            OutputTransform
+	outputTransformHoldBack    int
+	maxDeltaRate               int
+	maxThreadList              int
+	cwdLimits                  CWDRules
+	historyDefaults            HistoryDefaults
+	persistPrompts             bool
+	persistRawStopReasons      bool
+	eventDelivery              map[string]EventDelivery
+	costRates                  map[string]CostRate
+	agentCapabilities          map[string]AgentCapabilities
+	cwdValidators              map[string]CWDValidator
+	dbQueue                    *dbQueue
+	processLimiter             *agents.ProcessLimiter
+	cancelConfirmTimeout       time.Duration
+	eventCompactionAfter       time.Duration
+	maxTurnDeadline            time.Duration
+	defaultAgentOptions        map[string]map[string]any
+	turnRetry                  TurnRetryPolicy
+	enableDebugEndpoints       bool
+	emitTurnSummary            bool
+	emitEmptyResponse          bool
+	emitTurnAccepted           bool
+	emitTurnContext            bool
+	emitTurnSteps              bool
+	recordDeltaOffsets         bool
+	streamReplayEvents         int
+	auditStreams               bool
+	maxClientStoredBytes       int64
+	maxTurnsPerThread          int
+	storeClientMetadata        bool
+	faults                     faultInjector
+	webhookSecret              []byte
+	webhookAllowedHosts        map[string]struct{}
+	webhookClient              *http.Client
+	webhookRetryBackoff        time.Duration
+	webhookDrainTimeout        time.Duration
+	sseFlush                   sse.Options
+
+	permissionsMu         sync.Mutex
+	permissions           map[string]*pendingPermission
+	permissionsByTurn     map[string]map[string]struct{} // pending permission ids by turn
+	permissionSeq         uint64
+	maxPendingPermissions int
+	globalPermissionLimit int
+	maxPermissionChars    int
+	// permissionTombstones remembers when and why recently retired
+	// permission ids left the pending set, so late decisions are told they
+	// expired or were cancelled with their turn.
+	permissionTombstones map[string]permissionTombstone
+	// permissionTombstoneQueue holds tombstoned ids oldest first, so expired
+	// tombstones are pruned from the front without scanning the map.
+	permissionTombstoneQueue []string
+
+	clientTurnsMu  sync.Mutex
+	clientTurns    map[string]int
+	maxClientTurns int
 
 	agentMu       sync.Mutex
 	agentsByScope map[string]*managedAgent
 	janitorStop   chan struct{}
 	janitorDone   chan struct{}
+
+	contextPromptCapHits atomic.Int64
+	// activeStreams counts open turn SSE streams for /v1/stats.
+	activeStreams atomic.Int64
 }
 
 const (
-	defaultContextRecentTurns = 10
-	defaultContextMaxChars    = 20000
-	defaultCompactMaxChars    = 4000
-	defaultAgentIdleTTL       = 5 * time.Minute
-	defaultPermissionTimeout  = 2 * time.Hour
+	defaultContextRecentTurns    = 10
+	defaultContextScanFactor     = 5
+	defaultContextMaxChars       = 20000
+	defaultCompactMaxChars       = 4000
+	defaultAgentIdleTTL          = 5 * time.Minute
+	defaultAgentCloseTimeout     = 10 * time.Second
+	defaultJanitorCloseLimit     = 4
+	minEventCompactionAfter      = time.Minute
+	eventCompactionBatch         = 100
+	eventCompactionTimeout       = 30 * time.Second
+	defaultPermissionTimeout     = 2 * time.Hour
+	defaultMaxPendingPermissions = 64
+	defaultMaxPermissionChars    = 4096
+	defaultMaxThreadList         = 500
+	defaultMaxCWDBytes           = 4096
+	defaultMaxCWDDepth           = 128
+	defaultCancelConfirmTimeout  = 10 * time.Second
+	permissionTombstoneTTL       = 10 * time.Minute
+	defaultAdminThreadPageSize   = 50
+	defaultTurnRetryBackoff      = 500 * time.Millisecond
+	maxAdminThreadPageSize       = 200
 
 	threadAgentOptionFreshSessionKey = "_ngentFreshSession"
 	eventTypeUserPrompt              = "user_prompt"
 	eventTypeMessageContent          = "message_content"
 	eventTypeReasoningDelta          = "reasoning_delta"
+	eventTypeTurnContext             = "turn_context"
+	eventTypeTurnAccepted            = "turn_accepted"
+	eventTypeEmptyResponse           = "empty_response"
 	eventTypeSessionInfoUpdate       = "session_info_update"
 	eventTypeToolCall                = "tool_call"
 	eventTypeToolCallUpdate          = "tool_call_update"
+	eventTypeStreamOpened            = "stream_opened"
+	eventTypeStreamClosed            = "stream_closed"
 )
 
 const (
@@ -149,18 +640,34 @@ const (
 	codeNotFound            = "NOT_FOUND"
 	codeConflict            = "CONFLICT"
 	codeTimeout             = "TIMEOUT"
+	codeBusy                = "BUSY"
 	codeInternal            = "INTERNAL"
 	codeUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	codeAgentExited         = "AGENT_EXITED"
+	codeAgentProtocol       = "AGENT_PROTOCOL_ERROR"
 )
 
 var errThreadConfigOptionsUnavailable = errors.New("thread config options are not available yet")
 
 const maxTurnMultipartMemory = 32 << 20
 
+const readinessPingTimeout = 2 * time.Second
+
+const storeSwapPollInterval = 20 * time.Millisecond
+
+// maxContextPromptIterations bounds the context reduction loop. Each pass drops
+// one recent turn or shrinks the summary/input by a quarter, so reaching the cap
+// means the budget could not be met normally and the prompt is force-clamped.
+const maxContextPromptIterations = 256
+
 type turnCreateRequest struct {
 	Prompt  agents.Prompt
 	Stream  bool
 	Uploads []storedTurnAttachment
+	// Background runs the turn to completion even if the SSE client
+	// disconnects.
+	Background  bool
+	CallbackURL string
 }
 
 type storedTurnAttachment struct {
@@ -170,9 +677,6 @@ type storedTurnAttachment struct {
 
 // New creates a new API server.
 func New(cfg Config) *Server {
-	agentsList := make([]AgentInfo, len(cfg.Agents))
-	copy(agentsList, cfg.Agents)
-
 	roots := make([]string, 0, len(cfg.AllowedRoots))
 	for _, root := range cfg.AllowedRoots {
 		root = strings.TrimSpace(root)
@@ -182,41 +686,53 @@ func New(cfg Config) *Server {
 		roots = append(roots, filepath.Clean(root))
 	}
 
-	allowedAgent := make(map[string]struct{}, len(cfg.AllowedAgentIDs))
-	for _, agentID := range cfg.AllowedAgentIDs {
-		agentID = strings.TrimSpace(agentID)
-		if agentID == "" {
-			continue
-		}
-		allowedAgent[agentID] = struct{}{}
-	}
-
 	turnController := cfg.TurnController
 	if turnController == nil {
 		turnController = runtime.NewTurnController()
 	}
 
-	turnAgentFactory := cfg.TurnAgentFactory
-	if turnAgentFactory == nil {
-		agent := cfg.Agent
-		if agent == nil {
-			agent = agents.NewFakeAgent()
-		}
-		turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
-			_ = thread
-			return agent, nil
+	agentRegistry := cfg.AgentRegistry
+	if agentRegistry == nil {
+		turnAgentFactory := cfg.TurnAgentFactory
+		if turnAgentFactory == nil {
+			agent := cfg.Agent
+			if agent == nil {
+				agent = agents.NewFakeAgent()
+			}
+			turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
+				_ = thread
+				return agent, nil
+			}
 		}
+		agentRegistry = AgentRegistryFromFactory(cfg.Agents, cfg.AllowedAgentIDs, turnAgentFactory)
 	}
 
 	permissionTimeout := cfg.PermissionTimeout
 	if permissionTimeout <= 0 {
 		permissionTimeout = defaultPermissionTimeout
 	}
+	maxPendingPermissions := cfg.MaxPendingPermissions
+	if maxPendingPermissions <= 0 {
+		maxPendingPermissions = defaultMaxPendingPermissions
+	}
+	maxPermissionChars := cfg.MaxPermissionCommandChars
+	if maxPermissionChars <= 0 {
+		maxPermissionChars = defaultMaxPermissionChars
+	}
+	permissionMaxAge := cfg.PermissionMaxAge
+	if permissionMaxAge <= 0 {
+		permissionMaxAge = 2 * permissionTimeout
+	}
 
 	contextRecentTurns := cfg.ContextRecentTurns
 	if contextRecentTurns <= 0 {
 		contextRecentTurns = defaultContextRecentTurns
 	}
+	contextScanTurns := cfg.ContextScanTurns
+	if contextScanTurns <= 0 {
+		contextScanTurns = defaultContextScanFactor * contextRecentTurns
+	}
+	contextScanTurns = max(contextScanTurns, contextRecentTurns)
 
 	contextMaxChars := cfg.ContextMaxChars
 	if contextMaxChars <= 0 {
@@ -227,12 +743,49 @@ func New(cfg Config) *Server {
 	if compactMaxChars <= 0 {
 		compactMaxChars = defaultCompactMaxChars
 	}
+	compactContextMaxChars := cfg.CompactContextMaxChars
+	if compactContextMaxChars <= 0 {
+		compactContextMaxChars = contextMaxChars
+	}
 
 	agentIdleTTL := cfg.AgentIdleTTL
 	if agentIdleTTL <= 0 {
 		agentIdleTTL = defaultAgentIdleTTL
 	}
 
+	agentCloseTimeout := cfg.AgentCloseTimeout
+	if agentCloseTimeout <= 0 {
+		agentCloseTimeout = defaultAgentCloseTimeout
+	}
+
+	janitorCloseLimit := cfg.JanitorCloseConcurrency
+	if janitorCloseLimit <= 0 {
+		janitorCloseLimit = defaultJanitorCloseLimit
+	}
+
+	eventCompactionAfter := max(cfg.EventCompactionAfter, 0)
+	if eventCompactionAfter > 0 && eventCompactionAfter < minEventCompactionAfter {
+		eventCompactionAfter = minEventCompactionAfter
+	}
+
+	maxTurnDeadline := cfg.MaxTurnDeadline
+	if maxTurnDeadline <= 0 {
+		maxTurnDeadline = defaultMaxTurnDeadline
+	}
+
+	maxThreadList := cfg.MaxThreadList
+	if maxThreadList <= 0 {
+		maxThreadList = defaultMaxThreadList
+	}
+	maxCWDBytes := cfg.MaxCWDBytes
+	if maxCWDBytes <= 0 {
+		maxCWDBytes = defaultMaxCWDBytes
+	}
+	maxCWDDepth := cfg.MaxCWDDepth
+	if maxCWDDepth <= 0 {
+		maxCWDDepth = defaultMaxCWDDepth
+	}
+
 	logger := cfg.Logger
 	if logger == nil {
 		logger = observability.NewLoggerWithWriter(io.Discard, observability.LevelError)
@@ -244,26 +797,110 @@ func New(cfg Config) *Server {
 	}
 
 	server := &Server{
-		authToken:          cfg.AuthToken,
+		adminToken:         strings.TrimSpace(cfg.AdminToken),
 		dataDir:            dataDir,
-		agents:             agentsList,
+		agentRegistry:      agentRegistry,
 		allowedRoots:       roots,
 		store:              cfg.Store,
-		allowedAgent:       allowedAgent,
 		turns:              turnController,
-		turnAgentFactory:   turnAgentFactory,
+		turnAgentFactory:   agentRegistry.TurnAgentFactory(),
 		agentModelsFactory: cfg.AgentModelsFactory,
 		agentIdleTTL:       agentIdleTTL,
+		agentMaxLifetime:   max(cfg.AgentMaxLifetime, 0),
+		agentCloseTimeout:  agentCloseTimeout,
+		janitorCloseLimit:  janitorCloseLimit,
 		logger:             logger,
 		contextRecentTurns: contextRecentTurns,
+		contextScanTurns:   contextScanTurns,
 		contextMaxChars:    contextMaxChars,
 		compactMaxChars:    compactMaxChars,
 		permissionTimeout:  permissionTimeout,
+		permissionMaxAge:   permissionMaxAge,
 		frontendHandler:    cfg.FrontendHandler,
 		permissions:        make(map[string]*pendingPermission),
+		permissionsByTurn:  make(map[string]map[string]struct{}),
+		clientTurns:        make(map[string]int),
+		maxClientTurns:     max(cfg.MaxActiveTurnsPerClient, 0),
 		agentsByScope:      make(map[string]*managedAgent),
 		janitorStop:        make(chan struct{}),
 		janitorDone:        make(chan struct{}),
+
+		contextSkipIncompleteTurns: cfg.ContextSkipIncompleteTurns,
+		compactContextMaxChars:     compactContextMaxChars,
+		permissionTombstones:       make(map[string]permissionTombstone),
+		enableAgentFileSystem:      cfg.EnableAgentFileSystem,
+		maxThreadList:              maxThreadList,
+		cwdLimits:                  CWDRules{MaxDepth: maxCWDDepth, MaxLength: maxCWDBytes},
+		firstTurnPassthrough:       cfg.FirstTurnPassthrough == nil || *cfg.FirstTurnPassthrough,
+		routeHints:                 cfg.RouteHints == nil || *cfg.RouteHints,
+		htmlErrorPages:             cfg.HTMLErrorPages,
+		compactEmptyThreads:        cfg.CompactEmptyThreads,
+		strictModelIDs:             cfg.StrictModelIDs,
+		canonicalAgentOptionKeys:   cfg.CanonicalAgentOptionKeys,
+		stripInvalidInput:          cfg.StripInvalidInput,
+		exposeAgentStderr:          cfg.ExposeAgentStderr,
+		maxClientStoredBytes:       max(cfg.MaxClientStoredBytes, 0),
+		maxTurnsPerThread:          max(cfg.MaxTurnsPerThread, 0),
+		storeClientMetadata:        cfg.StoreClientMetadata,
+		compactActivateWait:        max(cfg.CompactWaitForActiveTurn, 0),
+		maxPendingPermissions:      maxPendingPermissions,
+		globalPermissionLimit:      max(cfg.MaxGlobalPendingPermissions, 0),
+		maxPermissionChars:         maxPermissionChars,
+		contextLabels: contextPromptLabels{
+			summaryHeader:      cfg.ContextSummaryHeader,
+			recentTurnsHeader:  cfg.ContextRecentTurnsHeader,
+			currentInputHeader: cfg.ContextCurrentInputHeader,
+			userLabel:          cfg.ContextUserLabel,
+			assistantLabel:     cfg.ContextAssistantLabel,
+		}.withDefaults(),
+		inputTransform:          cfg.InputTransform,
+		outputTransform:         cfg.OutputTransform,
+		outputTransformHoldBack: max(cfg.OutputTransformHoldBack, 0),
+		maxDeltaRate:            max(cfg.MaxDeltaRate, 0),
+		persistPrompts:          cfg.PersistPrompts,
+		persistRawStopReasons:   cfg.PersistRawStopReasons,
+		eventDelivery:           cloneEventDelivery(cfg.EventDelivery),
+		costRates:               cloneCostRates(cfg.CostRates),
+		agentCapabilities:       cloneAgentCapabilities(cfg.AgentCapabilities),
+		cwdValidators:           cloneCWDValidators(cfg.CWDValidators),
+		dbQueue:                 newDBQueue(cfg.DBQueueDepth, cfg.DBQueueTimeout),
+		processLimiter:          agents.NewProcessLimiter(cfg.MaxAgentProcesses, cfg.AgentProcessWait),
+		cancelConfirmTimeout:    defaultCancelConfirmTimeout,
+		eventCompactionAfter:    eventCompactionAfter,
+		maxTurnDeadline:         maxTurnDeadline,
+		defaultAgentOptions:     cloneDefaultAgentOptions(cfg.DefaultAgentOptions),
+		turnRetry:               cfg.TurnRetry.withDefaults(),
+		historyDefaults:         cfg.HistoryDefaults,
+		enableDebugEndpoints:    cfg.EnableDebugEndpoints,
+		emitTurnSummary:         cfg.EmitTurnSummary,
+		emitEmptyResponse:       cfg.EmitEmptyResponse,
+		emitTurnAccepted:        cfg.EmitTurnAccepted,
+		emitTurnContext:         cfg.EmitTurnContext,
+		emitTurnSteps:           cfg.EmitTurnSteps,
+		recordDeltaOffsets:      cfg.RecordDeltaOffsets,
+		streamReplayEvents:      min(max(cfg.StreamReplayEvents, 0), maxStreamReplayEvents),
+		auditStreams:            cfg.AuditStreams,
+		sseFlush: sse.Options{
+			FlushEvery:      cfg.SSEFlushEvery,
+			FlushInterval:   cfg.SSEFlushInterval,
+			ImmediateEvents: sseImmediateEvents,
+		},
+		webhookSecret:       []byte(cfg.WebhookSecret),
+		webhookAllowedHosts: normalizeWebhookHosts(cfg.WebhookAllowedHosts),
+		webhookRetryBackoff: defaultWebhookRetryBackoff,
+		webhookDrainTimeout: defaultWebhookDrainTimeout,
+	}
+	var eventNameErrs []error
+	server.sseFlush.EventNames, eventNameErrs = buildEventNames(cfg.EventNameMapping)
+	for _, err := range eventNameErrs {
+		logger.Warn("httpapi.event_name_ignored", "reason", err.Error())
+	}
+	server.authToken.Store(cfg.AuthToken)
+	server.webhookClient = server.newWebhookClient()
+	var disabledErrs []error
+	server.disabledEndpoints, disabledErrs = buildDisabledEndpoints(cfg.DisabledEndpoints)
+	for _, err := range disabledErrs {
+		logger.Warn("httpapi.disabled_endpoint_ignored", "reason", err.Error())
 	}
 	go server.idleJanitorLoop()
 	return server
@@ -273,7 +910,13 @@ func New(cfg Config) *Server {
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startedAt := time.Now()
 	loggingWriter := newLoggingResponseWriter(w)
-	s.serveHTTP(loggingWriter, r)
+	func() {
+		// Hold the store for the whole request so SwapStore cannot move a
+		// streaming turn to a different database mid-flight.
+		s.storeGate.RLock()
+		defer s.storeGate.RUnlock()
+		s.serveHTTP(loggingWriter, r)
+	}()
 	s.logRequestCompletion(r, loggingWriter, startedAt)
 }
 
@@ -288,6 +931,11 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/readyz" {
+		s.handleReadyz(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.URL.Path, "/v1/") {
 		if !s.isAuthorized(r) {
 			writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or invalid bearer token", map[string]any{
@@ -309,12 +957,32 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if s.dbQueue != nil && isDBQueuedRead(r) {
+			release, ok := s.dbQueue.acquire(r.Context())
+			if !ok {
+				s.logger.Warn("db.queue_saturated",
+					"path", r.URL.Path,
+					"depth", cap(s.dbQueue.slots),
+					"timeout", s.dbQueue.timeout.String(),
+				)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, codeBusy, "database queue is saturated", map[string]any{
+					"reason": "db_queue_saturated",
+				})
+				return
+			}
+			defer release()
+		}
+
 		if err := s.store.UpsertClient(r.Context(), clientID); err != nil {
 			writeError(w, http.StatusInternalServerError, codeInternal, "failed to upsert client", map[string]any{
 				"reason": err.Error(),
 			})
 			return
 		}
+		if s.storeClientMetadata && !s.recordClient(w, r, clientID) {
+			return
+		}
 
 		s.routeV1(w, r, clientID)
 		return
@@ -325,7 +993,7 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeError(w, http.StatusNotFound, codeNotFound, "endpoint not found", map[string]any{"path": r.URL.Path})
+	s.writeNegotiatedError(w, r, http.StatusNotFound, codeNotFound, "endpoint not found", map[string]any{"path": r.URL.Path})
 }
 
 func (s *Server) logRequestCompletion(r *http.Request, w *loggingResponseWriter, startedAt time.Time) {
@@ -344,46 +1012,194 @@ func (s *Server) logRequestCompletion(r *http.Request, w *loggingResponseWriter,
 }
 
 func (s *Server) routeV1(w http.ResponseWriter, r *http.Request, clientID string) {
+	if strings.HasPrefix(r.URL.Path, "/v1/admin/") {
+		s.routeAdmin(w, r)
+		return
+	}
 	if r.URL.Path == "/v1/agents" {
+		if s.rejectDisabledEndpoint(w, r, "agents") {
+			return
+		}
 		s.handleAgents(w, r)
 		return
 	}
+	if r.URL.Path == "/v1/version" {
+		if s.rejectDisabledEndpoint(w, r, "version") {
+			return
+		}
+		s.handleVersion(w, r)
+		return
+	}
+	if r.URL.Path == "/v1/stats" {
+		if s.rejectDisabledEndpoint(w, r, "stats") {
+			return
+		}
+		s.handleStats(w, r, clientID)
+		return
+	}
 	if agentID, ok := parseAgentModelsPath(r.URL.Path); ok {
+		if s.rejectDisabledEndpoint(w, r, "agent-models") {
+			return
+		}
 		s.handleAgentModels(w, r, agentID)
 		return
 	}
 
 	if r.URL.Path == "/v1/path-search" {
+		if s.rejectDisabledEndpoint(w, r, "path-search") {
+			return
+		}
 		s.handlePathSearch(w, r)
 		return
 	}
 
 	if r.URL.Path == "/v1/recent-directories" {
+		if s.rejectDisabledEndpoint(w, r, "recent-directories") {
+			return
+		}
 		s.handleRecentDirectories(w, r, clientID)
 		return
 	}
 
+	if target, ok := parseClientPath(r.URL.Path); ok {
+		if s.rejectDisabledEndpoint(w, r, "clients") {
+			return
+		}
+		s.handleClient(w, r, clientID, target)
+		return
+	}
+
 	if r.URL.Path == "/v1/threads" {
+		if s.rejectDisabledEndpoint(w, r, "threads") {
+			return
+		}
 		s.handleThreadsCollection(w, r, clientID)
 		return
 	}
 
 	if permissionID, ok := parsePermissionPath(r.URL.Path); ok {
+		if s.rejectDisabledEndpoint(w, r, "permissions") {
+			return
+		}
 		s.handlePermissionDecision(w, r, clientID, permissionID)
 		return
 	}
 
 	if turnID, ok := parseTurnCancelPath(r.URL.Path); ok {
+		if s.rejectDisabledEndpoint(w, r, "turn-cancel") {
+			return
+		}
 		s.handleCancelTurn(w, r, clientID, turnID)
 		return
 	}
 
+	if threadID, tag, ok := parseThreadTagPath(r.URL.Path); ok {
+		if s.rejectDisabledEndpoint(w, r, "tags") {
+			return
+		}
+		s.handleThreadTag(w, r, clientID, threadID, tag)
+		return
+	}
+
 	if threadID, subresource, ok := parseThreadPath(r.URL.Path); ok {
 		s.handleThreadResource(w, r, clientID, threadID, subresource)
 		return
 	}
 
-	writeError(w, http.StatusNotFound, "NOT_FOUND", "endpoint not found", map[string]any{"path": r.URL.Path})
+	s.writeRouteNotFound(w, r, "knownCollections", v1Collections)
+}
+
+// v1Collections and threadSubresources are reported by NOT_FOUND responses
+// for unknown /v1 paths when route hints are enabled.
+var (
+	v1Collections = []string{
+		"/v1/agents",
+		"/v1/agents/{agentId}/models",
+		"/v1/version",
+		"/v1/stats",
+		"/v1/path-search",
+		"/v1/recent-directories",
+		"/v1/clients/me",
+		"/v1/threads",
+		"/v1/permissions/{permissionId}",
+		"/v1/turns/{turnId}/cancel",
+	}
+	threadSubresources = []string{
+		"turns",
+		"compact",
+		"cancel",
+		"cost",
+		"tags",
+		"history",
+		"sessions",
+		"session-history",
+		"config-options",
+		"slash-commands",
+	}
+)
+
+// writeRouteNotFound writes the NOT_FOUND error of an unknown /v1 path,
+// listing valid alternatives under hintKey unless route hints are off.
+func (s *Server) writeRouteNotFound(w http.ResponseWriter, r *http.Request, hintKey string, hint []string) {
+	details := map[string]any{"path": r.URL.Path}
+	if s.routeHints {
+		details[hintKey] = hint
+	}
+	writeError(w, http.StatusNotFound, codeNotFound, "endpoint not found", details)
+}
+
+// handleVersion reports build info and the applied schema version so
+// operators can confirm a deployment ran its migrations.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	schemaVersion, err := s.store.SchemaVersion(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to read schema version", map[string]any{"reason": err.Error()})
+		return
+	}
+	applied, err := s.store.AppliedMigrationCount(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to count schema migrations", map[string]any{"reason": err.Error()})
+		return
+	}
+	latest := storage.LatestSchemaVersion()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"build": buildInfoPayload(),
+		"schema": map[string]any{
+			"version":           schemaVersion,
+			"latest":            latest,
+			"appliedMigrations": applied,
+			"upToDate":          schemaVersion >= latest,
+		},
+	})
+}
+
+func buildInfoPayload() map[string]any {
+	payload := map[string]any{
+		"goVersion": goruntime.Version(),
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return payload
+	}
+	payload["module"] = info.Main.Path
+	payload["version"] = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			payload["revision"] = setting.Value
+		case "vcs.time":
+			payload["revisionTime"] = setting.Value
+		case "vcs.modified":
+			payload["modified"] = setting.Value == "true"
+		}
+	}
+	return payload
 }
 
 func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
@@ -391,7 +1207,81 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 		writeMethodNotAllowed(w, r)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	if !parseBoolQuery(r, "verbose") {
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		return
+	}
+	checks, ok := s.readinessChecks(r.Context())
+	payload := map[string]any{
+		"ok":     ok,
+		"checks": checks,
+	}
+	if s.dbQueue != nil {
+		payload["dbQueue"] = s.dbQueue.stats()
+	}
+	payload["permissions"] = s.permissionStats()
+	if s.processLimiter != nil {
+		payload["agentProcesses"] = map[string]int{
+			"limit": s.processLimiter.Limit(),
+			"inUse": s.processLimiter.InUse(),
+		}
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	checks, ok := s.readinessChecks(r.Context())
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{
+		"ok":     ok,
+		"checks": checks,
+	})
+}
+
+// SwapStore replaces the backing store once no request is in flight, so a
+// running turn never writes across two databases. It polls until ctx is done
+// and returns the previous store on success; the caller owns closing it.
+func (s *Server) SwapStore(ctx context.Context, next ThreadStore) (ThreadStore, error) {
+	if next == nil {
+		return nil, errors.New("httpapi: swap store: next store is nil")
+	}
+	ticker := time.NewTicker(storeSwapPollInterval)
+	defer ticker.Stop()
+	for !s.storeGate.TryLock() {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("httpapi: swap store: requests still in flight: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	defer s.storeGate.Unlock()
+	previous := s.store
+	s.store = next
+	return previous, nil
+}
+
+// readinessChecks probes dependencies that must work before turns can run.
+func (s *Server) readinessChecks(ctx context.Context) (map[string]string, bool) {
+	checks := map[string]string{"storage": "ok"}
+	if s.store == nil {
+		checks["storage"] = "not configured"
+		return checks, false
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, readinessPingTimeout)
+	defer cancel()
+	if err := s.store.Ping(pingCtx); err != nil {
+		s.logger.Warn("health.storage_ping_failed", "error", err.Error())
+		checks["storage"] = err.Error()
+		return checks, false
+	}
+	return checks, true
 }
 
 func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request, attachmentID string) {
@@ -484,7 +1374,7 @@ func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, struct {
 		Agents []AgentInfo `json:"agents"`
-	}{Agents: s.agents})
+	}{Agents: s.agentRegistry.Agents()})
 }
 
 func (s *Server) handleAgentModels(w http.ResponseWriter, r *http.Request, agentID string) {
@@ -493,7 +1383,7 @@ func (s *Server) handleAgentModels(w http.ResponseWriter, r *http.Request, agent
 		return
 	}
 
-	if _, ok := s.allowedAgent[agentID]; !ok {
+	if _, ok := s.agentRegistry.Lookup(agentID); !ok {
 		writeError(w, http.StatusNotFound, codeNotFound, "agent not found", map[string]any{
 			"agent": agentID,
 		})
@@ -530,6 +1420,13 @@ func (s *Server) handleThreadsCollection(w http.ResponseWriter, r *http.Request,
 }
 
 func (s *Server) handleThreadResource(w http.ResponseWriter, r *http.Request, clientID, threadID, subresource string) {
+	endpoint := subresource
+	if endpoint == "" {
+		endpoint = "thread"
+	}
+	if s.rejectDisabledEndpoint(w, r, endpoint) {
+		return
+	}
 	switch subresource {
 	case "":
 		switch r.Method {
@@ -546,6 +1443,12 @@ func (s *Server) handleThreadResource(w http.ResponseWriter, r *http.Request, cl
 		s.handleCreateTurnStream(w, r, clientID, threadID)
 	case "compact":
 		s.handleCompactThread(w, r, clientID, threadID)
+	case "cancel":
+		s.handleCancelThreadTurn(w, r, clientID, threadID)
+	case "cost":
+		s.handleThreadCost(w, r, clientID, threadID)
+	case "tags":
+		s.handleListThreadTags(w, r, clientID, threadID)
 	case "history":
 		s.handleThreadHistory(w, r, clientID, threadID)
 	case "sessions":
@@ -557,7 +1460,7 @@ func (s *Server) handleThreadResource(w http.ResponseWriter, r *http.Request, cl
 	case "slash-commands":
 		s.handleThreadSlashCommands(w, r, clientID, threadID)
 	default:
-		writeError(w, http.StatusNotFound, "NOT_FOUND", "endpoint not found", map[string]any{"path": r.URL.Path})
+		s.writeRouteNotFound(w, r, "validSubresources", threadSubresources)
 	}
 }
 
@@ -567,6 +1470,8 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 		CWD          string          `json:"cwd"`
 		Title        string          `json:"title"`
 		AgentOptions json.RawMessage `json:"agentOptions"`
+		// OptionsLocked freezes agentOptions for the thread's lifetime.
+		OptionsLocked bool `json:"optionsLocked"`
 	}
 
 	if err := requireMethod(r, http.MethodPost); err != nil {
@@ -580,10 +1485,10 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 	}
 
 	req.Agent = strings.TrimSpace(req.Agent)
-	if _, ok := s.allowedAgent[req.Agent]; !ok {
+	if _, ok := s.agentRegistry.Lookup(req.Agent); !ok {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "agent is not in allowlist", map[string]any{
 			"field":         "agent",
-			"allowedAgents": sortedAgentIDs(s.allowedAgent),
+			"allowedAgents": s.agentRegistry.allowedIDs(),
 		})
 		return
 	}
@@ -607,6 +1512,15 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 		return
 	}
 	cwd = filepath.Clean(cwd)
+	if err := s.cwdLimits.Validate(cwd); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "cwd is too long", map[string]any{
+			"field":    "cwd",
+			"reason":   err.Error(),
+			"maxBytes": s.cwdLimits.MaxLength,
+			"maxDepth": s.cwdLimits.MaxDepth,
+		})
+		return
+	}
 	if !isPathAllowed(cwd, s.allowedRoots) {
 		writeError(w, http.StatusForbidden, "FORBIDDEN", "cwd is outside allowed roots", map[string]any{
 			"field":         "cwd",
@@ -630,10 +1544,30 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 		})
 		return
 	}
+	if validate := s.cwdValidators[req.Agent]; validate != nil {
+		if err := validate(cwd); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "cwd is not supported by agent", map[string]any{
+				"field":  "cwd",
+				"agent":  req.Agent,
+				"cwd":    cwd,
+				"reason": err.Error(),
+			})
+			return
+		}
+	}
 
-	agentOptionsJSON, err := normalizeAgentOptions(req.AgentOptions)
+	agentOptionsJSON, err := normalizeAgentOptions(req.AgentOptions, s.canonicalAgentOptionKeys)
+	if err != nil {
+		writeInvalidAgentOptions(w, err)
+		return
+	}
+	agentOptionsJSON, err = mergeDefaultAgentOptions(agentOptionsJSON, s.defaultAgentOptions[req.Agent])
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "agentOptions must be a JSON object", map[string]any{"field": "agentOptions"})
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to apply default agentOptions", map[string]any{"reason": err.Error()})
+		return
+	}
+	if err := s.validateThreadModelID(r.Context(), req.Agent, agentOptionsJSON); err != nil {
+		writeInvalidModelID(w, req.Agent, err)
 		return
 	}
 
@@ -645,8 +1579,13 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 		Title:            req.Title,
 		AgentOptionsJSON: agentOptionsJSON,
 		Summary:          "",
+		OptionsLocked:    req.OptionsLocked,
 	})
 	if err != nil {
+		if errors.Is(err, storage.ErrTooLarge) {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "title is too long", map[string]any{"field": "title", "reason": err.Error()})
+			return
+		}
 		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to create thread", map[string]any{"reason": err.Error()})
 		return
 	}
@@ -654,17 +1593,42 @@ func (s *Server) handleCreateThread(w http.ResponseWriter, r *http.Request, clie
 	writeJSON(w, http.StatusOK, map[string]string{"threadId": threadID})
 }
 
+func writeOptionsLocked(w http.ResponseWriter, threadID string) {
+	writeError(w, http.StatusForbidden, codeForbidden, "thread agent options are locked", map[string]any{
+		"threadId": threadID,
+		"reason":   "options_locked",
+	})
+}
+
 func (s *Server) handleListThreads(w http.ResponseWriter, r *http.Request, clientID string) {
 	if err := requireMethod(r, http.MethodGet); err != nil {
 		writeMethodNotAllowed(w, r)
 		return
 	}
 
-	threads, err := s.store.ListThreads(r.Context())
+	var (
+		threads []storage.Thread
+		err     error
+	)
+	if rawTag := r.URL.Query().Get("tag"); rawTag != "" {
+		tag, tagErr := normalizeThreadTag(rawTag)
+		if tagErr != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, tagErr.Error(), map[string]any{"field": "tag"})
+			return
+		}
+		threads, err = s.store.ListThreadsByTag(r.Context(), tag, s.maxThreadList+1)
+	} else {
+		threads, err = s.store.ListThreads(r.Context(), s.maxThreadList+1)
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to list threads", map[string]any{"reason": err.Error()})
 		return
 	}
+	// One extra row is fetched only to learn whether the list was cut.
+	truncated := len(threads) > s.maxThreadList
+	if truncated {
+		threads = threads[:s.maxThreadList]
+	}
 
 	items := make([]threadResponse, 0, len(threads))
 	for _, thread := range threads {
@@ -676,7 +1640,121 @@ func (s *Server) handleListThreads(w http.ResponseWriter, r *http.Request, clien
 		items = append(items, item)
 	}
 
-	writeJSON(w, http.StatusOK, map[string]any{"threads": items})
+	writeJSON(w, http.StatusOK, map[string]any{"threads": items, "truncated": truncated})
+}
+
+func (s *Server) routeAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/admin/auth-token" && s.adminToken == "" {
+		// Without an admin token, rotation is guarded by the current auth
+		// token (already checked by serveHTTP).
+		s.handleRotateAuthToken(w, r)
+		return
+	}
+	if s.adminToken == "" {
+		writeError(w, http.StatusForbidden, codeForbidden, "admin endpoints are disabled", map[string]any{})
+		return
+	}
+	if !s.isAdmin(r) {
+		writeError(w, http.StatusForbidden, codeForbidden, "admin token required", map[string]any{
+			"header": "Authorization",
+		})
+		return
+	}
+
+	if r.URL.Path == "/v1/admin/auth-token" {
+		s.handleRotateAuthToken(w, r)
+		return
+	}
+	if agentID, ok := parseAdminAgentThreadsPath(r.URL.Path); ok {
+		s.handleAdminAgentThreads(w, r, agentID)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, codeNotFound, "endpoint not found", map[string]any{"path": r.URL.Path})
+}
+
+func (s *Server) handleRotateAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := requireMethod(r, http.MethodPost); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if s.currentAuthToken() == "" {
+		writeError(w, http.StatusForbidden, codeForbidden, "auth token is not enabled", map[string]any{})
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid JSON body", map[string]any{"reason": err.Error()})
+		return
+	}
+	token := strings.TrimSpace(req.Token)
+	if token == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "token is required", map[string]any{"field": "token"})
+		return
+	}
+
+	s.authToken.Store(token)
+	if s.logger != nil {
+		s.logger.Info("auth.token_rotated", "remoteAddr", requestClientAddr(r), "byAdmin", s.isAdmin(r))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rotated": true})
+}
+
+func (s *Server) handleAdminAgentThreads(w http.ResponseWriter, r *http.Request, agentID string) {
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	limit := defaultAdminThreadPageSize
+	if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxAdminThreadPageSize {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("limit must be between 1 and %d", maxAdminThreadPageSize), map[string]any{"field": "limit"})
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if raw := strings.TrimSpace(r.URL.Query().Get("cursor")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid cursor", map[string]any{"field": "cursor"})
+			return
+		}
+		offset = parsed
+	}
+
+	// Fetch one extra row to learn whether another page exists.
+	threads, err := s.store.ListThreadsByAgent(r.Context(), agentID, limit+1, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to list threads", map[string]any{"reason": err.Error()})
+		return
+	}
+	nextCursor := ""
+	if len(threads) > limit {
+		threads = threads[:limit]
+		nextCursor = strconv.Itoa(offset + limit)
+	}
+
+	items := make([]threadResponse, 0, len(threads))
+	for _, thread := range threads {
+		item, convErr := toThreadResponse(thread)
+		if convErr != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "failed to encode thread", map[string]any{"reason": convErr.Error()})
+			return
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"agentId":    agentID,
+		"threads":    items,
+		"nextCursor": nextCursor,
+	})
 }
 
 func (s *Server) handleGetThread(w http.ResponseWriter, r *http.Request, clientID, threadID string) {
@@ -726,10 +1804,20 @@ func (s *Server) handleUpdateThread(w http.ResponseWriter, r *http.Request, clie
 	currentSessionID := threadSessionID(thread.AgentOptionsJSON)
 	currentFreshSession := threadFreshSessionRequested(thread.AgentOptionsJSON)
 	if req.AgentOptions != nil {
+		// Selecting a session replaces the thread's model state, so locked
+		// threads accept no agentOptions changes at all.
+		if thread.OptionsLocked {
+			writeOptionsLocked(w, thread.ThreadID)
+			return
+		}
 		var err error
-		agentOptionsJSON, err = normalizeAgentOptions(*req.AgentOptions)
+		agentOptionsJSON, err = normalizeAgentOptions(*req.AgentOptions, s.canonicalAgentOptionKeys)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, codeInvalidArgument, "agentOptions must be a JSON object", map[string]any{"field": "agentOptions"})
+			writeInvalidAgentOptions(w, err)
+			return
+		}
+		if err := s.validateThreadModelID(r.Context(), thread.AgentID, agentOptionsJSON); err != nil {
+			writeInvalidModelID(w, thread.AgentID, err)
 			return
 		}
 
@@ -776,7 +1864,11 @@ func (s *Server) handleUpdateThread(w http.ResponseWriter, r *http.Request, clie
 				writeError(w, http.StatusNotFound, codeNotFound, "thread not found", map[string]any{})
 				return
 			}
-			writeError(w, http.StatusInternalServerError, codeInternal, "failed to update thread", map[string]any{"reason": err.Error()})
+			if errors.Is(err, storage.ErrTooLarge) {
+				writeError(w, http.StatusBadRequest, codeInvalidArgument, "title is too long", map[string]any{"field": "title", "reason": err.Error()})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, codeInternal, "failed to update thread", map[string]any{"reason": err.Error()})
 			return
 		}
 	}
@@ -787,6 +1879,10 @@ func (s *Server) handleUpdateThread(w http.ResponseWriter, r *http.Request, clie
 				writeError(w, http.StatusNotFound, codeNotFound, "thread not found", map[string]any{})
 				return
 			}
+			if errors.Is(err, storage.ErrLocked) {
+				writeOptionsLocked(w, thread.ThreadID)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, codeInternal, "failed to update thread", map[string]any{"reason": err.Error()})
 			return
 		}
@@ -858,6 +1954,29 @@ func (s *Server) handleDeleteThread(w http.ResponseWriter, r *http.Request, clie
 	})
 }
 
+// acquireClientTurn reserves one active-turn slot for clientID. It reports
+// false when the client is already at MaxActiveTurnsPerClient. Slots are
+// counted even without a limit so /v1/stats can report them.
+func (s *Server) acquireClientTurn(clientID string) bool {
+	s.clientTurnsMu.Lock()
+	defer s.clientTurnsMu.Unlock()
+	if s.maxClientTurns > 0 && s.clientTurns[clientID] >= s.maxClientTurns {
+		return false
+	}
+	s.clientTurns[clientID]++
+	return true
+}
+
+func (s *Server) releaseClientTurn(clientID string) {
+	s.clientTurnsMu.Lock()
+	defer s.clientTurnsMu.Unlock()
+	if s.clientTurns[clientID] <= 1 {
+		delete(s.clientTurns, clientID)
+		return
+	}
+	s.clientTurns[clientID]--
+}
+
 func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request, clientID, threadID string) {
 	if err := requireMethod(r, http.MethodPost); err != nil {
 		writeMethodNotAllowed(w, r)
@@ -870,7 +1989,26 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	debugPrompt := parseBoolQuery(r, "debugPrompt")
+	if debugPrompt && !s.enableDebugEndpoints {
+		writeError(w, http.StatusForbidden, codeForbidden, "debug endpoints are disabled", map[string]any{"field": "debugPrompt"})
+		return
+	}
+
+	turnDeadline, err := parseTurnDeadline(r, time.Now(), s.maxTurnDeadline)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid turn deadline", map[string]any{
+			"header": turnDeadlineHeader,
+			"reason": err.Error(),
+		})
+		return
+	}
+
 	req, err := s.decodeTurnCreateRequest(r)
+	if errors.Is(err, errInvalidInputText) {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid input", map[string]any{"field": "input", "reason": err.Error()})
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid request body", map[string]any{"reason": err.Error()})
 		return
@@ -883,10 +2021,47 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		}
 		removeStoredAttachments(req.Uploads)
 	}()
-	if !req.Stream {
+	callbackURL := strings.TrimSpace(req.CallbackURL)
+	if callbackURL != "" {
+		if len(s.webhookSecret) == 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "webhook delivery is disabled", map[string]any{"field": "callbackUrl"})
+			return
+		}
+		if err := s.validateWebhookURL(r.Context(), callbackURL); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid callbackUrl", map[string]any{
+				"field":  "callbackUrl",
+				"reason": err.Error(),
+			})
+			return
+		}
+	} else if !req.Stream {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "stream must be true", map[string]any{"field": "stream"})
 		return
 	}
+	if s.maxTurnsPerThread > 0 {
+		turnCount, err := s.store.CountTurnsByThread(r.Context(), thread.ThreadID, false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "failed to count thread turns", map[string]any{"reason": err.Error()})
+			return
+		}
+		if turnCount >= s.maxTurnsPerThread {
+			writeError(w, http.StatusConflict, codeConflict, "thread reached its turn limit; start a new thread", map[string]any{
+				"threadId": thread.ThreadID,
+				"turns":    turnCount,
+				"limit":    s.maxTurnsPerThread,
+				"hint":     "compact this thread to keep a summary of it, then continue in a new thread",
+			})
+			return
+		}
+	}
+	req.Prompt, err = s.transformTurnInput(r.Context(), thread, req.Prompt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "input rejected by transform", map[string]any{
+			"field":  "input",
+			"reason": err.Error(),
+		})
+		return
+	}
 	if len(req.Prompt.Content) == 0 {
 		writeError(w, http.StatusBadRequest, codeInvalidArgument, "input or attachments are required", map[string]any{
 			"fields": []string{"input", "attachments"},
@@ -894,7 +2069,7 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	injectedPrompt, err := s.buildInjectedPrompt(r.Context(), thread, req.Prompt)
+	injectedPrompt, promptInfo, err := s.buildInjectedPromptWithInfo(r.Context(), thread, req.Prompt)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to build context window", map[string]any{
 			"reason": err.Error(),
@@ -902,111 +2077,391 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	turnID := newTurnID()
+	// With EmitTurnAccepted the stream opens before the agent is resolved,
+	// so later failures can only be reported as an SSE error event.
+	var streamWriter *sse.Writer
+	var streamOpenedAt time.Time
+	if s.emitTurnAccepted && callbackURL == "" {
+		streamWriter, err = sse.NewWriterWithOptions(w, s.sseFlush)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL", "SSE is not supported by response writer", map[string]any{})
+			return
+		}
+		streamOpenedAt = time.Now()
+		s.activeStreams.Add(1)
+		defer s.activeStreams.Add(-1)
+		defer streamWriter.Close()
+		w.WriteHeader(http.StatusOK)
+		if err := streamWriter.Event(eventTypeTurnAccepted, map[string]any{
+			"threadId": thread.ThreadID,
+			"turnId":   turnID,
+		}); err != nil {
+			return
+		}
+	}
+	failTurn := func(status int, code, message string, details map[string]any) {
+		if streamWriter == nil {
+			writeError(w, status, code, message, details)
+			return
+		}
+		_ = streamWriter.Event("error", map[string]any{
+			"turnId":  turnID,
+			"status":  status,
+			"code":    code,
+			"message": message,
+			"details": details,
+		})
+	}
+
 	streamAgent, err := s.resolveTurnAgent(thread)
 	if err != nil {
-		writeError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to resolve agent provider", map[string]any{
+		failTurn(http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to resolve agent provider", map[string]any{
 			"agent":  thread.AgentID,
 			"reason": err.Error(),
 		})
 		return
 	}
 
-	turnID := newTurnID()
 	turnSessionID := threadSessionID(thread.AgentOptionsJSON)
-	turnCtx, cancelTurn := context.WithCancel(r.Context())
+	// Webhook and background turns outlive the request, so they must not
+	// inherit its cancellation.
+	turnBaseCtx := r.Context()
+	if callbackURL != "" || req.Background {
+		turnBaseCtx = context.WithoutCancel(r.Context())
+	}
+	turnCtx, cancelTurn := context.WithCancel(turnBaseCtx)
+	if !turnDeadline.IsZero() {
+		deadlineCtx, cancelDeadline := context.WithDeadlineCause(turnCtx, turnDeadline, errTurnDeadlineExceeded)
+		cancelParent := cancelTurn
+		turnCtx, cancelTurn = deadlineCtx, func() {
+			cancelDeadline()
+			cancelParent()
+		}
+	}
 	persistCtx := context.WithoutCancel(r.Context())
+	if used, over, err := s.clientOverQuota(r.Context(), clientID); err != nil {
+		cancelTurn()
+		failTurn(http.StatusInternalServerError, codeInternal, "failed to load client usage", map[string]any{"reason": err.Error()})
+		return
+	} else if over {
+		cancelTurn()
+		failTurn(http.StatusTooManyRequests, codeQuotaExceeded, "client stored data quota exceeded", map[string]any{
+			"clientId":    clientID,
+			"storedBytes": used,
+			"limit":       s.maxClientStoredBytes,
+		})
+		return
+	}
+	if !s.acquireClientTurn(clientID) {
+		cancelTurn()
+		failTurn(http.StatusTooManyRequests, codeBusy, "client has too many active turns", map[string]any{
+			"clientId": clientID,
+			"limit":    s.maxClientTurns,
+		})
+		return
+	}
 	if err := s.turns.Activate(thread.ThreadID, turnSessionID, turnID, cancelTurn); err != nil {
+		cancelTurn()
+		s.releaseClientTurn(clientID)
 		if errors.Is(err, runtime.ErrActiveTurnExists) {
-			writeError(w, http.StatusConflict, "CONFLICT", "session already has an active turn", map[string]any{
+			failTurn(http.StatusConflict, "CONFLICT", "session already has an active turn", map[string]any{
 				"threadId":  thread.ThreadID,
 				"sessionId": turnSessionID,
 			})
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to activate turn", map[string]any{"reason": err.Error()})
+		failTurn(http.StatusInternalServerError, "INTERNAL", "failed to activate turn", map[string]any{"reason": err.Error()})
 		return
 	}
-	defer func() {
+	run := &turnExecution{
+		thread:      thread,
+		turnID:      turnID,
+		sessionID:   turnSessionID,
+		ctx:         turnCtx,
+		persistCtx:  persistCtx,
+		agent:       streamAgent,
+		prompt:      injectedPrompt,
+		debugPrompt: debugPrompt,
+	}
+	if s.emitTurnContext {
+		run.turnContext = s.turnContextPayload(thread, turnID, streamAgent, req.Prompt, injectedPrompt, promptInfo)
+	}
+	release := func() {
 		cancelTurn()
-		s.turns.Release(thread.ThreadID, turnSessionID, turnID)
+		s.turns.Release(thread.ThreadID, run.sessionID, turnID)
+		s.releaseClientTurn(clientID)
+	}
+	detached := false
+	defer func() {
+		if !detached {
+			release()
+		}
 	}()
 	if err := s.syncThreadConfigSelections(r.Context(), thread, streamAgent); err != nil {
-		writeError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to sync thread config options", map[string]any{
+		failTurn(http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to sync thread config options", map[string]any{
 			"threadId": thread.ThreadID,
 			"reason":   err.Error(),
 		})
 		return
 	}
 
+	promptText := ""
+	if s.persistPrompts {
+		promptText = injectedPrompt.Text()
+	}
 	if _, err := s.store.CreateTurn(r.Context(), storage.CreateTurnParams{
 		TurnID:      turnID,
 		ThreadID:    thread.ThreadID,
 		RequestText: req.Prompt.LegacyText(),
 		Status:      "running",
 		IsInternal:  false,
+		PromptText:  promptText,
+		ClientID:    clientID,
 	}); err != nil {
-		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to create turn", map[string]any{"reason": err.Error()})
+		failTurn(http.StatusInternalServerError, "INTERNAL", "failed to create turn", map[string]any{"reason": err.Error()})
 		return
 	}
 	if err := s.persistTurnAttachments(persistCtx, turnID, req.Uploads); err != nil {
 		s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
-		writeError(w, http.StatusInternalServerError, codeInternal, "failed to persist turn attachments", map[string]any{
+		failTurn(http.StatusInternalServerError, codeInternal, "failed to persist turn attachments", map[string]any{
 			"reason": err.Error(),
 		})
 		return
 	}
 	keepUploads = true
 
-	streamWriter, err := sse.NewWriter(w)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "INTERNAL", "SSE is not supported by response writer", map[string]any{})
-		return
-	}
-
-	aggregated := strings.Builder{}
-
-	emit := func(eventType string, payload map[string]any) error {
-		dataJSON, marshalErr := json.Marshal(payload)
-		if marshalErr != nil {
-			return marshalErr
+	if req.Prompt.HasResourceLinks() {
+		dataJSON, marshalErr := json.Marshal(req.Prompt.EventPayload(turnID))
+		if marshalErr == nil {
+			_, err = s.store.AppendEvent(persistCtx, turnID, eventTypeUserPrompt, string(dataJSON))
+		} else {
+			err = marshalErr
 		}
-		if _, appendErr := s.store.AppendEvent(persistCtx, turnID, eventType, string(dataJSON)); appendErr != nil {
-			return appendErr
+		if err != nil {
+			s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
+			failTurn(http.StatusInternalServerError, codeInternal, "failed to persist user prompt", map[string]any{"reason": err.Error()})
+			return
 		}
-		return streamWriter.Event(eventType, payload)
 	}
-	appendOnlyEvent := func(eventType string, payload map[string]any) error {
-		dataJSON, marshalErr := json.Marshal(payload)
-		if marshalErr != nil {
-			return marshalErr
-		}
-		_, appendErr := s.store.AppendEvent(persistCtx, turnID, eventType, string(dataJSON))
-		return appendErr
+
+	if callbackURL != "" {
+		sink := s.newWebhookSink(callbackURL, thread.ThreadID, turnID)
+		detached = true
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"threadId": thread.ThreadID,
+			"turnId":   turnID,
+			"status":   "accepted",
+		})
+		// Hold the store gate for the detached turn so SwapStore waits for it
+		// like any in-flight request.
+		s.storeGate.RLock()
+		go func() {
+			defer s.storeGate.RUnlock()
+			defer release()
+			defer sink.Close()
+			s.executeTurn(run, sink)
+		}()
+		return
 	}
 
-	if req.Prompt.HasResourceLinks() {
-		if err := appendOnlyEvent(eventTypeUserPrompt, req.Prompt.EventPayload(turnID)); err != nil {
+	if streamWriter == nil {
+		streamWriter, err = sse.NewWriterWithOptions(w, s.sseFlush)
+		if err != nil {
 			s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
-			writeError(w, http.StatusInternalServerError, codeInternal, "failed to persist user prompt", map[string]any{"reason": err.Error()})
+			writeError(w, http.StatusInternalServerError, "INTERNAL", "SSE is not supported by response writer", map[string]any{})
 			return
 		}
+		streamOpenedAt = time.Now()
+		s.activeStreams.Add(1)
+		defer s.activeStreams.Add(-1)
+		defer streamWriter.Close()
+		w.WriteHeader(http.StatusOK)
+	}
+	if s.auditStreams {
+		s.auditStreamOpened(persistCtx, turnID, clientID, streamOpenedAt)
+		defer s.auditStreamClosed(persistCtx, turnID, clientID, streamOpenedAt, streamWriter)
+	}
+	// A background turn runs even if the client left during the replay.
+	if err := s.replayRecentEvents(r.Context(), streamWriter, thread.ThreadID, turnID); err != nil && !req.Background {
+		s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if req.Background {
+		sink := &detachableSink{sink: streamWriter}
+		detached = true
+		s.storeGate.RLock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer s.storeGate.RUnlock()
+			defer release()
+			s.executeTurn(run, sink)
+		}()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			// The turn keeps running and persisting; only the live stream stops.
+			sink.detach()
+			s.logger.Info("turn.background_detached", "threadId", thread.ThreadID, "turnId", turnID)
+		}
+		return
+	}
+
+	s.executeTurn(run, streamWriter)
+}
+
+// detachableSink forwards events to the SSE stream of a background turn until
+// the client goes away, then drops them. Write errors detach instead of
+// failing the turn.
+type detachableSink struct {
+	mu       sync.Mutex
+	sink     turnEventSink
+	detached bool
+}
+
+func (d *detachableSink) Event(eventType string, payload any) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.detached {
+		return nil
+	}
+	if err := d.sink.Event(eventType, payload); err != nil {
+		d.detached = true
+	}
+	return nil
+}
+
+// detach stops forwarding; it waits for an in-flight write to finish so the
+// response writer is not used after the handler returns.
+func (d *detachableSink) detach() {
+	d.mu.Lock()
+	d.detached = true
+	d.mu.Unlock()
+}
+
+// turnEventSink receives the live events of one user turn (SSE stream or
+// webhook delivery). Events are persisted separately.
+type turnEventSink interface {
+	Event(eventType string, payload any) error
+}
+
+// turnExecution carries one activated user turn through executeTurn.
+// sessionID is updated when the agent binds a session mid-turn.
+type turnExecution struct {
+	thread      storage.Thread
+	turnID      string
+	sessionID   string
+	ctx         context.Context
+	persistCtx  context.Context
+	agent       agents.Streamer
+	prompt      agents.Prompt
+	debugPrompt bool
+	// turnContext is the turn_context payload, nil unless EmitTurnContext.
+	turnContext map[string]any
+}
+
+// executeTurn streams one activated turn to sink, persists its events, and
+// finalizes the turn row.
+func (s *Server) executeTurn(run *turnExecution, sink turnEventSink) {
+	thread := run.thread
+	turnID := run.turnID
+	turnCtx := run.ctx
+	persistCtx := run.persistCtx
+	startedAt := time.Now()
+
+	aggregated := strings.Builder{}
+	deltaCount := 0
+	var attemptOutput atomic.Bool
+	var steps *turnStepTracker
+	if s.emitTurnSteps {
+		steps = newTurnStepTracker()
+	}
+
+	writeEvent := func(eventType string, payload map[string]any) error {
+		if _, neutral := turnRetryNeutralEvents[eventType]; !neutral {
+			attemptOutput.Store(true)
+		}
+		steps.tag(eventType, payload)
+		if s.recordDeltaOffsets && (eventType == "message_delta" || eventType == eventTypeReasoningDelta) {
+			payload["offsetMs"] = float64(time.Since(startedAt).Microseconds()) / 1000
+		}
+		delivery := s.eventDeliveryFor(eventType)
+		if delivery.Persist {
+			dataJSON, marshalErr := json.Marshal(payload)
+			if marshalErr != nil {
+				return marshalErr
+			}
+			if faultErr := s.injectFault(persistCtx, faultEventPersist); faultErr != nil {
+				return faultErr
+			}
+			if _, appendErr := s.store.AppendEvent(persistCtx, turnID, eventType, string(dataJSON)); appendErr != nil {
+				return appendErr
+			}
+		}
+		if !delivery.Stream {
+			return nil
+		}
+		if faultErr := s.injectFault(turnCtx, faultStreamWrite); faultErr != nil {
+			return faultErr
+		}
+		return sink.Event(eventType, payload)
+	}
+	// Provider callbacks go through emit. Once a cancelled stream is
+	// abandoned, late callbacks are dropped so nothing is written after the
+	// turn is finalized.
+	// Any text the delta pacer is still holding is flushed first, so it
+	// reaches the client ahead of the event that followed it.
+	var (
+		emitMu          sync.Mutex
+		streamAbandoned bool
+		flushDeltas     func() error
+	)
+	emit := func(eventType string, payload map[string]any) error {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		if streamAbandoned {
+			return nil
+		}
+		if flushDeltas != nil {
+			if err := flushDeltas(); err != nil {
+				return err
+			}
+		}
+		return writeEvent(eventType, payload)
+	}
+	var cancelForced atomic.Bool
 
 	turnCtx = agents.WithPermissionHandler(turnCtx, func(permissionCtx context.Context, req agents.PermissionRequest) (agents.PermissionResponse, error) {
 		permissionID := s.nextPermissionID(req.RequestID)
 		pending := newPendingPermission(req.Options)
-		s.registerPermission(permissionID, pending)
+		pending.turnID = turnID
+		if reason, limit := s.registerPermission(permissionID, pending); reason != "" {
+			s.logger.Warn("permission.auto_declined",
+				"threadId", thread.ThreadID,
+				"turnId", turnID,
+				"requestId", req.RequestID,
+				"reason", reason,
+				"limit", limit,
+			)
+			if err := emit("permission_auto_declined", s.withPermissionText(map[string]any{
+				"turnId":    turnID,
+				"requestId": req.RequestID,
+				"reason":    reason,
+				"limit":     limit,
+			}, req)); err != nil {
+				return permissionFailClosedResponse(), err
+			}
+			return permissionFailClosedResponse(), nil
+		}
 		defer s.unregisterPermission(permissionID, pending)
 
-		payload := map[string]any{
+		payload := s.withPermissionText(map[string]any{
 			"turnId":       turnID,
 			"permissionId": permissionID,
-			"approval":     req.Approval,
-			"command":      req.Command,
 			"requestId":    req.RequestID,
-		}
+		}, req)
 		if len(req.Options) > 0 {
 			payload["options"] = req.Options
 		}
@@ -1028,6 +2483,11 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 			"entries": payloadEntries,
 		})
 	})
+	turnCtx = agents.WithProcessLimiter(turnCtx, s.processLimiter)
+	turnCtx = agents.WithCancelForcedHandler(turnCtx, func(context.Context) error {
+		cancelForced.Store(true)
+		return nil
+	})
 	turnCtx = agents.WithReasoningHandler(turnCtx, func(reasoningCtx context.Context, delta string) error {
 		_ = reasoningCtx
 		return emit(eventTypeReasoningDelta, map[string]any{
@@ -1035,6 +2495,42 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 			"delta":  delta,
 		})
 	})
+	if s.enableAgentFileSystem {
+		if access := ThreadFileSystemAccess(thread.AgentOptionsJSON); access != "" {
+			turnCtx = agents.WithFileSystemHandler(turnCtx, &threadFileSystem{
+				root:       thread.CWD,
+				allowWrite: access == fileSystemAccessWrite,
+				logger:     s.logger,
+				threadID:   thread.ThreadID,
+				turnID:     turnID,
+			})
+		}
+	}
+	var turnUsage agents.Usage
+	var turnUsageMu sync.Mutex
+	turnCtx = agents.WithUsageHandler(turnCtx, func(_ context.Context, usage agents.Usage) error {
+		turnUsageMu.Lock()
+		turnUsage.PromptTokens += usage.PromptTokens
+		turnUsage.CompletionTokens += usage.CompletionTokens
+		turnUsageMu.Unlock()
+		return nil
+	})
+	var rawStopReason atomic.Value
+	if s.persistRawStopReasons {
+		turnCtx = agents.WithRawStopReasonHandler(turnCtx, func(_ context.Context, reason string) error {
+			rawStopReason.Store(reason)
+			return nil
+		})
+	}
+	var pendingDeltaMetadata agents.DeltaMetadata
+	var deltaMetadataMu sync.Mutex
+	turnCtx = agents.WithDeltaMetadataHandler(turnCtx, func(metadataCtx context.Context, meta agents.DeltaMetadata) error {
+		_ = metadataCtx
+		deltaMetadataMu.Lock()
+		pendingDeltaMetadata = meta
+		deltaMetadataMu.Unlock()
+		return nil
+	})
 	turnCtx = agents.WithSessionInfoHandler(turnCtx, func(sessionInfoCtx context.Context, update agents.SessionInfoUpdate) error {
 		_ = sessionInfoCtx
 		return emit(eventTypeSessionInfoUpdate, map[string]any{
@@ -1089,7 +2585,7 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 				)
 			}
 		} else {
-			turnSessionID = sessionID
+			run.sessionID = sessionID
 		}
 
 		nextAgentOptionsJSON, changed, err := withThreadSessionID(thread.AgentOptionsJSON, sessionID)
@@ -1100,7 +2596,7 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 				"reason", err.Error(),
 			)
 		} else if changed {
-			if err := s.store.UpdateThreadAgentOptions(persistCtx, thread.ThreadID, nextAgentOptionsJSON); err != nil {
+			if err := s.store.UpdateThreadAgentState(persistCtx, thread.ThreadID, nextAgentOptionsJSON); err != nil {
 				s.logger.Warn("thread.session_bind_persist_failed",
 					"threadId", thread.ThreadID,
 					"agent", thread.AgentID,
@@ -1137,11 +2633,121 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
 		return
 	}
+	if run.turnContext != nil {
+		if err := emit(eventTypeTurnContext, run.turnContext); err != nil {
+			s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
+			return
+		}
+	}
+	if run.debugPrompt {
+		// Stream-only: the prompt embeds thread history, so it is never persisted.
+		promptText := run.prompt.Text()
+		if err := sink.Event("debug_prompt", map[string]any{
+			"turnId":  turnID,
+			"prompt":  promptText,
+			"chars":   len([]rune(promptText)),
+			"content": run.prompt.ACPContent(),
+		}); err != nil {
+			s.finalizeTurnWithBestEffort(persistCtx, turnID, "failed", "error", "", err.Error())
+			return
+		}
+	}
 
-	stopReason, streamErr := agents.StreamPrompt(turnCtx, streamAgent, injectedPrompt, func(delta string) error {
+	outputFilter := s.newOutputFilter(persistCtx, thread)
+	emitDelta := func(delta string, meta agents.DeltaMetadata) error {
+		if delta == "" {
+			return nil
+		}
 		aggregated.WriteString(delta)
-		return emit("message_delta", map[string]any{"turnId": turnID, "delta": delta})
-	})
+		deltaCount++
+		payload := map[string]any{"turnId": turnID, "delta": delta}
+		if meta.ContentType != "" {
+			payload["contentType"] = meta.ContentType
+		}
+		if meta.Lang != "" {
+			payload["lang"] = meta.Lang
+		}
+		return writeEvent("message_delta", payload)
+	}
+	pacer := newDeltaPacer(s.maxDeltaRate, emitDelta)
+	flushDeltas = pacer.flush
+	var (
+		stopReason agents.StopReason
+		streamErr  error
+		abandoned  bool
+	)
+	// Retries happen here only; providers must not restart on their own too.
+	streamCtx := turnCtx
+	if s.turnRetry.MaxAttempts > 1 {
+		streamCtx = agents.WithCallerRetries(turnCtx)
+	}
+	for attempt := 1; ; attempt++ {
+		attemptOutput.Store(false)
+		result := s.streamTurnPrompt(streamCtx, run.agent, run.prompt, func(delta string) error {
+			if delta != "" {
+				attemptOutput.Store(true)
+			}
+			deltaMetadataMu.Lock()
+			meta := pendingDeltaMetadata
+			pendingDeltaMetadata = agents.DeltaMetadata{}
+			deltaMetadataMu.Unlock()
+			return pacer.push(outputFilter.push(delta), meta)
+		})
+		stopReason, streamErr, abandoned = result.stopReason, result.err, result.abandoned
+		if abandoned {
+			emitMu.Lock()
+			streamAbandoned = true
+			emitMu.Unlock()
+			s.logger.Warn("turn.cancel_unconfirmed",
+				"threadId", thread.ThreadID,
+				"turnId", turnID,
+				"waitMs", s.cancelConfirmTimeout.Milliseconds(),
+			)
+			// The abandoned stream still owns the provider connection;
+			// replace the agent so the next turn cannot overlap it.
+			s.evictTurnAgent(thread, "cancel_unconfirmed")
+			break
+		}
+		if !s.shouldRetryTurn(turnCtx, attempt, streamErr, attemptOutput.Load()) {
+			break
+		}
+		delay := s.turnRetry.retryDelay(attempt + 1)
+		s.logger.Warn("turn.retry",
+			"threadId", thread.ThreadID,
+			"turnId", turnID,
+			"attempt", attempt+1,
+			"reason", streamErr.Error(),
+		)
+		if err := emit("turn_retry", map[string]any{
+			"turnId":      turnID,
+			"attempt":     attempt + 1,
+			"maxAttempts": s.turnRetry.MaxAttempts,
+			"delayMs":     delay.Milliseconds(),
+			"message":     streamErr.Error(),
+		}); err != nil {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-turnCtx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if turnCtx.Err() != nil {
+			stopReason, streamErr = agents.StopReasonCancelled, nil
+			break
+		}
+	}
+	if err := pacer.push(outputFilter.flush(), agents.DeltaMetadata{}); err != nil && streamErr == nil {
+		streamErr = err
+	}
+	if err := pacer.flush(); err != nil && streamErr == nil {
+		streamErr = err
+	}
+	if (streamErr != nil || stopReason == agents.StopReasonCancelled) && errors.Is(context.Cause(turnCtx), errTurnDeadlineExceeded) {
+		// The provider saw a plain cancel; report the client deadline.
+		streamErr = errTurnDeadlineExceeded
+	}
 
 	finalStatus := "completed"
 	finalReason := string(agents.StopReasonEndTurn)
@@ -1151,25 +2757,319 @@ func (s *Server) handleCreateTurnStream(w http.ResponseWriter, r *http.Request,
 		finalStatus = "failed"
 		finalReason = "error"
 		errorMessage = streamErr.Error()
-		_ = emit("error", map[string]any{
-			"turnId":  turnID,
-			"code":    classifyStreamErrorCode(streamErr),
-			"message": streamErr.Error(),
-		})
+		_ = writeEvent("error", s.streamErrorPayload(thread.ThreadID, turnID, streamErr))
 	} else if stopReason == agents.StopReasonCancelled {
 		finalStatus = "cancelled"
 		finalReason = string(agents.StopReasonCancelled)
 	}
 
-	if err := emit("turn_completed", map[string]any{"turnId": turnID, "stopReason": finalReason}); err != nil && errorMessage == "" {
+	completedPayload := map[string]any{"turnId": turnID, "stopReason": finalReason}
+	if finalStatus == "cancelled" {
+		// Confirmed means the provider returned within cancelConfirmTimeout
+		// without having to tear the agent down.
+		completedPayload["cancelConfirmed"] = !abandoned && !cancelForced.Load()
+	}
+	if s.emitEmptyResponse && finalStatus == "completed" && aggregated.Len() == 0 {
+		completedPayload["emptyResponse"] = true
+		_ = writeEvent(eventTypeEmptyResponse, map[string]any{
+			"turnId":     turnID,
+			"stopReason": finalReason,
+		})
+	}
+	if err := writeEvent("turn_completed", completedPayload); err != nil && errorMessage == "" {
 		errorMessage = err.Error()
 		if finalStatus == "completed" {
 			finalStatus = "failed"
 			finalReason = "error"
 		}
 	}
+	if s.emitTurnSummary {
+		// Stream-only trailer: every field is derivable from history.
+		_ = sink.Event("turn_summary", map[string]any{
+			"turnId":      turnID,
+			"deltaCount":  deltaCount,
+			"totalChars":  utf8.RuneCountInString(aggregated.String()),
+			"durationMs":  time.Since(startedAt).Milliseconds(),
+			"stopReason":  finalReason,
+			"finalStatus": finalStatus,
+		})
+	}
 
-	s.finalizeTurnWithBestEffort(persistCtx, turnID, finalStatus, finalReason, aggregated.String(), errorMessage)
+	turnUsageMu.Lock()
+	usage := turnUsage
+	turnUsageMu.Unlock()
+	rawReason, _ := rawStopReason.Load().(string)
+	_ = s.store.FinalizeTurn(persistCtx, storage.FinalizeTurnParams{
+		TurnID:           turnID,
+		ResponseText:     aggregated.String(),
+		Status:           finalStatus,
+		StopReason:       finalReason,
+		RawStopReason:    rawReason,
+		ErrorMessage:     errorMessage,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	})
+}
+
+// turnStreamResult is the outcome of one provider stream attempt.
+type turnStreamResult struct {
+	stopReason agents.StopReason
+	err        error
+	// abandoned is set when the provider did not return within
+	// cancelConfirmTimeout after the turn was cancelled.
+	abandoned bool
+}
+
+// streamTurnPrompt runs one provider stream. After ctx is cancelled the
+// provider gets cancelConfirmTimeout to return; past that the stream is
+// abandoned and its later deltas are rejected.
+func (s *Server) streamTurnPrompt(ctx context.Context, agent agents.Streamer, prompt agents.Prompt, onDelta func(string) error) turnStreamResult {
+	var (
+		deltaMu   sync.Mutex
+		abandoned bool
+	)
+	done := make(chan turnStreamResult, 1)
+	go func() {
+		if err := s.injectFault(ctx, faultAgentStream); err != nil {
+			done <- turnStreamResult{err: err}
+			return
+		}
+		stopReason, err := agents.StreamPrompt(ctx, agent, prompt, func(delta string) error {
+			deltaMu.Lock()
+			defer deltaMu.Unlock()
+			if abandoned {
+				return context.Canceled
+			}
+			return onDelta(delta)
+		})
+		done <- turnStreamResult{stopReason: stopReason, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(s.cancelConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result
+	case <-timer.C:
+		deltaMu.Lock()
+		abandoned = true
+		deltaMu.Unlock()
+		return turnStreamResult{stopReason: agents.StopReasonCancelled, abandoned: true}
+	}
+}
+
+// shouldRetryTurn reports whether a failed attempt may be retried under the
+// configured policy.
+func (s *Server) shouldRetryTurn(ctx context.Context, attempt int, streamErr error, producedOutput bool) bool {
+	if streamErr == nil || producedOutput || attempt >= s.turnRetry.MaxAttempts {
+		return false
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	return s.turnRetry.Retryable(streamErr)
+}
+
+// sseImmediateEvents bypass SSE flush batching: clients need the turn id to
+// cancel, must answer permissions promptly, and must see terminal events.
+var sseImmediateEvents = []string{eventTypeTurnAccepted, "turn_started", "permission_required", "error", "turn_completed"}
+
+func (p TurnRetryPolicy) withDefaults() TurnRetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = defaultTurnRetryBackoff
+	}
+	if p.Retryable == nil {
+		p.Retryable = DefaultTurnRetryable
+	}
+	return p
+}
+
+// retryDelay returns the backoff before attempt (2-based).
+func (p TurnRetryPolicy) retryDelay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 2; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// turnRetryNeutralEvents do not count as visible output when deciding
+// whether a failed attempt may be retried.
+var turnRetryNeutralEvents = map[string]struct{}{
+	"turn_started":             {},
+	eventTypeTurnContext:       {},
+	"turn_retry":               {},
+	"session_bound":            {},
+	eventTypeSessionInfoUpdate: {},
+}
+
+func cloneEventDelivery(in map[string]EventDelivery) map[string]EventDelivery {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]EventDelivery, len(in))
+	for eventType, delivery := range in {
+		out[strings.TrimSpace(eventType)] = delivery
+	}
+	return out
+}
+
+// eventDeliveryFor returns the configured delivery for one turn event type.
+func (s *Server) eventDeliveryFor(eventType string) EventDelivery {
+	if delivery, ok := s.eventDelivery[eventType]; ok {
+		return delivery
+	}
+	return EventDelivery{Stream: true, Persist: true}
+}
+
+// outputFilter applies the configured OutputTransform to a stream of deltas,
+// withholding a trailing window so patterns split across deltas still match.
+type outputFilter struct {
+	transform func(string) string
+	holdBack  int
+	pending   string
+}
+
+func (s *Server) newOutputFilter(ctx context.Context, thread storage.Thread) *outputFilter {
+	filter := &outputFilter{holdBack: s.outputTransformHoldBack}
+	if s.outputTransform != nil {
+		filter.transform = func(text string) string {
+			return s.outputTransform(ctx, thread, text)
+		}
+	}
+	return filter
+}
+
+// push returns the text that is safe to emit after adding delta.
+func (f *outputFilter) push(delta string) string {
+	if f.transform == nil {
+		return delta
+	}
+	text := f.transform(f.pending + delta)
+	if f.holdBack <= 0 {
+		f.pending = ""
+		return text
+	}
+	runes := []rune(text)
+	if len(runes) <= f.holdBack {
+		f.pending = text
+		return ""
+	}
+	cut := len(runes) - f.holdBack
+	f.pending = string(runes[cut:])
+	return string(runes[:cut])
+}
+
+// flush returns any withheld text at the end of the turn.
+func (f *outputFilter) flush() string {
+	if f.transform == nil || f.pending == "" {
+		return ""
+	}
+	text := f.transform(f.pending)
+	f.pending = ""
+	return text
+}
+
+// deltaPacer limits message_delta emission to one event per interval.
+// Deltas arriving sooner are merged into the pending text, which a timer
+// emits once the interval has passed; flush emits whatever is left.
+type deltaPacer struct {
+	interval time.Duration
+	emit     func(string, agents.DeltaMetadata) error
+
+	mu      sync.Mutex
+	last    time.Time
+	pending string
+	meta    agents.DeltaMetadata
+	timer   *time.Timer
+	// err is the first failed timer emission, reported by the next push.
+	err error
+}
+
+func newDeltaPacer(rate int, emit func(string, agents.DeltaMetadata) error) *deltaPacer {
+	pacer := &deltaPacer{emit: emit}
+	if rate > 0 {
+		pacer.interval = time.Second / time.Duration(rate)
+	}
+	return pacer
+}
+
+func (p *deltaPacer) push(delta string, meta agents.DeltaMetadata) error {
+	if p.interval <= 0 {
+		return p.emit(delta, meta)
+	}
+	if delta == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	// Different metadata starts a new block; keep it on its own event.
+	if p.pending != "" && meta != p.meta {
+		if err := p.emitPendingLocked(); err != nil {
+			return err
+		}
+	}
+	if p.pending == "" {
+		p.meta = meta
+	}
+	p.pending += delta
+
+	if wait := p.interval - time.Since(p.last); wait > 0 {
+		if p.timer == nil {
+			p.timer = time.AfterFunc(wait, p.emitFromTimer)
+		}
+		return nil
+	}
+	return p.emitPendingLocked()
+}
+
+func (p *deltaPacer) emitFromTimer() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timer = nil
+	if p.err == nil {
+		p.err = p.emitPendingLocked()
+	}
+}
+
+// flush emits any held text; call it before emitting any other event and
+// once the agent stream has ended.
+func (p *deltaPacer) flush() error {
+	if p.interval <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.emitPendingLocked()
+}
+
+func (p *deltaPacer) emitPendingLocked() error {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if p.pending == "" {
+		return nil
+	}
+	text, meta := p.pending, p.meta
+	p.pending, p.meta = "", agents.DeltaMetadata{}
+	p.last = time.Now()
+	return p.emit(text, meta)
 }
 
 func (s *Server) persistTurnAttachments(ctx context.Context, turnID string, uploads []storedTurnAttachment) error {
@@ -1206,6 +3106,13 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 		writeError(w, http.StatusNotFound, "NOT_FOUND", "thread not found", map[string]any{})
 		return
 	}
+	if s.agentCapabilities[thread.AgentID].DisableCompact {
+		writeError(w, http.StatusForbidden, codeForbidden, "compaction is disabled for this agent", map[string]any{
+			"agent":  thread.AgentID,
+			"reason": "compact_disabled",
+		})
+		return
+	}
 
 	var req struct {
 		MaxSummaryChars int `json:"maxSummaryChars"`
@@ -1222,27 +3129,12 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 		summaryLimit = s.compactMaxChars
 	}
 
-	streamAgent, err := s.resolveTurnAgent(thread)
-	if err != nil {
-		writeError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to resolve agent provider", map[string]any{
-			"agent":  thread.AgentID,
-			"reason": err.Error(),
-		})
-		return
-	}
-
-	compactPrompt, err := s.buildCompactPrompt(r.Context(), thread, summaryLimit)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to build compact prompt", map[string]any{
-			"reason": err.Error(),
-		})
-		return
-	}
-
+	// Activate before reading turns so a compact that waited for a running
+	// turn summarizes that turn too.
 	turnID := newTurnID()
 	turnCtx, cancelTurn := context.WithCancel(r.Context())
 	persistCtx := context.WithoutCancel(r.Context())
-	if err := s.turns.ActivateThreadExclusive(thread.ThreadID, turnID, cancelTurn); err != nil {
+	if err := s.turns.ActivateThreadExclusiveWait(r.Context(), thread.ThreadID, turnID, cancelTurn, s.compactActivateWait); err != nil {
 		if errors.Is(err, runtime.ErrActiveTurnExists) {
 			writeError(w, http.StatusConflict, "CONFLICT", "thread already has an active turn", map[string]any{"threadId": thread.ThreadID})
 			return
@@ -1254,6 +3146,41 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 		cancelTurn()
 		s.turns.ReleaseThreadExclusive(thread.ThreadID, turnID)
 	}()
+	if s.compactActivateWait > 0 {
+		// The summary may have changed while waiting.
+		if fresh, ok := s.getAccessibleThread(r.Context(), threadID); ok {
+			thread = fresh
+		}
+	}
+
+	recentTurns, err := s.loadCompactTurns(r.Context(), thread.ThreadID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to build compact prompt", map[string]any{
+			"reason": err.Error(),
+		})
+		return
+	}
+	if !s.compactEmptyThreads && len(recentTurns) == 0 && strings.TrimSpace(thread.Summary) == "" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"threadId":     thread.ThreadID,
+			"status":       "skipped",
+			"summary":      thread.Summary,
+			"summaryChars": runeLen(thread.Summary),
+			"note":         "nothing to compact: thread has no summary and no visible turns",
+		})
+		return
+	}
+
+	streamAgent, err := s.resolveTurnAgent(thread)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, codeUpstreamUnavailable, "failed to resolve agent provider", map[string]any{
+			"agent":  thread.AgentID,
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	compactPrompt := s.buildCompactPrompt(thread, recentTurns, summaryLimit)
 
 	if _, err := s.store.CreateTurn(r.Context(), storage.CreateTurnParams{
 		TurnID:      turnID,
@@ -1293,6 +3220,7 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 			"entries": payloadEntries,
 		})
 	})
+	turnCtx = agents.WithProcessLimiter(turnCtx, s.processLimiter)
 	turnCtx = agents.WithReasoningHandler(turnCtx, func(reasoningCtx context.Context, delta string) error {
 		_ = reasoningCtx
 		return appendOnlyEvent(eventTypeReasoningDelta, map[string]any{
@@ -1330,11 +3258,7 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 		finalStatus = "failed"
 		finalReason = "error"
 		errorMessage = streamErr.Error()
-		_ = appendOnlyEvent("error", map[string]any{
-			"turnId":  turnID,
-			"code":    classifyStreamErrorCode(streamErr),
-			"message": streamErr.Error(),
-		})
+		_ = appendOnlyEvent("error", s.streamErrorPayload(thread.ThreadID, turnID, streamErr))
 	} else if stopReason == agents.StopReasonCancelled {
 		finalStatus = "cancelled"
 		finalReason = string(agents.StopReasonCancelled)
@@ -1369,6 +3293,8 @@ func (s *Server) handleCompactThread(w http.ResponseWriter, r *http.Request, cli
 				statusCode = http.StatusGatewayTimeout
 			case codeUpstreamUnavailable:
 				statusCode = http.StatusServiceUnavailable
+			case codeAgentExited, codeAgentProtocol:
+				statusCode = http.StatusBadGateway
 			}
 		}
 		writeError(w, statusCode, errorCode, "compact failed", map[string]any{
@@ -1410,6 +3336,8 @@ func (s *Server) handleCancelTurn(w http.ResponseWriter, r *http.Request, client
 		return
 	}
 
+	// Pending permissions resolve as cancelled before the turn is torn down.
+	s.cancelTurnPermissions(turnID)
 	if err := s.turns.Cancel(turnID); err != nil {
 		if errors.Is(err, runtime.ErrTurnNotActive) {
 			writeError(w, http.StatusConflict, "CONFLICT", "turn is not active", map[string]any{"turnId": turnID})
@@ -1426,6 +3354,40 @@ func (s *Server) handleCancelTurn(w http.ResponseWriter, r *http.Request, client
 	})
 }
 
+func (s *Server) handleCancelThreadTurn(w http.ResponseWriter, r *http.Request, clientID, threadID string) {
+	if err := requireMethod(r, http.MethodPost); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	thread, ok := s.getAccessibleThread(r.Context(), threadID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "thread not found", map[string]any{})
+		return
+	}
+
+	turnID, ok := s.turns.TurnIDForThread(thread.ThreadID)
+	if !ok {
+		writeError(w, http.StatusConflict, "CONFLICT", "thread has no active turn", map[string]any{"threadId": thread.ThreadID})
+		return
+	}
+	s.cancelTurnPermissions(turnID)
+	if err := s.turns.Cancel(turnID); err != nil {
+		if errors.Is(err, runtime.ErrTurnNotActive) {
+			writeError(w, http.StatusConflict, "CONFLICT", "thread has no active turn", map[string]any{"threadId": thread.ThreadID})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to cancel turn", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"turnId":   turnID,
+		"threadId": thread.ThreadID,
+		"status":   "cancelling",
+	})
+}
+
 func (s *Server) handlePermissionDecision(w http.ResponseWriter, r *http.Request, clientID, permissionID string) {
 	if err := requireMethod(r, http.MethodPost); err != nil {
 		writeMethodNotAllowed(w, r)
@@ -1467,6 +3429,20 @@ func (s *Server) handlePermissionDecision(w http.ResponseWriter, r *http.Request
 			writeError(w, http.StatusNotFound, "NOT_FOUND", "permission not found", map[string]any{})
 			return
 		}
+		if errors.Is(err, errPermissionCancelled) {
+			writeError(w, http.StatusConflict, "CONFLICT", "permission was cancelled with its turn", map[string]any{
+				"permissionId": permissionID,
+				"reason":       "cancelled",
+			})
+			return
+		}
+		if errors.Is(err, errPermissionExpired) {
+			writeError(w, http.StatusConflict, "CONFLICT", "permission expired or its turn has ended", map[string]any{
+				"permissionId": permissionID,
+				"reason":       "expired",
+			})
+			return
+		}
 		if errors.Is(err, errPermissionInvalidOption) {
 			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "optionId must match one of the advertised permission options", map[string]any{
 				"field":        "optionId",
@@ -1515,8 +3491,8 @@ func (s *Server) handleThreadHistory(w http.ResponseWriter, r *http.Request, cli
 		return
 	}
 
-	includeEvents := parseBoolQuery(r, "includeEvents")
-	includeInternal := parseBoolQuery(r, "includeInternal")
+	includeEvents := parseBoolQueryDefault(r, "includeEvents", s.historyDefaults.IncludeEvents)
+	includeInternal := parseBoolQueryDefault(r, "includeInternal", s.historyDefaults.IncludeInternal)
 	sessionID := strings.TrimSpace(r.URL.Query().Get("sessionId"))
 
 	turns, err := s.store.ListTurnsByThread(r.Context(), threadID)
@@ -1525,6 +3501,15 @@ func (s *Server) handleThreadHistory(w http.ResponseWriter, r *http.Request, cli
 		return
 	}
 
+	var prompts map[string]string
+	if s.persistPrompts {
+		prompts, err = s.store.ListTurnPromptsByThread(r.Context(), threadID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to list history", map[string]any{"reason": err.Error()})
+			return
+		}
+	}
+
 	loadEvents := includeEvents || sessionID != ""
 	historyTurns := make([]threadHistoryTurn, 0, len(turns))
 	for _, turn := range turns {
@@ -1560,6 +3545,13 @@ func (s *Server) handleThreadHistory(w http.ResponseWriter, r *http.Request, cli
 			StopReason:   turn.StopReason,
 			ErrorMessage: turn.ErrorMessage,
 			CreatedAt:    turn.CreatedAt.UTC().Format(time.RFC3339Nano),
+
+			PromptTokens:     turn.PromptTokens,
+			CompletionTokens: turn.CompletionTokens,
+			RawStopReason:    turn.RawStopReason,
+		}
+		if s.persistPrompts {
+			respTurn.PromptText = prompts[turn.TurnID]
 		}
 		if turn.CompletedAt != nil {
 			completed := turn.CompletedAt.UTC().Format(time.RFC3339Nano)
@@ -1748,6 +3740,16 @@ func compactThreadHistoryDeltaPayload(turnID, currentDataJSON, nextDataJSON stri
 	if !threadHistoryDeltaPayloadMatchesTurn(turnID, nextPayload) {
 		return "", false, nil
 	}
+	// RecordDeltaOffsets timings are kept per delta.
+	if _, ok := currentPayload["offsetMs"]; ok {
+		return "", false, nil
+	}
+	if _, ok := nextPayload["offsetMs"]; ok {
+		return "", false, nil
+	}
+	if !threadHistoryDeltaMetadataMatches(currentPayload, nextPayload) {
+		return "", false, nil
+	}
 
 	currentPayload["delta"] = currentDelta + nextDelta
 	mergedJSON, err := json.Marshal(currentPayload)
@@ -1757,6 +3759,19 @@ func compactThreadHistoryDeltaPayload(turnID, currentDataJSON, nextDataJSON stri
 	return string(mergedJSON), true, nil
 }
 
+// threadHistoryDeltaMetadataMatches reports whether two deltas carry the
+// same contentType and lang, so merging them keeps both annotations intact.
+func threadHistoryDeltaMetadataMatches(current, next map[string]any) bool {
+	for _, key := range []string{"contentType", "lang"} {
+		currentValue, currentOK := current[key].(string)
+		nextValue, nextOK := next[key].(string)
+		if currentOK != nextOK || currentValue != nextValue {
+			return false
+		}
+	}
+	return true
+}
+
 func threadHistoryDeltaPayloadMatchesTurn(turnID string, payload map[string]any) bool {
 	value, ok := payload["turnId"]
 	if !ok {
@@ -2129,6 +4144,10 @@ func (s *Server) handleThreadConfigOptions(w http.ResponseWriter, r *http.Reques
 			"configOptions": options,
 		})
 	case http.MethodPost:
+		if thread.OptionsLocked {
+			writeOptionsLocked(w, thread.ThreadID)
+			return
+		}
 		if s.turns.IsThreadActive(thread.ThreadID) {
 			writeError(w, http.StatusConflict, codeConflict, "thread has an active turn", map[string]any{"threadId": thread.ThreadID})
 			return
@@ -2199,6 +4218,10 @@ func (s *Server) handleThreadConfigOptions(w http.ResponseWriter, r *http.Reques
 				writeError(w, http.StatusNotFound, codeNotFound, "thread not found", map[string]any{})
 				return
 			}
+			if errors.Is(err, storage.ErrLocked) {
+				writeOptionsLocked(w, thread.ThreadID)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, codeInternal, "failed to update thread", map[string]any{"reason": err.Error()})
 			return
 		}
@@ -2254,6 +4277,178 @@ func (s *Server) handleThreadSlashCommands(w http.ResponseWriter, r *http.Reques
 	})
 }
 
+const (
+	maxThreadTagRunes = 32
+	maxThreadTags     = 16
+)
+
+// normalizeThreadTag lowercases and trims one tag and checks it against the
+// allowed charset (letters, digits, '-', '_', '.', ':') and length limit.
+func normalizeThreadTag(raw string) (string, error) {
+	tag := strings.ToLower(strings.TrimSpace(raw))
+	if tag == "" {
+		return "", errors.New("tag must not be empty")
+	}
+	if utf8.RuneCountInString(tag) > maxThreadTagRunes {
+		return "", fmt.Errorf("tag must be at most %d characters", maxThreadTagRunes)
+	}
+	for _, r := range tag {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:", r) {
+			continue
+		}
+		return "", fmt.Errorf("tag contains invalid character %q", r)
+	}
+	return tag, nil
+}
+
+func (s *Server) handleListThreadTags(w http.ResponseWriter, r *http.Request, clientID, threadID string) {
+	_ = clientID
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	thread, ok := s.getAccessibleThread(r.Context(), threadID)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "thread not found", map[string]any{})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"threadId": thread.ThreadID,
+		"tags":     threadTagsForResponse(thread.Tags),
+	})
+}
+
+func (s *Server) handleThreadTag(w http.ResponseWriter, r *http.Request, clientID, threadID, rawTag string) {
+	_ = clientID
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	thread, ok := s.getAccessibleThread(r.Context(), threadID)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "thread not found", map[string]any{})
+		return
+	}
+	tag, err := normalizeThreadTag(rawTag)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error(), map[string]any{"field": "tag"})
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if !slices.Contains(thread.Tags, tag) && len(thread.Tags) >= maxThreadTags {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, "too many tags", map[string]any{"field": "tag", "maxTags": maxThreadTags})
+			return
+		}
+		err = s.store.AddThreadTag(r.Context(), thread.ThreadID, tag)
+	} else {
+		err = s.store.RemoveThreadTag(r.Context(), thread.ThreadID, tag)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "tag not found", map[string]any{"tag": tag})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to update thread tags", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	tags, err := s.store.ListThreadTags(r.Context(), thread.ThreadID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to list thread tags", map[string]any{"reason": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"threadId": thread.ThreadID,
+		"tags":     tags,
+	})
+}
+
+func (s *Server) handleThreadCost(w http.ResponseWriter, r *http.Request, clientID, threadID string) {
+	_ = clientID
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	thread, ok := s.getAccessibleThread(r.Context(), threadID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "thread not found", map[string]any{})
+		return
+	}
+
+	turns, err := s.store.ListTurnsByThread(r.Context(), thread.ThreadID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL", "failed to list turns", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	var promptTokens, completionTokens int64
+	turnsWithUsage := 0
+	for _, turn := range turns {
+		if turn.PromptTokens == 0 && turn.CompletionTokens == 0 {
+			continue
+		}
+		turnsWithUsage++
+		promptTokens += turn.PromptTokens
+		completionTokens += turn.CompletionTokens
+	}
+
+	resp := map[string]any{
+		"threadId":         thread.ThreadID,
+		"agent":            thread.AgentID,
+		"turns":            len(turns),
+		"turnsWithUsage":   turnsWithUsage,
+		"promptTokens":     promptTokens,
+		"completionTokens": completionTokens,
+		"totalTokens":      promptTokens + completionTokens,
+	}
+	// Without a configured rate the estimate is omitted rather than reported as zero.
+	if rate, ok := s.costRates[thread.AgentID]; ok {
+		resp["estimatedCost"] = float64(promptTokens)/1e6*rate.PromptPerMillion +
+			float64(completionTokens)/1e6*rate.CompletionPerMillion
+		resp["rate"] = rate
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func cloneCostRates(in map[string]CostRate) map[string]CostRate {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]CostRate, len(in))
+	for agentID, rate := range in {
+		out[strings.TrimSpace(agentID)] = rate
+	}
+	return out
+}
+
+func cloneAgentCapabilities(in map[string]AgentCapabilities) map[string]AgentCapabilities {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]AgentCapabilities, len(in))
+	for agentID, capabilities := range in {
+		out[strings.TrimSpace(agentID)] = capabilities
+	}
+	return out
+}
+
+func cloneCWDValidators(in map[string]CWDValidator) map[string]CWDValidator {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]CWDValidator, len(in))
+	for agentID, validator := range in {
+		if validator != nil {
+			out[strings.TrimSpace(agentID)] = validator
+		}
+	}
+	return out
+}
+
 func (s *Server) finalizeTurnWithBestEffort(ctx context.Context, turnID, status, stopReason, responseText, errorMessage string) {
 	_ = s.store.FinalizeTurn(ctx, storage.FinalizeTurnParams{
 		TurnID:       turnID,
@@ -2320,23 +4515,29 @@ func (s *Server) resolveTurnAgent(thread storage.Thread) (agents.Streamer, error
 	if existing, exists := s.agentsByScope[scopeKey]; exists {
 		existing.lastUsed = time.Now().UTC()
 		s.agentMu.Unlock()
-		if closer != nil {
-			_ = closer.Close()
-		}
+		s.closeAgentLogged(closer, thread.ThreadID, sessionID, provider.Name())
 		return existing.provider, nil
 	}
 	s.agentsByScope[scopeKey] = &managedAgent{
-		scopeKey:  scopeKey,
-		threadID:  thread.ThreadID,
-		sessionID: sessionID,
-		provider:  provider,
-		closer:    closer,
-		lastUsed:  time.Now().UTC(),
+		scopeKey:    scopeKey,
+		threadID:    thread.ThreadID,
+		sessionID:   sessionID,
+		displayName: s.agentRegistry.DisplayName(thread.AgentID),
+		provider:    provider,
+		closer:      closer,
+		lastUsed:    time.Now().UTC(),
+		createdAt:   time.Now().UTC(),
 	}
 	s.agentMu.Unlock()
 	return provider, nil
 }
 
+// AgentRegistry returns the registry backing /v1/agents and thread agent
+// resolution, so callers can enable or disable providers at runtime.
+func (s *Server) AgentRegistry() *AgentRegistry {
+	return s.agentRegistry
+}
+
 // Close stops background janitor and closes all cached thread agents.
 func (s *Server) Close() error {
 	select {
@@ -2351,6 +4552,9 @@ func (s *Server) Close() error {
 func (s *Server) idleJanitorLoop() {
 	defer close(s.janitorDone)
 	interval := s.agentIdleTTL / 2
+	if s.agentMaxLifetime > 0 {
+		interval = min(interval, s.agentMaxLifetime/2)
+	}
 	if interval < 500*time.Millisecond {
 		interval = 500 * time.Millisecond
 	}
@@ -2362,23 +4566,60 @@ func (s *Server) idleJanitorLoop() {
 		case <-s.janitorStop:
 			return
 		case <-ticker.C:
-			s.reapIdleAgents(time.Now().UTC())
+			now := time.Now().UTC()
+			s.reapIdleAgents(now)
+			s.reapStalePermissions(now)
+			s.compactTerminalTurnEvents(now)
 		}
 	}
 }
 
+// compactTerminalTurnEvents merges adjacent message_delta events of turns
+// that finished at least eventCompactionAfter ago, one batch per janitor tick.
+// Running turns have no completed_at and are never touched.
+func (s *Server) compactTerminalTurnEvents(now time.Time) int {
+	if s.eventCompactionAfter <= 0 {
+		return 0
+	}
+	s.storeGate.RLock()
+	defer s.storeGate.RUnlock()
+	if s.store == nil {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventCompactionTimeout)
+	defer cancel()
+	compacted, err := s.store.CompactTurnEvents(ctx, now.Add(-s.eventCompactionAfter), eventCompactionBatch)
+	if err != nil {
+		s.logger.Warn("turn.events_compaction_failed", "error", err.Error())
+	}
+	if compacted > 0 {
+		s.logger.Info("turn.events_compacted",
+			"turns", compacted,
+			"after", s.eventCompactionAfter.String(),
+		)
+	}
+	return compacted
+}
+
+// reapIdleAgents closes cached agents that have been idle for agentIdleTTL
+// or, when agentMaxLifetime is set, have existed longer than it. Agents with
+// an active turn are skipped, so reclamation happens at a turn boundary.
 func (s *Server) reapIdleAgents(now time.Time) {
 	if s.agentIdleTTL <= 0 {
 		return
 	}
 
 	type reclaimItem struct {
-		threadID  string
-		scopeKey  string
-		sessionID string
-		name      string
-		idleFor   time.Duration
-		closer    io.Closer
+		threadID    string
+		scopeKey    string
+		sessionID   string
+		name        string
+		displayName string
+		idleFor     time.Duration
+		age         time.Duration
+		expired     bool
+		closer      io.Closer
 	}
 	items := make([]reclaimItem, 0)
 
@@ -2388,31 +4629,98 @@ func (s *Server) reapIdleAgents(now time.Time) {
 			continue
 		}
 		idleFor := now.Sub(entry.lastUsed)
-		if idleFor < s.agentIdleTTL {
+		age := now.Sub(entry.createdAt)
+		expired := s.agentMaxLifetime > 0 && !entry.createdAt.IsZero() && age >= s.agentMaxLifetime
+		if idleFor < s.agentIdleTTL && !expired {
 			continue
 		}
 		delete(s.agentsByScope, scopeKey)
 		items = append(items, reclaimItem{
-			threadID:  entry.threadID,
-			scopeKey:  scopeKey,
-			sessionID: entry.sessionID,
-			name:      entry.provider.Name(),
-			idleFor:   idleFor,
-			closer:    entry.closer,
+			threadID:    entry.threadID,
+			scopeKey:    scopeKey,
+			sessionID:   entry.sessionID,
+			name:        entry.provider.Name(),
+			displayName: entry.displayName,
+			idleFor:     idleFor,
+			age:         age,
+			expired:     expired && idleFor < s.agentIdleTTL,
+			closer:      entry.closer,
 		})
 	}
 	s.agentMu.Unlock()
 
+	// Close concurrently so one slow runtime shutdown does not hold back the
+	// rest of the batch.
+	sem := make(chan struct{}, max(s.janitorCloseLimit, 1))
+	var wg sync.WaitGroup
 	for _, item := range items {
-		if item.closer != nil {
-			_ = item.closer.Close()
-		}
-		s.logger.Info("agent.idle_reclaimed",
-			"threadId", item.threadID,
-			"sessionId", item.sessionID,
-			"agentName", item.name,
-			"idleFor", item.idleFor.String(),
-		)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.closeAgentLogged(item.closer, item.threadID, item.sessionID, item.name)
+			if item.expired {
+				s.logger.Info("agent.lifetime_reclaimed",
+					"threadId", item.threadID,
+					"sessionId", item.sessionID,
+					"agentName", item.name,
+					"agentDisplayName", item.displayName,
+					"age", item.age.String(),
+				)
+				return
+			}
+			s.logger.Info("agent.idle_reclaimed",
+				"threadId", item.threadID,
+				"sessionId", item.sessionID,
+				"agentName", item.name,
+				"agentDisplayName", item.displayName,
+				"idleFor", item.idleFor.String(),
+			)
+		}()
+	}
+	wg.Wait()
+}
+
+// closeAgentLogged closes one cached agent with closeAgentWithTimeout and
+// logs agent.close_timeout when Close overruns.
+func (s *Server) closeAgentLogged(closer io.Closer, threadID, sessionID, name string) {
+	if s.closeAgentWithTimeout(closer) {
+		return
+	}
+	s.logger.Warn("agent.close_timeout",
+		"threadId", threadID,
+		"sessionId", sessionID,
+		"agentName", name,
+		"timeout", s.agentCloseTimeout.String(),
+	)
+}
+
+// closeAgentWithTimeout closes one agent and reports whether Close returned
+// within agentCloseTimeout. On timeout the Close call keeps running in the
+// background; the agent is already detached from agentsByScope.
+func (s *Server) closeAgentWithTimeout(closer io.Closer) bool {
+	if closer == nil {
+		return true
+	}
+	timeout := s.agentCloseTimeout
+	if timeout <= 0 {
+		_ = closer.Close()
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = closer.Close()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
 	}
 }
 
@@ -2435,19 +4743,24 @@ func (s *Server) closeAllThreadAgents() error {
 		})
 		delete(s.agentsByScope, scopeKey)
 	}
-	s.agentMu.Unlock()
-
-	for _, item := range items {
-		if item.closer != nil {
-			_ = item.closer.Close()
-		}
-		s.logger.Info("agent.closed",
-			"threadId", item.threadID,
-			"sessionId", item.sessionID,
-			"agentName", item.name,
-			"reason", "server_close",
-		)
+	s.agentMu.Unlock()
+
+	// Close in parallel so shutdown waits at most about one agentCloseTimeout.
+	var wg sync.WaitGroup
+	for _, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.closeAgentLogged(item.closer, item.threadID, item.sessionID, item.name)
+			s.logger.Info("agent.closed",
+				"threadId", item.threadID,
+				"sessionId", item.sessionID,
+				"agentName", item.name,
+				"reason", "server_close",
+			)
+		}()
 	}
+	wg.Wait()
 	return nil
 }
 
@@ -2478,9 +4791,7 @@ func (s *Server) closeThreadAgents(threadID, reason string) {
 	s.agentMu.Unlock()
 
 	for _, item := range items {
-		if item.closer != nil {
-			_ = item.closer.Close()
-		}
+		s.closeAgentLogged(item.closer, threadID, item.sessionID, item.name)
 		s.logger.Info("agent.closed",
 			"threadId", threadID,
 			"sessionId", item.sessionID,
@@ -2515,9 +4826,32 @@ func (s *Server) closeThreadAgentScope(threadID, agentOptionsJSON, reason string
 		return
 	}
 
-	if item.closer != nil {
-		_ = item.closer.Close()
+	s.closeAgentLogged(item.closer, item.threadID, item.sessionID, item.provider.Name())
+	s.logger.Info("agent.closed",
+		"threadId", item.threadID,
+		"sessionId", item.sessionID,
+		"agentName", item.provider.Name(),
+		"reason", reason,
+	)
+}
+
+// evictTurnAgent drops and closes the cached agent serving thread even while
+// its turn is still active. It is used when a cancelled stream did not
+// return: the provider may still be writing to its connection, so it must
+// not be handed to the next turn.
+func (s *Server) evictTurnAgent(thread storage.Thread, reason string) {
+	scopeKey := threadAgentScopeKey(thread)
+	s.agentMu.Lock()
+	item, ok := s.agentsByScope[scopeKey]
+	if ok {
+		delete(s.agentsByScope, scopeKey)
+	}
+	s.agentMu.Unlock()
+	if !ok {
+		return
 	}
+
+	s.closeAgentLogged(item.closer, item.threadID, item.sessionID, item.provider.Name())
 	s.logger.Info("agent.closed",
 		"threadId", item.threadID,
 		"sessionId", item.sessionID,
@@ -2556,29 +4890,71 @@ func (s *Server) rebindManagedAgentScope(threadID, fromAgentOptionsJSON, toAgent
 	return nil
 }
 
+// transformTurnInput applies the configured InputTransform to each text block.
+func (s *Server) transformTurnInput(ctx context.Context, thread storage.Thread, prompt agents.Prompt) (agents.Prompt, error) {
+	if s.inputTransform == nil || len(prompt.Content) == 0 {
+		return prompt, nil
+	}
+	content := make([]agents.PromptContent, len(prompt.Content))
+	copy(content, prompt.Content)
+	for i, item := range content {
+		if item.Type != agents.PromptContentTypeText {
+			continue
+		}
+		text, err := s.inputTransform(ctx, thread, item.Text)
+		if err != nil {
+			return agents.Prompt{}, err
+		}
+		content[i].Text = text
+	}
+	return agents.NormalizePrompt(agents.Prompt{Content: content}), nil
+}
+
 func (s *Server) buildInjectedPrompt(ctx context.Context, thread storage.Thread, prompt agents.Prompt) (agents.Prompt, error) {
+	injected, _, err := s.buildInjectedPromptWithInfo(ctx, thread, prompt)
+	return injected, err
+}
+
+// injectedPromptInfo describes how buildInjectedPromptWithInfo framed one
+// prompt.
+type injectedPromptInfo struct {
+	// ContextInjected is false when the input was sent unwrapped, e.g. for
+	// threads bound to an agent session.
+	ContextInjected bool
+	RecentTurns     int
+	// Truncated reports that the full context did not fit ContextMaxChars
+	// and turns, summary, or input were trimmed.
+	Truncated bool
+}
+
+func (s *Server) buildInjectedPromptWithInfo(ctx context.Context, thread storage.Thread, prompt agents.Prompt) (agents.Prompt, injectedPromptInfo, error) {
 	prompt = agents.NormalizePrompt(prompt)
 	if threadSessionID(thread.AgentOptionsJSON) != "" || threadFreshSessionRequested(thread.AgentOptionsJSON) {
-		return prompt, nil
+		return prompt, injectedPromptInfo{}, nil
 	}
 
 	recentTurns, err := s.loadRecentVisibleTurns(ctx, thread.ThreadID)
 	if err != nil {
-		return agents.Prompt{}, err
+		return agents.Prompt{}, injectedPromptInfo{}, err
 	}
 
 	currentInput := prompt.Text()
 	if strings.TrimSpace(thread.Summary) == "" && len(recentTurns) == 0 && currentInput == "" {
-		return prompt, nil
+		return prompt, injectedPromptInfo{}, nil
 	}
-
 	content := make([]agents.PromptContent, 0, len(prompt.Content))
-	injectedText := composeContextPrompt(
+	injectedText, truncated := s.composeThreadContextPromptWithin(
+		thread.ThreadID,
 		thread.Summary,
 		recentTurns,
 		currentInput,
 		s.contextMaxChars,
 	)
+	info := injectedPromptInfo{
+		ContextInjected: true,
+		RecentTurns:     len(recentTurns),
+		Truncated:       truncated,
+	}
 	if strings.TrimSpace(injectedText) != "" {
 		content = append(content, agents.PromptContent{
 			Type: agents.PromptContentTypeText,
@@ -2590,49 +4966,190 @@ func (s *Server) buildInjectedPrompt(ctx context.Context, thread storage.Thread,
 			content = append(content, item)
 		}
 	}
-	return agents.NormalizePrompt(agents.Prompt{Content: content}), nil
+	return agents.NormalizePrompt(agents.Prompt{Content: content}), info, nil
 }
 
-func (s *Server) buildCompactPrompt(ctx context.Context, thread storage.Thread, maxSummaryChars int) (string, error) {
-	recentTurns, err := s.loadRecentVisibleTurns(ctx, thread.ThreadID)
-	if err != nil {
-		return "", err
+// turnContextPayload builds the turn_context event for one user turn. The
+// injected prompt is only included when prompts are persisted anyway.
+func (s *Server) turnContextPayload(
+	thread storage.Thread,
+	turnID string,
+	agent agents.Streamer,
+	input, injected agents.Prompt,
+	info injectedPromptInfo,
+) map[string]any {
+	modelID, _ := threadConfigSelections(thread.AgentOptionsJSON)
+	if modelID == "" {
+		if current, ok := agent.(interface{ CurrentModelID() string }); ok {
+			modelID = strings.TrimSpace(current.CurrentModelID())
+		}
+	}
+	injectedText := injected.Text()
+	payload := map[string]any{
+		"turnId":          turnID,
+		"agent":           thread.AgentID,
+		"cwd":             thread.CWD,
+		"inputChars":      runeLen(input.Text()),
+		"contextChars":    runeLen(injectedText),
+		"contextInjected": info.ContextInjected,
+		"recentTurns":     info.RecentTurns,
+		"truncated":       info.Truncated,
+	}
+	if modelID != "" {
+		payload["modelId"] = modelID
+	}
+	if s.persistPrompts {
+		payload["prompt"] = injectedText
 	}
+	return payload
+}
 
+func (s *Server) buildCompactPrompt(thread storage.Thread, recentTurns []storage.Turn, maxSummaryChars int) string {
 	instruction := fmt.Sprintf(
 		"Please generate an updated rolling summary of the conversation. "+
 			"Output plain text only, keep key decisions/constraints, and limit to %d characters.",
 		maxSummaryChars,
 	)
-	return composeContextPrompt(
+	prompt, _ := s.composeThreadContextPromptWithin(
+		thread.ThreadID,
 		thread.Summary,
 		recentTurns,
 		instruction,
-		s.contextMaxChars,
-	), nil
+		s.compactContextMaxChars,
+	)
+	return prompt
 }
 
+// loadRecentVisibleTurns returns the newest contextRecentTurns non-internal
+// turns of a thread. Only the window itself is read unless incomplete turns
+// are skipped, in which case up to contextScanTurns rows are scanned.
 func (s *Server) loadRecentVisibleTurns(ctx context.Context, threadID string) ([]storage.Turn, error) {
-	turns, err := s.store.ListTurnsByThread(ctx, threadID)
+	limit := s.contextRecentTurns
+	if s.contextSkipIncompleteTurns {
+		limit = s.contextScanTurns
+	}
+	turns, err := s.store.ListRecentTurnsByThread(ctx, threadID, limit, false)
 	if err != nil {
 		return nil, err
 	}
 
+	filtered := s.contextTurns(turns)
+	if len(filtered) > s.contextRecentTurns {
+		filtered = filtered[len(filtered)-s.contextRecentTurns:]
+	}
+	return filtered, nil
+}
+
+// loadCompactTurns returns the non-internal turns /compact summarizes: the
+// newest ones whose rendered text fills compactContextMaxChars, or every turn
+// of a shorter thread. The read window starts at contextRecentTurns and
+// doubles until the budget is used up.
+func (s *Server) loadCompactTurns(ctx context.Context, threadID string) ([]storage.Turn, error) {
+	for limit := s.contextRecentTurns; ; limit *= 2 {
+		turns, err := s.store.ListRecentTurnsByThread(ctx, threadID, limit, false)
+		if err != nil {
+			return nil, err
+		}
+		filtered := s.contextTurns(turns)
+		if len(turns) < limit || runeLen(renderContextPrompt(s.contextLabels, "", filtered, "")) >= s.compactContextMaxChars {
+			return filtered, nil
+		}
+	}
+}
+
+// contextTurns drops the turns ContextSkipIncompleteTurns excludes from
+// injected context.
+func (s *Server) contextTurns(turns []storage.Turn) []storage.Turn {
 	filtered := make([]storage.Turn, 0, len(turns))
 	for _, turn := range turns {
-		if turn.IsInternal {
+		if s.contextSkipIncompleteTurns && !isContextCompleteTurn(turn) {
 			continue
 		}
 		filtered = append(filtered, turn)
 	}
+	return filtered
+}
 
-	if len(filtered) > s.contextRecentTurns {
-		filtered = filtered[len(filtered)-s.contextRecentTurns:]
+// ContextPromptIterationCapHits reports how many context prompts were
+// force-clamped after exhausting maxContextPromptIterations.
+func (s *Server) ContextPromptIterationCapHits() int64 {
+	return s.contextPromptCapHits.Load()
+}
+
+func (s *Server) composeThreadContextPrompt(
+	threadID, summary string,
+	recentTurns []storage.Turn,
+	currentInput string,
+) string {
+	prompt, _ := s.composeThreadContextPromptWithin(threadID, summary, recentTurns, currentInput, s.contextMaxChars)
+	return prompt
+}
+
+// composeThreadContextPromptWithin is composeThreadContextPrompt with an
+// explicit character budget. It also reports whether turns, summary, or
+// input had to be trimmed to fit.
+func (s *Server) composeThreadContextPromptWithin(
+	threadID, summary string,
+	recentTurns []storage.Turn,
+	currentInput string,
+	maxChars int,
+) (string, bool) {
+	prompt, truncated, capped := composeContextPromptBounded(
+		s.contextLabels,
+		summary,
+		recentTurns,
+		currentInput,
+		maxChars,
+		maxContextPromptIterations,
+		s.firstTurnPassthrough,
+	)
+	if capped {
+		s.contextPromptCapHits.Add(1)
+		s.logger.Warn("context.prompt_iteration_cap_reached",
+			"threadId", threadID,
+			"iterations", maxContextPromptIterations,
+			"maxChars", maxChars,
+			"summaryChars", runeLen(strings.TrimSpace(summary)),
+			"recentTurns", len(recentTurns),
+			"inputChars", runeLen(strings.TrimSpace(currentInput)),
+			"promptChars", runeLen(prompt),
+		)
 	}
-	return filtered, nil
+	return prompt, truncated
+}
+
+// isContextCompleteTurn reports whether one turn finished normally with a
+// non-empty response, i.e. it contributes a useful User/Assistant pair.
+func isContextCompleteTurn(turn storage.Turn) bool {
+	return turn.Status == "completed" && strings.TrimSpace(turn.ResponseText) != ""
 }
 
 func composeContextPrompt(summary string, recentTurns []storage.Turn, currentInput string, maxChars int) string {
+	prompt, _, _ := composeContextPromptBounded(
+		defaultContextPromptLabels,
+		summary,
+		recentTurns,
+		currentInput,
+		maxChars,
+		maxContextPromptIterations,
+		true,
+	)
+	return prompt
+}
+
+// composeContextPromptBounded fits the rendered context prompt into maxChars.
+// It reports whether anything was trimmed to fit, and whether maxIterations
+// reduction passes were not enough and the result had to be force-clamped.
+// With firstTurnPassthrough, a prompt with no summary and no recent turns is
+// the raw input.
+func composeContextPromptBounded(
+	labels contextPromptLabels,
+	summary string,
+	recentTurns []storage.Turn,
+	currentInput string,
+	maxChars, maxIterations int,
+	firstTurnPassthrough bool,
+) (prompt string, truncated, capped bool) {
 	summary = strings.TrimSpace(summary)
 	currentInput = strings.TrimSpace(currentInput)
 
@@ -2641,17 +5158,17 @@ func composeContextPrompt(summary string, recentTurns []storage.Turn, currentInp
 
 	// Preserve raw user input on the very first turn so slash-command style inputs
 	// (for example "/mcp ...") are not masked by context wrapper headings.
-	if summary == "" && len(recentCopy) == 0 {
+	if firstTurnPassthrough && summary == "" && len(recentCopy) == 0 {
 		if maxChars <= 0 || runeLen(currentInput) <= maxChars {
-			return currentInput
+			return currentInput, false, false
 		}
-		return clampToChars(currentInput, maxChars)
+		return clampToChars(currentInput, maxChars), true, false
 	}
 
-	for i := 0; i < 256; i++ {
-		prompt := renderContextPrompt(summary, recentCopy, currentInput)
-		if maxChars <= 0 || runeLen(prompt) <= maxChars {
-			return prompt
+	for i := 0; i < maxIterations; i++ {
+		rendered := renderContextPrompt(labels, summary, recentCopy, currentInput)
+		if maxChars <= 0 || runeLen(rendered) <= maxChars {
+			return rendered, i > 0, false
 		}
 
 		if len(recentCopy) > 0 {
@@ -2669,36 +5186,78 @@ func composeContextPrompt(summary string, recentTurns []storage.Turn, currentInp
 			continue
 		}
 
-		return clampToChars(prompt, maxChars)
+		return clampToChars(rendered, maxChars), true, false
 	}
 
-	return clampToChars(renderContextPrompt(summary, recentCopy, currentInput), maxChars)
+	return clampToChars(renderContextPrompt(labels, summary, recentCopy, currentInput), maxChars), true, true
+}
+
+// contextPromptLabels holds the section headers and role markers used when
+// rendering injected context prompts.
+type contextPromptLabels struct {
+	summaryHeader      string
+	recentTurnsHeader  string
+	currentInputHeader string
+	userLabel          string
+	assistantLabel     string
+}
+
+var defaultContextPromptLabels = contextPromptLabels{
+	summaryHeader:      "[Conversation Summary]",
+	recentTurnsHeader:  "[Recent Turns]",
+	currentInputHeader: "[Current User Input]",
+	userLabel:          "User",
+	assistantLabel:     "Assistant",
 }
 
-func renderContextPrompt(summary string, recentTurns []storage.Turn, currentInput string) string {
+func (l contextPromptLabels) withDefaults() contextPromptLabels {
+	pick := func(value, fallback string) string {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+		return fallback
+	}
+	return contextPromptLabels{
+		summaryHeader:      pick(l.summaryHeader, defaultContextPromptLabels.summaryHeader),
+		recentTurnsHeader:  pick(l.recentTurnsHeader, defaultContextPromptLabels.recentTurnsHeader),
+		currentInputHeader: pick(l.currentInputHeader, defaultContextPromptLabels.currentInputHeader),
+		userLabel:          pick(l.userLabel, defaultContextPromptLabels.userLabel),
+		assistantLabel:     pick(l.assistantLabel, defaultContextPromptLabels.assistantLabel),
+	}
+}
+
+func renderContextPrompt(labels contextPromptLabels, summary string, recentTurns []storage.Turn, currentInput string) string {
 	var builder strings.Builder
-	builder.WriteString("[Conversation Summary]\n")
+	builder.WriteString(labels.summaryHeader)
+	builder.WriteString("\n")
 	if summary == "" {
 		builder.WriteString("(empty)")
 	} else {
 		builder.WriteString(summary)
 	}
 
-	builder.WriteString("\n\n[Recent Turns]\n")
+	builder.WriteString("\n\n")
+	builder.WriteString(labels.recentTurnsHeader)
+	builder.WriteString("\n")
 	if len(recentTurns) == 0 {
 		builder.WriteString("(none)")
 	} else {
 		for _, turn := range recentTurns {
-			builder.WriteString("User: ")
+			builder.WriteString(labels.userLabel)
+			builder.WriteString(": ")
 			builder.WriteString(strings.TrimSpace(turn.RequestText))
-			builder.WriteString("\nAssistant: ")
+			builder.WriteString("\n")
+			builder.WriteString(labels.assistantLabel)
+			builder.WriteString(": ")
 			builder.WriteString(strings.TrimSpace(turn.ResponseText))
 			builder.WriteString("\n")
 		}
 		builder.WriteString("----")
 	}
 
-	builder.WriteString("\n\n[Current User Input]\n")
+	builder.WriteString("\n\n")
+	builder.WriteString(labels.currentInputHeader)
+	builder.WriteString("\n")
 	builder.WriteString(currentInput)
 	return builder.String()
 }
@@ -2746,9 +5305,45 @@ func classifyStreamErrorCode(err error) string {
 	if errors.Is(err, context.Canceled) {
 		return codeTimeout
 	}
+	if errors.Is(err, agents.ErrProcessLimit) {
+		return codeBusy
+	}
+	var exitErr *agents.ExitError
+	if errors.As(err, &exitErr) {
+		return codeAgentExited
+	}
+	if errors.Is(err, agents.ErrAgentProtocol) {
+		return codeAgentProtocol
+	}
 	return codeUpstreamUnavailable
 }
 
+// streamErrorPayload builds the error event of a failed turn. An agent that
+// exited during startup is logged with its stderr tail; the tail reaches
+// the client only when ExposeAgentStderr is on.
+func (s *Server) streamErrorPayload(threadID, turnID string, err error) map[string]any {
+	payload := map[string]any{
+		"turnId":  turnID,
+		"code":    classifyStreamErrorCode(err),
+		"message": err.Error(),
+	}
+	var exitErr *agents.ExitError
+	if errors.As(err, &exitErr) {
+		stderr := agents.StderrTail(err)
+		s.logger.Warn("agent.exited",
+			"threadId", threadID,
+			"turnId", turnID,
+			"exitCode", exitErr.Code,
+			"stderr", stderr,
+		)
+		payload["exitCode"] = exitErr.Code
+		if s.exposeAgentStderr && stderr != "" {
+			payload["stderr"] = stderr
+		}
+	}
+	return payload
+}
+
 func (s *Server) getAccessibleThread(ctx context.Context, threadID string) (storage.Thread, bool) {
 	thread, err := s.store.GetThread(ctx, threadID)
 	if err != nil {
@@ -2764,21 +5359,37 @@ type threadResponse struct {
 	Title        string          `json:"title"`
 	AgentOptions json.RawMessage `json:"agentOptions"`
 	Summary      string          `json:"summary"`
+	Tags         []string        `json:"tags"`
 	CreatedAt    string          `json:"createdAt"`
 	UpdatedAt    string          `json:"updatedAt"`
+	// LastActivityAt is the last turn start/finish (or creation) time.
+	LastActivityAt string `json:"lastActivityAt"`
+	// TurnsSinceCompact counts completed user turns not yet reflected in
+	// the summary.
+	TurnsSinceCompact int `json:"turnsSinceCompact"`
+	// OptionsLocked means agentOptions can no longer be changed by clients.
+	OptionsLocked bool `json:"optionsLocked"`
 }
 
 type turnHistoryResponse struct {
-	TurnID       string                 `json:"turnId"`
-	RequestText  string                 `json:"requestText"`
-	ResponseText string                 `json:"responseText"`
-	IsInternal   bool                   `json:"isInternal,omitempty"`
-	Status       string                 `json:"status"`
-	StopReason   string                 `json:"stopReason"`
-	ErrorMessage string                 `json:"errorMessage"`
-	CreatedAt    string                 `json:"createdAt"`
-	CompletedAt  *string                `json:"completedAt,omitempty"`
-	Events       []eventHistoryResponse `json:"events,omitempty"`
+	TurnID       string `json:"turnId"`
+	RequestText  string `json:"requestText"`
+	ResponseText string `json:"responseText"`
+	IsInternal   bool   `json:"isInternal,omitempty"`
+	Status       string `json:"status"`
+	StopReason   string `json:"stopReason"`
+	ErrorMessage string `json:"errorMessage"`
+	// RawStopReason is the agent-reported stop reason, present only with
+	// PersistRawStopReasons.
+	RawStopReason string `json:"rawStopReason,omitempty"`
+	// PromptText is the injected prompt, present only with PersistPrompts.
+	PromptText string `json:"promptText,omitempty"`
+	// Token counts are omitted when the provider reported no usage.
+	PromptTokens     int64                  `json:"promptTokens,omitempty"`
+	CompletionTokens int64                  `json:"completionTokens,omitempty"`
+	CreatedAt        string                 `json:"createdAt"`
+	CompletedAt      *string                `json:"completedAt,omitempty"`
+	Events           []eventHistoryResponse `json:"events,omitempty"`
 }
 
 type eventHistoryResponse struct {
@@ -2794,22 +5405,34 @@ var (
 	errPermissionAlreadyResolved = errors.New("permission already resolved")
 	errPermissionInvalidOption   = errors.New("permission option is invalid")
 	errPermissionOutcomeRequired = errors.New("permission outcome is required")
+	errPermissionExpired         = errors.New("permission expired")
+	errPermissionCancelled       = errors.New("permission cancelled with its turn")
 )
 
+type permissionTombstone struct {
+	retiredAt time.Time
+	cancelled bool
+}
+
 type pendingPermission struct {
-	options map[string]agents.PermissionOption
+	options   map[string]agents.PermissionOption
+	createdAt time.Time
+	// turnID keys the per-turn pending count; empty entries are not capped.
+	turnID string
 
 	ch   chan agents.PermissionResponse
 	once sync.Once
 }
 
 type managedAgent struct {
-	scopeKey  string
-	threadID  string
-	sessionID string
-	provider  agents.Streamer
-	closer    io.Closer
-	lastUsed  time.Time
+	scopeKey    string
+	threadID    string
+	sessionID   string
+	displayName string
+	provider    agents.Streamer
+	closer      io.Closer
+	lastUsed    time.Time
+	createdAt   time.Time
 }
 
 type threadConfigSelectionState interface {
@@ -2831,8 +5454,9 @@ func newPendingPermission(options []agents.PermissionOption) *pendingPermission
 		}
 	}
 	return &pendingPermission{
-		options: optionMap,
-		ch:      make(chan agents.PermissionResponse, 1),
+		options:   optionMap,
+		createdAt: time.Now().UTC(),
+		ch:        make(chan agents.PermissionResponse, 1),
 	}
 }
 
@@ -2880,11 +5504,35 @@ func toThreadResponse(thread storage.Thread) (threadResponse, error) {
 		Title:        thread.Title,
 		AgentOptions: raw,
 		Summary:      thread.Summary,
+		Tags:         threadTagsForResponse(thread.Tags),
 		CreatedAt:    thread.CreatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:    thread.UpdatedAt.UTC().Format(time.RFC3339Nano),
+
+		LastActivityAt:    thread.LastActivityAt.UTC().Format(time.RFC3339Nano),
+		TurnsSinceCompact: thread.TurnsSinceCompact,
+		OptionsLocked:     thread.OptionsLocked,
 	}, nil
 }
 
+func threadTagsForResponse(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+func parseThreadTagPath(path string) (threadID, tag string, ok bool) {
+	const prefix = "/v1/threads/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] != "tags" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[2], true
+}
+
 func parseThreadPath(path string) (threadID, subresource string, ok bool) {
 	const prefix = "/v1/threads/"
 	if !strings.HasPrefix(path, prefix) {
@@ -2930,6 +5578,19 @@ func parseAgentModelsPath(path string) (agentID string, ok bool) {
 	return raw, true
 }
 
+func parseAdminAgentThreadsPath(path string) (agentID string, ok bool) {
+	const prefix = "/v1/admin/agents/"
+	const suffix = "/threads"
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	raw := strings.Trim(strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix), "/")
+	if raw == "" || strings.Contains(raw, "/") {
+		return "", false
+	}
+	return raw, true
+}
+
 func parsePermissionPath(path string) (permissionID string, ok bool) {
 	const prefix = "/v1/permissions/"
 	if !strings.HasPrefix(path, prefix) {
@@ -3014,10 +5675,26 @@ func sanitizePermissionIDComponent(raw string) string {
 	return strings.Trim(builder.String(), "_")
 }
 
-func (s *Server) registerPermission(permissionID string, pending *pendingPermission) {
+// registerPermission records a pending permission. When the owning turn
+// already has maxPendingPermissions waiting, or the server globalPermissionLimit,
+// it registers nothing and returns the auto-decline reason and the limit hit.
+func (s *Server) registerPermission(permissionID string, pending *pendingPermission) (string, int) {
 	s.permissionsMu.Lock()
+	defer s.permissionsMu.Unlock()
+	if pending.turnID != "" && len(s.permissionsByTurn[pending.turnID]) >= s.maxPendingPermissions {
+		return "too_many_pending", s.maxPendingPermissions
+	}
+	if s.globalPermissionLimit > 0 && len(s.permissions) >= s.globalPermissionLimit {
+		return "too_many_pending_global", s.globalPermissionLimit
+	}
+	if pending.turnID != "" {
+		if s.permissionsByTurn[pending.turnID] == nil {
+			s.permissionsByTurn[pending.turnID] = make(map[string]struct{})
+		}
+		s.permissionsByTurn[pending.turnID][permissionID] = struct{}{}
+	}
 	s.permissions[permissionID] = pending
-	s.permissionsMu.Unlock()
+	return "", 0
 }
 
 func (s *Server) unregisterPermission(permissionID string, pending *pendingPermission) {
@@ -3025,8 +5702,121 @@ func (s *Server) unregisterPermission(permissionID string, pending *pendingPermi
 	current, ok := s.permissions[permissionID]
 	if ok && current == pending {
 		delete(s.permissions, permissionID)
+		s.releaseTurnPermissionLocked(permissionID, pending)
+		s.tombstonePermissionLocked(permissionID, time.Now().UTC(), false)
+	}
+	s.permissionsMu.Unlock()
+}
+
+// tombstonePermissionLocked records a retired permission id and drops
+// tombstones older than permissionTombstoneTTL from the front of the queue.
+func (s *Server) tombstonePermissionLocked(permissionID string, now time.Time, cancelled bool) {
+	expired := 0
+	for _, id := range s.permissionTombstoneQueue {
+		tombstone, ok := s.permissionTombstones[id]
+		if ok && now.Sub(tombstone.retiredAt) < permissionTombstoneTTL {
+			break
+		}
+		delete(s.permissionTombstones, id)
+		expired++
+	}
+	s.permissionTombstoneQueue = s.permissionTombstoneQueue[expired:]
+	if _, ok := s.permissionTombstones[permissionID]; !ok {
+		s.permissionTombstoneQueue = append(s.permissionTombstoneQueue, permissionID)
+	}
+	s.permissionTombstones[permissionID] = permissionTombstone{retiredAt: now, cancelled: cancelled}
+}
+
+func (s *Server) releaseTurnPermissionLocked(permissionID string, pending *pendingPermission) {
+	if pending.turnID == "" {
+		return
+	}
+	ids := s.permissionsByTurn[pending.turnID]
+	delete(ids, permissionID)
+	if len(ids) == 0 {
+		delete(s.permissionsByTurn, pending.turnID)
+	}
+}
+
+// cancelTurnPermissions resolves every pending permission of turnID as
+// cancelled and retires it, so a decision that arrives after the turn was
+// cancelled gets CONFLICT instead of racing the teardown. It returns how many
+// permissions it cancelled.
+func (s *Server) cancelTurnPermissions(turnID string) int {
+	s.permissionsMu.Lock()
+	now := time.Now().UTC()
+	cancelled := make([]*pendingPermission, 0, len(s.permissionsByTurn[turnID]))
+	for permissionID := range s.permissionsByTurn[turnID] {
+		pending, ok := s.permissions[permissionID]
+		if !ok {
+			continue
+		}
+		delete(s.permissions, permissionID)
+		s.tombstonePermissionLocked(permissionID, now, true)
+		cancelled = append(cancelled, pending)
+	}
+	delete(s.permissionsByTurn, turnID)
+	s.permissionsMu.Unlock()
+
+	for _, pending := range cancelled {
+		pending.Resolve(agents.PermissionResponse{Outcome: agents.PermissionOutcomeCancelled})
+	}
+	return len(cancelled)
+}
+
+// reapStalePermissions declines and removes pending permissions older than
+// permissionMaxAge. Live turns unregister their own entries after the
+// permission timeout, so anything reaped here was leaked by a stuck turn.
+func (s *Server) reapStalePermissions(now time.Time) int {
+	if s.permissionMaxAge <= 0 {
+		return 0
+	}
+
+	type staleItem struct {
+		permissionID string
+		pending      *pendingPermission
+		age          time.Duration
+	}
+	items := make([]staleItem, 0)
+
+	s.permissionsMu.Lock()
+	for permissionID, pending := range s.permissions {
+		age := now.Sub(pending.createdAt)
+		if age < s.permissionMaxAge {
+			continue
+		}
+		delete(s.permissions, permissionID)
+		s.releaseTurnPermissionLocked(permissionID, pending)
+		s.tombstonePermissionLocked(permissionID, now, false)
+		items = append(items, staleItem{permissionID: permissionID, pending: pending, age: age})
 	}
 	s.permissionsMu.Unlock()
+
+	for _, item := range items {
+		item.pending.Resolve(permissionFailClosedResponse())
+		s.logger.Warn("permission.stale_reaped",
+			"permissionId", item.permissionID,
+			"age", item.age.String(),
+			"maxAge", s.permissionMaxAge.String(),
+		)
+	}
+	return len(items)
+}
+
+// withPermissionText adds the approval and command of req to a permission
+// event payload, cut to maxPermissionChars. A cut field ends with a
+// truncation marker and sets <field>Truncated; req itself is not modified.
+func (s *Server) withPermissionText(payload map[string]any, req agents.PermissionRequest) map[string]any {
+	for field, value := range map[string]string{"approval": req.Approval, "command": req.Command} {
+		overflow := runeLen(value) - s.maxPermissionChars
+		if s.maxPermissionChars <= 0 || overflow <= 0 {
+			payload[field] = value
+			continue
+		}
+		payload[field] = clampToChars(value, s.maxPermissionChars) + fmt.Sprintf("…[truncated %d chars]", overflow)
+		payload[field+"Truncated"] = true
+	}
+	return payload
 }
 
 func permissionFailClosedResponse() agents.PermissionResponse {
@@ -3079,8 +5869,15 @@ func (s *Server) waitPermissionResponse(ctx context.Context, pending *pendingPer
 func (s *Server) resolvePermission(permissionID string, response agents.PermissionResponse) (agents.PermissionResponse, error) {
 	s.permissionsMu.Lock()
 	pending, ok := s.permissions[permissionID]
+	tombstone, retired := s.permissionTombstones[permissionID]
 	s.permissionsMu.Unlock()
 	if !ok {
+		if retired && time.Since(tombstone.retiredAt) < permissionTombstoneTTL {
+			if tombstone.cancelled {
+				return agents.PermissionResponse{}, errPermissionCancelled
+			}
+			return agents.PermissionResponse{}, errPermissionExpired
+		}
 		return agents.PermissionResponse{}, errPermissionNotFound
 	}
 	normalized, err := pending.normalizeDecision(response)
@@ -3088,11 +5885,20 @@ func (s *Server) resolvePermission(permissionID string, response agents.Permissi
 		return agents.PermissionResponse{}, err
 	}
 	if !pending.Resolve(normalized) {
+		if s.permissionCancelled(permissionID) {
+			return agents.PermissionResponse{}, errPermissionCancelled
+		}
 		return agents.PermissionResponse{}, errPermissionAlreadyResolved
 	}
 	return normalized, nil
 }
 
+func (s *Server) permissionCancelled(permissionID string) bool {
+	s.permissionsMu.Lock()
+	defer s.permissionsMu.Unlock()
+	return s.permissionTombstones[permissionID].cancelled
+}
+
 func (s *Server) loadStoredAgentModels(ctx context.Context, agentID string) ([]agents.ModelOption, bool, error) {
 	catalogs, err := s.store.ListAgentConfigCatalogsByAgent(ctx, agentID)
 	if err != nil {
@@ -3435,7 +6241,7 @@ func (s *Server) persistThreadConfigSnapshotBestEffort(
 		return
 	}
 	if nextAgentOptionsJSON != thread.AgentOptionsJSON {
-		if err := s.store.UpdateThreadAgentOptions(ctx, thread.ThreadID, nextAgentOptionsJSON); err != nil {
+		if err := s.store.UpdateThreadAgentState(ctx, thread.ThreadID, nextAgentOptionsJSON); err != nil {
 			s.logger.Warn("thread.config_snapshot_persist_failed",
 				"threadId", thread.ThreadID,
 				"agent", thread.AgentID,
@@ -3564,7 +6370,7 @@ func (s *Server) persistAgentSlashCommands(
 	})
 }
 
-func normalizeAgentOptions(raw json.RawMessage) (string, error) {
+func normalizeAgentOptions(raw json.RawMessage, canonicalKeys bool) (string, error) {
 	if len(strings.TrimSpace(string(raw))) == 0 {
 		return "{}", nil
 	}
@@ -3573,6 +6379,11 @@ func normalizeAgentOptions(raw json.RawMessage) (string, error) {
 	if err := json.Unmarshal(raw, &objectValue); err != nil {
 		return "", err
 	}
+	if canonicalKeys {
+		if err := canonicalizeAgentOptionKeys(objectValue); err != nil {
+			return "", err
+		}
+	}
 
 	normalized, err := json.Marshal(objectValue)
 	if err != nil {
@@ -3581,6 +6392,79 @@ func normalizeAgentOptions(raw json.RawMessage) (string, error) {
 	return string(normalized), nil
 }
 
+func writeInvalidAgentOptions(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAgentOptionKeyConflict) {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid agentOptions", map[string]any{
+			"field":  "agentOptions",
+			"reason": err.Error(),
+		})
+		return
+	}
+	writeError(w, http.StatusBadRequest, codeInvalidArgument, "agentOptions must be a JSON object", map[string]any{"field": "agentOptions"})
+}
+
+// mergeDefaultAgentOptions layers agentOptionsJSON over defaults. Values from
+// agentOptionsJSON win; when both sides hold an object the merge recurses.
+func mergeDefaultAgentOptions(agentOptionsJSON string, defaults map[string]any) (string, error) {
+	if len(defaults) == 0 {
+		return agentOptionsJSON, nil
+	}
+
+	objectValue := map[string]any{}
+	if trimmed := strings.TrimSpace(agentOptionsJSON); trimmed != "" && trimmed != "null" {
+		if err := json.Unmarshal([]byte(trimmed), &objectValue); err != nil {
+			return "", err
+		}
+	}
+
+	merged, err := json.Marshal(mergeJSONObjects(defaults, objectValue))
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+func mergeJSONObjects(base, override map[string]any) map[string]any {
+	out := make(map[string]any, len(base)+len(override))
+	for key, value := range base {
+		out[key] = value
+	}
+	for key, value := range override {
+		baseObject, baseOK := out[key].(map[string]any)
+		overrideObject, overrideOK := value.(map[string]any)
+		if baseOK && overrideOK {
+			out[key] = mergeJSONObjects(baseObject, overrideObject)
+			continue
+		}
+		out[key] = value
+	}
+	return out
+}
+
+func cloneDefaultAgentOptions(in map[string]map[string]any) map[string]map[string]any {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]map[string]any, len(in))
+	for agentID, options := range in {
+		if len(options) == 0 {
+			continue
+		}
+		// Round-trip through JSON so later caller mutations cannot leak in and
+		// values already have the shapes json.Unmarshal produces.
+		encoded, err := json.Marshal(options)
+		if err != nil {
+			continue
+		}
+		var cloned map[string]any
+		if err := json.Unmarshal(encoded, &cloned); err != nil {
+			continue
+		}
+		out[strings.TrimSpace(agentID)] = cloned
+	}
+	return out
+}
+
 func withThreadConfigState(agentOptionsJSON, modelID string, options []agents.ConfigOption) (string, error) {
 	modelID = strings.TrimSpace(modelID)
 
@@ -3974,24 +6858,6 @@ func isPathAllowed(path string, roots []string) bool {
 	return false
 }
 
-func sortedAgentIDs(allowed map[string]struct{}) []string {
-	if len(allowed) == 0 {
-		return []string{}
-	}
-	ids := make([]string, 0, len(allowed))
-	for id := range allowed {
-		ids = append(ids, id)
-	}
-	for i := 0; i < len(ids); i++ {
-		for j := i + 1; j < len(ids); j++ {
-			if ids[j] < ids[i] {
-				ids[i], ids[j] = ids[j], ids[i]
-			}
-		}
-	}
-	return ids
-}
-
 func newThreadID() string {
 	buf := make([]byte, 8)
 	if _, err := rand.Read(buf); err != nil {
@@ -4013,6 +6879,15 @@ func parseBoolQuery(r *http.Request, key string) bool {
 	return value == "1" || value == "true" || value == "yes"
 }
 
+// parseBoolQueryDefault is parseBoolQuery with a fallback used only when key
+// is absent from the query string.
+func parseBoolQueryDefault(r *http.Request, key string, fallback bool) bool {
+	if !r.URL.Query().Has(key) {
+		return fallback
+	}
+	return parseBoolQuery(r, key)
+}
+
 func requireMethod(r *http.Request, method string) error {
 	if r.Method != method {
 		return errors.New("method not allowed")
@@ -4035,20 +6910,47 @@ func decodeJSONBody(r *http.Request, dst any) error {
 func (s *Server) decodeTurnCreateRequest(r *http.Request) (turnCreateRequest, error) {
 	contentType := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Type")))
 	if strings.HasPrefix(contentType, "multipart/form-data") {
-		return decodeMultipartTurnCreateRequest(r, s.dataDir)
+		req, err := decodeMultipartTurnCreateRequest(r, s.dataDir)
+		if err != nil {
+			return turnCreateRequest{}, err
+		}
+		if req.Prompt, err = s.checkPromptText(req.Prompt); err != nil {
+			removeStoredAttachments(req.Uploads)
+			return turnCreateRequest{}, err
+		}
+		return req, nil
 	}
 
 	var req struct {
-		Input  string `json:"input"`
-		Stream bool   `json:"stream"`
+		Input       json.RawMessage `json:"input"`
+		Stream      bool            `json:"stream"`
+		Background  bool            `json:"background"`
+		CallbackURL string          `json:"callbackUrl"`
 	}
 	if err := decodeJSONBody(r, &req); err != nil {
 		return turnCreateRequest{}, err
 	}
+	// Check the raw literal: decoding would silently turn invalid UTF-8
+	// into U+FFFD.
+	var input string
+	if len(req.Input) > 0 {
+		rawInput, err := s.checkInputText(string(req.Input))
+		if err != nil {
+			return turnCreateRequest{}, err
+		}
+		if err := json.Unmarshal([]byte(rawInput), &input); err != nil {
+			return turnCreateRequest{}, fmt.Errorf("input: %w", err)
+		}
+		if input, err = s.checkInputText(input); err != nil {
+			return turnCreateRequest{}, err
+		}
+	}
 
 	return turnCreateRequest{
-		Stream: req.Stream,
-		Prompt: agents.TextPrompt(req.Input),
+		Stream:      req.Stream,
+		Background:  req.Background,
+		Prompt:      agents.TextPrompt(input),
+		CallbackURL: req.CallbackURL,
 	}, nil
 }
 
@@ -4062,6 +6964,7 @@ func decodeMultipartTurnCreateRequest(r *http.Request, dataDir string) (turnCrea
 
 	text := strings.TrimSpace(r.FormValue("input"))
 	stream := parseFormBoolValue(r.FormValue("stream"))
+	background := parseFormBoolValue(r.FormValue("background"))
 	attachments, err := persistTurnAttachments(dataDir, r.MultipartForm.File["attachments"])
 	if err != nil {
 		return turnCreateRequest{}, err
@@ -4079,9 +6982,10 @@ func decodeMultipartTurnCreateRequest(r *http.Request, dataDir string) (turnCrea
 	}
 
 	return turnCreateRequest{
-		Stream:  stream,
-		Prompt:  agents.NormalizePrompt(agents.Prompt{Content: content}),
-		Uploads: attachments,
+		Stream:     stream,
+		Background: background,
+		Prompt:     agents.NormalizePrompt(agents.Prompt{Content: content}),
+		Uploads:    attachments,
 	}, nil
 }
 
@@ -4420,6 +7324,12 @@ func (w *loggingResponseWriter) Flush() {
 	flusher.Flush()
 }
 
+// FlushError flushes like Flush but reports failures, so SSE streams notice a
+// dead connection.
+func (w *loggingResponseWriter) FlushError() error {
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
 func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hijacker, ok := w.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -4486,41 +7396,59 @@ func requestLogPath(r *http.Request) string {
 	return observability.RedactString(path)
 }
 
+// currentAuthToken returns the active bearer token; empty disables auth.
+func (s *Server) currentAuthToken() string {
+	token, _ := s.authToken.Load().(string)
+	return token
+}
+
 func (s *Server) isAuthorized(r *http.Request) bool {
-	if s.authToken == "" {
+	if s.currentAuthToken() == "" {
 		return true
 	}
 
+	provided := bearerToken(r)
+	return s.matchesAuthToken(provided) || matchesToken(provided, s.adminToken)
+}
+
+// isAdmin reports whether the request carries the admin bearer token.
+func (s *Server) isAdmin(r *http.Request) bool {
+	return matchesToken(bearerToken(r), s.adminToken)
+}
+
+func bearerToken(r *http.Request) string {
 	const prefix = "Bearer "
 	authHeader := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authHeader, prefix) {
-		return false
+		return ""
 	}
-
-	provided := strings.TrimSpace(strings.TrimPrefix(authHeader, prefix))
-	return s.matchesAuthToken(provided)
+	return strings.TrimSpace(strings.TrimPrefix(authHeader, prefix))
 }
 
 func (s *Server) isAttachmentAuthorized(r *http.Request) bool {
 	if s.isAuthorized(r) {
 		return true
 	}
-	if s.authToken == "" || r == nil || r.URL == nil {
-		return s.authToken == ""
+	if s.currentAuthToken() == "" || r == nil || r.URL == nil {
+		return s.currentAuthToken() == ""
 	}
 	return s.matchesAuthToken(strings.TrimSpace(r.URL.Query().Get("access_token")))
 }
 
 func (s *Server) matchesAuthToken(provided string) bool {
-	if provided == "" {
+	return matchesToken(provided, s.currentAuthToken())
+}
+
+func matchesToken(provided, want string) bool {
+	if provided == "" || want == "" {
 		return false
 	}
 
-	if len(provided) != len(s.authToken) {
+	if len(provided) != len(want) {
 		return false
 	}
 
-	return subtle.ConstantTimeCompare([]byte(provided), []byte(s.authToken)) == 1
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(want)) == 1
 }
 
 func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,7 @@ package httpapi
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -17,17 +18,21 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/beyond5959/ngent/internal/agents"
 	"github.com/beyond5959/ngent/internal/agents/acp"
 	"github.com/beyond5959/ngent/internal/agents/acpmodel"
+	"github.com/beyond5959/ngent/internal/agents/echo"
 	"github.com/beyond5959/ngent/internal/observability"
 	runtimectl "github.com/beyond5959/ngent/internal/runtime"
+	"github.com/beyond5959/ngent/internal/sse"
 	"github.com/beyond5959/ngent/internal/storage"
 )
 
@@ -53,6 +58,84 @@ func TestHealthz(t *testing.T) {
 	}
 }
 
+func TestHealthzVerboseAndReadyzReportStorage(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+
+	verboseRR := performJSONRequest(t, h, http.MethodGet, "/healthz?verbose=1", nil, nil)
+	if verboseRR.Code != http.StatusOK {
+		t.Fatalf("verbose healthz status = %d, want %d", verboseRR.Code, http.StatusOK)
+	}
+	var verbose struct {
+		OK     bool              `json:"ok"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(verboseRR.Body.Bytes(), &verbose); err != nil {
+		t.Fatalf("unmarshal verbose healthz: %v", err)
+	}
+	if !verbose.OK || verbose.Checks["storage"] != "ok" {
+		t.Fatalf("verbose healthz = %+v, want ok storage", verbose)
+	}
+
+	readyRR := performJSONRequest(t, h, http.MethodGet, "/readyz", nil, nil)
+	if readyRR.Code != http.StatusOK {
+		t.Fatalf("readyz status = %d, want %d", readyRR.Code, http.StatusOK)
+	}
+
+	if err := h.store.(*storage.Store).Close(); err != nil {
+		t.Fatalf("close store: %v", err)
+	}
+
+	notReadyRR := performJSONRequest(t, h, http.MethodGet, "/readyz", nil, nil)
+	if notReadyRR.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz after close status = %d, want %d", notReadyRR.Code, http.StatusServiceUnavailable)
+	}
+	var notReady struct {
+		OK     bool              `json:"ok"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(notReadyRR.Body.Bytes(), &notReady); err != nil {
+		t.Fatalf("unmarshal readyz: %v", err)
+	}
+	if notReady.OK || notReady.Checks["storage"] == "ok" {
+		t.Fatalf("readyz after close = %+v, want storage failure", notReady)
+	}
+
+	plainRR := performJSONRequest(t, h, http.MethodGet, "/healthz", nil, nil)
+	if plainRR.Code != http.StatusOK {
+		t.Fatalf("plain healthz status = %d, want %d (liveness only)", plainRR.Code, http.StatusOK)
+	}
+}
+
+func TestSwapStoreWaitsForInFlightRequests(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	next, err := storage.New(filepath.Join(t.TempDir(), "next.db"))
+	if err != nil {
+		t.Fatalf("storage.New(next): %v", err)
+	}
+	t.Cleanup(func() { _ = next.Close() })
+
+	h.storeGate.RLock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = h.SwapStore(ctx, next)
+	cancel()
+	if err == nil {
+		t.Fatalf("SwapStore() with an in-flight request err = nil, want timeout")
+	}
+	h.storeGate.RUnlock()
+
+	previous, err := h.SwapStore(context.Background(), next)
+	if err != nil {
+		t.Fatalf("SwapStore() after drain: %v", err)
+	}
+	if previous == nil || previous == ThreadStore(next) {
+		t.Fatalf("SwapStore() previous = %v, want original store", previous)
+	}
+	if h.store != ThreadStore(next) {
+		t.Fatalf("server store was not swapped")
+	}
+	_ = previous.(*storage.Store).Close()
+}
+
 func TestRequestCompletionLogIncludesPathIPAndStatus(t *testing.T) {
 	var logBuf bytes.Buffer
 	logger := observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo)
@@ -282,6 +365,149 @@ func TestV1AgentModelsNotFound(t *testing.T) {
 	assertErrorCode(t, rr.Body.Bytes(), "NOT_FOUND")
 }
 
+func TestHTMLErrorPagesNegotiateNonAPIPaths(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	browserAccept := map[string]string{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}
+
+	rr := performJSONRequest(t, h, http.MethodGet, "/missing-page", nil, browserAccept)
+	if rr.Code != http.StatusNotFound || !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("default status = %d, content type = %q, want JSON 404", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	h.htmlErrorPages = true
+	rr = performJSONRequest(t, h, http.MethodGet, "/missing-page?x=<script>", nil, browserAccept)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("html status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("html content type = %q, want text/html", got)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "<h1>404 Not Found</h1>") || strings.Contains(body, "<script>") {
+		t.Fatalf("html body = %s, want escaped 404 page", body)
+	}
+
+	rr = performJSONRequest(t, h, http.MethodGet, "/missing-page", nil, map[string]string{"Accept": "application/json, text/html;q=0.5"})
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("json-preferring status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), codeNotFound)
+
+	browserAccept["X-Client-ID"] = "client-a"
+	rr = performJSONRequest(t, h, http.MethodGet, "/v1/bogus", nil, browserAccept)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("/v1 status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), codeNotFound)
+}
+
+func TestUnknownV1PathsListValidRoutes(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+
+	notFoundDetails := func(path string) map[string]any {
+		t.Helper()
+		rr := performJSONRequest(t, h, http.MethodGet, path, nil, map[string]string{"X-Client-ID": "client-a"})
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("GET %s status = %d, want %d", path, rr.Code, http.StatusNotFound)
+		}
+		assertErrorCode(t, rr.Body.Bytes(), "NOT_FOUND")
+		var body struct {
+			Error struct {
+				Details map[string]any `json:"details"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("unmarshal error response: %v", err)
+		}
+		return body.Error.Details
+	}
+	hasEntry := func(value any, want string) bool {
+		list, _ := value.([]any)
+		for _, item := range list {
+			if item == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	details := notFoundDetails("/v1/threads/th-1/bogus")
+	if !hasEntry(details["validSubresources"], "turns") || !hasEntry(details["validSubresources"], "history") {
+		t.Fatalf("thread subresource details = %v, want validSubresources with turns and history", details)
+	}
+	details = notFoundDetails("/v1/bogus")
+	if !hasEntry(details["knownCollections"], "/v1/threads") || !hasEntry(details["knownCollections"], "/v1/agents") {
+		t.Fatalf("collection details = %v, want knownCollections with /v1/threads and /v1/agents", details)
+	}
+
+	h.routeHints = false
+	details = notFoundDetails("/v1/threads/th-1/bogus")
+	if _, ok := details["validSubresources"]; ok {
+		t.Fatalf("details with route hints off = %v, want no validSubresources", details)
+	}
+	if got := details["path"]; got != "/v1/threads/th-1/bogus" {
+		t.Fatalf("details.path = %v, want request path", got)
+	}
+}
+
+func TestDisabledEndpointsReturnForbidden(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	headers := map[string]string{"X-Client-ID": "client-a"}
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	status, body := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID+"/history", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("history status before disabling = %d, body=%s", status, body)
+	}
+
+	disabled, errs := buildDisabledEndpoints([]string{"compact", "History", "delete thread", "agents"})
+	if len(errs) != 0 {
+		t.Fatalf("buildDisabledEndpoints() errs = %v", errs)
+	}
+	h.disabledEndpoints = disabled
+
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodPost, path: "/v1/threads/" + threadID + "/compact"},
+		{method: http.MethodGet, path: "/v1/threads/" + threadID + "/history"},
+		{method: http.MethodDelete, path: "/v1/threads/" + threadID},
+		{method: http.MethodGet, path: "/v1/agents"},
+	} {
+		status, body := doJSON(t, tc.method, ts.URL+tc.path, map[string]any{}, headers)
+		if status != http.StatusForbidden {
+			t.Fatalf("%s %s status = %d, want %d, body=%s", tc.method, tc.path, status, http.StatusForbidden, body)
+		}
+		assertErrorCode(t, []byte(body), codeForbidden)
+	}
+
+	// Disabling one method leaves the others on the same endpoint alone.
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID, nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("GET thread status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+
+	h.disabledEndpoints = nil
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID+"/history", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("history status after re-enabling = %d, body=%s", status, body)
+	}
+}
+
+func TestValidateDisabledEndpoints(t *testing.T) {
+	if err := ValidateDisabledEndpoints([]string{"compact", "GET history", "turn-cancel"}); err != nil {
+		t.Fatalf("ValidateDisabledEndpoints(valid) = %v", err)
+	}
+	for _, entry := range []string{"compaction", "GET", "GET history now"} {
+		if err := ValidateDisabledEndpoints([]string{entry}); err == nil {
+			t.Fatalf("ValidateDisabledEndpoints(%q) = nil, want error", entry)
+		}
+	}
+}
+
 func TestV1AgentModelsEmptyWhenNoStoredCatalog(t *testing.T) {
 	h := newTestServer(t, testServerOptions{
 		allowedAgentIDs: []string{"codex"},
@@ -351,6 +577,91 @@ func TestV1AuthToggle(t *testing.T) {
 	}
 }
 
+func TestRotateAuthTokenRejectsOldToken(t *testing.T) {
+	h := newTestServer(t, testServerOptions{authToken: "old-token"})
+
+	agentsStatus := func(token string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+		req.Header.Set("X-Client-ID", "client-a")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	rr := performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "new-token"}, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer wrong-token",
+	})
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("rotate with wrong token status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr = performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "  "}, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer old-token",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("rotate with empty token status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "new-token"}, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer old-token",
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rotate status = %d, want %d; body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if got := agentsStatus("old-token"); got != http.StatusUnauthorized {
+		t.Fatalf("old token status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := agentsStatus("new-token"); got != http.StatusOK {
+		t.Fatalf("new token status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestRotateAuthTokenRequiresAdminTokenWhenConfigured(t *testing.T) {
+	h := newTestServer(t, testServerOptions{authToken: "old-token"})
+	h.adminToken = "admin-token"
+
+	rr := performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "new-token"}, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer old-token",
+	})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("rotate with auth token status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), "FORBIDDEN")
+	if got := h.currentAuthToken(); got != "old-token" {
+		t.Fatalf("auth token = %q after rejected rotation, want old-token", got)
+	}
+
+	rr = performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "new-token"}, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer admin-token",
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rotate with admin token status = %d, want %d; body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if got := h.currentAuthToken(); got != "new-token" {
+		t.Fatalf("auth token = %q, want new-token", got)
+	}
+}
+
+func TestRotateAuthTokenForbiddenWhenAuthDisabled(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+
+	rr := performJSONRequest(t, h, http.MethodPost, "/v1/admin/auth-token", map[string]any{"token": "new-token"}, map[string]string{
+		"X-Client-ID": "client-a",
+	})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("rotate without auth status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), "FORBIDDEN")
+}
+
 func TestCreateThreadValidationCWDAbsolute(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
@@ -392,6 +703,40 @@ func TestCreateThreadValidationCWDExists(t *testing.T) {
 	assertErrorCode(t, rr.Body.Bytes(), "INVALID_ARGUMENT")
 }
 
+func TestCreateThreadValidationCWDLimits(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	rootDepth := len(strings.Split(strings.Trim(filepath.ToSlash(root), "/"), "/"))
+	h.cwdLimits = CWDRules{MaxLength: len(root) + 10, MaxDepth: rootDepth + 3}
+
+	for name, tc := range map[string]struct {
+		cwd    string
+		reason string
+	}{
+		"over length": {cwd: filepath.Join(root, strings.Repeat("a", 20)), reason: "bytes long"},
+		"over depth":  {cwd: filepath.Join(root, "a", "b", "c", "d"), reason: "directories deep"},
+	} {
+		body := map[string]any{"agent": "codex", "cwd": tc.cwd}
+		rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads", body, map[string]string{"X-Client-ID": "client-a"})
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status code = %d, want %d", name, rr.Code, http.StatusBadRequest)
+		}
+		assertErrorCode(t, rr.Body.Bytes(), "INVALID_ARGUMENT")
+		if !strings.Contains(rr.Body.String(), tc.reason) {
+			t.Fatalf("%s: body = %s, want reason mentioning %q", name, rr.Body.String(), tc.reason)
+		}
+	}
+
+	within := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(within, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	body := map[string]any{"agent": "codex", "cwd": within}
+	if rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads", body, map[string]string{"X-Client-ID": "client-a"}); rr.Code != http.StatusOK {
+		t.Fatalf("within limits: status code = %d, want %d, body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+}
+
 func TestCreateThreadValidationAgentAllowlist(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
@@ -732,6 +1077,125 @@ func TestDeleteThreadRemovesThreadAndHistory(t *testing.T) {
 	assertErrorCode(t, historyRR.Body.Bytes(), "NOT_FOUND")
 }
 
+func TestCreateThreadRunsAgentCWDValidator(t *testing.T) {
+	root := t.TempDir()
+	deep := filepath.Join(root, "a", "b", "c")
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.cwdValidators = map[string]CWDValidator{
+		"codex": CWDRules{MaxDepth: strings.Count(filepath.ToSlash(root), "/") + 2}.Validate,
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads", map[string]any{"agent": "codex", "cwd": deep}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("create thread in deep cwd status = %d, want %d, body=%s", status, http.StatusBadRequest, body)
+	}
+	assertErrorCode(t, []byte(body), codeInvalidArgument)
+	if !strings.Contains(body, "directories deep") {
+		t.Fatalf("error body = %s, want agent-specific reason", body)
+	}
+
+	createThreadHTTP(t, ts.URL, "client-a", filepath.Join(root, "a"))
+}
+
+func TestHistoryDefaultsApplyOnlyWhenParamsAbsent(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	if result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello"); result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+	if _, err := h.store.CreateTurn(context.Background(), storage.CreateTurnParams{
+		TurnID:      "tu-internal",
+		ThreadID:    threadID,
+		RequestText: "compact",
+		Status:      "completed",
+		IsInternal:  true,
+	}); err != nil {
+		t.Fatalf("CreateTurn(internal): %v", err)
+	}
+
+	// history returns the turn count and whether any turn carried events.
+	history := func(query string) (int, bool) {
+		t.Helper()
+		status, body := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID+"/history"+query, nil, map[string]string{"X-Client-ID": "client-a"})
+		if status != http.StatusOK {
+			t.Fatalf("history%s status = %d, body=%s", query, status, body)
+		}
+		var resp historyWithEventsResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("unmarshal history%s: %v", query, err)
+		}
+		hasEvents := false
+		for _, turn := range resp.Turns {
+			hasEvents = hasEvents || len(turn.Events) > 0
+		}
+		return len(resp.Turns), hasEvents
+	}
+
+	if turns, events := history(""); turns != 1 || events {
+		t.Fatalf("history with zero defaults = (%d turns, events=%v), want (1, false)", turns, events)
+	}
+
+	h.historyDefaults = HistoryDefaults{IncludeEvents: true, IncludeInternal: true}
+	if turns, events := history(""); turns != 2 || !events {
+		t.Fatalf("history with defaults on = (%d turns, events=%v), want (2, true)", turns, events)
+	}
+	if turns, events := history("?includeEvents=false&includeInternal=0"); turns != 1 || events {
+		t.Fatalf("explicit false params = (%d turns, events=%v), want (1, false)", turns, events)
+	}
+	if turns, events := history("?includeInternal=false"); turns != 1 || !events {
+		t.Fatalf("explicit includeInternal=false = (%d turns, events=%v), want (1, true)", turns, events)
+	}
+}
+
+func TestListThreadsTruncatesAtMaxThreadList(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.maxThreadList = 3
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	for i := 0; i < 5; i++ {
+		createThreadHTTP(t, ts.URL, "client-a", root)
+	}
+
+	listRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads", nil, map[string]string{"X-Client-ID": "client-a"})
+	if listRR.Code != http.StatusOK {
+		t.Fatalf("list status code = %d, want %d", listRR.Code, http.StatusOK)
+	}
+	var listBody struct {
+		Threads   []threadResponse `json:"threads"`
+		Truncated bool             `json:"truncated"`
+	}
+	if err := json.Unmarshal(listRR.Body.Bytes(), &listBody); err != nil {
+		t.Fatalf("unmarshal list response: %v", err)
+	}
+	if got, want := len(listBody.Threads), 3; got != want {
+		t.Fatalf("len(threads) = %d, want %d", got, want)
+	}
+	if !listBody.Truncated {
+		t.Fatalf("truncated = false, want true")
+	}
+
+	h.maxThreadList = 5
+	listRR = performJSONRequest(t, h, http.MethodGet, "/v1/threads", nil, map[string]string{"X-Client-ID": "client-a"})
+	listBody.Truncated = true
+	if err := json.Unmarshal(listRR.Body.Bytes(), &listBody); err != nil {
+		t.Fatalf("unmarshal list response: %v", err)
+	}
+	if len(listBody.Threads) != 5 || listBody.Truncated {
+		t.Fatalf("at cap: len(threads) = %d, truncated = %v; want 5, false", len(listBody.Threads), listBody.Truncated)
+	}
+}
+
 func TestDeleteThreadConflictWhenActiveTurn(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{
@@ -3133,12 +3597,17 @@ func TestTurnsSSEIncludesReasoningAndPersistsHistory(t *testing.T) {
 	}
 }
 
-func TestTurnsSSEIncludesPlanUpdatesAndPersistsHistory(t *testing.T) {
+func TestEventDeliveryPersistOnlyAndStreamOnly(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{
 		allowedRoots: []string{root},
 		agent:        &planStreamer{},
 	})
+	h.eventDelivery = map[string]EventDelivery{
+		"plan_update":   {Persist: true},
+		"turn_started":  {Stream: true},
+		"message_delta": {Stream: true, Persist: true},
+	}
 
 	threadID := createThreadForClient(t, h, "client-a", root)
 
@@ -3150,45 +3619,25 @@ func TestTurnsSSEIncludesPlanUpdatesAndPersistsHistory(t *testing.T) {
 		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
 	}
 
-	events := parseSSEEvents(t, turnRR.Body.String())
-	var lastPlanEntries []any
-	planCount := 0
-	for _, ev := range events {
-		if ev.Event != "plan_update" {
-			continue
-		}
-		planCount++
-		rawEntries, ok := ev.Data["entries"].([]any)
-		if !ok {
-			t.Fatalf("plan_update.entries type = %T, want []any", ev.Data["entries"])
-		}
-		lastPlanEntries = rawEntries
-	}
-	if planCount != 2 {
-		t.Fatalf("plan_update count = %d, want %d", planCount, 2)
-	}
-	if got := len(lastPlanEntries); got != 2 {
-		t.Fatalf("len(lastPlanEntries) = %d, want %d", got, 2)
+	streamed := map[string]int{}
+	for _, ev := range parseSSEEvents(t, turnRR.Body.String()) {
+		streamed[ev.Event]++
 	}
-	lastEntry, ok := lastPlanEntries[1].(map[string]any)
-	if !ok {
-		t.Fatalf("last plan entry type = %T, want map[string]any", lastPlanEntries[1])
+	if streamed["plan_update"] != 0 {
+		t.Fatalf("persist-only plan_update was streamed %d times", streamed["plan_update"])
 	}
-	if got := stringField(lastEntry, "content"); got != "Apply patch" {
-		t.Fatalf("last plan entry content = %q, want %q", got, "Apply patch")
+	if streamed["turn_started"] != 1 || streamed["message_delta"] == 0 || streamed["turn_completed"] != 1 {
+		t.Fatalf("streamed events = %v, want turn_started, message_delta, turn_completed", streamed)
 	}
 
 	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
 	if historyRR.Code != http.StatusOK {
 		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
 	}
-
 	var history struct {
 		Turns []struct {
-			ResponseText string `json:"responseText"`
-			Events       []struct {
-				Type string         `json:"type"`
-				Data map[string]any `json:"data"`
+			Events []struct {
+				Type string `json:"type"`
 			} `json:"events"`
 		} `json:"turns"`
 	}
@@ -3198,26 +3647,173 @@ func TestTurnsSSEIncludesPlanUpdatesAndPersistsHistory(t *testing.T) {
 	if got, want := len(history.Turns), 1; got != want {
 		t.Fatalf("len(history.turns) = %d, want %d", got, want)
 	}
-	if got := history.Turns[0].ResponseText; got != "final answer" {
-		t.Fatalf("history responseText = %q, want %q", got, "final answer")
-	}
-
-	seenPlanUpdate := false
+	persisted := map[string]int{}
 	for _, event := range history.Turns[0].Events {
-		if event.Type != "plan_update" {
-			continue
-		}
-		seenPlanUpdate = true
-		rawEntries, ok := event.Data["entries"].([]any)
-		if !ok {
-			t.Fatalf("history plan_update.entries type = %T, want []any", event.Data["entries"])
-		}
-		if len(rawEntries) == 0 {
-			t.Fatalf("history plan_update.entries is empty")
-		}
+		persisted[event.Type]++
 	}
-	if !seenPlanUpdate {
-		t.Fatalf("missing persisted plan_update event")
+	if persisted["plan_update"] != 2 {
+		t.Fatalf("persisted plan_update count = %d, want 2", persisted["plan_update"])
+	}
+	if persisted["turn_started"] != 0 {
+		t.Fatalf("stream-only turn_started was persisted %d times", persisted["turn_started"])
+	}
+}
+
+func TestEventNameMappingRenamesStreamOnly(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        &planStreamer{},
+	})
+	names, errs := buildEventNames(map[string]string{
+		"message_delta":  "message.delta",
+		"turn_completed": "turn.completed",
+		"plan_update":    "bad\nname",
+		"turn_started":   "turn.completed",
+	})
+	if len(errs) != 2 {
+		t.Fatalf("buildEventNames errors = %v, want 2", errs)
+	}
+	h.sseFlush.EventNames = names
+
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "show plan",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+
+	streamed := map[string]int{}
+	for _, ev := range parseSSEEvents(t, turnRR.Body.String()) {
+		streamed[ev.Event]++
+	}
+	if streamed["message.delta"] == 0 || streamed["turn.completed"] != 1 {
+		t.Fatalf("streamed events = %v, want message.delta and turn.completed", streamed)
+	}
+	if streamed["message_delta"] != 0 || streamed["turn_completed"] != 0 {
+		t.Fatalf("streamed events = %v, want no canonical names for remapped types", streamed)
+	}
+	if streamed["turn_started"] != 1 || streamed["plan_update"] == 0 {
+		t.Fatalf("streamed events = %v, want unmapped turn_started and plan_update unchanged", streamed)
+	}
+
+	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
+	if historyRR.Code != http.StatusOK {
+		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
+	}
+	var history struct {
+		Turns []struct {
+			Events []struct {
+				Type string `json:"type"`
+			} `json:"events"`
+		} `json:"turns"`
+	}
+	if err := json.Unmarshal(historyRR.Body.Bytes(), &history); err != nil {
+		t.Fatalf("unmarshal history: %v", err)
+	}
+	if got, want := len(history.Turns), 1; got != want {
+		t.Fatalf("len(history.turns) = %d, want %d", got, want)
+	}
+	persisted := map[string]int{}
+	for _, event := range history.Turns[0].Events {
+		persisted[event.Type]++
+	}
+	if persisted["message_delta"] == 0 || persisted["turn_completed"] != 1 {
+		t.Fatalf("persisted events = %v, want canonical message_delta and turn_completed", persisted)
+	}
+	if persisted["message.delta"] != 0 || persisted["turn.completed"] != 0 {
+		t.Fatalf("persisted events = %v, want no remapped names", persisted)
+	}
+}
+
+func TestTurnsSSEIncludesPlanUpdatesAndPersistsHistory(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        &planStreamer{},
+	})
+
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "show plan",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+
+	events := parseSSEEvents(t, turnRR.Body.String())
+	var lastPlanEntries []any
+	planCount := 0
+	for _, ev := range events {
+		if ev.Event != "plan_update" {
+			continue
+		}
+		planCount++
+		rawEntries, ok := ev.Data["entries"].([]any)
+		if !ok {
+			t.Fatalf("plan_update.entries type = %T, want []any", ev.Data["entries"])
+		}
+		lastPlanEntries = rawEntries
+	}
+	if planCount != 2 {
+		t.Fatalf("plan_update count = %d, want %d", planCount, 2)
+	}
+	if got := len(lastPlanEntries); got != 2 {
+		t.Fatalf("len(lastPlanEntries) = %d, want %d", got, 2)
+	}
+	lastEntry, ok := lastPlanEntries[1].(map[string]any)
+	if !ok {
+		t.Fatalf("last plan entry type = %T, want map[string]any", lastPlanEntries[1])
+	}
+	if got := stringField(lastEntry, "content"); got != "Apply patch" {
+		t.Fatalf("last plan entry content = %q, want %q", got, "Apply patch")
+	}
+
+	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
+	if historyRR.Code != http.StatusOK {
+		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
+	}
+
+	var history struct {
+		Turns []struct {
+			ResponseText string `json:"responseText"`
+			Events       []struct {
+				Type string         `json:"type"`
+				Data map[string]any `json:"data"`
+			} `json:"events"`
+		} `json:"turns"`
+	}
+	if err := json.Unmarshal(historyRR.Body.Bytes(), &history); err != nil {
+		t.Fatalf("unmarshal history: %v", err)
+	}
+	if got, want := len(history.Turns), 1; got != want {
+		t.Fatalf("len(history.turns) = %d, want %d", got, want)
+	}
+	if got := history.Turns[0].ResponseText; got != "final answer" {
+		t.Fatalf("history responseText = %q, want %q", got, "final answer")
+	}
+
+	seenPlanUpdate := false
+	for _, event := range history.Turns[0].Events {
+		if event.Type != "plan_update" {
+			continue
+		}
+		seenPlanUpdate = true
+		rawEntries, ok := event.Data["entries"].([]any)
+		if !ok {
+			t.Fatalf("history plan_update.entries type = %T, want []any", event.Data["entries"])
+		}
+		if len(rawEntries) == 0 {
+			t.Fatalf("history plan_update.entries is empty")
+		}
+	}
+	if !seenPlanUpdate {
+		t.Fatalf("missing persisted plan_update event")
 	}
 }
 
@@ -3320,65 +3916,54 @@ func TestTurnsSSEIncludesToolCallUpdatesAndPersistsHistory(t *testing.T) {
 	}
 }
 
-func TestTurnsSSEIncludesStructuredMessageContentAndPersistsHistory(t *testing.T) {
+func TestTurnStepsGroupMultiPhaseTurn(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{
 		allowedRoots: []string{root},
-		agent:        &messageContentStreamer{},
+		agent:        &multiPhaseStreamer{},
 	})
+	h.emitTurnSteps = true
 
 	threadID := createThreadForClient(t, h, "client-a", root)
-
 	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
-		"input":  "show content",
+		"input":  "run tool",
 		"stream": true,
 	}, map[string]string{"X-Client-ID": "client-a"})
 	if turnRR.Code != http.StatusOK {
 		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
 	}
 
-	events := parseSSEEvents(t, turnRR.Body.String())
-	var seenContent int
-	for _, ev := range events {
-		if ev.Event != eventTypeMessageContent {
-			continue
-		}
-		seenContent += 1
-		content, ok := ev.Data["content"].(map[string]any)
-		if !ok {
-			t.Fatalf("message_content.content type = %T, want map[string]any", ev.Data["content"])
-		}
-		if seenContent == 1 {
-			if got := stringField(content, "type"); got != "image" {
-				t.Fatalf("first message_content.type = %q, want %q", got, "image")
-			}
-		}
-		if seenContent == 2 {
-			if got := stringField(content, "type"); got != "resource" {
-				t.Fatalf("second message_content.type = %q, want %q", got, "resource")
-			}
-			resource, ok := content["resource"].(map[string]any)
-			if !ok {
-				t.Fatalf("message_content.resource type = %T, want map[string]any", content["resource"])
-			}
-			if got := stringField(resource, "uri"); got != "file:///tmp/demo.txt" {
-				t.Fatalf("message_content.resource.uri = %q, want %q", got, "file:///tmp/demo.txt")
+	want := []string{
+		"reasoning_delta step-1 thinking",
+		"reasoning_delta step-1 thinking",
+		"message_delta step-2 answer",
+		"tool_call step-3 tool_request",
+		"reasoning_delta step-4 thinking",
+		"tool_call_update step-3 tool_result",
+		"message_delta step-5 answer",
+	}
+	var got []string
+	for _, ev := range parseSSEEvents(t, turnRR.Body.String()) {
+		stepID := stringField(ev.Data, "stepId")
+		if stepID == "" {
+			if _, ok := ev.Data["phase"]; ok {
+				t.Fatalf("%s has phase without stepId: %v", ev.Event, ev.Data)
 			}
+			continue
 		}
+		got = append(got, ev.Event+" "+stepID+" "+stringField(ev.Data, "phase"))
 	}
-	if seenContent != 2 {
-		t.Fatalf("seen %d message_content events, want 2", seenContent)
+	if !slices.Equal(got, want) {
+		t.Fatalf("SSE steps = %q, want %q", got, want)
 	}
 
 	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
 	if historyRR.Code != http.StatusOK {
 		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
 	}
-
 	var history struct {
 		Turns []struct {
-			ResponseText string `json:"responseText"`
-			Events       []struct {
+			Events []struct {
 				Type string         `json:"type"`
 				Data map[string]any `json:"data"`
 			} `json:"events"`
@@ -3387,101 +3972,440 @@ func TestTurnsSSEIncludesStructuredMessageContentAndPersistsHistory(t *testing.T
 	if err := json.Unmarshal(historyRR.Body.Bytes(), &history); err != nil {
 		t.Fatalf("unmarshal history: %v", err)
 	}
-	if got, want := len(history.Turns), 1; got != want {
-		t.Fatalf("len(history.turns) = %d, want %d", got, want)
-	}
-	if got := history.Turns[0].ResponseText; got != "preview:\n\ndone" {
-		t.Fatalf("history responseText = %q, want %q", got, "preview:\n\ndone")
+	if len(history.Turns) != 1 {
+		t.Fatalf("history turns = %d, want 1", len(history.Turns))
 	}
-
-	var historyContent int
-	for _, event := range history.Turns[0].Events {
-		if event.Type != eventTypeMessageContent {
-			continue
+	var persisted []string
+	for _, ev := range history.Turns[0].Events {
+		if stepID := stringField(ev.Data, "stepId"); stepID != "" {
+			persisted = append(persisted, ev.Type+" "+stepID+" "+stringField(ev.Data, "phase"))
 		}
-		historyContent += 1
 	}
-	if historyContent != 2 {
-		t.Fatalf("history message_content events = %d, want 2", historyContent)
+	if !slices.Contains(persisted, "tool_call_update step-3 tool_result") || !slices.Contains(persisted, "message_delta step-5 answer") {
+		t.Fatalf("persisted steps = %q, want tool result and final answer steps", persisted)
 	}
 }
 
-func TestCodexTurnWorksWithoutBinaryPathConfig(t *testing.T) {
+func TestStreamReplayEventsPrecedeLiveEvents(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
-	ts := httptest.NewServer(h)
-	defer ts.Close()
+	threadID := createThreadForClient(t, h, "client-a", root)
 
-	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
-	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello without codex binary path config")
-	if result.StatusCode != http.StatusOK {
-		t.Fatalf("turn stream status = %d, want %d", result.StatusCode, http.StatusOK)
+	firstRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "first",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if firstRR.Code != http.StatusOK {
+		t.Fatalf("first turn status code = %d, want %d", firstRR.Code, http.StatusOK)
+	}
+	firstEvents := parseSSEEvents(t, firstRR.Body.String())
+	firstTurnID := stringField(firstEvents[0].Data, "turnId")
+	persisted, err := h.store.ListEventsByTurn(context.Background(), firstTurnID)
+	if err != nil {
+		t.Fatalf("ListEventsByTurn: %v", err)
+	}
+	if len(persisted) < 3 {
+		t.Fatalf("first turn persisted %d events, want at least 3", len(persisted))
 	}
 
-	events := parseSSEEvents(t, result.Body)
-	seenDelta := false
-	seenCompleted := false
-	for _, ev := range events {
-		if ev.Event == "message_delta" && stringField(ev.Data, "delta") != "" {
-			seenDelta = true
+	h.streamReplayEvents = 3
+	secondRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "second",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if secondRR.Code != http.StatusOK {
+		t.Fatalf("second turn status code = %d, want %d", secondRR.Code, http.StatusOK)
+	}
+	secondEvents := parseSSEEvents(t, secondRR.Body.String())
+	if len(secondEvents) < 4 {
+		t.Fatalf("second turn events = %v, want replay plus live events", secondEvents)
+	}
+
+	for i, want := range persisted[len(persisted)-3:] {
+		got := secondEvents[i]
+		if got.Event != eventTypeReplay {
+			t.Fatalf("event[%d] = %q, want %q", i, got.Event, eventTypeReplay)
 		}
-		if ev.Event == "turn_completed" {
-			seenCompleted = true
+		if stringField(got.Data, "turnId") != firstTurnID || stringField(got.Data, "type") != want.Type || got.Data["seq"] != float64(want.Seq) {
+			t.Fatalf("event[%d] = %v, want replay of %s #%d from %s", i, got.Data, want.Type, want.Seq, firstTurnID)
 		}
 	}
-	if !seenDelta {
-		t.Fatalf("expected at least one message_delta event")
+	if secondEvents[3].Event != "turn_started" {
+		t.Fatalf("event[3] = %q, want turn_started after replay", secondEvents[3].Event)
 	}
-	if !seenCompleted {
-		t.Fatalf("expected turn_completed event")
+	for _, ev := range secondEvents[4:] {
+		if ev.Event == eventTypeReplay {
+			t.Fatalf("replay event after live events: %v", ev.Data)
+		}
 	}
 }
 
-func TestTurnCancel(t *testing.T) {
+func TestStreamReplaySkipsAuditAndInternalEvents(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
-	ts := httptest.NewServer(h)
-	defer ts.Close()
-
-	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
-
-	streamResultCh := make(chan httpTurnStreamResult, 1)
-	go func() {
-		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", threadID, strings.Repeat("cancel-me-", 60))
-	}()
+	h.auditStreams = true
+	h.emitTurnContext = true
+	threadID := createThreadForClient(t, h, "client-a", root)
 
-	turnID := waitForTurnID(t, ts.URL, "client-a", threadID, 4*time.Second)
-	if turnID == "" {
-		t.Fatalf("failed to observe running turn before timeout")
+	runTurn := func(input string) []parsedSSEEvent {
+		t.Helper()
+		rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+			"input":  input,
+			"stream": true,
+		}, map[string]string{"X-Client-ID": "client-a"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s turn status code = %d, want %d", input, rr.Code, http.StatusOK)
+		}
+		return parseSSEEvents(t, rr.Body.String())
 	}
 
-	cancelStatus, cancelBody := postCancel(t, ts.URL, "client-a", turnID)
-	if cancelStatus != http.StatusOK {
-		t.Fatalf("cancel status = %d, want %d, body=%s", cancelStatus, http.StatusOK, cancelBody)
+	firstTurnID := stringField(runTurn("first")[0].Data, "turnId")
+	persisted, err := h.store.ListEventsByTurn(context.Background(), firstTurnID)
+	if err != nil {
+		t.Fatalf("ListEventsByTurn: %v", err)
 	}
-
-	streamResult := <-streamResultCh
-	if streamResult.StatusCode != http.StatusOK {
-		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	persistedTypes := make([]string, 0, len(persisted))
+	for _, event := range persisted {
+		persistedTypes = append(persistedTypes, event.Type)
+	}
+	if !slices.Contains(persistedTypes, eventTypeStreamOpened) || !slices.Contains(persistedTypes, eventTypeTurnContext) {
+		t.Fatalf("first turn persisted %v, want audit and turn_context events", persistedTypes)
 	}
 
-	events := parseSSEEvents(t, streamResult.Body)
-	lastCompletedReason := ""
-	for _, ev := range events {
-		if ev.Event == "turn_completed" {
-			lastCompletedReason = stringField(ev.Data, "stopReason")
+	h.streamReplayEvents = 50
+	var replayed []string
+	for _, ev := range runTurn("second") {
+		if ev.Event == eventTypeReplay {
+			replayed = append(replayed, stringField(ev.Data, "type"))
 		}
 	}
-	if lastCompletedReason != "cancelled" {
-		t.Fatalf("turn_completed.stopReason = %q, want %q", lastCompletedReason, "cancelled")
+	if !slices.Contains(replayed, "turn_completed") {
+		t.Fatalf("replayed %v, want turn output of the first turn", replayed)
 	}
-
-	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
-	if len(history.Turns) == 0 {
-		t.Fatalf("history turns is empty")
+	for _, eventType := range replayed {
+		if _, skipped := streamReplaySkippedEvents[eventType]; skipped {
+			t.Fatalf("replayed %v, want no %s", replayed, eventType)
+		}
 	}
-	if got := history.Turns[len(history.Turns)-1].StopReason; got != "cancelled" {
-		t.Fatalf("history stopReason = %q, want %q", got, "cancelled")
+}
+
+func TestAuditStreamsRecordsStreamLifecycleInHistory(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.auditStreams = true
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "watch me",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+	for _, ev := range parseSSEEvents(t, turnRR.Body.String()) {
+		if ev.Event == eventTypeStreamOpened || ev.Event == eventTypeStreamClosed {
+			t.Fatalf("audit event %q was streamed to the client", ev.Event)
+		}
+	}
+
+	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
+	if historyRR.Code != http.StatusOK {
+		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
+	}
+	var history historyWithEventsResponse
+	if err := json.Unmarshal(historyRR.Body.Bytes(), &history); err != nil {
+		t.Fatalf("unmarshal history: %v", err)
+	}
+	if len(history.Turns) != 1 {
+		t.Fatalf("history turns = %d, want 1", len(history.Turns))
+	}
+	events := history.Turns[0].Events
+	if len(events) < 2 || events[0].Type != eventTypeStreamOpened || events[len(events)-1].Type != eventTypeStreamClosed {
+		types := make([]string, 0, len(events))
+		for _, ev := range events {
+			types = append(types, ev.Type)
+		}
+		t.Fatalf("event types = %v, want stream_opened first and stream_closed last", types)
+	}
+	if got := stringField(events[0].Data, "clientId"); got != "client-a" {
+		t.Fatalf("stream_opened clientId = %q, want client-a", got)
+	}
+	closed := events[len(events)-1].Data
+	if got, _ := closed["bytes"].(float64); int(got) != turnRR.Body.Len() {
+		t.Fatalf("stream_closed bytes = %v, want %d", closed["bytes"], turnRR.Body.Len())
+	}
+	if _, ok := closed["durationMs"].(float64); !ok {
+		t.Fatalf("stream_closed durationMs = %v, want a number", closed["durationMs"])
+	}
+}
+
+func TestRecordDeltaOffsetsIncreaseMonotonically(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        &pacedDeltaStreamer{deltas: []string{"a", "b", "c", "d"}, gap: 5 * time.Millisecond},
+	})
+	h.recordDeltaOffsets = true
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "pace",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var offsets []float64
+	var turnID string
+	for _, ev := range parseSSEEvents(t, rr.Body.String()) {
+		if ev.Event != "message_delta" {
+			continue
+		}
+		offset, ok := ev.Data["offsetMs"].(float64)
+		if !ok {
+			t.Fatalf("message_delta payload = %v, want numeric offsetMs", ev.Data)
+		}
+		offsets = append(offsets, offset)
+		turnID = stringField(ev.Data, "turnId")
+	}
+	if len(offsets) != 4 {
+		t.Fatalf("delta offsets = %v, want 4", offsets)
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] <= offsets[i-1] {
+			t.Fatalf("delta offsets = %v, want strictly increasing", offsets)
+		}
+	}
+
+	persisted, err := h.store.ListEventsByTurn(context.Background(), turnID)
+	if err != nil {
+		t.Fatalf("ListEventsByTurn: %v", err)
+	}
+	var persistedOffsets int
+	for _, event := range persisted {
+		if event.Type == "message_delta" && strings.Contains(event.DataJSON, `"offsetMs":`) {
+			persistedOffsets++
+		}
+	}
+	if persistedOffsets != len(offsets) {
+		t.Fatalf("persisted deltas with offsetMs = %d, want %d", persistedOffsets, len(offsets))
+	}
+}
+
+func TestTurnsSSEIncludesStructuredMessageContentAndPersistsHistory(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        &messageContentStreamer{},
+	})
+
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "show content",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+
+	events := parseSSEEvents(t, turnRR.Body.String())
+	var seenContent int
+	for _, ev := range events {
+		if ev.Event != eventTypeMessageContent {
+			continue
+		}
+		seenContent += 1
+		content, ok := ev.Data["content"].(map[string]any)
+		if !ok {
+			t.Fatalf("message_content.content type = %T, want map[string]any", ev.Data["content"])
+		}
+		if seenContent == 1 {
+			if got := stringField(content, "type"); got != "image" {
+				t.Fatalf("first message_content.type = %q, want %q", got, "image")
+			}
+		}
+		if seenContent == 2 {
+			if got := stringField(content, "type"); got != "resource" {
+				t.Fatalf("second message_content.type = %q, want %q", got, "resource")
+			}
+			resource, ok := content["resource"].(map[string]any)
+			if !ok {
+				t.Fatalf("message_content.resource type = %T, want map[string]any", content["resource"])
+			}
+			if got := stringField(resource, "uri"); got != "file:///tmp/demo.txt" {
+				t.Fatalf("message_content.resource.uri = %q, want %q", got, "file:///tmp/demo.txt")
+			}
+		}
+	}
+	if seenContent != 2 {
+		t.Fatalf("seen %d message_content events, want 2", seenContent)
+	}
+
+	historyRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+threadID+"/history?includeEvents=true", nil, map[string]string{"X-Client-ID": "client-a"})
+	if historyRR.Code != http.StatusOK {
+		t.Fatalf("history status code = %d, want %d", historyRR.Code, http.StatusOK)
+	}
+
+	var history struct {
+		Turns []struct {
+			ResponseText string `json:"responseText"`
+			Events       []struct {
+				Type string         `json:"type"`
+				Data map[string]any `json:"data"`
+			} `json:"events"`
+		} `json:"turns"`
+	}
+	if err := json.Unmarshal(historyRR.Body.Bytes(), &history); err != nil {
+		t.Fatalf("unmarshal history: %v", err)
+	}
+	if got, want := len(history.Turns), 1; got != want {
+		t.Fatalf("len(history.turns) = %d, want %d", got, want)
+	}
+	if got := history.Turns[0].ResponseText; got != "preview:\n\ndone" {
+		t.Fatalf("history responseText = %q, want %q", got, "preview:\n\ndone")
+	}
+
+	var historyContent int
+	for _, event := range history.Turns[0].Events {
+		if event.Type != eventTypeMessageContent {
+			continue
+		}
+		historyContent += 1
+	}
+	if historyContent != 2 {
+		t.Fatalf("history message_content events = %d, want 2", historyContent)
+	}
+}
+
+func TestCodexTurnWorksWithoutBinaryPathConfig(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello without codex binary path config")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+
+	events := parseSSEEvents(t, result.Body)
+	seenDelta := false
+	seenCompleted := false
+	for _, ev := range events {
+		if ev.Event == "message_delta" && stringField(ev.Data, "delta") != "" {
+			seenDelta = true
+		}
+		if ev.Event == "turn_completed" {
+			seenCompleted = true
+		}
+	}
+	if !seenDelta {
+		t.Fatalf("expected at least one message_delta event")
+	}
+	if !seenCompleted {
+		t.Fatalf("expected turn_completed event")
+	}
+}
+
+func TestTurnCancel(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	streamResultCh := make(chan httpTurnStreamResult, 1)
+	go func() {
+		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", threadID, strings.Repeat("cancel-me-", 60))
+	}()
+
+	turnID := waitForTurnID(t, ts.URL, "client-a", threadID, 4*time.Second)
+	if turnID == "" {
+		t.Fatalf("failed to observe running turn before timeout")
+	}
+
+	cancelStatus, cancelBody := postCancel(t, ts.URL, "client-a", turnID)
+	if cancelStatus != http.StatusOK {
+		t.Fatalf("cancel status = %d, want %d, body=%s", cancelStatus, http.StatusOK, cancelBody)
+	}
+
+	streamResult := <-streamResultCh
+	if streamResult.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	}
+
+	events := parseSSEEvents(t, streamResult.Body)
+	lastCompletedReason := ""
+	for _, ev := range events {
+		if ev.Event == "turn_completed" {
+			lastCompletedReason = stringField(ev.Data, "stopReason")
+		}
+	}
+	if lastCompletedReason != "cancelled" {
+		t.Fatalf("turn_completed.stopReason = %q, want %q", lastCompletedReason, "cancelled")
+	}
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) == 0 {
+		t.Fatalf("history turns is empty")
+	}
+	if got := history.Turns[len(history.Turns)-1].StopReason; got != "cancelled" {
+		t.Fatalf("history stopReason = %q, want %q", got, "cancelled")
+	}
+}
+
+func TestThreadCancelCancelsActiveTurn(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	idleStatus, idleBody := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/cancel", nil, map[string]string{"X-Client-ID": "client-a"})
+	if idleStatus != http.StatusConflict {
+		t.Fatalf("idle thread cancel status = %d, want %d, body=%s", idleStatus, http.StatusConflict, idleBody)
+	}
+	assertErrorCode(t, []byte(idleBody), "CONFLICT")
+
+	streamResultCh := make(chan httpTurnStreamResult, 1)
+	go func() {
+		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", threadID, strings.Repeat("cancel-me-", 60))
+	}()
+
+	turnID := waitForTurnID(t, ts.URL, "client-a", threadID, 4*time.Second)
+	if turnID == "" {
+		t.Fatalf("failed to observe running turn before timeout")
+	}
+
+	cancelStatus, cancelBody := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/cancel", nil, map[string]string{"X-Client-ID": "client-a"})
+	if cancelStatus != http.StatusOK {
+		t.Fatalf("thread cancel status = %d, want %d, body=%s", cancelStatus, http.StatusOK, cancelBody)
+	}
+	var cancelResp struct {
+		TurnID   string `json:"turnId"`
+		ThreadID string `json:"threadId"`
+		Status   string `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(cancelBody), &cancelResp); err != nil {
+		t.Fatalf("unmarshal cancel response: %v", err)
+	}
+	if cancelResp.TurnID != turnID || cancelResp.ThreadID != threadID || cancelResp.Status != "cancelling" {
+		t.Fatalf("cancel response = %+v, want turnId=%q threadId=%q", cancelResp, turnID, threadID)
+	}
+
+	streamResult := <-streamResultCh
+	if !strings.Contains(streamResult.Body, `"stopReason":"cancelled"`) {
+		t.Fatalf("turn stream did not end cancelled: %s", streamResult.Body)
+	}
+
+	missingStatus, _ := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/th_missing/cancel", nil, map[string]string{"X-Client-ID": "client-a"})
+	if missingStatus != http.StatusNotFound {
+		t.Fatalf("missing thread cancel status = %d, want %d", missingStatus, http.StatusNotFound)
 	}
 }
 
@@ -3760,7 +4684,51 @@ func TestAgentIdleTTLReclaimsThreadAgent(t *testing.T) {
 	t.Fatalf("agent was not reclaimed by idle TTL")
 }
 
-func TestMultiThreadParallelTurns(t *testing.T) {
+func TestAgentDisplayNameInAgentsListAndReclaimLogs(t *testing.T) {
+	root := t.TempDir()
+	var logBuf bytes.Buffer
+	streamer := &countingClosableStreamer{}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:    []string{root},
+		allowedAgentIDs: []string{"codex"},
+		agentList: []AgentInfo{
+			{ID: "codex", Name: "Team Codex", Status: "available"},
+		},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+		logger: observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo),
+	})
+
+	rr := performJSONRequest(t, h, http.MethodGet, "/v1/agents", nil, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /v1/agents status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), `"name":"Team Codex"`) {
+		t.Fatalf("GET /v1/agents body = %s, want display name", rr.Body.String())
+	}
+
+	threadID := createThreadForClient(t, h, "client-a", root)
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "hi",
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+
+	h.reapIdleAgents(time.Now().UTC().Add(h.agentIdleTTL + time.Minute))
+	if got := streamer.CloseCount(); got != 1 {
+		t.Fatalf("close count = %d, want 1", got)
+	}
+	logs := logBuf.String()
+	if !strings.Contains(logs, "agent.idle_reclaimed") || !strings.Contains(logs, "Team Codex") {
+		t.Fatalf("logs = %s, want agent.idle_reclaimed with display name", logs)
+	}
+}
+
+func TestMultiThreadParallelTurns(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
 	ts := httptest.NewServer(h)
@@ -3817,6 +4785,7 @@ func TestCompactTimeoutCode(t *testing.T) {
 			return &errorStreamer{err: context.DeadlineExceeded}, nil
 		},
 	})
+	h.compactEmptyThreads = true
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
@@ -3834,6 +4803,61 @@ func TestCompactTimeoutCode(t *testing.T) {
 	assertErrorCode(t, []byte(body), "TIMEOUT")
 }
 
+func TestTurnErrorEventDistinguishesAgentStartupFailures(t *testing.T) {
+	root := t.TempDir()
+	var streamErr atomic.Value
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return &errorStreamer{err: streamErr.Load().(error)}, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	exitErr := fmt.Errorf("codex: initialize: %w", &agents.ExitError{Code: 3, Stderr: "missing API key\n"})
+	errorEvent := func(err error) map[string]any {
+		t.Helper()
+		streamErr.Store(err)
+		threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+		result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello")
+		for _, ev := range parseSSEEvents(t, result.Body) {
+			if ev.Event == "error" {
+				return ev.Data
+			}
+		}
+		t.Fatalf("no error event in stream: %s", result.Body)
+		return nil
+	}
+
+	data := errorEvent(exitErr)
+	if got := stringField(data, "code"); got != codeAgentExited {
+		t.Fatalf("exit error code = %q, want %q", got, codeAgentExited)
+	}
+	if got, _ := data["exitCode"].(float64); got != 3 {
+		t.Fatalf("exitCode = %v, want 3", data["exitCode"])
+	}
+	if _, ok := data["stderr"]; ok {
+		t.Fatalf("stderr exposed by default: %v", data)
+	}
+
+	h.exposeAgentStderr = true
+	data = errorEvent(exitErr)
+	if got := stringField(data, "stderr"); got != "missing API key" {
+		t.Fatalf("stderr = %q, want %q", got, "missing API key")
+	}
+
+	data = errorEvent(fmt.Errorf("codex: initialize: %w: rpc initialize error", agents.ErrAgentProtocol))
+	if got := stringField(data, "code"); got != codeAgentProtocol {
+		t.Fatalf("protocol error code = %q, want %q", got, codeAgentProtocol)
+	}
+	data = errorEvent(fmt.Errorf("codex: initialize: %w", context.DeadlineExceeded))
+	if got := stringField(data, "code"); got != codeTimeout {
+		t.Fatalf("timeout error code = %q, want %q", got, codeTimeout)
+	}
+}
+
 func TestTurnPermissionRequiredSSEEvent(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{
@@ -3869,6 +4893,62 @@ func TestTurnPermissionRequiredSSEEvent(t *testing.T) {
 	}
 }
 
+func TestPermissionRequiredClampsOversizedCommand(t *testing.T) {
+	root := t.TempDir()
+	command := strings.Repeat("x", 5000)
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		agent:             &permissionFloodStreamer{requests: 1, command: command},
+		permissionTimeout: 100 * time.Millisecond,
+	})
+	h.maxPermissionChars = 100
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	streamResult := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "permission please")
+	if streamResult.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	}
+
+	wantCommand := strings.Repeat("x", 100) + "…[truncated 4900 chars]"
+	checkPayload := func(source string, data map[string]any) {
+		t.Helper()
+		if got := stringField(data, "command"); got != wantCommand {
+			t.Fatalf("%s command = %q (%d chars), want clamped command", source, got, len(got))
+		}
+		if got, _ := data["commandTruncated"].(bool); !got {
+			t.Fatalf("%s commandTruncated = %v, want true", source, data["commandTruncated"])
+		}
+		if _, ok := data["approvalTruncated"]; ok {
+			t.Fatalf("%s approvalTruncated is set for a short approval", source)
+		}
+	}
+
+	seen := false
+	for _, ev := range parseSSEEvents(t, streamResult.Body) {
+		if ev.Event == "permission_required" {
+			seen = true
+			checkPayload("SSE", ev.Data)
+		}
+	}
+	if !seen {
+		t.Fatal("missing permission_required SSE event")
+	}
+
+	history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+	seen = false
+	for _, event := range history.Turns[0].Events {
+		if event.Type == "permission_required" {
+			seen = true
+			checkPayload("history", event.Data)
+		}
+	}
+	if !seen {
+		t.Fatal("missing persisted permission_required event")
+	}
+}
+
 func TestTurnPermissionApprovedContinuesAndCompletes(t *testing.T) {
 	root := t.TempDir()
 	h := newTestServer(t, testServerOptions{
@@ -3925,6 +5005,245 @@ func TestTurnPermissionApprovedContinuesAndCompletes(t *testing.T) {
 	}
 }
 
+func TestMaxAgentProcessesFailsTurnWithBusy(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		agent:             newFakeACPStreamer(t),
+		permissionTimeout: 50 * time.Millisecond,
+	})
+	h.processLimiter = agents.NewProcessLimiter(1, 20*time.Millisecond)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	release, err := h.processLimiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	events := parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello").Body)
+	var errorCode string
+	for _, event := range events {
+		if event.Event == "error" {
+			errorCode = stringField(event.Data, "code")
+		}
+	}
+	if errorCode != codeBusy {
+		t.Fatalf("error code = %q, want %q; events=%+v", errorCode, codeBusy, events)
+	}
+
+	release()
+	events = parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello again").Body)
+	if last := events[len(events)-1]; last.Event != "turn_completed" || stringField(last.Data, "stopReason") == "error" {
+		t.Fatalf("last event = %+v, want turn_completed without error", last)
+	}
+	if h.processLimiter.InUse() != 0 {
+		t.Fatalf("InUse() = %d after turn, want 0", h.processLimiter.InUse())
+	}
+}
+
+func TestTurnPermissionDeclinedThroughInProcessEchoAgent(t *testing.T) {
+	root := t.TempDir()
+	echoAgent, err := echo.New(echo.Config{Dir: root})
+	if err != nil {
+		t.Fatalf("echo.New: %v", err)
+	}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		agent:             echoAgent,
+		permissionTimeout: 2 * time.Second,
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	streamResultCh := make(chan httpTurnStreamResult, 1)
+	go func() {
+		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", threadID, echo.PermissionPrefix+" deploy")
+	}()
+
+	permissionID := waitForPermissionID(t, ts.URL, "client-a", threadID, 4*time.Second)
+	if permissionID == "" {
+		t.Fatalf("failed to observe permission_required before timeout")
+	}
+	permissionStatus, permissionBody := postPermissionDecision(t, ts.URL, "client-a", permissionID, "declined")
+	if permissionStatus != http.StatusOK {
+		t.Fatalf("permission decision status = %d, want %d, body=%s", permissionStatus, http.StatusOK, permissionBody)
+	}
+
+	streamResult := <-streamResultCh
+	if streamResult.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	}
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) == 0 {
+		t.Fatalf("history turns is empty")
+	}
+	lastTurn := history.Turns[len(history.Turns)-1]
+	if lastTurn.StopReason != "end_turn" {
+		t.Fatalf("history stopReason = %q, want %q", lastTurn.StopReason, "end_turn")
+	}
+	if lastTurn.ResponseText != "[permission declined] deploy" {
+		t.Fatalf("history responseText = %q, want %q", lastTurn.ResponseText, "[permission declined] deploy")
+	}
+}
+
+func TestCancelledTurnReportsCancelConfirmed(t *testing.T) {
+	root := t.TempDir()
+	echoAgent, err := echo.New(echo.Config{Dir: root})
+	if err != nil {
+		t.Fatalf("echo.New: %v", err)
+	}
+	completed := runCancelledTurn(t, root, echoAgent, time.Second)
+	if got, ok := completed["cancelConfirmed"].(bool); !ok || !got {
+		t.Fatalf("turn_completed = %+v, want cancelConfirmed=true", completed)
+	}
+}
+
+func TestCancelledTurnReportsUnconfirmedCancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		streamer agents.Streamer
+	}{
+		{name: "force killed", streamer: forcedCancelStreamer{}},
+		{name: "stream never returns", streamer: newHungStreamer(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			completed := runCancelledTurn(t, root, tt.streamer, 50*time.Millisecond)
+			if got, ok := completed["cancelConfirmed"].(bool); !ok || got {
+				t.Fatalf("turn_completed = %+v, want cancelConfirmed=false", completed)
+			}
+		})
+	}
+}
+
+func TestCancelledTurnUnconfirmedReplacesCachedAgent(t *testing.T) {
+	root := t.TempDir()
+	var (
+		mu        sync.Mutex
+		providers []*cancelIgnoringStreamer
+	)
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			mu.Lock()
+			defer mu.Unlock()
+			provider := newCancelIgnoringStreamer(len(providers) == 0)
+			providers = append(providers, provider)
+			return provider, nil
+		},
+	})
+	h.cancelConfirmTimeout = 50 * time.Millisecond
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	resp, stop := startTurnStreamHTTP(t, ts.URL, "client-a", threadID, "cancel me")
+	defer stop()
+	defer resp.Body.Close()
+	eventsCh, doneCh := streamSSEEvents(resp.Body)
+
+	var turnID string
+	var last parsedSSEEvent
+	for event := range eventsCh {
+		switch event.Event {
+		case "turn_started":
+			turnID = stringField(event.Data, "turnId")
+		case "message_delta":
+			if turnID != "" {
+				if status, body := postCancel(t, ts.URL, "client-a", turnID); status != http.StatusOK {
+					t.Fatalf("cancel status = %d, want %d, body=%s", status, http.StatusOK, body)
+				}
+				turnID = ""
+			}
+		}
+		last = event
+	}
+	if err := <-doneCh; err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if got, ok := last.Data["cancelConfirmed"].(bool); last.Event != "turn_completed" || !ok || got {
+		t.Fatalf("last event = %+v, want turn_completed with cancelConfirmed=false", last)
+	}
+
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "next")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("second turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(providers) != 2 {
+		t.Fatalf("providers created = %d, want 2 (abandoned agent replaced)", len(providers))
+	}
+	if !providers[0].closed.Load() {
+		t.Fatalf("abandoned provider was not closed")
+	}
+	if providers[1].overlapped.Load() || providers[0].overlapped.Load() {
+		t.Fatalf("a later turn reused the provider of the abandoned stream")
+	}
+}
+
+// runCancelledTurn starts a turn on streamer, cancels it after the first
+// delta, and returns the turn_completed payload after checking it was
+// recorded as cancelled.
+func runCancelledTurn(t *testing.T, root string, streamer agents.Streamer, confirmTimeout time.Duration) map[string]any {
+	t.Helper()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        streamer,
+	})
+	h.cancelConfirmTimeout = confirmTimeout
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	resp, stop := startTurnStreamHTTP(t, ts.URL, "client-a", threadID, strings.Repeat("cancel me ", 300))
+	defer stop()
+	defer resp.Body.Close()
+	eventsCh, doneCh := streamSSEEvents(resp.Body)
+
+	var turnID string
+	var last parsedSSEEvent
+	for event := range eventsCh {
+		switch event.Event {
+		case "turn_started":
+			turnID = stringField(event.Data, "turnId")
+		case "message_delta":
+			if turnID != "" {
+				if status, body := postCancel(t, ts.URL, "client-a", turnID); status != http.StatusOK {
+					t.Fatalf("cancel status = %d, want %d, body=%s", status, http.StatusOK, body)
+				}
+				turnID = ""
+			}
+		}
+		last = event
+	}
+	if err := <-doneCh; err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if last.Event != "turn_completed" || stringField(last.Data, "stopReason") != "cancelled" {
+		t.Fatalf("last event = %+v, want turn_completed cancelled", last)
+	}
+
+	history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+	turn := history.Turns[len(history.Turns)-1]
+	var persisted map[string]any
+	for _, event := range turn.Events {
+		if event.Type == "turn_completed" {
+			persisted = event.Data
+		}
+	}
+	if persisted["cancelConfirmed"] != last.Data["cancelConfirmed"] {
+		t.Fatalf("history cancelConfirmed = %v, stream = %v", persisted["cancelConfirmed"], last.Data["cancelConfirmed"])
+	}
+	return last.Data
+}
+
 func TestTurnPermissionSelectedOptionFlowsThroughExactAgentChoice(t *testing.T) {
 	root := t.TempDir()
 	streamer := &permissionOptionStreamer{
@@ -4032,41 +5351,229 @@ func TestTurnPermissionSelectedOptionFlowsThroughExactAgentChoice(t *testing.T)
 	}
 }
 
-func TestTurnPermissionTimeoutFailClosed(t *testing.T) {
+func TestCancelTurnResolvesPendingPermissionAsCancelled(t *testing.T) {
 	root := t.TempDir()
+	streamer := &permissionOptionStreamer{
+		request: agents.PermissionRequest{
+			RequestID: "provider-request-cancel",
+			Approval:  "command",
+			Command:   "Run shell command",
+			Options: []agents.PermissionOption{
+				{OptionID: "allow_once_opt", Name: "Allow once", Kind: "allow_once"},
+			},
+		},
+	}
 	h := newTestServer(t, testServerOptions{
 		allowedRoots:      []string{root},
-		agent:             newFakeACPStreamer(t),
-		permissionTimeout: 250 * time.Millisecond,
+		agent:             streamer,
+		permissionTimeout: 5 * time.Second,
 	})
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
 	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
-	streamResult := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "timeout permission")
-	if streamResult.StatusCode != http.StatusOK {
-		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	streamResultCh := make(chan httpTurnStreamResult, 1)
+	go func() {
+		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", threadID, "needs approval")
+	}()
+
+	var turnID, permissionID string
+	deadline := time.Now().Add(4 * time.Second)
+	for permissionID == "" && time.Now().Before(deadline) {
+		history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+		for _, turn := range history.Turns {
+			for _, event := range turn.Events {
+				if event.Type == "permission_required" {
+					turnID, permissionID = turn.TurnID, stringField(event.Data, "permissionId")
+				}
+			}
+		}
+		if permissionID == "" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if permissionID == "" {
+		t.Fatalf("failed to observe permission_required before timeout")
 	}
 
-	events := parseSSEEvents(t, streamResult.Body)
-	lastStopReason := ""
-	for _, ev := range events {
-		if ev.Event == "turn_completed" {
-			lastStopReason = stringField(ev.Data, "stopReason")
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/turns/"+turnID+"/cancel", nil, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("cancel status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	select {
+	case result := <-streamResultCh:
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("turn stream status = %d, want %d", result.StatusCode, http.StatusOK)
 		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("turn did not finish after cancel")
 	}
-	if lastStopReason != "cancelled" {
-		t.Fatalf("turn_completed.stopReason = %q, want %q", lastStopReason, "cancelled")
+	if got := streamer.Response().Outcome; got != agents.PermissionOutcomeCancelled {
+		t.Fatalf("permission outcome = %q, want %q", got, agents.PermissionOutcomeCancelled)
 	}
 
-	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
-	if len(history.Turns) == 0 {
-		t.Fatalf("history turns is empty")
+	status, body = postPermissionSelection(t, ts.URL, "client-a", permissionID, "allow_once_opt")
+	if status != http.StatusConflict {
+		t.Fatalf("late decision status = %d, want %d, body=%s", status, http.StatusConflict, body)
 	}
-	if got := history.Turns[len(history.Turns)-1].StopReason; got != "cancelled" {
-		t.Fatalf("history stopReason = %q, want %q", got, "cancelled")
+	assertErrorCode(t, []byte(body), codeConflict)
+	if !strings.Contains(body, `"reason":"cancelled"`) {
+		t.Fatalf("late decision body = %s, want reason cancelled", body)
 	}
-}
+
+	if err := h.checkPermissionLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTurnPermissionTimeoutFailClosed(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		agent:             newFakeACPStreamer(t),
+		permissionTimeout: 250 * time.Millisecond,
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	streamResult := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "timeout permission")
+	if streamResult.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	}
+
+	events := parseSSEEvents(t, streamResult.Body)
+	lastStopReason := ""
+	for _, ev := range events {
+		if ev.Event == "turn_completed" {
+			lastStopReason = stringField(ev.Data, "stopReason")
+		}
+	}
+	if lastStopReason != "cancelled" {
+		t.Fatalf("turn_completed.stopReason = %q, want %q", lastStopReason, "cancelled")
+	}
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) == 0 {
+		t.Fatalf("history turns is empty")
+	}
+	if got := history.Turns[len(history.Turns)-1].StopReason; got != "cancelled" {
+		t.Fatalf("history stopReason = %q, want %q", got, "cancelled")
+	}
+}
+
+func TestPermissionDecisionAfterTimeoutReportsExpired(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		agent:             newFakeACPStreamer(t),
+		permissionTimeout: 250 * time.Millisecond,
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	streamResult := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "timeout permission")
+	if streamResult.StatusCode != http.StatusOK {
+		t.Fatalf("turn stream status = %d, want %d", streamResult.StatusCode, http.StatusOK)
+	}
+
+	permissionID := ""
+	for _, ev := range parseSSEEvents(t, streamResult.Body) {
+		if ev.Event == "permission_required" {
+			permissionID = stringField(ev.Data, "permissionId")
+		}
+	}
+	if permissionID == "" {
+		t.Fatalf("missing permission_required event")
+	}
+
+	status, body := postPermissionDecision(t, ts.URL, "client-a", permissionID, "approved")
+	if status != http.StatusConflict {
+		t.Fatalf("late decision status = %d, want %d; body=%s", status, http.StatusConflict, body)
+	}
+	var resp struct {
+		Error struct {
+			Code    string         `json:"code"`
+			Details map[string]any `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal late decision response: %v", err)
+	}
+	if resp.Error.Code != "CONFLICT" || resp.Error.Details["reason"] != "expired" {
+		t.Fatalf("late decision error = %+v, want CONFLICT with reason expired", resp.Error)
+	}
+
+	status, _ = postPermissionDecision(t, ts.URL, "client-a", "perm-never-issued", "approved")
+	if status != http.StatusNotFound {
+		t.Fatalf("unknown permission status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestPermissionTombstonesExpireOldestFirst(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	start := time.Now().UTC()
+
+	h.permissionsMu.Lock()
+	h.tombstonePermissionLocked("perm-old", start, false)
+	h.tombstonePermissionLocked("perm-newer", start.Add(time.Minute), true)
+	h.tombstonePermissionLocked("perm-latest", start.Add(permissionTombstoneTTL+30*time.Second), false)
+	_, oldKept := h.permissionTombstones["perm-old"]
+	newer, newerKept := h.permissionTombstones["perm-newer"]
+	queue := slices.Clone(h.permissionTombstoneQueue)
+	h.permissionsMu.Unlock()
+
+	if oldKept {
+		t.Fatalf("perm-old tombstone kept past permissionTombstoneTTL")
+	}
+	if !newerKept || !newer.cancelled {
+		t.Fatalf("perm-newer tombstone = %+v, %v; want kept and cancelled", newer, newerKept)
+	}
+	if want := []string{"perm-newer", "perm-latest"}; !slices.Equal(queue, want) {
+		t.Fatalf("tombstone queue = %v, want %v", queue, want)
+	}
+}
+
+func TestReapStalePermissionsDeclinesLeakedEntries(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo)
+	h := newTestServer(t, testServerOptions{logger: logger, permissionTimeout: time.Minute})
+	if got, want := h.permissionMaxAge, 2*time.Minute; got != want {
+		t.Fatalf("default permissionMaxAge = %v, want %v", got, want)
+	}
+
+	now := time.Now().UTC()
+	stale := newPendingPermission(nil)
+	stale.createdAt = now.Add(-3 * time.Minute)
+	fresh := newPendingPermission(nil)
+	h.registerPermission("perm-stale", stale)
+	h.registerPermission("perm-fresh", fresh)
+
+	if reaped := h.reapStalePermissions(now); reaped != 1 {
+		t.Fatalf("reapStalePermissions() = %d, want 1", reaped)
+	}
+
+	h.permissionsMu.Lock()
+	_, staleRegistered := h.permissions["perm-stale"]
+	_, freshRegistered := h.permissions["perm-fresh"]
+	h.permissionsMu.Unlock()
+	if staleRegistered || !freshRegistered {
+		t.Fatalf("registered stale=%v fresh=%v, want stale removed and fresh kept", staleRegistered, freshRegistered)
+	}
+
+	select {
+	case response := <-stale.ch:
+		if response.Outcome != agents.PermissionOutcomeDeclined {
+			t.Fatalf("stale outcome = %q, want %q", response.Outcome, agents.PermissionOutcomeDeclined)
+		}
+	default:
+		t.Fatalf("stale permission was not resolved")
+	}
+	if !strings.Contains(logBuf.String(), "permission.stale_reaped") || !strings.Contains(logBuf.String(), "perm-stale") {
+		t.Fatalf("missing stale permission warning:\n%s", logBuf.String())
+	}
+}
 
 func TestTurnPermissionSSEDisconnectFailClosed(t *testing.T) {
 	root := t.TempDir()
@@ -4163,649 +5670,3561 @@ func TestInjectedPromptIncludesSummaryAndRecent(t *testing.T) {
 	}
 }
 
-func TestComposeContextPromptFirstTurnPassThrough(t *testing.T) {
-	input := "/mcp call demo_server demo_tool {}"
+func TestInjectedPromptSkipsIncompleteTurnsWhenConfigured(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	store := h.store.(*storage.Store)
+	ctx := context.Background()
 
-	got := composeContextPrompt("", nil, input, 1024)
-	if got != input {
-		t.Fatalf("first-turn prompt = %q, want %q", got, input)
+	thread, err := store.CreateThread(ctx, storage.CreateThreadParams{
+		ThreadID: "th-skip-incomplete",
+		AgentID:  "codex",
+		CWD:      t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+	seed := []struct {
+		turnID   string
+		request  string
+		response string
+		status   string
+	}{
+		{turnID: "tu-ok", request: "good question", response: "good answer", status: "completed"},
+		{turnID: "tu-failed", request: "failed question", response: "", status: "failed"},
+		{turnID: "tu-empty", request: "empty question", response: "", status: "completed"},
+	}
+	for _, item := range seed {
+		if _, err := store.CreateTurn(ctx, storage.CreateTurnParams{
+			TurnID:      item.turnID,
+			ThreadID:    thread.ThreadID,
+			RequestText: item.request,
+			Status:      "running",
+		}); err != nil {
+			t.Fatalf("CreateTurn(%s): %v", item.turnID, err)
+		}
+		if err := store.FinalizeTurn(ctx, storage.FinalizeTurnParams{
+			TurnID:       item.turnID,
+			ResponseText: item.response,
+			Status:       item.status,
+			StopReason:   "end_turn",
+		}); err != nil {
+			t.Fatalf("FinalizeTurn(%s): %v", item.turnID, err)
+		}
 	}
 
-	truncated := composeContextPrompt("", nil, input, 12)
-	if truncated != input[:12] {
-		t.Fatalf("first-turn truncation = %q, want %q", truncated, input[:12])
+	prompt, err := h.buildInjectedPrompt(ctx, thread, agents.TextPrompt("next question"))
+	if err != nil {
+		t.Fatalf("buildInjectedPrompt: %v", err)
+	}
+	if text := prompt.Text(); !strings.Contains(text, "User: failed question") {
+		t.Fatalf("default prompt should keep failed turn:\n%s", text)
+	}
+
+	h.contextSkipIncompleteTurns = true
+	prompt, err = h.buildInjectedPrompt(ctx, thread, agents.TextPrompt("next question"))
+	if err != nil {
+		t.Fatalf("buildInjectedPrompt(skip): %v", err)
+	}
+	text := prompt.Text()
+	if !strings.Contains(text, "User: good question\nAssistant: good answer") {
+		t.Fatalf("prompt missing completed turn:\n%s", text)
+	}
+	for _, unwanted := range []string{"failed question", "empty question"} {
+		if strings.Contains(text, unwanted) {
+			t.Fatalf("prompt should skip %q:\n%s", unwanted, text)
+		}
 	}
 }
 
-func TestCompactUpdatesSummaryAndAffectsNextTurn(t *testing.T) {
+func TestInjectedPromptUsesConfiguredLabels(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "labels.db"))
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	h := New(Config{
+		Store:                     store,
+		ContextUserLabel:          "Human",
+		ContextAssistantLabel:     "AI",
+		ContextSummaryHeader:      "## Summary",
+		ContextRecentTurnsHeader:  "## History",
+		ContextCurrentInputHeader: "## Request",
+	})
+	t.Cleanup(func() { _ = h.Close() })
+
+	got := h.composeThreadContextPrompt("th-labels", "earlier context", []storage.Turn{
+		{RequestText: "hi", ResponseText: "hello"},
+	}, "next")
+	want := "## Summary\nearlier context\n\n## History\nHuman: hi\nAI: hello\n----\n\n## Request\nnext"
+	if got != want {
+		t.Fatalf("prompt = %q, want %q", got, want)
+	}
+
+	defaults := composeContextPrompt("", []storage.Turn{{RequestText: "hi", ResponseText: "hello"}}, "next", 0)
+	if !strings.Contains(defaults, "[Recent Turns]\nUser: hi\nAssistant: hello") {
+		t.Fatalf("default labels changed:\n%s", defaults)
+	}
+}
+
+func TestInputTransformRewritesTurnInput(t *testing.T) {
 	root := t.TempDir()
-	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	streamer := &promptCaptureStreamer{}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	h.inputTransform = func(ctx context.Context, thread storage.Thread, input string) (string, error) {
+		_ = ctx
+		_ = thread
+		if strings.Contains(input, "reject") {
+			return "", errors.New("input contains a forbidden word")
+		}
+		return strings.ToUpper(input), nil
+	}
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
 	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
-
-	first := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "important decision for compact")
-	if first.StatusCode != http.StatusOK {
-		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
-	}
-
-	compactStatus, compactBody := doJSON(
-		t,
-		http.MethodPost,
-		ts.URL+"/v1/threads/"+threadID+"/compact",
-		map[string]any{"maxSummaryChars": 120},
-		map[string]string{"X-Client-ID": "client-a"},
-	)
-	if compactStatus != http.StatusOK {
-		t.Fatalf("compact status = %d, want %d, body=%s", compactStatus, http.StatusOK, compactBody)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello agent")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
 	}
-	var compactResp struct {
-		TurnID       string `json:"turnId"`
-		Summary      string `json:"summary"`
-		SummaryChars int    `json:"summaryChars"`
+	if got, want := streamer.prompt.Text(), "HELLO AGENT"; got != want {
+		t.Fatalf("agent prompt = %q, want %q", got, want)
 	}
-	if err := json.Unmarshal([]byte(compactBody), &compactResp); err != nil {
-		t.Fatalf("unmarshal compact response: %v", err)
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 1 || history.Turns[0].RequestText != "HELLO AGENT" {
+		t.Fatalf("history turns = %+v, want transformed request text", history.Turns)
 	}
-	if compactResp.TurnID == "" {
-		t.Fatalf("compact turnId is empty")
+
+	rejected := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "please reject this")
+	if rejected.StatusCode != http.StatusBadRequest {
+		t.Fatalf("rejected turn status = %d, want %d", rejected.StatusCode, http.StatusBadRequest)
 	}
-	if compactResp.SummaryChars > 120 {
-		t.Fatalf("summaryChars = %d, want <= 120", compactResp.SummaryChars)
+	if !strings.Contains(rejected.Body, codeInvalidArgument) {
+		t.Fatalf("rejected turn body = %s, want %s", rejected.Body, codeInvalidArgument)
 	}
-	if compactResp.Summary == "" {
-		t.Fatalf("compact summary is empty")
+}
+
+func TestOutputTransformRedactsTokenSplitAcrossDeltas(t *testing.T) {
+	root := t.TempDir()
+	streamer := &deltaSequenceStreamer{deltas: []string{"your key is sk-ab", "cd1234 keep it safe"}}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	tokenPattern := regexp.MustCompile(`sk-[a-z0-9]{6,}`)
+	h.outputTransform = func(ctx context.Context, thread storage.Thread, text string) string {
+		_ = ctx
+		_ = thread
+		return tokenPattern.ReplaceAllString(text, "[REDACTED]")
 	}
+	h.outputTransformHoldBack = 16
+	ts := httptest.NewServer(h)
+	defer ts.Close()
 
-	threadStatus, threadBody := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID, nil, map[string]string{"X-Client-ID": "client-a"})
-	if threadStatus != http.StatusOK {
-		t.Fatalf("get thread status = %d, body=%s", threadStatus, threadBody)
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "show key")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
 	}
-	var threadResp struct {
-		Thread struct {
-			Summary string `json:"summary"`
-		} `json:"thread"`
+
+	streamed := strings.Builder{}
+	for _, event := range parseSSEEvents(t, result.Body) {
+		if event.Event == "message_delta" {
+			streamed.WriteString(stringField(event.Data, "delta"))
+		}
 	}
-	if err := json.Unmarshal([]byte(threadBody), &threadResp); err != nil {
-		t.Fatalf("unmarshal get thread response: %v", err)
+	want := "your key is [REDACTED] keep it safe"
+	if got := streamed.String(); got != want {
+		t.Fatalf("streamed text = %q, want %q", got, want)
 	}
-	if threadResp.Thread.Summary != compactResp.Summary {
-		t.Fatalf("thread summary mismatch after compact")
+	if strings.Contains(result.Body, "sk-ab") {
+		t.Fatalf("stream leaked token prefix: %s", result.Body)
 	}
 
-	next := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "follow up after compact")
-	if next.StatusCode != http.StatusOK {
-		t.Fatalf("next turn status = %d, want %d", next.StatusCode, http.StatusOK)
-	}
 	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
-	if got, want := len(history.Turns), 2; got != want {
-		t.Fatalf("default history should hide internal turns: got %d, want %d", got, want)
-	}
-	lastResp := history.Turns[len(history.Turns)-1].ResponseText
-	if !strings.Contains(lastResp, compactResp.Summary) {
-		t.Fatalf("next injected prompt does not include compacted summary")
+	if len(history.Turns) != 1 || history.Turns[0].ResponseText != want {
+		t.Fatalf("history turns = %+v, want redacted response %q", history.Turns, want)
 	}
+}
 
-	historyInternal := getHistoryWithInternalHTTP(t, ts.URL, "client-a", threadID, false)
-	if got, want := len(historyInternal.Turns), 3; got != want {
-		t.Fatalf("history(includeInternal) turns = %d, want %d", got, want)
+func TestMessageDeltaCarriesContentTypeMetadata(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return deltaMetadataStreamer{}, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "write code")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
 	}
-	internalCount := 0
-	for _, turn := range historyInternal.Turns {
-		if turn.IsInternal {
-			internalCount++
+
+	deltas := make([]parsedSSEEvent, 0, 2)
+	for _, event := range parseSSEEvents(t, result.Body) {
+		if event.Event == "message_delta" {
+			deltas = append(deltas, event)
 		}
 	}
-	if internalCount != 1 {
-		t.Fatalf("internal turn count = %d, want 1", internalCount)
+	if len(deltas) != 2 {
+		t.Fatalf("message_delta count = %d, want 2", len(deltas))
+	}
+	if got := stringField(deltas[0].Data, "contentType"); got != "code" {
+		t.Fatalf("first delta contentType = %q, want %q", got, "code")
+	}
+	if got := stringField(deltas[0].Data, "lang"); got != "go" {
+		t.Fatalf("first delta lang = %q, want %q", got, "go")
+	}
+	if _, ok := deltas[1].Data["contentType"]; ok {
+		t.Fatalf("second delta should not inherit metadata: %v", deltas[1].Data)
 	}
 }
 
-func TestRestartRecoveryWithInjectedContext(t *testing.T) {
+func TestThreadCostAggregatesRecordedUsage(t *testing.T) {
 	root := t.TempDir()
-	dbPath := filepath.Join(t.TempDir(), "restart.db")
-
-	serverOne, closeOne := newTestServerWithDBPath(t, dbPath, testServerOptions{allowedRoots: []string{root}})
-	tsOne := httptest.NewServer(serverOne)
-	threadID := createThreadHTTP(t, tsOne.URL, "client-a", root)
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return usageStreamer{}, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
 
-	first := runTurnStreamRequest(t, tsOne.URL, "client-a", threadID, "pre-restart message")
-	if first.StatusCode != http.StatusOK {
-		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	for _, input := range []string{"first", "second"} {
+		result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, input)
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
+		}
 	}
-	tsOne.Close()
-	closeOne()
 
-	serverTwo, closeTwo := newTestServerWithDBPath(t, dbPath, testServerOptions{allowedRoots: []string{root}})
-	defer closeTwo()
-	tsTwo := httptest.NewServer(serverTwo)
-	defer tsTwo.Close()
+	getCost := func() map[string]any {
+		t.Helper()
+		status, raw := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID+"/cost", nil, map[string]string{"X-Client-ID": "client-a"})
+		if status != http.StatusOK {
+			t.Fatalf("cost status = %d, want %d, body=%s", status, http.StatusOK, raw)
+		}
+		var body map[string]any
+		if err := json.Unmarshal([]byte(raw), &body); err != nil {
+			t.Fatalf("unmarshal cost response: %v", err)
+		}
+		return body
+	}
 
-	second := runTurnStreamRequest(t, tsTwo.URL, "client-a", threadID, "post-restart message")
-	if second.StatusCode != http.StatusOK {
-		t.Fatalf("second turn status = %d, want %d", second.StatusCode, http.StatusOK)
+	body := getCost()
+	if got := body["promptTokens"]; got != float64(200) {
+		t.Fatalf("promptTokens = %v, want 200", got)
+	}
+	if got := body["completionTokens"]; got != float64(50) {
+		t.Fatalf("completionTokens = %v, want 50", got)
+	}
+	if got := body["totalTokens"]; got != float64(250) {
+		t.Fatalf("totalTokens = %v, want 250", got)
+	}
+	if _, ok := body["estimatedCost"]; ok {
+		t.Fatalf("estimatedCost present without configured rate: %v", body)
 	}
 
-	history := getHistoryHTTP(t, tsTwo.URL, "client-a", threadID, false)
-	if got, want := len(history.Turns), 2; got != want {
-		t.Fatalf("len(history.turns) = %d, want %d", got, want)
+	h.costRates = map[string]CostRate{"codex": {PromptPerMillion: 1000, CompletionPerMillion: 4000}}
+	body = getCost()
+	if got := body["estimatedCost"]; got != 0.4 {
+		t.Fatalf("estimatedCost = %v, want 0.4", got)
 	}
-	lastResp := history.Turns[len(history.Turns)-1].ResponseText
-	if !strings.Contains(lastResp, "User: pre-restart message") {
-		t.Fatalf("restart-injected prompt missing pre-restart history")
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 2 || history.Turns[0].PromptTokens != 100 || history.Turns[0].CompletionTokens != 25 {
+		t.Fatalf("history turn usage = %+v, want 100/25 per turn", history.Turns)
 	}
 }
 
-type testServerOptions struct {
-	authToken          string
-	dataDir            string
-	allowedRoots       []string
-	allowedAgentIDs    []string
-	agentList          []AgentInfo
-	agent              agents.Streamer
-	turnAgentFactory   TurnAgentFactory
-	agentModelsFactory AgentModelsFactory
-	agentIdleTTL       time.Duration
-	permissionTimeout  time.Duration
-	logger             *observability.Logger
-}
+func TestPersistRawStopReasonsKeepsAgentReportedReason(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        rawStopReasonStreamer{reason: "max_tokens"},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
 
-func newTestServer(t *testing.T, opt testServerOptions) *Server {
-	t.Helper()
+	runTurnStreamRequest(t, ts.URL, "client-a", threadID, "off")
+	h.persistRawStopReasons = true
+	runTurnStreamRequest(t, ts.URL, "client-a", threadID, "on")
 
-	dataDir := strings.TrimSpace(opt.dataDir)
-	if dataDir == "" {
-		dataDir = t.TempDir()
-	}
-	if err := os.MkdirAll(dataDir, 0o755); err != nil {
-		t.Fatalf("os.MkdirAll(%q): %v", dataDir, err)
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 2 {
+		t.Fatalf("history turns = %d, want 2", len(history.Turns))
 	}
-	dbPath := filepath.Join(dataDir, "api.db")
-	store, err := storage.New(dbPath)
-	if err != nil {
-		t.Fatalf("storage.New(%q): %v", dbPath, err)
+	if got := history.Turns[0].RawStopReason; got != "" {
+		t.Fatalf("rawStopReason with option off = %q, want empty", got)
 	}
-	allowedRoots := opt.allowedRoots
-	if len(allowedRoots) == 0 {
-		allowedRoots = []string{t.TempDir()}
+	if got := history.Turns[1]; got.StopReason != "end_turn" || got.RawStopReason != "max_tokens" {
+		t.Fatalf("stopReason/rawStopReason = %q/%q, want end_turn/max_tokens", got.StopReason, got.RawStopReason)
 	}
+}
 
-	agentList := opt.agentList
-	if len(agentList) == 0 {
-		agentList = []AgentInfo{
-			{ID: "codex", Name: "Codex", Status: "available"},
-			{ID: "claude", Name: "Claude Code", Status: "unavailable"},
+func TestCompactTerminalTurnEventsKeepsEventOrder(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        interleavedDeltaStreamer{},
+	})
+	h.eventCompactionAfter = time.Hour
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hello")
+
+	eventTypes := func() []string {
+		history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+		if len(history.Turns) != 1 {
+			t.Fatalf("history turns = %d, want 1", len(history.Turns))
+		}
+		types := make([]string, 0, len(history.Turns[0].Events))
+		for _, event := range history.Turns[0].Events {
+			types = append(types, event.Type)
 		}
+		return types
 	}
+	before := eventTypes()
 
-	allowedAgentIDs := opt.allowedAgentIDs
-	if len(allowedAgentIDs) == 0 {
-		allowedAgentIDs = []string{"codex"}
+	if got := h.compactTerminalTurnEvents(time.Now().UTC()); got != 0 {
+		t.Fatalf("compacted inside retention window = %d, want 0", got)
 	}
 
-	streamAgent := opt.agent
-	if streamAgent == nil {
-		streamAgent = agents.NewFakeAgentWithConfig(3, 10*time.Millisecond)
+	// The deltas are split by a tool call, so there is nothing to merge
+	// and the answer text must stay on both sides of it.
+	if got := h.compactTerminalTurnEvents(time.Now().UTC().Add(2 * time.Hour)); got != 0 {
+		t.Fatalf("compacted after retention window = %d, want 0", got)
 	}
-
-	turnAgentFactory := opt.turnAgentFactory
-	if turnAgentFactory == nil {
-		turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
-			_ = thread
-			return streamAgent, nil
-		}
+	if after := eventTypes(); !slices.Equal(after, before) {
+		t.Fatalf("event types after compaction = %v, want unchanged %v", after, before)
+	}
+	history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+	if got := history.Turns[0].ResponseText; got != "hello" {
+		t.Fatalf("responseText = %q, want %q", got, "hello")
 	}
-
-	server := New(Config{
-		AuthToken:          opt.authToken,
-		DataDir:            dataDir,
-		Agents:             agentList,
-		AllowedAgentIDs:    allowedAgentIDs,
-		AllowedRoots:       allowedRoots,
-		Store:              store,
-		TurnController:     runtimectl.NewTurnController(),
-		TurnAgentFactory:   turnAgentFactory,
-		AgentModelsFactory: opt.agentModelsFactory,
-		AgentIdleTTL:       opt.agentIdleTTL,
-		PermissionTimeout:  opt.permissionTimeout,
-		Logger:             opt.logger,
-	})
-	t.Cleanup(func() {
-		_ = server.Close()
-		_ = store.Close()
-	})
-	return server
 }
 
-func newTestServerWithDBPath(t *testing.T, dbPath string, opt testServerOptions) (*Server, func()) {
-	t.Helper()
+func TestReapIdleAgentsEnforcesMaxLifetimeAtTurnBoundary(t *testing.T) {
+	h := newTestServer(t, testServerOptions{agentMaxLifetime: time.Hour})
 
-	store, err := storage.New(dbPath)
-	if err != nil {
-		t.Fatalf("storage.New(%q): %v", dbPath, err)
+	now := time.Now().UTC()
+	busy := &countingClosableStreamer{}
+	old := &countingClosableStreamer{}
+	young := &countingClosableStreamer{}
+	h.agentMu.Lock()
+	h.agentsByScope["scope-busy"] = &managedAgent{scopeKey: "scope-busy", threadID: "th-busy", provider: busy, closer: busy, lastUsed: now, createdAt: now.Add(-2 * time.Hour)}
+	h.agentsByScope["scope-old"] = &managedAgent{scopeKey: "scope-old", threadID: "th-old", provider: old, closer: old, lastUsed: now, createdAt: now.Add(-2 * time.Hour)}
+	h.agentsByScope["scope-young"] = &managedAgent{scopeKey: "scope-young", threadID: "th-young", provider: young, closer: young, lastUsed: now, createdAt: now.Add(-time.Minute)}
+	h.agentMu.Unlock()
+
+	if err := h.turns.Activate("th-busy", "", "tu-busy", func() {}); err != nil {
+		t.Fatalf("Activate(th-busy): %v", err)
 	}
-	dataDir := strings.TrimSpace(opt.dataDir)
-	if dataDir == "" {
-		dataDir = filepath.Dir(dbPath)
+	h.reapIdleAgents(now)
+	if got := old.CloseCount(); got != 1 {
+		t.Fatalf("expired agent close count = %d, want 1", got)
 	}
-	if err := os.MkdirAll(dataDir, 0o755); err != nil {
-		t.Fatalf("os.MkdirAll(%q): %v", dataDir, err)
+	if busy.CloseCount() != 0 || young.CloseCount() != 0 {
+		t.Fatalf("busy/young close counts = %d/%d, want 0/0", busy.CloseCount(), young.CloseCount())
 	}
 
-	allowedRoots := opt.allowedRoots
-	if len(allowedRoots) == 0 {
-		allowedRoots = []string{t.TempDir()}
+	h.turns.Release("th-busy", "", "tu-busy")
+	h.reapIdleAgents(now)
+	if got := busy.CloseCount(); got != 1 {
+		t.Fatalf("expired agent close count after turn = %d, want 1", got)
 	}
-
-	agentList := opt.agentList
-	if len(agentList) == 0 {
-		agentList = []AgentInfo{
-			{ID: "codex", Name: "Codex", Status: "available"},
-			{ID: "claude", Name: "Claude Code", Status: "unavailable"},
-		}
+	h.agentMu.Lock()
+	_, youngCached := h.agentsByScope["scope-young"]
+	remaining := len(h.agentsByScope)
+	h.agentMu.Unlock()
+	if !youngCached || remaining != 1 {
+		t.Fatalf("agentsByScope size = %d (young cached %v), want only the young agent", remaining, youngCached)
 	}
+}
 
-	allowedAgentIDs := opt.allowedAgentIDs
-	if len(allowedAgentIDs) == 0 {
-		allowedAgentIDs = []string{"codex"}
+func TestReapIdleAgentsClosesConcurrentlyWithTimeout(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	h.agentCloseTimeout = 100 * time.Millisecond
+	h.janitorCloseLimit = 2
+
+	stuck := &blockingCloseStreamer{release: make(chan struct{})}
+	defer close(stuck.release)
+	others := []*countingClosableStreamer{{}, {}, {}}
+
+	lastUsed := time.Now().UTC().Add(-2 * h.agentIdleTTL)
+	h.agentMu.Lock()
+	h.agentsByScope["scope-stuck"] = &managedAgent{scopeKey: "scope-stuck", threadID: "th-stuck", provider: stuck, closer: stuck, lastUsed: lastUsed}
+	for i, provider := range others {
+		scopeKey := fmt.Sprintf("scope-%d", i)
+		h.agentsByScope[scopeKey] = &managedAgent{scopeKey: scopeKey, threadID: fmt.Sprintf("th-%d", i), provider: provider, closer: provider, lastUsed: lastUsed}
 	}
+	h.agentMu.Unlock()
 
-	streamAgent := opt.agent
-	if streamAgent == nil {
-		streamAgent = agents.NewFakeAgentWithConfig(3, 10*time.Millisecond)
+	start := time.Now()
+	h.reapIdleAgents(time.Now().UTC())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("reapIdleAgents took %s, want bounded by close timeout", elapsed)
 	}
 
-	turnAgentFactory := opt.turnAgentFactory
-	if turnAgentFactory == nil {
-		turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
-			_ = thread
-			return streamAgent, nil
+	for i, provider := range others {
+		if got := provider.CloseCount(); got != 1 {
+			t.Fatalf("agent %d close count = %d, want 1", i, got)
 		}
 	}
-
-	server := New(Config{
-		AuthToken:          opt.authToken,
-		DataDir:            dataDir,
-		Agents:             agentList,
-		AllowedAgentIDs:    allowedAgentIDs,
-		AllowedRoots:       allowedRoots,
-		Store:              store,
-		TurnController:     runtimectl.NewTurnController(),
-		TurnAgentFactory:   turnAgentFactory,
-		AgentModelsFactory: opt.agentModelsFactory,
-		AgentIdleTTL:       opt.agentIdleTTL,
-		PermissionTimeout:  opt.permissionTimeout,
-		Logger:             opt.logger,
-	})
-	return server, func() {
-		_ = server.Close()
-		_ = store.Close()
+	if got := stuck.CloseCount(); got != 1 {
+		t.Fatalf("stuck agent close count = %d, want 1", got)
 	}
-}
-
-func createThreadForClient(t *testing.T, h http.Handler, clientID, root string) string {
-	t.Helper()
-	createRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads", map[string]any{"agent": "codex", "cwd": root}, map[string]string{"X-Client-ID": clientID})
-	if createRR.Code != http.StatusOK {
-		t.Fatalf("create thread status code = %d, want %d", createRR.Code, http.StatusOK)
+	h.agentMu.Lock()
+	remaining := len(h.agentsByScope)
+	h.agentMu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("agentsByScope size = %d, want 0", remaining)
 	}
-	return extractThreadID(t, createRR.Body.Bytes())
 }
 
-func performJSONRequest(t *testing.T, h http.Handler, method, path string, body any, headers map[string]string) *httptest.ResponseRecorder {
-	t.Helper()
-
-	var reqBody []byte
-	if body != nil {
-		encoded, err := json.Marshal(body)
+func TestServerCloseDoesNotHangOnStuckAgentClose(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo)
+	h := newTestServer(t, testServerOptions{logger: logger})
+	h.agentCloseTimeout = 50 * time.Millisecond
+
+	stuck := &blockingCloseStreamer{release: make(chan struct{})}
+	defer close(stuck.release)
+	healthy := &countingClosableStreamer{}
+	h.agentMu.Lock()
+	h.agentsByScope["scope-stuck"] = &managedAgent{scopeKey: "scope-stuck", threadID: "th-stuck", provider: stuck, closer: stuck, lastUsed: time.Now().UTC()}
+	h.agentsByScope["scope-ok"] = &managedAgent{scopeKey: "scope-ok", threadID: "th-ok", provider: healthy, closer: healthy, lastUsed: time.Now().UTC()}
+	h.agentMu.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- h.Close() }()
+	select {
+	case err := <-done:
 		if err != nil {
-			t.Fatalf("json.Marshal request body: %v", err)
+			t.Fatalf("Close() error = %v", err)
 		}
-		reqBody = encoded
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close() did not return with a stuck agent Close")
 	}
 
-	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	if got := healthy.CloseCount(); got != 1 {
+		t.Fatalf("healthy agent close count = %d, want 1", got)
 	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	if !strings.Contains(logBuf.String(), "agent.close_timeout") {
+		t.Fatalf("expected agent.close_timeout log, got %s", logBuf.String())
 	}
-
-	rr := httptest.NewRecorder()
-	h.ServeHTTP(rr, req)
-	return rr
 }
 
-func extractThreadID(t *testing.T, payload []byte) string {
-	t.Helper()
-	var body struct {
-		ThreadID string `json:"threadId"`
+func TestBatchedSSEFlushDeliversAllEvents(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return &deltaSequenceStreamer{deltas: []string{"a", "b", "c"}}, nil
+		},
+	})
+	h.sseFlush.FlushEvery = 64
+	h.sseFlush.FlushInterval = time.Hour
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hi")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d, body=%s", result.StatusCode, http.StatusOK, result.Body)
 	}
-	if err := json.Unmarshal(payload, &body); err != nil {
-		t.Fatalf("unmarshal threadId response: %v", err)
+
+	var deltas []string
+	completed := false
+	for _, event := range parseSSEEvents(t, result.Body) {
+		switch event.Event {
+		case "message_delta":
+			deltas = append(deltas, stringField(event.Data, "delta"))
+		case "turn_completed":
+			completed = true
+		}
 	}
-	if body.ThreadID == "" {
-		t.Fatalf("threadId is empty")
+	if got := strings.Join(deltas, ""); got != "abc" || !completed {
+		t.Fatalf("deltas = %q completed = %v, want %q and turn_completed", got, completed, "abc")
 	}
-	return body.ThreadID
 }
 
-type parsedSSEEvent struct {
-	Event string
-	Data  map[string]any
-}
+func TestDebugPromptEmitsInjectedPromptWhenEnabled(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
 
-func parseSSEEvents(t *testing.T, raw string) []parsedSSEEvent {
-	t.Helper()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	if result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "first question"); result.StatusCode != http.StatusOK {
+		t.Fatalf("first turn status = %d, body=%s", result.StatusCode, result.Body)
+	}
 
-	blocks := strings.Split(strings.TrimSpace(raw), "\n\n")
-	events := make([]parsedSSEEvent, 0)
-	for _, block := range blocks {
-		block = strings.TrimSpace(block)
-		if block == "" {
-			continue
+	debugURL := ts.URL + "/v1/threads/" + threadID + "/turns?debugPrompt=true"
+	status, body := doJSON(t, http.MethodPost, debugURL, map[string]any{"input": "second", "stream": true}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusForbidden {
+		t.Fatalf("debugPrompt disabled status = %d, want %d, body=%s", status, http.StatusForbidden, body)
+	}
+	assertErrorCode(t, []byte(body), "FORBIDDEN")
+
+	h.enableDebugEndpoints = true
+	status, body = doJSON(t, http.MethodPost, debugURL, map[string]any{"input": "second", "stream": true}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("debugPrompt status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	var prompt string
+	for _, event := range parseSSEEvents(t, body) {
+		if event.Event == "debug_prompt" {
+			prompt = stringField(event.Data, "prompt")
 		}
-		lines := strings.Split(block, "\n")
-		eventType := ""
-		dataLine := ""
-		for _, line := range lines {
-			if strings.HasPrefix(line, "event: ") {
-				eventType = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
-			}
-			if strings.HasPrefix(line, "data: ") {
-				dataLine = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+	}
+	if !strings.Contains(prompt, "first question") || !strings.Contains(prompt, "second") {
+		t.Fatalf("debug_prompt = %q, want injected history and current input", prompt)
+	}
+
+	history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+	for _, turn := range history.Turns {
+		for _, event := range turn.Events {
+			if event.Type == "debug_prompt" {
+				t.Fatalf("debug_prompt was persisted to history")
 			}
 		}
-		if eventType == "" {
-			continue
-		}
-		payload := make(map[string]any)
-		if dataLine != "" {
-			if err := json.Unmarshal([]byte(dataLine), &payload); err != nil {
-				t.Fatalf("unmarshal sse data for event %q: %v", eventType, err)
+	}
+}
+
+func TestThreadTagsEndpointsAndListFilter(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	headers := map[string]string{"X-Client-ID": "client-a"}
+	tagged := createThreadHTTP(t, ts.URL, "client-a", root)
+	other := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	status, body := doJSON(t, http.MethodPut, ts.URL+"/v1/threads/"+tagged+"/tags/%20Work%20", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("add tag status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	if !strings.Contains(body, `"tags":["work"]`) {
+		t.Fatalf("add tag body = %s, want normalized tag", body)
+	}
+
+	status, body = doJSON(t, http.MethodPut, ts.URL+"/v1/threads/"+tagged+"/tags/"+strings.Repeat("x", maxThreadTagRunes+1), nil, headers)
+	if status != http.StatusBadRequest {
+		t.Fatalf("long tag status = %d, want %d, body=%s", status, http.StatusBadRequest, body)
+	}
+	status, body = doJSON(t, http.MethodPut, ts.URL+"/v1/threads/th-missing/tags/work", nil, headers)
+	if status != http.StatusNotFound {
+		t.Fatalf("missing thread status = %d, want %d, body=%s", status, http.StatusNotFound, body)
+	}
+
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/threads?tag=WORK", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("list by tag status = %d, body=%s", status, body)
+	}
+	if !strings.Contains(body, tagged) || strings.Contains(body, other) {
+		t.Fatalf("list by tag body = %s, want only %s", body, tagged)
+	}
+
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+other, nil, headers)
+	if status != http.StatusOK || !strings.Contains(body, `"tags":[]`) {
+		t.Fatalf("untagged thread status = %d body = %s, want empty tags", status, body)
+	}
+
+	status, body = doJSON(t, http.MethodDelete, ts.URL+"/v1/threads/"+tagged+"/tags/work", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("remove tag status = %d, body=%s", status, body)
+	}
+	status, body = doJSON(t, http.MethodDelete, ts.URL+"/v1/threads/"+tagged+"/tags/work", nil, headers)
+	if status != http.StatusNotFound {
+		t.Fatalf("remove missing tag status = %d, want %d, body=%s", status, http.StatusNotFound, body)
+	}
+}
+
+func TestBackgroundTurnSurvivesClientDisconnect(t *testing.T) {
+	root := t.TempDir()
+	streamer := &gatedDeltaStreamer{started: make(chan struct{}), release: make(chan struct{})}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, _ := json.Marshal(map[string]any{"input": "hi", "stream": true, "background": true})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/turns", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-ID", "client-a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("background turn request: %v", err)
+	}
+	<-streamer.started
+	cancel()
+	_ = resp.Body.Close()
+
+	// Give the server time to observe the disconnect before the agent finishes.
+	time.Sleep(100 * time.Millisecond)
+	close(streamer.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+		if len(history.Turns) == 1 && history.Turns[0].Status != "running" {
+			if history.Turns[0].Status != "completed" || history.Turns[0].ResponseText != "first second" {
+				t.Fatalf("background turn = %+v, want completed with full response", history.Turns[0])
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("background turn did not finish after client disconnect")
+}
+
+func TestMaxActiveTurnsPerClientRejectsExcessTurns(t *testing.T) {
+	root := t.TempDir()
+	gated := &gatedDeltaStreamer{started: make(chan struct{}), release: make(chan struct{})}
+	var gatedThreadID string
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			if thread.ThreadID == gatedThreadID {
+				return gated, nil
+			}
+			return &deltaSequenceStreamer{deltas: []string{"ok"}}, nil
+		},
+	})
+	h.maxClientTurns = 1
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	gatedThreadID = createThreadHTTP(t, ts.URL, "client-a", root)
+	otherThreadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	clientBThreadID := createThreadHTTP(t, ts.URL, "client-b", root)
+
+	streamResultCh := make(chan httpTurnStreamResult, 1)
+	go func() {
+		streamResultCh <- runTurnStreamRequest(t, ts.URL, "client-a", gatedThreadID, "hold")
+	}()
+	<-gated.started
+
+	busy := runTurnStreamRequest(t, ts.URL, "client-a", otherThreadID, "second")
+	if busy.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second client-a turn status = %d, want %d, body=%s", busy.StatusCode, http.StatusTooManyRequests, busy.Body)
+	}
+	assertErrorCode(t, []byte(busy.Body), codeBusy)
+
+	if other := runTurnStreamRequest(t, ts.URL, "client-b", clientBThreadID, "other client"); other.StatusCode != http.StatusOK {
+		t.Fatalf("client-b turn status = %d, want %d, body=%s", other.StatusCode, http.StatusOK, other.Body)
+	}
+
+	close(gated.release)
+	if first := <-streamResultCh; first.StatusCode != http.StatusOK {
+		t.Fatalf("first client-a turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+	if again := runTurnStreamRequest(t, ts.URL, "client-a", otherThreadID, "after release"); again.StatusCode != http.StatusOK {
+		t.Fatalf("client-a turn after release status = %d, want %d, body=%s", again.StatusCode, http.StatusOK, again.Body)
+	}
+}
+
+func TestClientStoredBytesQuotaRejectsTurns(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.maxClientStoredBytes = 20
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	first := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "fill the quota")
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+	used, err := h.store.GetClientStoredBytes(context.Background(), "client-a")
+	if err != nil {
+		t.Fatalf("GetClientStoredBytes: %v", err)
+	}
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if want := int64(len("fill the quota") + len(history.Turns[0].ResponseText)); used != want {
+		t.Fatalf("stored bytes = %d, want %d", used, want)
+	}
+
+	over := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "one more")
+	if over.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over-quota turn status = %d, want %d", over.StatusCode, http.StatusTooManyRequests)
+	}
+	assertErrorCode(t, []byte(over.Body), codeQuotaExceeded)
+
+	otherThreadID := createThreadHTTP(t, ts.URL, "client-b", root)
+	if other := runTurnStreamRequest(t, ts.URL, "client-b", otherThreadID, "hi"); other.StatusCode != http.StatusOK {
+		t.Fatalf("other client turn status = %d, want %d", other.StatusCode, http.StatusOK)
+	}
+	if turns := getHistoryHTTP(t, ts.URL, "client-a", threadID, false).Turns; len(turns) != 1 {
+		t.Fatalf("client-a turns = %d, want 1 (rejected turn must not be stored)", len(turns))
+	}
+
+	// Deleting the thread frees the quota again.
+	if rr := performJSONRequest(t, h, http.MethodDelete, "/v1/threads/"+threadID, nil, map[string]string{"X-Client-ID": "client-a"}); rr.Code != http.StatusOK {
+		t.Fatalf("DELETE thread status = %d, want %d, body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	freshThreadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	if again := runTurnStreamRequest(t, ts.URL, "client-a", freshThreadID, "after delete"); again.StatusCode != http.StatusOK {
+		t.Fatalf("turn after delete status = %d, want %d, body=%s", again.StatusCode, http.StatusOK, again.Body)
+	}
+}
+
+func TestMaxTurnsPerThreadRejectsTurnsAtCap(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.maxTurnsPerThread = 2
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	if first := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "one"); first.StatusCode != http.StatusOK {
+		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+	// The internal compaction turn does not count toward the cap.
+	status, body := doJSON(
+		t,
+		http.MethodPost,
+		ts.URL+"/v1/threads/"+threadID+"/compact",
+		map[string]any{"maxSummaryChars": 120},
+		map[string]string{"X-Client-ID": "client-a"},
+	)
+	if status != http.StatusOK {
+		t.Fatalf("compact status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	if second := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "two"); second.StatusCode != http.StatusOK {
+		t.Fatalf("second turn status = %d, want %d", second.StatusCode, http.StatusOK)
+	}
+
+	over := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "three")
+	if over.StatusCode != http.StatusConflict {
+		t.Fatalf("turn over cap status = %d, want %d", over.StatusCode, http.StatusConflict)
+	}
+	assertErrorCode(t, []byte(over.Body), codeConflict)
+	if !strings.Contains(over.Body, `"limit":2`) || !strings.Contains(over.Body, "new thread") {
+		t.Fatalf("turn over cap body = %s, want limit and guidance", over.Body)
+	}
+	if turns := getHistoryHTTP(t, ts.URL, "client-a", threadID, false).Turns; len(turns) != 2 {
+		t.Fatalf("visible turns = %d, want 2 (rejected turn must not be stored)", len(turns))
+	}
+
+	otherThreadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	if other := runTurnStreamRequest(t, ts.URL, "client-a", otherThreadID, "fresh"); other.StatusCode != http.StatusOK {
+		t.Fatalf("new thread turn status = %d, want %d", other.StatusCode, http.StatusOK)
+	}
+}
+
+func TestTurnInputRejectsOrStripsInvalidUTF8(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	postTurn := func(body []byte) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/turns", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Client-ID", "client-a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post turn: %v", err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	for name, body := range map[string][]byte{
+		"invalid bytes": []byte("{\"input\":\"bad \xff\xfe bytes\",\"stream\":true}"),
+		"nul escape":    []byte(`{"input":"bad \u0000 byte","stream":true}`),
+	} {
+		status, respBody := postTurn(body)
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want %d, body=%s", name, status, http.StatusBadRequest, respBody)
+		}
+		assertErrorCode(t, []byte(respBody), codeInvalidArgument)
+		if !strings.Contains(respBody, `"field":"input"`) {
+			t.Fatalf("%s: body = %s, want field input", name, respBody)
+		}
+	}
+	if turns := getHistoryHTTP(t, ts.URL, "client-a", threadID, false).Turns; len(turns) != 0 {
+		t.Fatalf("turns = %d, want 0 after rejected input", len(turns))
+	}
+
+	h.stripInvalidInput = true
+	if status, respBody := postTurn([]byte("{\"input\":\"ok \xff\xfe\\u0000text\",\"stream\":true}")); status != http.StatusOK {
+		t.Fatalf("strip mode status = %d, want %d, body=%s", status, http.StatusOK, respBody)
+	}
+	turns := getHistoryHTTP(t, ts.URL, "client-a", threadID, false).Turns
+	if len(turns) != 1 || turns[0].RequestText != "ok text" {
+		t.Fatalf("turns = %+v, want one turn with requestText %q", turns, "ok text")
+	}
+}
+
+// seedClientStoredBytes stores one finalized turn of n request bytes on
+// behalf of clientID.
+func seedClientStoredBytes(t *testing.T, h *Server, clientID string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	thread, err := h.store.CreateThread(ctx, storage.CreateThreadParams{
+		ThreadID:         "th-usage-" + clientID,
+		AgentID:          "codex",
+		CWD:              t.TempDir(),
+		AgentOptionsJSON: "{}",
+	})
+	if err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+	turnID := "tu-usage-" + clientID
+	if _, err := h.store.CreateTurn(ctx, storage.CreateTurnParams{
+		TurnID:      turnID,
+		ThreadID:    thread.ThreadID,
+		RequestText: strings.Repeat("x", n),
+		ClientID:    clientID,
+	}); err != nil {
+		t.Fatalf("CreateTurn: %v", err)
+	}
+	if err := h.store.FinalizeTurn(ctx, storage.FinalizeTurnParams{TurnID: turnID, Status: "completed"}); err != nil {
+		t.Fatalf("FinalizeTurn: %v", err)
+	}
+}
+
+func TestClientRecordEndpointReturnsOnlyOwnRecord(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+
+	// Without StoreClientMetadata only the id and usage are reported.
+	rr := performJSONRequest(t, h, http.MethodGet, "/v1/clients/me", nil, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /v1/clients/me status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp struct {
+		Client map[string]any `json:"client"`
+		Stats  struct {
+			StoredBytes int64 `json:"storedBytes"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.Client) != 1 || resp.Client["clientId"] != "client-a" {
+		t.Fatalf("client = %v, want only clientId", resp.Client)
+	}
+
+	h.storeClientMetadata = true
+	headers := map[string]string{
+		"X-Client-ID":       "client-a",
+		"X-Client-Name":     "Ops laptop",
+		"X-Client-Metadata": `{"team":"ops"}`,
+		"User-Agent":        "ngent-test/1.0",
+	}
+	if rr := performJSONRequest(t, h, http.MethodGet, "/v1/agents", nil, headers); rr.Code != http.StatusOK {
+		t.Fatalf("GET /v1/agents status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	seedClientStoredBytes(t, h, "client-a", 42)
+	for _, path := range []string{"/v1/clients/me", "/v1/clients/client-a"} {
+		rr = performJSONRequest(t, h, http.MethodGet, path, nil, map[string]string{"X-Client-ID": "client-a", "User-Agent": "other/2.0"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", path, rr.Code, http.StatusOK)
+		}
+		resp.Client = nil
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		metadata, _ := resp.Client["metadata"].(map[string]any)
+		if resp.Client["displayName"] != "Ops laptop" || resp.Client["userAgent"] != "ngent-test/1.0" || metadata["team"] != "ops" {
+			t.Fatalf("GET %s client = %v, want stored name, first user agent, and metadata", path, resp.Client)
+		}
+		if resp.Client["lastSeenAt"] == nil || resp.Stats.StoredBytes != 42 {
+			t.Fatalf("GET %s = %s, want lastSeenAt and storedBytes 42", path, rr.Body.String())
+		}
+	}
+
+	rr = performJSONRequest(t, h, http.MethodGet, "/v1/clients/client-b", nil, map[string]string{"X-Client-ID": "client-a"})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("GET other client status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), codeForbidden)
+
+	rr = performJSONRequest(t, h, http.MethodGet, "/v1/clients/me", nil, map[string]string{"X-Client-ID": "client-a", "X-Client-Metadata": `["not","object"]`})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid metadata status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	assertErrorCode(t, rr.Body.Bytes(), codeInvalidArgument)
+}
+
+func TestAdminAgentThreadsRequiresAdminTokenAndPaginates(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{authToken: "user-token", allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	userHeaders := map[string]string{"X-Client-ID": "client-a", "Authorization": "Bearer user-token"}
+	adminHeaders := map[string]string{"X-Client-ID": "ops", "Authorization": "Bearer admin-token"}
+	url := ts.URL + "/v1/admin/agents/codex/threads"
+
+	status, body := doJSON(t, http.MethodGet, url, nil, userHeaders)
+	if status != http.StatusForbidden {
+		t.Fatalf("admin endpoint without admin token configured status = %d, want %d, body=%s", status, http.StatusForbidden, body)
+	}
+
+	h.adminToken = "admin-token"
+	threadIDs := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		threadIDs[createThreadHTTPWithHeaders(t, ts.URL, "client-a", root, map[string]string{"Authorization": "Bearer user-token"})] = true
+	}
+
+	status, body = doJSON(t, http.MethodGet, url, nil, userHeaders)
+	if status != http.StatusForbidden {
+		t.Fatalf("admin endpoint with user token status = %d, want %d, body=%s", status, http.StatusForbidden, body)
+	}
+	assertErrorCode(t, []byte(body), codeForbidden)
+
+	var page struct {
+		AgentID    string           `json:"agentId"`
+		Threads    []threadResponse `json:"threads"`
+		NextCursor string           `json:"nextCursor"`
+	}
+	status, body = doJSON(t, http.MethodGet, url+"?limit=2", nil, adminHeaders)
+	if status != http.StatusOK {
+		t.Fatalf("admin page 1 status = %d, body=%s", status, body)
+	}
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("decode admin page 1: %v", err)
+	}
+	if page.AgentID != "codex" || len(page.Threads) != 2 || page.NextCursor != "2" {
+		t.Fatalf("admin page 1 = %+v, want 2 codex threads with nextCursor 2", page)
+	}
+	seen := []string{page.Threads[0].ThreadID, page.Threads[1].ThreadID}
+
+	status, body = doJSON(t, http.MethodGet, url+"?limit=2&cursor="+page.NextCursor, nil, adminHeaders)
+	if status != http.StatusOK {
+		t.Fatalf("admin page 2 status = %d, body=%s", status, body)
+	}
+	page.Threads = nil
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("decode admin page 2: %v", err)
+	}
+	if len(page.Threads) != 1 || page.NextCursor != "" {
+		t.Fatalf("admin page 2 = %+v, want 1 thread and no nextCursor", page)
+	}
+	seen = append(seen, page.Threads[0].ThreadID)
+	for _, threadID := range seen {
+		if !threadIDs[threadID] {
+			t.Fatalf("unexpected thread %q in admin listing", threadID)
+		}
+		delete(threadIDs, threadID)
+	}
+
+	if status, body := doJSON(t, http.MethodGet, url+"?limit=0", nil, adminHeaders); status != http.StatusBadRequest {
+		t.Fatalf("admin invalid limit status = %d, want %d, body=%s", status, http.StatusBadRequest, body)
+	}
+}
+
+func TestCreateThreadMergesDefaultAgentOptions(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.defaultAgentOptions = cloneDefaultAgentOptions(map[string]map[string]any{
+		"codex": {
+			"modelId":         "default-model",
+			"configOverrides": map[string]any{"effort": "low", "mode": "ask"},
+			"extra":           true,
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	getOptions := func(threadID string) map[string]any {
+		t.Helper()
+		status, body := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID, nil, map[string]string{"X-Client-ID": "client-a"})
+		if status != http.StatusOK {
+			t.Fatalf("get thread status = %d, body=%s", status, body)
+		}
+		var resp struct {
+			Thread threadResponse `json:"thread"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("decode thread: %v", err)
+		}
+		var options map[string]any
+		if err := json.Unmarshal(resp.Thread.AgentOptions, &options); err != nil {
+			t.Fatalf("decode agentOptions: %v", err)
+		}
+		return options
+	}
+
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads", map[string]any{
+		"agent": "codex",
+		"cwd":   root,
+		"agentOptions": map[string]any{
+			"modelId":         "client-model",
+			"configOverrides": map[string]any{"effort": "high"},
+		},
+	}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("create thread status = %d, body=%s", status, body)
+	}
+	options := getOptions(extractThreadID(t, []byte(body)))
+	if options["modelId"] != "client-model" {
+		t.Fatalf("modelId = %v, want client-model (client wins)", options["modelId"])
+	}
+	overrides, _ := options["configOverrides"].(map[string]any)
+	if overrides["effort"] != "high" || overrides["mode"] != "ask" {
+		t.Fatalf("configOverrides = %v, want effort=high mode=ask", overrides)
+	}
+	if options["extra"] != true {
+		t.Fatalf("extra = %v, want inherited default true", options["extra"])
+	}
+
+	defaultsOnly := getOptions(createThreadHTTP(t, ts.URL, "client-a", root))
+	if defaultsOnly["modelId"] != "default-model" {
+		t.Fatalf("thread without options modelId = %v, want default-model", defaultsOnly["modelId"])
+	}
+}
+
+func TestTurnRetryPolicyRetriesTransientFailure(t *testing.T) {
+	root := t.TempDir()
+	streamer := &flakyStreamer{failures: 1, err: fmt.Errorf("start turn: %w", agents.ErrTransient)}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	h.turnRetry = TurnRetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}.withDefaults()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hi")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+	events := parseSSEEvents(t, result.Body)
+	var retries int
+	for _, event := range events {
+		switch event.Event {
+		case "turn_retry":
+			retries++
+			if got := event.Data["attempt"]; got != float64(2) {
+				t.Fatalf("turn_retry attempt = %v, want 2", got)
+			}
+		case "error":
+			t.Fatalf("unexpected error event after retry: %v", event.Data)
+		}
+	}
+	if retries != 1 {
+		t.Fatalf("turn_retry events = %d, want 1", retries)
+	}
+	if got := streamer.calls.Load(); got != 2 {
+		t.Fatalf("stream attempts = %d, want 2", got)
+	}
+	if !streamer.callerRetries.Load() {
+		t.Fatalf("agent context not marked with caller retries; providers would retry too")
+	}
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 1 || history.Turns[0].Status != "completed" || history.Turns[0].ResponseText != "recovered" {
+		t.Fatalf("history turns = %+v, want one completed turn with recovered text", history.Turns)
+	}
+}
+
+func TestTurnRetryPolicySkipsNonTransientFailure(t *testing.T) {
+	root := t.TempDir()
+	streamer := &flakyStreamer{failures: 1, err: errors.New("permanent failure")}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	h.turnRetry = TurnRetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}.withDefaults()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hi")
+	for _, event := range parseSSEEvents(t, result.Body) {
+		if event.Event == "turn_retry" {
+			t.Fatalf("unexpected turn_retry for non-transient error")
+		}
+	}
+	if got := streamer.calls.Load(); got != 1 {
+		t.Fatalf("stream attempts = %d, want 1", got)
+	}
+}
+
+// scriptedFaults fails the first failures[point] injections at each point
+// with err and counts every call.
+type scriptedFaults struct {
+	mu       sync.Mutex
+	failures map[faultPoint]int
+	err      error
+	calls    map[faultPoint]int
+}
+
+func (f *scriptedFaults) inject(_ context.Context, point faultPoint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[faultPoint]int)
+	}
+	f.calls[point]++
+	if f.failures[point] > 0 {
+		f.failures[point]--
+		return f.err
+	}
+	return nil
+}
+
+func TestFaultInjectionPoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		point      faultPoint
+		err        error
+		wantStatus string
+		wantRetry  bool
+	}{
+		{name: "agent stream retried", point: faultAgentStream, err: fmt.Errorf("injected: %w", agents.ErrTransient), wantStatus: "completed", wantRetry: true},
+		{name: "agent stream fails turn", point: faultAgentStream, err: errors.New("injected"), wantStatus: "failed"},
+		{name: "event persist", point: faultEventPersist, err: errors.New("injected disk full"), wantStatus: "failed"},
+		{name: "stream write", point: faultStreamWrite, err: errors.New("injected flush error"), wantStatus: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+			h.turnRetry = TurnRetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}.withDefaults()
+			faults := &scriptedFaults{failures: map[faultPoint]int{tt.point: 1}, err: tt.err}
+			h.faults = faults
+			ts := httptest.NewServer(h)
+			defer ts.Close()
+
+			threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+			result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hi")
+			if result.StatusCode != http.StatusOK {
+				t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+			}
+			retried := false
+			for _, event := range parseSSEEvents(t, result.Body) {
+				retried = retried || event.Event == "turn_retry"
+			}
+			if retried != tt.wantRetry {
+				t.Fatalf("turn_retry seen = %v, want %v", retried, tt.wantRetry)
+			}
+			if faults.calls[tt.point] == 0 {
+				t.Fatalf("fault point %q was never reached", tt.point)
+			}
+
+			history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+			if len(history.Turns) != 1 || history.Turns[0].Status != tt.wantStatus {
+				t.Fatalf("history turns = %+v, want one %s turn", history.Turns, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTurnStopsStreamingWhenResponseWriterFails(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ctx := context.Background()
+
+	thread, err := h.store.CreateThread(ctx, storage.CreateThreadParams{
+		ThreadID:         "th-dead-conn",
+		AgentID:          "codex",
+		CWD:              root,
+		AgentOptionsJSON: "{}",
+	})
+	if err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+	if _, err := h.store.CreateTurn(ctx, storage.CreateTurnParams{
+		TurnID:      "tu-dead-conn",
+		ThreadID:    thread.ThreadID,
+		RequestText: "hi",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn: %v", err)
+	}
+
+	// The connection dies after turn_started; the streamer ignores ctx, so
+	// only onDelta errors can stop it.
+	writer := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), okWrites: 2}
+	sink, err := sse.NewWriter(writer)
+	if err != nil {
+		t.Fatalf("sse.NewWriter: %v", err)
+	}
+	streamer := &endlessDeltaStreamer{limit: 1000}
+	h.executeTurn(&turnExecution{
+		thread:     thread,
+		turnID:     "tu-dead-conn",
+		ctx:        ctx,
+		persistCtx: ctx,
+		agent:      streamer,
+		prompt:     agents.TextPrompt("hi"),
+	}, sink)
+
+	if got := streamer.sent.Load(); got >= streamer.limit {
+		t.Fatalf("streamer sent %d deltas into a dead connection, want early stop", got)
+	}
+	turn, err := h.store.GetTurn(ctx, "tu-dead-conn")
+	if err != nil {
+		t.Fatalf("GetTurn: %v", err)
+	}
+	if turn.Status != "failed" {
+		t.Fatalf("turn status = %q, want failed", turn.Status)
+	}
+}
+
+func TestMaxPendingPermissionsAutoDeclinesExcessRequests(t *testing.T) {
+	root := t.TempDir()
+	streamer := &permissionFloodStreamer{requests: 10}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		permissionTimeout: 500 * time.Millisecond,
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	h.maxPendingPermissions = 3
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "flood")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+
+	var required, autoDeclined int
+	for _, event := range parseSSEEvents(t, result.Body) {
+		switch event.Event {
+		case "permission_required":
+			required++
+		case "permission_auto_declined":
+			autoDeclined++
+			if got := stringField(event.Data, "reason"); got != "too_many_pending" {
+				t.Fatalf("auto-declined reason = %q, want too_many_pending", got)
+			}
+		}
+	}
+	if required != 3 || autoDeclined != 7 {
+		t.Fatalf("permission_required=%d permission_auto_declined=%d, want 3 and 7", required, autoDeclined)
+	}
+	if got := streamer.declined.Load(); got != 10 {
+		t.Fatalf("declined responses = %d, want 10", got)
+	}
+
+	if err := h.checkPermissionLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxGlobalPendingPermissionsAutoDeclinesAcrossTurns(t *testing.T) {
+	root := t.TempDir()
+	streamer := &permissionFloodStreamer{requests: 5}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		permissionTimeout: time.Second,
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	h.globalPermissionLimit = 4
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	clientIDs := []string{"client-a", "client-b"}
+	threadIDs := make([]string, len(clientIDs))
+	for i, clientID := range clientIDs {
+		threadIDs[i] = createThreadHTTP(t, ts.URL, clientID, root)
+	}
+	results := make([]httpTurnStreamResult, len(clientIDs))
+	var wg sync.WaitGroup
+	for i, clientID := range clientIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runTurnStreamRequest(t, ts.URL, clientID, threadIDs[i], "flood")
+		}()
+	}
+	wg.Wait()
+
+	var required, autoDeclined int
+	for _, result := range results {
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+		}
+		for _, event := range parseSSEEvents(t, result.Body) {
+			switch event.Event {
+			case "permission_required":
+				required++
+			case "permission_auto_declined":
+				autoDeclined++
+				if got := stringField(event.Data, "reason"); got != "too_many_pending_global" {
+					t.Fatalf("auto-declined reason = %q, want too_many_pending_global", got)
+				}
+				if got := event.Data["limit"]; got != float64(4) {
+					t.Fatalf("auto-declined limit = %v, want 4", got)
+				}
+			}
+		}
+	}
+	if required != 4 || autoDeclined != 6 {
+		t.Fatalf("permission_required=%d permission_auto_declined=%d, want 4 and 6", required, autoDeclined)
+	}
+	if got := streamer.declined.Load(); got != 10 {
+		t.Fatalf("declined responses = %d, want 10", got)
+	}
+
+	if err := h.checkPermissionLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPermissionBookkeepingDrainsAfterManyTurns(t *testing.T) {
+	root := t.TempDir()
+	streamer := &permissionFloodStreamer{requests: 5}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots:      []string{root},
+		permissionTimeout: 300 * time.Millisecond,
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	const turns = 8
+	threadIDs := make([]string, turns)
+	for i := range threadIDs {
+		threadIDs[i] = createThreadHTTP(t, ts.URL, "client-a", root)
+	}
+
+	// Approve some pending permissions and cancel one turn while the rest
+	// time out, so every exit path of the pipeline runs.
+	stopDecider := make(chan struct{})
+	deciderDone := make(chan struct{})
+	var sawPending atomic.Bool
+	go func() {
+		defer close(deciderDone)
+		cancelled := false
+		for {
+			select {
+			case <-stopDecider:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if h.permissionStats()["pending"] > 0 {
+				sawPending.Store(true)
+			}
+			if !cancelled {
+				if status, _ := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadIDs[0]+"/cancel", nil, map[string]string{"X-Client-ID": "client-a"}); status == http.StatusOK {
+					cancelled = true
+				}
+			}
+			h.permissionsMu.Lock()
+			ids := make([]string, 0, len(h.permissions))
+			for id := range h.permissions {
+				ids = append(ids, id)
+			}
+			h.permissionsMu.Unlock()
+			for i, id := range ids {
+				if i%2 == 0 {
+					doJSON(t, http.MethodPost, ts.URL+"/v1/permissions/"+id, map[string]any{"outcome": "approved"}, map[string]string{"X-Client-ID": "client-a"})
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, threadID := range threadIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runTurnStreamRequest(t, ts.URL, "client-a", threadID, "flood")
+		}()
+	}
+	wg.Wait()
+	close(stopDecider)
+	<-deciderDone
+
+	if !sawPending.Load() {
+		t.Fatalf("never observed pending permissions while turns ran")
+	}
+	if err := h.checkPermissionLeaks(); err != nil {
+		t.Fatal(err)
+	}
+	status, body := doJSON(t, http.MethodGet, ts.URL+"/healthz?verbose=1", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("healthz status = %d, body=%s", status, body)
+	}
+	if !strings.Contains(body, `"permissions":{"limit":0,"pending":0,"turns":0}`) {
+		t.Fatalf("healthz body = %s, want drained permission stats", body)
+	}
+}
+
+func TestVersionEndpointReportsSchemaVersion(t *testing.T) {
+	h := newTestServer(t, testServerOptions{authToken: "secret"})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	if status, _ := doJSON(t, http.MethodGet, ts.URL+"/v1/version", nil, map[string]string{"X-Client-ID": "client-a"}); status != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated version status = %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, body := doJSON(t, http.MethodGet, ts.URL+"/v1/version", nil, map[string]string{
+		"X-Client-ID":   "client-a",
+		"Authorization": "Bearer secret",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("version status = %d, body=%s", status, body)
+	}
+	var resp struct {
+		Build  map[string]any `json:"build"`
+		Schema struct {
+			Version           int  `json:"version"`
+			Latest            int  `json:"latest"`
+			AppliedMigrations int  `json:"appliedMigrations"`
+			UpToDate          bool `json:"upToDate"`
+		} `json:"schema"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode version: %v", err)
+	}
+	if resp.Schema.Version != storage.LatestSchemaVersion() || !resp.Schema.UpToDate || resp.Schema.AppliedMigrations == 0 {
+		t.Fatalf("schema = %+v, want up to date at version %d", resp.Schema, storage.LatestSchemaVersion())
+	}
+	if stringField(resp.Build, "goVersion") == "" {
+		t.Fatalf("build info missing goVersion: %v", resp.Build)
+	}
+}
+
+func TestStatsEndpointReportsLiveCounters(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}, authToken: "secret"})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	if status, _ := doJSON(t, http.MethodGet, ts.URL+"/v1/stats", nil, map[string]string{"X-Client-ID": "client-a"}); status != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated stats status = %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	headers := map[string]string{"X-Client-ID": "client-a", "Authorization": "Bearer secret"}
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads", map[string]any{"agent": "codex", "cwd": root}, headers)
+	if status != http.StatusOK {
+		t.Fatalf("create thread status = %d, body=%s", status, body)
+	}
+	var created struct {
+		ThreadID string `json:"threadId"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("decode thread: %v", err)
+	}
+	threadID := created.ThreadID
+	turnRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  "count me",
+		"stream": true,
+	}, headers)
+	if turnRR.Code != http.StatusOK {
+		t.Fatalf("turn status code = %d, want %d", turnRR.Code, http.StatusOK)
+	}
+	if err := h.turns.Activate("th-live", "", "tu-live", func() {}); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	defer h.turns.Release("th-live", "", "tu-live")
+	if !h.acquireClientTurn("client-b") {
+		t.Fatalf("acquireClientTurn(client-b) = false")
+	}
+	defer h.releaseClientTurn("client-b")
+
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/stats", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("stats status = %d, body=%s", status, body)
+	}
+	var resp struct {
+		Server struct {
+			ActiveTurns        *int `json:"activeTurns"`
+			ActiveStreams      *int `json:"activeStreams"`
+			CachedAgents       *int `json:"cachedAgents"`
+			PendingPermissions *int `json:"pendingPermissions"`
+			Threads            *int `json:"threads"`
+			Turns              *int `json:"turns"`
+			ContextCapHits     *int `json:"contextPromptCapHits"`
+		} `json:"server"`
+		Client struct {
+			ClientID    string `json:"clientId"`
+			ActiveTurns *int   `json:"activeTurns"`
+			StoredBytes *int64 `json:"storedBytes"`
+		} `json:"client"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	srv, client := resp.Server, resp.Client
+	if srv.ActiveTurns == nil || srv.ActiveStreams == nil || srv.CachedAgents == nil || srv.PendingPermissions == nil || srv.Threads == nil || srv.Turns == nil || srv.ContextCapHits == nil ||
+		client.ActiveTurns == nil || client.StoredBytes == nil {
+		t.Fatalf("stats response missing fields: %s", body)
+	}
+	if *srv.ActiveTurns != 1 || *srv.ActiveStreams != 0 || *srv.PendingPermissions != 0 || *srv.CachedAgents < 0 {
+		t.Fatalf("server live counters = %s, want 1 active turn, no streams or permissions", body)
+	}
+	if *srv.Threads != 1 || *srv.Turns != 1 {
+		t.Fatalf("server totals = %s, want 1 thread and 1 turn", body)
+	}
+	h.contextPromptCapHits.Add(2)
+	status, body = doJSON(t, http.MethodGet, ts.URL+"/v1/stats", nil, headers)
+	if status != http.StatusOK {
+		t.Fatalf("stats status = %d, body=%s", status, body)
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if got := *resp.Server.ContextCapHits; got != 2 {
+		t.Fatalf("contextPromptCapHits = %d, want 2", got)
+	}
+	if client.ClientID != "client-a" || *client.ActiveTurns != 0 || *client.StoredBytes <= 0 {
+		t.Fatalf("client stats = %s, want client-a with no active turns and stored bytes", body)
+	}
+}
+
+func TestTurnSummaryEventMatchesStreamedDeltas(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return &deltaSequenceStreamer{deltas: []string{"hel", "lo ", "wörld"}}, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	for _, event := range parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "off").Body) {
+		if event.Event == "turn_summary" {
+			t.Fatalf("turn_summary emitted while EmitTurnSummary is off")
+		}
+	}
+
+	h.emitTurnSummary = true
+	events := parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "on").Body)
+	if len(events) < 2 || events[len(events)-1].Event != "turn_summary" || events[len(events)-2].Event != "turn_completed" {
+		t.Fatalf("events = %+v, want turn_completed followed by turn_summary", events)
+	}
+	var deltas, chars int
+	for _, event := range events {
+		if event.Event == "message_delta" {
+			deltas++
+			chars += utf8.RuneCountInString(stringField(event.Data, "delta"))
+		}
+	}
+	summary := events[len(events)-1].Data
+	if summary["deltaCount"] != float64(deltas) || summary["totalChars"] != float64(chars) {
+		t.Fatalf("turn_summary = %v, want deltaCount=%d totalChars=%d", summary, deltas, chars)
+	}
+	if stringField(summary, "finalStatus") != "completed" || stringField(summary, "stopReason") != "end_turn" {
+		t.Fatalf("turn_summary status = %v, want completed/end_turn", summary)
+	}
+	if _, ok := summary["durationMs"].(float64); !ok {
+		t.Fatalf("turn_summary durationMs missing: %v", summary)
+	}
+}
+
+// silentStreamer completes every turn with end_turn without sending text.
+type silentStreamer struct{}
+
+func (silentStreamer) Name() string { return "silent-streamer" }
+
+func (silentStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_, _, _ = ctx, input, onDelta
+	return agents.StopReasonEndTurn, nil
+}
+
+func TestEmptyResponseMarksTurnWithoutDeltas(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			root := t.TempDir()
+			h := newTestServer(t, testServerOptions{
+				allowedRoots: []string{root},
+				agent:        silentStreamer{},
+			})
+			h.emitEmptyResponse = enabled
+			ts := httptest.NewServer(h)
+			defer ts.Close()
+
+			threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+			result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "say nothing")
+			if result.StatusCode != http.StatusOK {
+				t.Fatalf("turn status = %d, want %d", result.StatusCode, http.StatusOK)
+			}
+			var types []string
+			var completed map[string]any
+			for _, event := range parseSSEEvents(t, result.Body) {
+				types = append(types, event.Event)
+				if event.Event == "turn_completed" {
+					completed = event.Data
+				}
+			}
+			wantTypes := []string{"turn_started", "turn_completed"}
+			if enabled {
+				wantTypes = []string{"turn_started", eventTypeEmptyResponse, "turn_completed"}
+			}
+			if !slices.Equal(types, wantTypes) {
+				t.Fatalf("events = %q, want %q", types, wantTypes)
+			}
+			if got, _ := completed["emptyResponse"].(bool); got != enabled {
+				t.Fatalf("turn_completed.emptyResponse = %v, want %v", completed["emptyResponse"], enabled)
+			}
+			if stringField(completed, "stopReason") != string(agents.StopReasonEndTurn) {
+				t.Fatalf("turn_completed.stopReason = %v, want end_turn", completed["stopReason"])
+			}
+
+			history := getHistoryHTTP(t, ts.URL, "client-a", threadID, true)
+			if len(history.Turns) != 1 || history.Turns[0].Status != "completed" || history.Turns[0].ResponseText != "" {
+				t.Fatalf("history turns = %+v, want one completed turn without text", history.Turns)
+			}
+		})
+	}
+}
+
+func TestTurnContextEventRecordsMetadataWithoutPrompt(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return &deltaSequenceStreamer{deltas: []string{"ok"}}, nil
+		},
+	})
+	h.emitTurnContext = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	events := parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "first question").Body)
+	if len(events) < 2 || events[0].Event != "turn_started" || events[1].Event != "turn_context" {
+		t.Fatalf("events = %+v, want turn_started followed by turn_context", events)
+	}
+	first := events[1].Data
+	if stringField(first, "agent") != "codex" || stringField(first, "cwd") != root {
+		t.Fatalf("turn_context = %v, want agent codex and cwd %s", first, root)
+	}
+	if first["truncated"] != false || first["recentTurns"] != float64(0) || first["inputChars"] != float64(len("first question")) {
+		t.Fatalf("turn_context = %v, want untruncated first turn", first)
+	}
+	if _, ok := first["prompt"]; ok {
+		t.Fatalf("turn_context includes prompt while PersistPrompts is off: %v", first)
+	}
+
+	h.contextMaxChars = 40
+	h.persistPrompts = true
+	runTurnStreamRequest(t, ts.URL, "client-a", threadID, "second question that pushes the context over the cap")
+
+	history := getHistoryWithEventsHTTP(t, ts.URL, "client-a", threadID)
+	if len(history.Turns) != 2 {
+		t.Fatalf("history turns = %d, want 2", len(history.Turns))
+	}
+	var second map[string]any
+	for _, event := range history.Turns[1].Events {
+		if event.Type == "turn_context" {
+			second = event.Data
+		}
+	}
+	if second == nil {
+		t.Fatalf("turn_context not persisted: %+v", history.Turns[1].Events)
+	}
+	if second["truncated"] != true || second["recentTurns"] != float64(1) || second["contextInjected"] != true {
+		t.Fatalf("turn_context = %v, want truncated context with one recent turn", second)
+	}
+	if prompt := stringField(second, "prompt"); prompt == "" || second["contextChars"] != float64(utf8.RuneCountInString(prompt)) {
+		t.Fatalf("turn_context prompt = %q, contextChars = %v; want prompt matching contextChars", prompt, second["contextChars"])
+	}
+}
+
+func TestTurnAcceptedEventPrecedesAgentResolution(t *testing.T) {
+	root := t.TempDir()
+	factoryEntered := make(chan struct{})
+	releaseFactory := make(chan struct{})
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			close(factoryEntered)
+			<-releaseFactory
+			return &deltaSequenceStreamer{deltas: []string{"ok"}}, nil
+		},
+	})
+	h.emitTurnAccepted = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	resp, cancel := startTurnStreamHTTP(t, ts.URL, "client-a", threadID, "slow start")
+	defer cancel()
+	defer resp.Body.Close()
+	eventsCh, doneCh := streamSSEEvents(resp.Body)
+
+	select {
+	case event := <-eventsCh:
+		if event.Event != "turn_accepted" || stringField(event.Data, "threadId") != threadID || stringField(event.Data, "turnId") == "" {
+			t.Fatalf("first event = %+v, want turn_accepted for %s", event, threadID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("turn_accepted not received while agent resolution is blocked")
+	}
+	select {
+	case <-factoryEntered:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("agent factory was not called")
+	}
+	close(releaseFactory)
+
+	var names []string
+	for event := range eventsCh {
+		names = append(names, event.Event)
+	}
+	if err := <-doneCh; err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if len(names) < 2 || names[0] != "turn_started" || names[len(names)-1] != "turn_completed" {
+		t.Fatalf("remaining events = %v, want turn_started ... turn_completed", names)
+	}
+}
+
+func TestTurnAcceptedReportsLateFailureAsSSEError(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return nil, errors.New("agent binary missing")
+		},
+	})
+	h.emitTurnAccepted = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "hi")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+	events := parseSSEEvents(t, result.Body)
+	if len(events) != 2 || events[0].Event != "turn_accepted" || events[1].Event != "error" {
+		t.Fatalf("events = %+v, want turn_accepted then error", events)
+	}
+	if stringField(events[1].Data, "code") != codeUpstreamUnavailable || events[1].Data["status"] != float64(http.StatusServiceUnavailable) {
+		t.Fatalf("error event = %v, want %s/503", events[1].Data, codeUpstreamUnavailable)
+	}
+}
+
+func TestMaxDeltaRateCoalescesWithoutDroppingText(t *testing.T) {
+	root := t.TempDir()
+	deltas := make([]string, 20)
+	for i := range deltas {
+		deltas[i] = fmt.Sprintf("d%02d ", i)
+	}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return &pacedDeltaStreamer{deltas: deltas, gap: 10 * time.Millisecond}, nil
+		},
+	})
+	h.maxDeltaRate = 10
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	events := parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "paced").Body)
+	var streamed strings.Builder
+	emitted := 0
+	for _, event := range events {
+		if event.Event == "message_delta" {
+			emitted++
+			streamed.WriteString(stringField(event.Data, "delta"))
+		}
+	}
+	want := strings.Join(deltas, "")
+	if streamed.String() != want {
+		t.Fatalf("streamed text = %q, want %q", streamed.String(), want)
+	}
+	if emitted < 2 || emitted >= len(deltas) {
+		t.Fatalf("message_delta events = %d, want paced between 2 and %d", emitted, len(deltas)-1)
+	}
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 1 || history.Turns[0].ResponseText != want {
+		t.Fatalf("history = %+v, want responseText %q", history.Turns, want)
+	}
+}
+
+func TestMaxDeltaRateFlushesHeldTextBeforeToolCall(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        heldDeltaToolStreamer{},
+	})
+	h.maxDeltaRate = 1
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	events := parseSSEEvents(t, runTurnStreamRequest(t, ts.URL, "client-a", threadID, "paced").Body)
+	var before, after strings.Builder
+	sawToolCall := false
+	for _, event := range events {
+		switch event.Event {
+		case eventTypeToolCall:
+			sawToolCall = true
+		case "message_delta":
+			if sawToolCall {
+				after.WriteString(stringField(event.Data, "delta"))
+			} else {
+				before.WriteString(stringField(event.Data, "delta"))
+			}
+		}
+	}
+	if !sawToolCall {
+		t.Fatalf("events = %+v, want a tool_call", events)
+	}
+	if before.String() != "ab" || after.String() != "c" {
+		t.Fatalf("text before/after tool_call = %q/%q, want %q/%q", before.String(), after.String(), "ab", "c")
+	}
+}
+
+func TestDeltaPacerKeepsMetadataBlocksApart(t *testing.T) {
+	type emitted struct {
+		text string
+		meta agents.DeltaMetadata
+	}
+	var got []emitted
+	pacer := newDeltaPacer(1, func(text string, meta agents.DeltaMetadata) error {
+		got = append(got, emitted{text: text, meta: meta})
+		return nil
+	})
+	code := agents.DeltaMetadata{ContentType: "code", Lang: "go"}
+	for _, push := range []emitted{
+		{"lead", agents.DeltaMetadata{}},
+		{"fmt.", code},
+		{"Println()", code},
+		{" prose", agents.DeltaMetadata{}},
+	} {
+		if err := pacer.push(push.text, push.meta); err != nil {
+			t.Fatalf("push(%q): %v", push.text, err)
+		}
+	}
+	if err := pacer.flush(); err != nil {
+		t.Fatalf("flush(): %v", err)
+	}
+	want := []emitted{
+		{"lead", agents.DeltaMetadata{}},
+		{"fmt.Println()", code},
+		{" prose", agents.DeltaMetadata{}},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("emitted = %+v, want %+v", got, want)
+	}
+}
+
+func TestPersistPromptsStoresInjectedPrompt(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	_ = runTurnStreamRequest(t, ts.URL, "client-a", threadID, "first question")
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 1 || history.Turns[0].PromptText != "" {
+		t.Fatalf("history without PersistPrompts = %+v, want no promptText", history.Turns)
+	}
+
+	h.persistPrompts = true
+	_ = runTurnStreamRequest(t, ts.URL, "client-a", threadID, "second question")
+	history = getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 2 {
+		t.Fatalf("len(history.Turns) = %d, want 2", len(history.Turns))
+	}
+	prompt := history.Turns[1].PromptText
+	if !strings.Contains(prompt, "first question") || !strings.Contains(prompt, "second question") {
+		t.Fatalf("promptText = %q, want injected context with both turns", prompt)
+	}
+	if history.Turns[0].PromptText != "" {
+		t.Fatalf("first turn promptText = %q, want empty (recorded before enabling)", history.Turns[0].PromptText)
+	}
+}
+
+func TestComposeContextPromptFirstTurnPassThrough(t *testing.T) {
+	input := "/mcp call demo_server demo_tool {}"
+
+	got := composeContextPrompt("", nil, input, 1024)
+	if got != input {
+		t.Fatalf("first-turn prompt = %q, want %q", got, input)
+	}
+
+	truncated := composeContextPrompt("", nil, input, 12)
+	if truncated != input[:12] {
+		t.Fatalf("first-turn truncation = %q, want %q", truncated, input[:12])
+	}
+}
+
+func TestComposeContextPromptBoundedReportsTruncation(t *testing.T) {
+	recentTurns := []storage.Turn{
+		{RequestText: "first question", ResponseText: "first answer"},
+		{RequestText: "second question", ResponseText: "second answer"},
+	}
+	full := renderContextPrompt(defaultContextPromptLabels, "summary", recentTurns, "next")
+
+	for _, tc := range []struct {
+		name          string
+		turns         []storage.Turn
+		input         string
+		maxChars      int
+		wantTruncated bool
+	}{
+		{name: "fits", turns: recentTurns, input: "next", maxChars: runeLen(full), wantTruncated: false},
+		{name: "unbounded", turns: recentTurns, input: "next", maxChars: 0, wantTruncated: false},
+		{name: "drops oldest turn", turns: recentTurns, input: "next", maxChars: runeLen(full) - 1, wantTruncated: true},
+		{name: "passthrough fits", input: "next", maxChars: 4, wantTruncated: false},
+		{name: "passthrough clamped", input: "next input", maxChars: 4, wantTruncated: true},
+	} {
+		summary := "summary"
+		if tc.turns == nil {
+			summary = ""
+		}
+		prompt, truncated, capped := composeContextPromptBounded(
+			defaultContextPromptLabels, summary, tc.turns, tc.input, tc.maxChars, maxContextPromptIterations, true,
+		)
+		if truncated != tc.wantTruncated || capped {
+			t.Fatalf("%s: truncated, capped = %v, %v; want %v, false (prompt %q)", tc.name, truncated, capped, tc.wantTruncated, prompt)
+		}
+	}
+}
+
+func TestFirstTurnPassthroughCanBeDisabled(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	input := "/mcp call demo_server demo_tool {}"
+
+	if !h.firstTurnPassthrough {
+		t.Fatalf("firstTurnPassthrough = false, want true by default")
+	}
+	if got := h.composeThreadContextPrompt("th-1", "", nil, input); got != input {
+		t.Fatalf("passthrough prompt = %q, want raw input %q", got, input)
+	}
+
+	h.firstTurnPassthrough = false
+	got := h.composeThreadContextPrompt("th-1", "", nil, input)
+	want := "[Conversation Summary]\n(empty)\n\n[Recent Turns]\n(none)\n\n[Current User Input]\n" + input
+	if got != want {
+		t.Fatalf("framed prompt = %q, want %q", got, want)
+	}
+}
+
+func TestComposeThreadContextPromptWarnsWhenIterationCapReached(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := observability.NewLoggerWithWriter(&logBuf, observability.LevelInfo)
+	h := newTestServer(t, testServerOptions{logger: logger})
+	h.contextMaxChars = 64
+
+	recentTurns := make([]storage.Turn, maxContextPromptIterations+10)
+	for i := range recentTurns {
+		recentTurns[i] = storage.Turn{
+			RequestText:  fmt.Sprintf("question %d", i),
+			ResponseText: fmt.Sprintf("answer %d", i),
+		}
+	}
+
+	got := h.composeThreadContextPrompt("th-cap", "summary", recentTurns, "current input")
+	if runeLen(got) > h.contextMaxChars {
+		t.Fatalf("prompt chars = %d, want <= %d", runeLen(got), h.contextMaxChars)
+	}
+	if hits := h.ContextPromptIterationCapHits(); hits != 1 {
+		t.Fatalf("ContextPromptIterationCapHits() = %d, want 1", hits)
+	}
+	logs := logBuf.String()
+	if !strings.Contains(logs, "context.prompt_iteration_cap_reached") || !strings.Contains(logs, "th-cap") {
+		t.Fatalf("missing iteration cap warning:\n%s", logs)
+	}
+
+	logBuf.Reset()
+	_ = h.composeThreadContextPrompt("th-ok", "summary", recentTurns[:3], "current input")
+	if hits := h.ContextPromptIterationCapHits(); hits != 1 {
+		t.Fatalf("ContextPromptIterationCapHits() after normal prompt = %d, want 1", hits)
+	}
+	if strings.Contains(logBuf.String(), "context.prompt_iteration_cap_reached") {
+		t.Fatalf("unexpected iteration cap warning:\n%s", logBuf.String())
+	}
+}
+
+func TestCompactPromptUsesSeparateContextBudget(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	h.contextMaxChars = 400
+	h.compactContextMaxChars = h.contextMaxChars
+
+	recentTurns := make([]storage.Turn, 8)
+	for i := range recentTurns {
+		recentTurns[i] = storage.Turn{
+			RequestText:  fmt.Sprintf("question %d %s", i, strings.Repeat("q", 60)),
+			ResponseText: fmt.Sprintf("answer %d %s", i, strings.Repeat("a", 60)),
+		}
+	}
+	thread := storage.Thread{ThreadID: "th-compact-budget", Summary: "earlier summary"}
+
+	defaultPrompt := h.buildCompactPrompt(thread, recentTurns, 1000)
+	if runeLen(defaultPrompt) > h.contextMaxChars || strings.Contains(defaultPrompt, "question 0 ") {
+		t.Fatalf("default compact prompt (%d chars) should fit the %d-char context budget and drop old turns", runeLen(defaultPrompt), h.contextMaxChars)
+	}
+
+	h.compactContextMaxChars = 4000
+	widePrompt := h.buildCompactPrompt(thread, recentTurns, 1000)
+	if runeLen(widePrompt) <= h.contextMaxChars {
+		t.Fatalf("compact prompt chars = %d, want more than context budget %d", runeLen(widePrompt), h.contextMaxChars)
+	}
+	if runeLen(widePrompt) > h.compactContextMaxChars || !strings.Contains(widePrompt, "question 0 ") {
+		t.Fatalf("compact prompt (%d chars) should include every turn within %d chars", runeLen(widePrompt), h.compactContextMaxChars)
+	}
+
+	turnPrompt := h.composeThreadContextPrompt(thread.ThreadID, thread.Summary, recentTurns, "next input")
+	if runeLen(turnPrompt) > h.contextMaxChars {
+		t.Fatalf("turn prompt chars = %d, want <= %d", runeLen(turnPrompt), h.contextMaxChars)
+	}
+}
+
+func TestCompactTurnsFillCompactBudget(t *testing.T) {
+	h := newTestServer(t, testServerOptions{})
+	ctx := context.Background()
+	thread, err := h.store.CreateThread(ctx, storage.CreateThreadParams{
+		ThreadID:         "th-compact-window",
+		AgentID:          "codex",
+		CWD:              t.TempDir(),
+		AgentOptionsJSON: "{}",
+	})
+	if err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+	const total = 3*defaultContextRecentTurns + 5
+	for i := 0; i < total; i++ {
+		turnID := fmt.Sprintf("tu-%02d", i)
+		if _, err := h.store.CreateTurn(ctx, storage.CreateTurnParams{
+			TurnID:      turnID,
+			ThreadID:    thread.ThreadID,
+			RequestText: fmt.Sprintf("question %02d %s", i, strings.Repeat("q", 40)),
+		}); err != nil {
+			t.Fatalf("CreateTurn(%s): %v", turnID, err)
+		}
+		if err := h.store.FinalizeTurn(ctx, storage.FinalizeTurnParams{
+			TurnID:       turnID,
+			ResponseText: fmt.Sprintf("answer %02d %s", i, strings.Repeat("a", 40)),
+			Status:       "completed",
+		}); err != nil {
+			t.Fatalf("FinalizeTurn(%s): %v", turnID, err)
+		}
+	}
+
+	h.compactContextMaxChars = 1 << 20
+	turns, err := h.loadCompactTurns(ctx, thread.ThreadID)
+	if err != nil {
+		t.Fatalf("loadCompactTurns: %v", err)
+	}
+	if len(turns) != total || turns[0].TurnID != "tu-00" || turns[total-1].TurnID != fmt.Sprintf("tu-%02d", total-1) {
+		t.Fatalf("loadCompactTurns = %d turns, want all %d in order", len(turns), total)
+	}
+
+	// A budget that the recent-turn window already fills reads no further.
+	h.compactContextMaxChars = 100
+	turns, err = h.loadCompactTurns(ctx, thread.ThreadID)
+	if err != nil {
+		t.Fatalf("loadCompactTurns(small budget): %v", err)
+	}
+	if len(turns) != defaultContextRecentTurns {
+		t.Fatalf("loadCompactTurns(small budget) = %d turns, want %d", len(turns), defaultContextRecentTurns)
+	}
+
+	recent, err := h.loadRecentVisibleTurns(ctx, thread.ThreadID)
+	if err != nil {
+		t.Fatalf("loadRecentVisibleTurns: %v", err)
+	}
+	if len(recent) != defaultContextRecentTurns {
+		t.Fatalf("loadRecentVisibleTurns = %d turns, want %d", len(recent), defaultContextRecentTurns)
+	}
+}
+
+func TestCompactForbiddenWhenDisabledForAgent(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	h.agentCapabilities = map[string]AgentCapabilities{"codex": {DisableCompact: true}}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	status, body := doJSON(
+		t,
+		http.MethodPost,
+		ts.URL+"/v1/threads/"+threadID+"/compact",
+		map[string]any{},
+		map[string]string{"X-Client-ID": "client-a"},
+	)
+	if status != http.StatusForbidden {
+		t.Fatalf("compact status = %d, want %d, body=%s", status, http.StatusForbidden, body)
+	}
+	assertErrorCode(t, []byte(body), "FORBIDDEN")
+	if !strings.Contains(body, "compact_disabled") {
+		t.Fatalf("compact error body = %s, want reason compact_disabled", body)
+	}
+
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if len(history.Turns) != 0 {
+		t.Fatalf("history turns = %d, want 0 after rejected compact", len(history.Turns))
+	}
+}
+
+func TestCompactSkipsThreadWithoutContent(t *testing.T) {
+	root := t.TempDir()
+	var factoryCalls atomic.Int32
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			factoryCalls.Add(1)
+			return agents.NewFakeAgentWithConfig(3, time.Millisecond), nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/compact", map[string]any{}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("compact status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	var resp struct {
+		TurnID  string `json:"turnId"`
+		Status  string `json:"status"`
+		Summary string `json:"summary"`
+		Note    string `json:"note"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal compact response: %v", err)
+	}
+	if resp.Status != "skipped" || resp.TurnID != "" || resp.Summary != "" || resp.Note == "" {
+		t.Fatalf("compact response = %+v, want skipped with empty summary and a note", resp)
+	}
+	if got := factoryCalls.Load(); got != 0 {
+		t.Fatalf("agent factory calls = %d, want 0", got)
+	}
+	turns, err := h.store.ListTurnsByThread(context.Background(), threadID)
+	if err != nil {
+		t.Fatalf("ListTurnsByThread(): %v", err)
+	}
+	if len(turns) != 0 {
+		t.Fatalf("stored turns = %d, want 0 after skipped compact", len(turns))
+	}
+}
+
+func TestStrictModelIDsRejectsMalformedAndUnknownModelID(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agentModelsFactory: func(context.Context, string) ([]agents.ModelOption, error) {
+			return []agents.ModelOption{{ID: "gpt-5", Name: "GPT-5"}}, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	headers := map[string]string{"X-Client-ID": "client-a"}
+	createWith := func(agentOptions map[string]any) (int, string) {
+		return doJSON(t, http.MethodPost, ts.URL+"/v1/threads", map[string]any{
+			"agent":        "codex",
+			"cwd":          root,
+			"agentOptions": agentOptions,
+		}, headers)
+	}
+
+	// Lenient by default: an unknown model is stored and ignored later.
+	if status, body := createWith(map[string]any{"modelId": "gpt-typo"}); status != http.StatusOK {
+		t.Fatalf("lenient create status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+
+	h.strictModelIDs = true
+	for _, tc := range []struct {
+		name    string
+		modelID any
+	}{
+		{name: "not a string", modelID: 42},
+		{name: "blank", modelID: "  "},
+		{name: "unknown", modelID: "gpt-typo"},
+	} {
+		status, body := createWith(map[string]any{"modelId": tc.modelID})
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s: create status = %d, want %d, body=%s", tc.name, status, http.StatusBadRequest, body)
+		}
+		assertErrorCode(t, []byte(body), codeInvalidArgument)
+		if !strings.Contains(body, `"field":"agentOptions.modelId"`) {
+			t.Fatalf("%s: error body = %s, want field agentOptions.modelId", tc.name, body)
+		}
+	}
+
+	if status, body := createWith(map[string]any{"modelId": "gpt-5"}); status != http.StatusOK {
+		t.Fatalf("known model create status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	status, body := doJSON(t, http.MethodPatch, ts.URL+"/v1/threads/"+threadID, map[string]any{
+		"agentOptions": map[string]any{"modelId": "gpt-typo"},
+	}, headers)
+	if status != http.StatusBadRequest {
+		t.Fatalf("patch status = %d, want %d, body=%s", status, http.StatusBadRequest, body)
+	}
+	assertErrorCode(t, []byte(body), codeInvalidArgument)
+}
+
+func TestCanonicalAgentOptionKeysNormalizesMixedCasing(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agentModelsFactory: func(context.Context, string) ([]agents.ModelOption, error) {
+			return []agents.ModelOption{{ID: "gpt-5", Name: "GPT-5"}}, nil
+		},
+	})
+	h.strictModelIDs = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	headers := map[string]string{"X-Client-ID": "client-a"}
+	createWith := func(agentOptions map[string]any) (int, string) {
+		return doJSON(t, http.MethodPost, ts.URL+"/v1/threads", map[string]any{
+			"agent":        "codex",
+			"cwd":          root,
+			"agentOptions": agentOptions,
+		}, headers)
+	}
+
+	// Off by default: a differently cased key slips past modelId validation.
+	if status, body := createWith(map[string]any{"ModelId": "gpt-typo"}); status != http.StatusOK {
+		t.Fatalf("default create status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+
+	h.canonicalAgentOptionKeys = true
+	status, body := createWith(map[string]any{"ModelId": "gpt-typo"})
+	if status != http.StatusBadRequest || !strings.Contains(body, `"field":"agentOptions.modelId"`) {
+		t.Fatalf("canonical create status = %d, body=%s, want 400 on agentOptions.modelId", status, body)
+	}
+
+	status, body = createWith(map[string]any{"modelId": "gpt-5", "MODELID": "gpt-5"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("conflicting casing status = %d, want %d, body=%s", status, http.StatusBadRequest, body)
+	}
+	assertErrorCode(t, []byte(body), codeInvalidArgument)
+
+	status, body = createWith(map[string]any{
+		"MODELID":         "gpt-5",
+		"ConfigOverrides": map[string]any{"mode": "plan"},
+		"CustomFlag":      true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("mixed casing create status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	var created struct {
+		ThreadID string `json:"threadId"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("unmarshal create response: %v", err)
+	}
+	thread, err := h.store.GetThread(context.Background(), created.ThreadID)
+	if err != nil {
+		t.Fatalf("GetThread: %v", err)
+	}
+	var stored map[string]any
+	if err := json.Unmarshal([]byte(thread.AgentOptionsJSON), &stored); err != nil {
+		t.Fatalf("unmarshal stored agentOptions: %v", err)
+	}
+	if stored["modelId"] != "gpt-5" || stored["configOverrides"] == nil || stored["CustomFlag"] != true {
+		t.Fatalf("stored agentOptions = %v, want canonical modelId/configOverrides and verbatim CustomFlag", stored)
+	}
+	if _, ok := stored["MODELID"]; ok {
+		t.Fatalf("stored agentOptions kept MODELID: %v", stored)
+	}
+	if modelID, overrides := threadConfigSelections(thread.AgentOptionsJSON); modelID != "gpt-5" || overrides["mode"] != "plan" {
+		t.Fatalf("threadConfigSelections = %q, %v, want gpt-5 and mode=plan", modelID, overrides)
+	}
+}
+
+func TestLockedThreadRejectsAgentOptionsUpdates(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	headers := map[string]string{"X-Client-ID": "client-a"}
+
+	createRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads", map[string]any{
+		"agent":         "codex",
+		"cwd":           root,
+		"agentOptions":  map[string]any{"modelId": "gpt-5"},
+		"optionsLocked": true,
+	}, headers)
+	if createRR.Code != http.StatusOK {
+		t.Fatalf("create locked thread status = %d, body=%s", createRR.Code, createRR.Body.String())
+	}
+	lockedID := extractThreadID(t, createRR.Body.Bytes())
+	openID := createThreadForClient(t, h, "client-a", root)
+
+	getRR := performJSONRequest(t, h, http.MethodGet, "/v1/threads/"+lockedID, nil, headers)
+	if !strings.Contains(getRR.Body.String(), `"optionsLocked":true`) {
+		t.Fatalf("GET locked thread = %s, want optionsLocked true", getRR.Body.String())
+	}
+
+	patchRR := performJSONRequest(t, h, http.MethodPatch, "/v1/threads/"+lockedID, map[string]any{
+		"agentOptions": map[string]any{"modelId": "o3"},
+	}, headers)
+	if patchRR.Code != http.StatusForbidden {
+		t.Fatalf("PATCH locked agentOptions status = %d, want %d, body=%s", patchRR.Code, http.StatusForbidden, patchRR.Body.String())
+	}
+	assertErrorCode(t, patchRR.Body.Bytes(), codeForbidden)
+
+	configRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+lockedID+"/config-options", map[string]any{
+		"configId": "model",
+		"value":    "o3",
+	}, headers)
+	if configRR.Code != http.StatusForbidden {
+		t.Fatalf("POST locked config-options status = %d, want %d, body=%s", configRR.Code, http.StatusForbidden, configRR.Body.String())
+	}
+
+	// Selecting a session would drop the locked model state, so it is
+	// refused too; the title stays editable.
+	sessionRR := performJSONRequest(t, h, http.MethodPatch, "/v1/threads/"+lockedID, map[string]any{
+		"agentOptions": map[string]any{"modelId": "gpt-5", "sessionId": "session-1"},
+	}, headers)
+	if sessionRR.Code != http.StatusForbidden {
+		t.Fatalf("PATCH locked sessionId status = %d, want %d, body=%s", sessionRR.Code, http.StatusForbidden, sessionRR.Body.String())
+	}
+	titleRR := performJSONRequest(t, h, http.MethodPatch, "/v1/threads/"+lockedID, map[string]any{"title": "renamed"}, headers)
+	if titleRR.Code != http.StatusOK {
+		t.Fatalf("PATCH locked title status = %d, want %d, body=%s", titleRR.Code, http.StatusOK, titleRR.Body.String())
+	}
+	thread, err := h.store.GetThread(context.Background(), lockedID)
+	if err != nil {
+		t.Fatalf("GetThread(locked): %v", err)
+	}
+	if thread.AgentOptionsJSON != `{"modelId":"gpt-5"}` || thread.Title != "renamed" {
+		t.Fatalf("locked thread = %+v, want unchanged agentOptions and new title", thread)
+	}
+
+	openRR := performJSONRequest(t, h, http.MethodPatch, "/v1/threads/"+openID, map[string]any{
+		"agentOptions": map[string]any{"modelId": "o3"},
+	}, headers)
+	if openRR.Code != http.StatusOK {
+		t.Fatalf("PATCH unlocked agentOptions status = %d, want %d, body=%s", openRR.Code, http.StatusOK, openRR.Body.String())
+	}
+}
+
+func TestCompactWaitsForActiveTurnWhenConfigured(t *testing.T) {
+	root := t.TempDir()
+	streamer := &onceGatedStreamer{gated: &gatedDeltaStreamer{started: make(chan struct{}), release: make(chan struct{})}}
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		turnAgentFactory: func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamer, nil
+		},
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	resp, cancel := startTurnStreamHTTP(t, ts.URL, "client-a", threadID, "hello")
+	defer cancel()
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	<-streamer.gated.started
+
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/compact", map[string]any{}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusConflict {
+		t.Fatalf("compact without wait status = %d, want %d, body=%s", status, http.StatusConflict, body)
+	}
+
+	h.compactActivateWait = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(streamer.gated.release)
+	}()
+	status, body = doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/compact", map[string]any{}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("compact with wait status = %d, want %d, body=%s", status, http.StatusOK, body)
+	}
+	if !strings.Contains(streamer.LastInput(), "first second") {
+		t.Fatalf("compact prompt = %q, want it to include the turn it waited for", streamer.LastInput())
+	}
+}
+
+func TestCompactUpdatesSummaryAndAffectsNextTurn(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+
+	first := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "important decision for compact")
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+
+	compactStatus, compactBody := doJSON(
+		t,
+		http.MethodPost,
+		ts.URL+"/v1/threads/"+threadID+"/compact",
+		map[string]any{"maxSummaryChars": 120},
+		map[string]string{"X-Client-ID": "client-a"},
+	)
+	if compactStatus != http.StatusOK {
+		t.Fatalf("compact status = %d, want %d, body=%s", compactStatus, http.StatusOK, compactBody)
+	}
+	var compactResp struct {
+		TurnID       string `json:"turnId"`
+		Summary      string `json:"summary"`
+		SummaryChars int    `json:"summaryChars"`
+	}
+	if err := json.Unmarshal([]byte(compactBody), &compactResp); err != nil {
+		t.Fatalf("unmarshal compact response: %v", err)
+	}
+	if compactResp.TurnID == "" {
+		t.Fatalf("compact turnId is empty")
+	}
+	if compactResp.SummaryChars > 120 {
+		t.Fatalf("summaryChars = %d, want <= 120", compactResp.SummaryChars)
+	}
+	if compactResp.Summary == "" {
+		t.Fatalf("compact summary is empty")
+	}
+
+	threadStatus, threadBody := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID, nil, map[string]string{"X-Client-ID": "client-a"})
+	if threadStatus != http.StatusOK {
+		t.Fatalf("get thread status = %d, body=%s", threadStatus, threadBody)
+	}
+	var threadResp struct {
+		Thread struct {
+			Summary string `json:"summary"`
+		} `json:"thread"`
+	}
+	if err := json.Unmarshal([]byte(threadBody), &threadResp); err != nil {
+		t.Fatalf("unmarshal get thread response: %v", err)
+	}
+	if threadResp.Thread.Summary != compactResp.Summary {
+		t.Fatalf("thread summary mismatch after compact")
+	}
+
+	next := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "follow up after compact")
+	if next.StatusCode != http.StatusOK {
+		t.Fatalf("next turn status = %d, want %d", next.StatusCode, http.StatusOK)
+	}
+	history := getHistoryHTTP(t, ts.URL, "client-a", threadID, false)
+	if got, want := len(history.Turns), 2; got != want {
+		t.Fatalf("default history should hide internal turns: got %d, want %d", got, want)
+	}
+	lastResp := history.Turns[len(history.Turns)-1].ResponseText
+	if !strings.Contains(lastResp, compactResp.Summary) {
+		t.Fatalf("next injected prompt does not include compacted summary")
+	}
+
+	historyInternal := getHistoryWithInternalHTTP(t, ts.URL, "client-a", threadID, false)
+	if got, want := len(historyInternal.Turns), 3; got != want {
+		t.Fatalf("history(includeInternal) turns = %d, want %d", got, want)
+	}
+	internalCount := 0
+	for _, turn := range historyInternal.Turns {
+		if turn.IsInternal {
+			internalCount++
+		}
+	}
+	if internalCount != 1 {
+		t.Fatalf("internal turn count = %d, want 1", internalCount)
+	}
+}
+
+func TestCompactResetsTurnsSinceCompact(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	threadID := createThreadHTTP(t, ts.URL, "client-a", root)
+	turnsSinceCompact := func() int {
+		t.Helper()
+		status, body := doJSON(t, http.MethodGet, ts.URL+"/v1/threads/"+threadID, nil, map[string]string{"X-Client-ID": "client-a"})
+		if status != http.StatusOK {
+			t.Fatalf("get thread status = %d, body=%s", status, body)
+		}
+		var resp struct {
+			Thread struct {
+				TurnsSinceCompact int `json:"turnsSinceCompact"`
+			} `json:"thread"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("unmarshal get thread response: %v", err)
+		}
+		return resp.Thread.TurnsSinceCompact
+	}
+
+	for _, input := range []string{"first", "second"} {
+		if result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, input); result.StatusCode != http.StatusOK {
+			t.Fatalf("turn %q status = %d, want %d", input, result.StatusCode, http.StatusOK)
+		}
+	}
+	if got, want := turnsSinceCompact(), 2; got != want {
+		t.Fatalf("turnsSinceCompact before compact = %d, want %d", got, want)
+	}
+
+	status, body := doJSON(t, http.MethodPost, ts.URL+"/v1/threads/"+threadID+"/compact", map[string]any{}, map[string]string{"X-Client-ID": "client-a"})
+	if status != http.StatusOK {
+		t.Fatalf("compact status = %d, body=%s", status, body)
+	}
+	if got := turnsSinceCompact(); got != 0 {
+		t.Fatalf("turnsSinceCompact after compact = %d, want 0", got)
+	}
+
+	if result := runTurnStreamRequest(t, ts.URL, "client-a", threadID, "third"); result.StatusCode != http.StatusOK {
+		t.Fatalf("turn after compact status = %d, want %d", result.StatusCode, http.StatusOK)
+	}
+	if got, want := turnsSinceCompact(), 1; got != want {
+		t.Fatalf("turnsSinceCompact after next turn = %d, want %d", got, want)
+	}
+}
+
+func TestRestartRecoveryWithInjectedContext(t *testing.T) {
+	root := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "restart.db")
+
+	serverOne, closeOne := newTestServerWithDBPath(t, dbPath, testServerOptions{allowedRoots: []string{root}})
+	tsOne := httptest.NewServer(serverOne)
+	threadID := createThreadHTTP(t, tsOne.URL, "client-a", root)
+
+	first := runTurnStreamRequest(t, tsOne.URL, "client-a", threadID, "pre-restart message")
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first turn status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+	tsOne.Close()
+	closeOne()
+
+	serverTwo, closeTwo := newTestServerWithDBPath(t, dbPath, testServerOptions{allowedRoots: []string{root}})
+	defer closeTwo()
+	tsTwo := httptest.NewServer(serverTwo)
+	defer tsTwo.Close()
+
+	second := runTurnStreamRequest(t, tsTwo.URL, "client-a", threadID, "post-restart message")
+	if second.StatusCode != http.StatusOK {
+		t.Fatalf("second turn status = %d, want %d", second.StatusCode, http.StatusOK)
+	}
+
+	history := getHistoryHTTP(t, tsTwo.URL, "client-a", threadID, false)
+	if got, want := len(history.Turns), 2; got != want {
+		t.Fatalf("len(history.turns) = %d, want %d", got, want)
+	}
+	lastResp := history.Turns[len(history.Turns)-1].ResponseText
+	if !strings.Contains(lastResp, "User: pre-restart message") {
+		t.Fatalf("restart-injected prompt missing pre-restart history")
+	}
+}
+
+type testServerOptions struct {
+	authToken          string
+	dataDir            string
+	allowedRoots       []string
+	allowedAgentIDs    []string
+	agentList          []AgentInfo
+	agent              agents.Streamer
+	turnAgentFactory   TurnAgentFactory
+	agentModelsFactory AgentModelsFactory
+	agentIdleTTL       time.Duration
+	agentMaxLifetime   time.Duration
+	permissionTimeout  time.Duration
+	logger             *observability.Logger
+}
+
+func newTestServer(t *testing.T, opt testServerOptions) *Server {
+	t.Helper()
+
+	dataDir := strings.TrimSpace(opt.dataDir)
+	if dataDir == "" {
+		dataDir = t.TempDir()
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		t.Fatalf("os.MkdirAll(%q): %v", dataDir, err)
+	}
+	dbPath := filepath.Join(dataDir, "api.db")
+	store, err := storage.New(dbPath)
+	if err != nil {
+		t.Fatalf("storage.New(%q): %v", dbPath, err)
+	}
+	allowedRoots := opt.allowedRoots
+	if len(allowedRoots) == 0 {
+		allowedRoots = []string{t.TempDir()}
+	}
+
+	agentList := opt.agentList
+	if len(agentList) == 0 {
+		agentList = []AgentInfo{
+			{ID: "codex", Name: "Codex", Status: "available"},
+			{ID: "claude", Name: "Claude Code", Status: "unavailable"},
+		}
+	}
+
+	allowedAgentIDs := opt.allowedAgentIDs
+	if len(allowedAgentIDs) == 0 {
+		allowedAgentIDs = []string{"codex"}
+	}
+
+	streamAgent := opt.agent
+	if streamAgent == nil {
+		streamAgent = agents.NewFakeAgentWithConfig(3, 10*time.Millisecond)
+	}
+
+	turnAgentFactory := opt.turnAgentFactory
+	if turnAgentFactory == nil {
+		turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamAgent, nil
+		}
+	}
+
+	server := New(Config{
+		AuthToken:          opt.authToken,
+		DataDir:            dataDir,
+		Agents:             agentList,
+		AllowedAgentIDs:    allowedAgentIDs,
+		AllowedRoots:       allowedRoots,
+		Store:              store,
+		TurnController:     runtimectl.NewTurnController(),
+		TurnAgentFactory:   turnAgentFactory,
+		AgentModelsFactory: opt.agentModelsFactory,
+		AgentIdleTTL:       opt.agentIdleTTL,
+		AgentMaxLifetime:   opt.agentMaxLifetime,
+		PermissionTimeout:  opt.permissionTimeout,
+		Logger:             opt.logger,
+	})
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = store.Close()
+	})
+	return server
+}
+
+func newTestServerWithDBPath(t *testing.T, dbPath string, opt testServerOptions) (*Server, func()) {
+	t.Helper()
+
+	store, err := storage.New(dbPath)
+	if err != nil {
+		t.Fatalf("storage.New(%q): %v", dbPath, err)
+	}
+	dataDir := strings.TrimSpace(opt.dataDir)
+	if dataDir == "" {
+		dataDir = filepath.Dir(dbPath)
+	}
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		t.Fatalf("os.MkdirAll(%q): %v", dataDir, err)
+	}
+
+	allowedRoots := opt.allowedRoots
+	if len(allowedRoots) == 0 {
+		allowedRoots = []string{t.TempDir()}
+	}
+
+	agentList := opt.agentList
+	if len(agentList) == 0 {
+		agentList = []AgentInfo{
+			{ID: "codex", Name: "Codex", Status: "available"},
+			{ID: "claude", Name: "Claude Code", Status: "unavailable"},
+		}
+	}
+
+	allowedAgentIDs := opt.allowedAgentIDs
+	if len(allowedAgentIDs) == 0 {
+		allowedAgentIDs = []string{"codex"}
+	}
+
+	streamAgent := opt.agent
+	if streamAgent == nil {
+		streamAgent = agents.NewFakeAgentWithConfig(3, 10*time.Millisecond)
+	}
+
+	turnAgentFactory := opt.turnAgentFactory
+	if turnAgentFactory == nil {
+		turnAgentFactory = func(thread storage.Thread) (agents.Streamer, error) {
+			_ = thread
+			return streamAgent, nil
+		}
+	}
+
+	server := New(Config{
+		AuthToken:          opt.authToken,
+		DataDir:            dataDir,
+		Agents:             agentList,
+		AllowedAgentIDs:    allowedAgentIDs,
+		AllowedRoots:       allowedRoots,
+		Store:              store,
+		TurnController:     runtimectl.NewTurnController(),
+		TurnAgentFactory:   turnAgentFactory,
+		AgentModelsFactory: opt.agentModelsFactory,
+		AgentIdleTTL:       opt.agentIdleTTL,
+		PermissionTimeout:  opt.permissionTimeout,
+		Logger:             opt.logger,
+	})
+	return server, func() {
+		_ = server.Close()
+		_ = store.Close()
+	}
+}
+
+func createThreadForClient(t *testing.T, h http.Handler, clientID, root string) string {
+	t.Helper()
+	createRR := performJSONRequest(t, h, http.MethodPost, "/v1/threads", map[string]any{"agent": "codex", "cwd": root}, map[string]string{"X-Client-ID": clientID})
+	if createRR.Code != http.StatusOK {
+		t.Fatalf("create thread status code = %d, want %d", createRR.Code, http.StatusOK)
+	}
+	return extractThreadID(t, createRR.Body.Bytes())
+}
+
+func performJSONRequest(t *testing.T, h http.Handler, method, path string, body any, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reqBody []byte
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("json.Marshal request body: %v", err)
+		}
+		reqBody = encoded
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func extractThreadID(t *testing.T, payload []byte) string {
+	t.Helper()
+	var body struct {
+		ThreadID string `json:"threadId"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		t.Fatalf("unmarshal threadId response: %v", err)
+	}
+	if body.ThreadID == "" {
+		t.Fatalf("threadId is empty")
+	}
+	return body.ThreadID
+}
+
+type parsedSSEEvent struct {
+	Event string
+	Data  map[string]any
+}
+
+func parseSSEEvents(t *testing.T, raw string) []parsedSSEEvent {
+	t.Helper()
+
+	blocks := strings.Split(strings.TrimSpace(raw), "\n\n")
+	events := make([]parsedSSEEvent, 0)
+	for _, block := range blocks {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		lines := strings.Split(block, "\n")
+		eventType := ""
+		dataLine := ""
+		for _, line := range lines {
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			}
+			if strings.HasPrefix(line, "data: ") {
+				dataLine = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if eventType == "" {
+			continue
+		}
+		payload := make(map[string]any)
+		if dataLine != "" {
+			if err := json.Unmarshal([]byte(dataLine), &payload); err != nil {
+				t.Fatalf("unmarshal sse data for event %q: %v", eventType, err)
 			}
 		}
-		events = append(events, parsedSSEEvent{Event: eventType, Data: payload})
+		events = append(events, parsedSSEEvent{Event: eventType, Data: payload})
+	}
+	return events
+}
+
+func stringField(payload map[string]any, key string) string {
+	v, _ := payload[key]
+	s, _ := v.(string)
+	return s
+}
+
+func assertErrorCode(t *testing.T, payload []byte, wantCode string) {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		t.Fatalf("unmarshal error response: %v", err)
+	}
+	if body.Error.Code != wantCode {
+		t.Fatalf("error.code = %q, want %q", body.Error.Code, wantCode)
+	}
+}
+
+type httpTurnStreamResult struct {
+	StatusCode int
+	Body       string
+}
+
+type planStreamer struct{}
+
+func (s *planStreamer) Name() string {
+	return "plan-streamer"
+}
+
+func (s *planStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if handler, ok := agents.PlanHandlerFromContext(ctx); ok {
+		if err := handler(ctx, []agents.PlanEntry{{
+			Content:  "Inspect files",
+			Status:   "in_progress",
+			Priority: "high",
+		}}); err != nil {
+			return agents.StopReasonEndTurn, err
+		}
+		if err := handler(ctx, []agents.PlanEntry{
+			{
+				Content:  "Inspect files",
+				Status:   "completed",
+				Priority: "high",
+			},
+			{
+				Content:  "Apply patch",
+				Status:   "pending",
+				Priority: "medium",
+			},
+		}); err != nil {
+			return agents.StopReasonEndTurn, err
+		}
+	}
+	if err := onDelta("final answer"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+type reasoningStreamer struct{}
+
+func (s *reasoningStreamer) Name() string {
+	return "reasoning-streamer"
+}
+
+func (s *reasoningStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := agents.NotifyReasoningDelta(ctx, "step one\n"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := agents.NotifyReasoningDelta(ctx, "step two"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("final answer"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+type permissionOptionStreamer struct {
+	request agents.PermissionRequest
+
+	mu       sync.Mutex
+	response agents.PermissionResponse
+}
+
+func (s *permissionOptionStreamer) Name() string {
+	return "permission-option-streamer"
+}
+
+func (s *permissionOptionStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("before-permission "); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+
+	handler, ok := agents.PermissionHandlerFromContext(ctx)
+	if !ok {
+		return agents.StopReasonCancelled, errors.New("permission handler missing")
+	}
+
+	response, err := handler(ctx, s.request)
+	if err != nil {
+		return agents.StopReasonCancelled, err
+	}
+
+	s.mu.Lock()
+	s.response = response
+	s.mu.Unlock()
+
+	if err := onDelta("selected:" + response.SelectedOptionID); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if response.Outcome == agents.PermissionOutcomeApproved {
+		return agents.StopReasonEndTurn, nil
+	}
+	return agents.StopReasonCancelled, nil
+}
+
+func (s *permissionOptionStreamer) Response() agents.PermissionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.response
+}
+
+type toolCallStreamer struct{}
+
+func (s *toolCallStreamer) Name() string {
+	return "tool-call-streamer"
+}
+
+func (s *toolCallStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
+		Type:       agents.ACPUpdateTypeToolCall,
+		ToolCallID: "call-1",
+		Title:      "Read file",
+		Kind:       "read_file",
+		Status:     "running",
+		Content: json.RawMessage(`[
+			{"type":"content","content":{"type":"text","text":"opening file"}}
+		]`),
+		RawInput:    json.RawMessage(`{"path":"/tmp/demo.txt"}`),
+		HasTitle:    true,
+		HasKind:     true,
+		HasStatus:   true,
+		HasContent:  true,
+		HasRawInput: true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
+		Type:         agents.ACPUpdateTypeToolCallUpdate,
+		ToolCallID:   "call-1",
+		Status:       "completed",
+		RawOutput:    json.RawMessage(`{"ok":true}`),
+		HasStatus:    true,
+		HasRawOutput: true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("tool done"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+// multiPhaseStreamer thinks, answers, calls a tool while still thinking,
+// and answers again.
+type multiPhaseStreamer struct{}
+
+func (s *multiPhaseStreamer) Name() string {
+	return "multi-phase-streamer"
+}
+
+func (s *multiPhaseStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	steps := []func() error{
+		func() error { return agents.NotifyReasoningDelta(ctx, "need the file") },
+		func() error { return agents.NotifyReasoningDelta(ctx, ", reading it") },
+		func() error { return onDelta("Let me check. ") },
+		func() error {
+			return agents.NotifyToolCall(ctx, agents.ACPToolCall{
+				Type:       agents.ACPUpdateTypeToolCall,
+				ToolCallID: "call-1",
+				Title:      "Read file",
+				Status:     "in_progress",
+				HasTitle:   true,
+				HasStatus:  true,
+			})
+		},
+		func() error { return agents.NotifyReasoningDelta(ctx, "waiting") },
+		func() error {
+			return agents.NotifyToolCall(ctx, agents.ACPToolCall{
+				Type:       agents.ACPUpdateTypeToolCallUpdate,
+				ToolCallID: "call-1",
+				Status:     "completed",
+				HasStatus:  true,
+			})
+		},
+		func() error { return onDelta("done") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return agents.StopReasonEndTurn, err
+		}
 	}
-	return events
+	return agents.StopReasonEndTurn, nil
 }
 
-func stringField(payload map[string]any, key string) string {
-	v, _ := payload[key]
-	s, _ := v.(string)
-	return s
+type messageContentStreamer struct{}
+
+func (s *messageContentStreamer) Name() string {
+	return "message-content-streamer"
 }
 
-func assertErrorCode(t *testing.T, payload []byte, wantCode string) {
-	t.Helper()
-	var body struct {
-		Error struct {
-			Code string `json:"code"`
-		} `json:"error"`
+func (s *messageContentStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("preview:\n"); err != nil {
+		return agents.StopReasonEndTurn, err
 	}
-	if err := json.Unmarshal(payload, &body); err != nil {
-		t.Fatalf("unmarshal error response: %v", err)
+	if err := agents.NotifyMessageContent(ctx, agents.ACPMessageContent{
+		Content: json.RawMessage(`{
+			"type":"image",
+			"mimeType":"image/png",
+			"data":"aGVsbG8="
+		}`),
+		HasContent: true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
 	}
-	if body.Error.Code != wantCode {
-		t.Fatalf("error.code = %q, want %q", body.Error.Code, wantCode)
+	if err := agents.NotifyMessageContent(ctx, agents.ACPMessageContent{
+		Content: json.RawMessage(`{
+			"type":"resource",
+			"resource":{
+				"uri":"file:///tmp/demo.txt",
+				"mimeType":"text/plain",
+				"text":"embedded text"
+			}
+		}`),
+		HasContent: true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("\ndone"); err != nil {
+		return agents.StopReasonEndTurn, err
 	}
+	return agents.StopReasonEndTurn, nil
 }
 
-type httpTurnStreamResult struct {
-	StatusCode int
-	Body       string
+type promptCaptureStreamer struct {
+	prompt agents.Prompt
 }
 
-type planStreamer struct{}
+func (s *promptCaptureStreamer) Name() string {
+	return "prompt-capture-streamer"
+}
 
-func (s *planStreamer) Name() string {
-	return "plan-streamer"
+func (s *promptCaptureStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	return s.StreamPrompt(ctx, agents.TextPrompt(input), onDelta)
 }
 
-func (s *planStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *promptCaptureStreamer) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta func(delta string) error) (agents.StopReason, error) {
+	s.prompt = prompt.Clone()
+	if err := onDelta("ok"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+type deltaSequenceStreamer struct {
+	deltas []string
+}
+
+func (s *deltaSequenceStreamer) Name() string {
+	return "delta-sequence-streamer"
+}
+
+func (s *deltaSequenceStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = ctx
 	_ = input
-	if handler, ok := agents.PlanHandlerFromContext(ctx); ok {
-		if err := handler(ctx, []agents.PlanEntry{{
-			Content:  "Inspect files",
-			Status:   "in_progress",
-			Priority: "high",
-		}}); err != nil {
+	for _, delta := range s.deltas {
+		if err := onDelta(delta); err != nil {
 			return agents.StopReasonEndTurn, err
 		}
-		if err := handler(ctx, []agents.PlanEntry{
-			{
-				Content:  "Inspect files",
-				Status:   "completed",
-				Priority: "high",
-			},
-			{
-				Content:  "Apply patch",
-				Status:   "pending",
-				Priority: "medium",
-			},
-		}); err != nil {
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+type deltaMetadataStreamer struct{}
+
+func (deltaMetadataStreamer) Name() string {
+	return "delta-metadata-streamer"
+}
+
+func (deltaMetadataStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := agents.NotifyDeltaMetadata(ctx, agents.DeltaMetadata{ContentType: "code", Lang: "go"}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("package main"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta(" // done"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+type usageStreamer struct{}
+
+func (usageStreamer) Name() string {
+	return "usage-streamer"
+}
+
+func (usageStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("ok"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := agents.NotifyUsage(ctx, agents.Usage{PromptTokens: 100, CompletionTokens: 25}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+// rawStopReasonStreamer ends every turn with a non-standard ACP stop reason.
+type rawStopReasonStreamer struct {
+	reason string
+}
+
+func (rawStopReasonStreamer) Name() string {
+	return "raw-stop-reason"
+}
+
+func (s rawStopReasonStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("ok"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	result, err := json.Marshal(map[string]any{"stopReason": s.reason})
+	if err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, agents.NotifyACPPromptStopReason(ctx, result)
+}
+
+type interleavedDeltaStreamer struct{}
+
+func (interleavedDeltaStreamer) Name() string {
+	return "interleaved-delta"
+}
+
+func (interleavedDeltaStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("hel"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
+		Type:       agents.ACPUpdateTypeToolCall,
+		ToolCallID: "call-1",
+		Title:      "Read file",
+		HasTitle:   true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("lo"); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+// heldDeltaToolStreamer emits two deltas back to back, a tool call, then a
+// final delta, so a paced stream is still holding text at the tool call.
+type heldDeltaToolStreamer struct{}
+
+func (heldDeltaToolStreamer) Name() string {
+	return "held-delta-tool"
+}
+
+func (heldDeltaToolStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	for _, delta := range []string{"a", "b"} {
+		if err := onDelta(delta); err != nil {
 			return agents.StopReasonEndTurn, err
 		}
 	}
-	if err := onDelta("final answer"); err != nil {
+	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
+		Type:       agents.ACPUpdateTypeToolCall,
+		ToolCallID: "call-1",
+		Title:      "Read file",
+		HasTitle:   true,
+	}); err != nil {
+		return agents.StopReasonEndTurn, err
+	}
+	if err := onDelta("c"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-type reasoningStreamer struct{}
+type slashCommandStreamer struct {
+	commands []agents.SlashCommand
+}
 
-func (s *reasoningStreamer) Name() string {
-	return "reasoning-streamer"
+func (s *slashCommandStreamer) Name() string {
+	return "slash-command-streamer"
 }
 
-func (s *reasoningStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *slashCommandStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
 	_ = input
-	if err := agents.NotifyReasoningDelta(ctx, "step one\n"); err != nil {
+	if err := agents.NotifySlashCommands(ctx, s.commands); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	if err := agents.NotifyReasoningDelta(ctx, "step two"); err != nil {
+	if err := onDelta("ok"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	if err := onDelta("final answer"); err != nil {
+	return agents.StopReasonEndTurn, nil
+}
+
+type countingClosableStreamer struct {
+	streamCalls atomic.Int32
+	closeCalls  atomic.Int32
+}
+
+func (s *countingClosableStreamer) Name() string {
+	return "counting-closable"
+}
+
+func (s *countingClosableStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	s.streamCalls.Add(1)
+	if err := onDelta(input); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-type permissionOptionStreamer struct {
-	request agents.PermissionRequest
+func (s *countingClosableStreamer) Close() error {
+	s.closeCalls.Add(1)
+	return nil
+}
 
-	mu       sync.Mutex
-	response agents.PermissionResponse
+func (s *countingClosableStreamer) CloseCount() int32 {
+	return s.closeCalls.Load()
 }
 
-func (s *permissionOptionStreamer) Name() string {
-	return "permission-option-streamer"
+// flakyStreamer fails its first failures attempts with err before emitting
+// anything, then streams "recovered".
+type flakyStreamer struct {
+	failures int32
+	err      error
+	calls    atomic.Int32
+	// callerRetries records whether the last call's context was marked
+	// with agents.WithCallerRetries.
+	callerRetries atomic.Bool
 }
 
-func (s *permissionOptionStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *flakyStreamer) Name() string {
+	return "flaky"
+}
+
+func (s *flakyStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
 	_ = input
-	if err := onDelta("before-permission "); err != nil {
+	s.callerRetries.Store(agents.CallerRetries(ctx))
+	if s.calls.Add(1) <= s.failures {
+		return agents.StopReasonEndTurn, s.err
+	}
+	if err := onDelta("recovered"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
+	return agents.StopReasonEndTurn, nil
+}
 
-	handler, ok := agents.PermissionHandlerFromContext(ctx)
-	if !ok {
-		return agents.StopReasonCancelled, errors.New("permission handler missing")
+// failingResponseWriter accepts okWrites writes and fails every later one.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	okWrites int
+	writes   int
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.okWrites {
+		return 0, errors.New("write: broken pipe")
 	}
+	return w.ResponseRecorder.Write(p)
+}
 
-	response, err := handler(ctx, s.request)
-	if err != nil {
-		return agents.StopReasonCancelled, err
+// endlessDeltaStreamer emits up to limit deltas, ignoring ctx, and stops only
+// when onDelta fails.
+type endlessDeltaStreamer struct {
+	limit int32
+	sent  atomic.Int32
+}
+
+func (s *endlessDeltaStreamer) Name() string {
+	return "endless-delta"
+}
+
+func (s *endlessDeltaStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = ctx
+	_ = input
+	for i := int32(0); i < s.limit; i++ {
+		if err := onDelta("x"); err != nil {
+			return agents.StopReasonEndTurn, err
+		}
+		s.sent.Add(1)
 	}
+	return agents.StopReasonEndTurn, nil
+}
 
-	s.mu.Lock()
-	s.response = response
-	s.mu.Unlock()
+// forcedCancelStreamer reports that it had to tear the agent down on cancel.
+type forcedCancelStreamer struct{}
 
-	if err := onDelta("selected:" + response.SelectedOptionID); err != nil {
+func (forcedCancelStreamer) Name() string { return "forced-cancel" }
+
+func (forcedCancelStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	if err := onDelta("partial"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	if response.Outcome == agents.PermissionOutcomeApproved {
-		return agents.StopReasonEndTurn, nil
-	}
+	<-ctx.Done()
+	_ = agents.NotifyCancelForced(ctx)
 	return agents.StopReasonCancelled, nil
 }
 
-func (s *permissionOptionStreamer) Response() agents.PermissionResponse {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.response
+// hungStreamer ignores cancellation until the test ends.
+type hungStreamer struct {
+	release chan struct{}
 }
 
-type toolCallStreamer struct{}
-
-func (s *toolCallStreamer) Name() string {
-	return "tool-call-streamer"
+func newHungStreamer(t *testing.T) *hungStreamer {
+	s := &hungStreamer{release: make(chan struct{})}
+	t.Cleanup(func() { close(s.release) })
+	return s
 }
 
-func (s *toolCallStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *hungStreamer) Name() string { return "hung" }
+
+func (s *hungStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = ctx
 	_ = input
-	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
-		Type:       agents.ACPUpdateTypeToolCall,
-		ToolCallID: "call-1",
-		Title:      "Read file",
-		Kind:       "read_file",
-		Status:     "running",
-		Content: json.RawMessage(`[
-			{"type":"content","content":{"type":"text","text":"opening file"}}
-		]`),
-		RawInput:    json.RawMessage(`{"path":"/tmp/demo.txt"}`),
-		HasTitle:    true,
-		HasKind:     true,
-		HasStatus:   true,
-		HasContent:  true,
-		HasRawInput: true,
-	}); err != nil {
-		return agents.StopReasonEndTurn, err
-	}
-	if err := agents.NotifyToolCall(ctx, agents.ACPToolCall{
-		Type:         agents.ACPUpdateTypeToolCallUpdate,
-		ToolCallID:   "call-1",
-		Status:       "completed",
-		RawOutput:    json.RawMessage(`{"ok":true}`),
-		HasStatus:    true,
-		HasRawOutput: true,
-	}); err != nil {
-		return agents.StopReasonEndTurn, err
-	}
-	if err := onDelta("tool done"); err != nil {
+	if err := onDelta("partial"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	return agents.StopReasonEndTurn, nil
+	<-s.release
+	return agents.StopReasonEndTurn, onDelta("late")
 }
 
-type messageContentStreamer struct{}
+// cancelIgnoringStreamer's first Stream call ignores cancellation and only
+// returns once the streamer is closed, like a provider whose process has to
+// be killed. It records whether a later call started while one was running.
+type cancelIgnoringStreamer struct {
+	hang       bool
+	calls      atomic.Int32
+	active     atomic.Int32
+	overlapped atomic.Bool
+	closed     atomic.Bool
+	closeCh    chan struct{}
+	closeOnce  sync.Once
+}
 
-func (s *messageContentStreamer) Name() string {
-	return "message-content-streamer"
+func newCancelIgnoringStreamer(hang bool) *cancelIgnoringStreamer {
+	return &cancelIgnoringStreamer{hang: hang, closeCh: make(chan struct{})}
 }
 
-func (s *messageContentStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *cancelIgnoringStreamer) Name() string { return "cancel-ignoring" }
+
+func (s *cancelIgnoringStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = ctx
 	_ = input
-	if err := onDelta("preview:\n"); err != nil {
-		return agents.StopReasonEndTurn, err
-	}
-	if err := agents.NotifyMessageContent(ctx, agents.ACPMessageContent{
-		Content: json.RawMessage(`{
-			"type":"image",
-			"mimeType":"image/png",
-			"data":"aGVsbG8="
-		}`),
-		HasContent: true,
-	}); err != nil {
-		return agents.StopReasonEndTurn, err
+	if s.active.Add(1) > 1 {
+		s.overlapped.Store(true)
 	}
-	if err := agents.NotifyMessageContent(ctx, agents.ACPMessageContent{
-		Content: json.RawMessage(`{
-			"type":"resource",
-			"resource":{
-				"uri":"file:///tmp/demo.txt",
-				"mimeType":"text/plain",
-				"text":"embedded text"
-			}
-		}`),
-		HasContent: true,
-	}); err != nil {
+	defer s.active.Add(-1)
+	if err := onDelta("partial"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	if err := onDelta("\ndone"); err != nil {
-		return agents.StopReasonEndTurn, err
+	if s.hang && s.calls.Add(1) == 1 {
+		<-s.closeCh
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-type promptCaptureStreamer struct {
-	prompt agents.Prompt
+func (s *cancelIgnoringStreamer) Close() error {
+	s.closed.Store(true)
+	s.closeOnce.Do(func() { close(s.closeCh) })
+	return nil
 }
 
-func (s *promptCaptureStreamer) Name() string {
-	return "prompt-capture-streamer"
+// pacedDeltaStreamer emits deltas with a fixed gap between them.
+type pacedDeltaStreamer struct {
+	deltas []string
+	gap    time.Duration
 }
 
-func (s *promptCaptureStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
-	return s.StreamPrompt(ctx, agents.TextPrompt(input), onDelta)
+func (s *pacedDeltaStreamer) Name() string {
+	return "paced-delta"
 }
 
-func (s *promptCaptureStreamer) StreamPrompt(ctx context.Context, prompt agents.Prompt, onDelta func(delta string) error) (agents.StopReason, error) {
-	s.prompt = prompt.Clone()
-	if err := onDelta("ok"); err != nil {
+func (s *pacedDeltaStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	for _, delta := range s.deltas {
+		if err := onDelta(delta); err != nil {
+			return agents.StopReasonEndTurn, err
+		}
+		select {
+		case <-ctx.Done():
+			return agents.StopReasonCancelled, nil
+		case <-time.After(s.gap):
+		}
+	}
+	return agents.StopReasonEndTurn, nil
+}
+
+// permissionFloodStreamer issues requests concurrent permission requests and
+// counts declined outcomes.
+type permissionFloodStreamer struct {
+	requests int
+	// command defaults to "rm -rf /tmp/x".
+	command  string
+	declined atomic.Int32
+}
+
+func (s *permissionFloodStreamer) Name() string {
+	return "permission-flood"
+}
+
+func (s *permissionFloodStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	_ = input
+	handler, ok := agents.PermissionHandlerFromContext(ctx)
+	if !ok {
+		return agents.StopReasonEndTurn, errors.New("missing permission handler")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < s.requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := handler(ctx, agents.PermissionRequest{
+				RequestID: fmt.Sprintf("req-%d", i),
+				Approval:  "command",
+				Command:   cmp.Or(s.command, "rm -rf /tmp/x"),
+			})
+			if err == nil && resp.Outcome == agents.PermissionOutcomeDeclined {
+				s.declined.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := onDelta("done"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-type slashCommandStreamer struct {
-	commands []agents.SlashCommand
+type gatedDeltaStreamer struct {
+	started chan struct{}
+	release chan struct{}
 }
 
-func (s *slashCommandStreamer) Name() string {
-	return "slash-command-streamer"
+func (s *gatedDeltaStreamer) Name() string {
+	return "gated-delta"
 }
 
-func (s *slashCommandStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+func (s *gatedDeltaStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
 	_ = input
-	if err := agents.NotifySlashCommands(ctx, s.commands); err != nil {
+	if err := onDelta("first"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
-	if err := onDelta("ok"); err != nil {
+	close(s.started)
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return agents.StopReasonCancelled, nil
+	}
+	if err := onDelta(" second"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-type countingClosableStreamer struct {
-	streamCalls atomic.Int32
-	closeCalls  atomic.Int32
+// onceGatedStreamer gates its first stream and answers later ones (such as
+// compaction) immediately, remembering their input.
+type onceGatedStreamer struct {
+	gated *gatedDeltaStreamer
+	calls atomic.Int32
+
+	mu        sync.Mutex
+	lastInput string
 }
 
-func (s *countingClosableStreamer) Name() string {
-	return "counting-closable"
+func (s *onceGatedStreamer) Name() string {
+	return "once-gated"
 }
 
-func (s *countingClosableStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
-	s.streamCalls.Add(1)
-	if err := onDelta(input); err != nil {
+func (s *onceGatedStreamer) Stream(ctx context.Context, input string, onDelta func(delta string) error) (agents.StopReason, error) {
+	if s.calls.Add(1) == 1 {
+		return s.gated.Stream(ctx, input, onDelta)
+	}
+	s.mu.Lock()
+	s.lastInput = input
+	s.mu.Unlock()
+	if err := onDelta("summary"); err != nil {
 		return agents.StopReasonEndTurn, err
 	}
 	return agents.StopReasonEndTurn, nil
 }
 
-func (s *countingClosableStreamer) Close() error {
-	s.closeCalls.Add(1)
-	return nil
+func (s *onceGatedStreamer) LastInput() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastInput
 }
 
-func (s *countingClosableStreamer) CloseCount() int32 {
-	return s.closeCalls.Load()
+type blockingCloseStreamer struct {
+	countingClosableStreamer
+	release chan struct{}
+}
+
+func (s *blockingCloseStreamer) Close() error {
+	s.closeCalls.Add(1)
+	<-s.release
+	return nil
 }
 
 type closableSessionBoundStreamer struct {
@@ -5299,7 +9718,13 @@ type historyResponse struct {
 		IsInternal   bool   `json:"isInternal"`
 		StopReason   string `json:"stopReason"`
 		Status       string `json:"status"`
+		RequestText  string `json:"requestText"`
 		ResponseText string `json:"responseText"`
+		PromptText   string `json:"promptText"`
+
+		RawStopReason    string `json:"rawStopReason"`
+		PromptTokens     int64  `json:"promptTokens"`
+		CompletionTokens int64  `json:"completionTokens"`
 	} `json:"turns"`
 }
 
@@ -5546,3 +9971,88 @@ func doRawRequest(t *testing.T, method, url string, body io.Reader, headers map[
 	}
 	return resp.StatusCode, string(raw)
 }
+
+func TestTurnDeadlineHeaderFailsTurnWithTimeout(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{
+		allowedRoots: []string{root},
+		agent:        agents.NewFakeAgentWithConfig(1, 50*time.Millisecond),
+	})
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	startedAt := time.Now()
+	rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+		"input":  strings.Repeat("slow ", 40),
+		"stream": true,
+	}, map[string]string{"X-Client-ID": "client-a", "X-Turn-Deadline": "100ms"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("turn status = %d, want %d, body=%s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if elapsed := time.Since(startedAt); elapsed > 3*time.Second {
+		t.Fatalf("turn took %s, want the client deadline to stop it early", elapsed)
+	}
+
+	var errorCode, stopReason string
+	for _, ev := range parseSSEEvents(t, rr.Body.String()) {
+		switch ev.Event {
+		case "error":
+			errorCode = stringField(ev.Data, "code")
+		case "turn_completed":
+			stopReason = stringField(ev.Data, "stopReason")
+		}
+	}
+	if errorCode != "TIMEOUT" || stopReason != "error" {
+		t.Fatalf("error code/stopReason = %q/%q, want TIMEOUT/error", errorCode, stopReason)
+	}
+
+	turns, err := h.store.ListTurnsByThread(context.Background(), threadID)
+	if err != nil {
+		t.Fatalf("ListTurnsByThread(): %v", err)
+	}
+	if len(turns) != 1 || turns[0].Status != "failed" || !strings.Contains(turns[0].ErrorMessage, "turn deadline exceeded") {
+		t.Fatalf("turns = %+v, want one failed turn with deadline error", turns)
+	}
+}
+
+func TestTurnDeadlineHeaderRejectsInvalidValues(t *testing.T) {
+	root := t.TempDir()
+	h := newTestServer(t, testServerOptions{allowedRoots: []string{root}})
+	threadID := createThreadForClient(t, h, "client-a", root)
+
+	for _, value := range []string{"soon", "-5s", "2000-01-01T00:00:00Z"} {
+		rr := performJSONRequest(t, h, http.MethodPost, "/v1/threads/"+threadID+"/turns", map[string]any{
+			"input":  "hello",
+			"stream": true,
+		}, map[string]string{"X-Client-ID": "client-a", "X-Turn-Deadline": value})
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("X-Turn-Deadline %q status = %d, want %d", value, rr.Code, http.StatusBadRequest)
+		}
+		assertErrorCode(t, rr.Body.Bytes(), "INVALID_ARGUMENT")
+	}
+}
+
+func TestParseTurnDeadlineClampsToServerMax(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"30s", now.Add(30 * time.Second)},
+		{"3h", now.Add(time.Hour)},
+		{"2026-03-01T12:10:00Z", now.Add(10 * time.Minute)},
+		{"2026-03-02T12:00:00Z", now.Add(time.Hour)},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/threads/th/turns", nil)
+		if tc.value != "" {
+			req.Header.Set("X-Turn-Deadline", tc.value)
+		}
+		got, err := parseTurnDeadline(req, now, time.Hour)
+		if err != nil {
+			t.Fatalf("parseTurnDeadline(%q): %v", tc.value, err)
+		}
+		if !got.Equal(tc.want) {
+			t.Fatalf("parseTurnDeadline(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package httpapi
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/beyond5959/ngent/internal/agents"
+)
+
+// errInvalidInputText reports turn input that is not UTF-8 text.
+var errInvalidInputText = errors.New("input must be valid UTF-8 text without NUL bytes")
+
+// checkInputText rejects text with invalid UTF-8 sequences or NUL bytes, or,
+// with StripInvalidInput, drops them.
+func (s *Server) checkInputText(text string) (string, error) {
+	if utf8.ValidString(text) && !strings.ContainsRune(text, 0) {
+		return text, nil
+	}
+	if !s.stripInvalidInput {
+		return "", errInvalidInputText
+	}
+	return strings.ReplaceAll(strings.ToValidUTF8(text, ""), "\x00", ""), nil
+}
+
+// checkPromptText applies checkInputText to every text block of prompt.
+func (s *Server) checkPromptText(prompt agents.Prompt) (agents.Prompt, error) {
+	for i, content := range prompt.Content {
+		if content.Type != agents.PromptContentTypeText {
+			continue
+		}
+		text, err := s.checkInputText(content.Text)
+		if err != nil {
+			return agents.Prompt{}, err
+		}
+		prompt.Content[i].Text = text
+	}
+	return prompt, nil
+}
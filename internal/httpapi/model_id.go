@@ -0,0 +1,79 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/beyond5959/ngent/internal/agents"
+)
+
+// errUnknownModelID reports a modelId the agent does not advertise.
+var errUnknownModelID = errors.New("modelId is not offered by agent")
+
+// validateThreadModelID checks agentOptions.modelId in strict mode. A missing
+// key is fine; a present key must be a non-blank string and, when the agent's
+// model list is known, one of its models. Models come from stored config
+// catalogs first and from live discovery otherwise; if neither yields a list
+// the value is accepted as-is.
+func (s *Server) validateThreadModelID(ctx context.Context, agentID, agentOptionsJSON string) error {
+	if !s.strictModelIDs || strings.TrimSpace(agentOptionsJSON) == "" {
+		return nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(agentOptionsJSON), &raw); err != nil {
+		return err
+	}
+	rawModelID, ok := raw["modelId"]
+	if !ok {
+		return nil
+	}
+	var modelID string
+	if err := json.Unmarshal(rawModelID, &modelID); err != nil {
+		return errors.New("modelId must be a string")
+	}
+	modelID = strings.TrimSpace(modelID)
+	if modelID == "" {
+		return errors.New("modelId must not be blank")
+	}
+
+	models, err := s.knownAgentModels(ctx, agentID)
+	if err != nil {
+		s.logger.Warn("agent.models_unavailable",
+			"agent", agentID,
+			"reason", err.Error(),
+		)
+		return nil
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	for _, model := range models {
+		if model.ID == modelID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", errUnknownModelID, modelID)
+}
+
+func (s *Server) knownAgentModels(ctx context.Context, agentID string) ([]agents.ModelOption, error) {
+	models, found, err := s.loadStoredAgentModels(ctx, agentID)
+	if err != nil || found {
+		return models, err
+	}
+	if s.agentModelsFactory == nil {
+		return nil, nil
+	}
+	return s.agentModelsFactory(ctx, agentID)
+}
+
+func writeInvalidModelID(w http.ResponseWriter, agentID string, err error) {
+	writeError(w, http.StatusBadRequest, codeInvalidArgument, "invalid agentOptions.modelId", map[string]any{
+		"field":  "agentOptions.modelId",
+		"agent":  agentID,
+		"reason": err.Error(),
+	})
+}
@@ -0,0 +1,33 @@
+package httpapi
+
+import "fmt"
+
+// permissionStats reports the in-memory permission bookkeeping: pending
+// entries (each holding a response channel), turns with pending entries, and
+// the MaxGlobalPendingPermissions cap (0 = unlimited).
+func (s *Server) permissionStats() map[string]int {
+	s.permissionsMu.Lock()
+	defer s.permissionsMu.Unlock()
+	return map[string]int{
+		"pending": len(s.permissions),
+		"turns":   len(s.permissionsByTurn),
+		"limit":   s.globalPermissionLimit,
+	}
+}
+
+// checkPermissionLeaks reports pending permissions or per-turn index entries
+// that outlived their turn. It is meant for tests and debugging once every
+// turn has finished; while turns run, non-empty maps are expected.
+func (s *Server) checkPermissionLeaks() error {
+	s.permissionsMu.Lock()
+	defer s.permissionsMu.Unlock()
+	if len(s.permissions) == 0 && len(s.permissionsByTurn) == 0 {
+		return nil
+	}
+	turns := make([]string, 0, len(s.permissionsByTurn))
+	for turnID := range s.permissionsByTurn {
+		turns = append(turns, turnID)
+	}
+	return fmt.Errorf("permission bookkeeping leaked %d pending entries and %d turn index entries (turns %v)",
+		len(s.permissions), len(s.permissionsByTurn), turns)
+}
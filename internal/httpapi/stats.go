@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"net/http"
+)
+
+// handleStats reports live counters for simple dashboards. Server numbers
+// cover every client; threads are shared, so only active turns and stored
+// bytes can be scoped to the caller.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request, clientID string) {
+	if err := requireMethod(r, http.MethodGet); err != nil {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	threads, err := s.store.CountThreads(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to count threads", map[string]any{"reason": err.Error()})
+		return
+	}
+	turns, err := s.store.CountTurns(r.Context(), false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to count turns", map[string]any{"reason": err.Error()})
+		return
+	}
+	storedBytes, err := s.store.GetClientStoredBytes(r.Context(), clientID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "failed to load client usage", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	s.agentMu.Lock()
+	cachedAgents := len(s.agentsByScope)
+	s.agentMu.Unlock()
+	s.permissionsMu.Lock()
+	pendingPermissions := len(s.permissions)
+	s.permissionsMu.Unlock()
+	s.clientTurnsMu.Lock()
+	clientActiveTurns := s.clientTurns[clientID]
+	s.clientTurnsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"server": map[string]any{
+			"activeTurns":          s.turns.ActiveCount(),
+			"activeStreams":        s.activeStreams.Load(),
+			"cachedAgents":         cachedAgents,
+			"pendingPermissions":   pendingPermissions,
+			"threads":              threads,
+			"turns":                turns,
+			"contextPromptCapHits": s.ContextPromptIterationCapHits(),
+		},
+		"client": map[string]any{
+			"clientId":    clientID,
+			"activeTurns": clientActiveTurns,
+			"storedBytes": storedBytes,
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/sse"
+)
+
+// auditStreamOpened records that clientID started watching turnID's stream.
+// Audit events are persisted only; they are never sent on the stream.
+func (s *Server) auditStreamOpened(ctx context.Context, turnID, clientID string, openedAt time.Time) {
+	s.appendAuditEvent(ctx, turnID, eventTypeStreamOpened, map[string]any{
+		"turnId":   turnID,
+		"clientId": clientID,
+		"openedAt": openedAt.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// auditStreamClosed records the end of a stream opened at openedAt, with how
+// long it stayed open and how many bytes it carried.
+func (s *Server) auditStreamClosed(ctx context.Context, turnID, clientID string, openedAt time.Time, stream *sse.Writer) {
+	s.appendAuditEvent(ctx, turnID, eventTypeStreamClosed, map[string]any{
+		"turnId":     turnID,
+		"clientId":   clientID,
+		"durationMs": time.Since(openedAt).Milliseconds(),
+		"bytes":      stream.BytesWritten(),
+	})
+}
+
+func (s *Server) appendAuditEvent(ctx context.Context, turnID, eventType string, payload map[string]any) {
+	dataJSON, err := json.Marshal(payload)
+	if err == nil {
+		_, err = s.store.AppendEvent(ctx, turnID, eventType, string(dataJSON))
+	}
+	if err != nil {
+		s.logger.Warn("stream.audit_failed",
+			"turnId", turnID,
+			"type", eventType,
+			"reason", err.Error(),
+		)
+	}
+}
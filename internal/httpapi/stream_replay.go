@@ -0,0 +1,104 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/beyond5959/ngent/internal/storage"
+)
+
+const (
+	// maxStreamReplayEvents caps Config.StreamReplayEvents.
+	maxStreamReplayEvents = 500
+
+	// eventTypeReplay wraps one persisted event of an earlier turn, sent
+	// before the live events of a new stream.
+	eventTypeReplay = "replay"
+)
+
+// streamReplaySkippedEvents are persisted event types that are never
+// replayed: stream audit records and internal turn bookkeeping.
+var streamReplaySkippedEvents = map[string]struct{}{
+	eventTypeStreamOpened: {},
+	eventTypeStreamClosed: {},
+	eventTypeUserPrompt:   {},
+	eventTypeTurnContext:  {},
+}
+
+// replayRecentEvents writes the newest streamReplayEvents persisted events of
+// the thread's earlier turns to sink, oldest first, each wrapped in a replay
+// event so clients never mistake them for output of currentTurnID. Load
+// failures are logged and skip the replay; only sink errors are returned.
+func (s *Server) replayRecentEvents(ctx context.Context, sink turnEventSink, threadID, currentTurnID string) error {
+	if s.streamReplayEvents <= 0 {
+		return nil
+	}
+	events, err := s.recentThreadEvents(ctx, threadID, currentTurnID, s.streamReplayEvents)
+	if err != nil {
+		s.logger.Warn("turn.replay_failed",
+			"threadId", threadID,
+			"turnId", currentTurnID,
+			"reason", err.Error(),
+		)
+		return nil
+	}
+	for _, event := range events {
+		data := json.RawMessage(event.DataJSON)
+		if !json.Valid(data) {
+			data = json.RawMessage("null")
+		}
+		if err := sink.Event(eventTypeReplay, map[string]any{
+			"turnId":    event.TurnID,
+			"seq":       event.Seq,
+			"type":      event.Type,
+			"createdAt": event.CreatedAt.UTC().Format(time.RFC3339Nano),
+			"data":      data,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recentThreadEvents returns up to limit of the newest replayable events of
+// threadID's non-internal turns other than currentTurnID, in stream order.
+// At most limit turns are read; turns without such events only shorten the
+// result.
+func (s *Server) recentThreadEvents(ctx context.Context, threadID, currentTurnID string, limit int) ([]storage.Event, error) {
+	turns, err := s.store.ListRecentTurnsByThread(ctx, threadID, limit+1, false)
+	if err != nil {
+		return nil, err
+	}
+	var events []storage.Event
+	for _, turn := range slices.Backward(turns) {
+		if turn.TurnID == currentTurnID {
+			continue
+		}
+		turnEvents, err := s.store.ListEventsByTurn(ctx, turn.TurnID)
+		if err != nil {
+			return nil, err
+		}
+		turnEvents = slices.DeleteFunc(turnEvents, func(event storage.Event) bool {
+			return !s.replayableEvent(event.Type)
+		})
+		events = append(turnEvents, events...)
+		if len(events) >= limit {
+			break
+		}
+	}
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+// replayableEvent reports whether events of eventType may be replayed: not
+// audit or internal bookkeeping, and streamed under the configured delivery.
+func (s *Server) replayableEvent(eventType string) bool {
+	if _, skip := streamReplaySkippedEvents[eventType]; skip {
+		return false
+	}
+	return s.eventDeliveryFor(eventType).Stream
+}
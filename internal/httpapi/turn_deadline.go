@@ -0,0 +1,52 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// turnDeadlineHeader lets a client bound how long one turn may run.
+	turnDeadlineHeader = "X-Turn-Deadline"
+
+	defaultMaxTurnDeadline = time.Hour
+)
+
+// errTurnDeadlineExceeded is the cancel cause of a turn that ran past its
+// client deadline; it wraps context.DeadlineExceeded so the turn fails with
+// TIMEOUT.
+var errTurnDeadlineExceeded = fmt.Errorf("turn deadline exceeded: %w", context.DeadlineExceeded)
+
+// parseTurnDeadline reads X-Turn-Deadline as a Go duration ("90s") or an
+// RFC 3339 time and returns the absolute deadline, clamped to now+limit. A
+// missing header yields the zero time.
+func parseTurnDeadline(r *http.Request, now time.Time, limit time.Duration) (time.Time, error) {
+	raw := strings.TrimSpace(r.Header.Get(turnDeadlineHeader))
+	if raw == "" {
+		return time.Time{}, nil
+	}
+
+	var deadline time.Time
+	if d, err := time.ParseDuration(raw); err == nil {
+		if d <= 0 {
+			return time.Time{}, errors.New("duration must be positive")
+		}
+		deadline = now.Add(d)
+	} else if at, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		if !at.After(now) {
+			return time.Time{}, errors.New("deadline is in the past")
+		}
+		deadline = at
+	} else {
+		return time.Time{}, errors.New(`want a duration like "90s" or an RFC 3339 time`)
+	}
+
+	if limit > 0 && deadline.After(now.Add(limit)) {
+		deadline = now.Add(limit)
+	}
+	return deadline, nil
+}
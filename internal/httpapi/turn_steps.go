@@ -0,0 +1,108 @@
+package httpapi
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Turn step phases, in the order a typical agent turn moves through them.
+const (
+	stepPhaseThinking    = "thinking"
+	stepPhasePlanning    = "planning"
+	stepPhaseToolRequest = "tool_request"
+	stepPhaseToolResult  = "tool_result"
+	stepPhaseAnswer      = "answer"
+)
+
+// turnStepTracker groups the events of one turn into steps. Consecutive
+// thinking, planning, or answer events share a step; every tool call gets
+// its own step, which its updates and permission prompts join even when
+// other events interleave. Lifecycle events are left untagged.
+type turnStepTracker struct {
+	mu       sync.Mutex
+	next     int
+	current  string
+	phase    string
+	toolStep map[string]string
+}
+
+func newTurnStepTracker() *turnStepTracker {
+	return &turnStepTracker{toolStep: make(map[string]string)}
+}
+
+// tag adds stepId and phase to payload when eventType belongs to a step.
+func (t *turnStepTracker) tag(eventType string, payload map[string]any) {
+	if t == nil || payload == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stepID, phase string
+	switch eventType {
+	case eventTypeReasoningDelta:
+		stepID, phase = t.continueStep(stepPhaseThinking), stepPhaseThinking
+	case "plan_update":
+		stepID, phase = t.continueStep(stepPhasePlanning), stepPhasePlanning
+	case "message_delta", eventTypeMessageContent:
+		stepID, phase = t.continueStep(stepPhaseAnswer), stepPhaseAnswer
+	case eventTypeToolCall, eventTypeToolCallUpdate:
+		phase = stepPhaseToolRequest
+		if eventType == eventTypeToolCallUpdate && isTerminalToolStatus(payload["status"]) {
+			phase = stepPhaseToolResult
+		}
+		stepID = t.toolCallStep(payload["toolCallId"])
+		t.current, t.phase = stepID, phase
+	case "permission_required", "permission_auto_declined":
+		phase = stepPhaseToolRequest
+		if t.phase == stepPhaseToolRequest || t.phase == stepPhaseToolResult {
+			stepID = t.current
+		} else {
+			stepID = t.newStep()
+		}
+		t.current, t.phase = stepID, phase
+	default:
+		return
+	}
+	payload["stepId"] = stepID
+	payload["phase"] = phase
+}
+
+// continueStep keeps the current step while phase is unchanged and opens a
+// new one otherwise.
+func (t *turnStepTracker) continueStep(phase string) string {
+	if t.current == "" || t.phase != phase {
+		t.current = t.newStep()
+		t.phase = phase
+	}
+	return t.current
+}
+
+func (t *turnStepTracker) toolCallStep(rawID any) string {
+	toolCallID, _ := rawID.(string)
+	toolCallID = strings.TrimSpace(toolCallID)
+	if stepID, ok := t.toolStep[toolCallID]; ok && toolCallID != "" {
+		return stepID
+	}
+	stepID := t.newStep()
+	if toolCallID != "" {
+		t.toolStep[toolCallID] = stepID
+	}
+	return stepID
+}
+
+func (t *turnStepTracker) newStep() string {
+	t.next++
+	return "step-" + strconv.Itoa(t.next)
+}
+
+func isTerminalToolStatus(raw any) bool {
+	status, _ := raw.(string)
+	switch strings.ToLower(strings.TrimSpace(status)) {
+	case "completed", "failed", "cancelled":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,327 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultWebhookRetryBackoff = 500 * time.Millisecond
+	webhookMaxAttempts         = 4
+	webhookRequestTimeout      = 10 * time.Second
+	webhookDeliveryTimeout     = 30 * time.Second
+	defaultWebhookDrainTimeout = 30 * time.Second
+	webhookQueueSize           = 256
+	// webhookReservedSlots stay free for terminal events, so a full queue
+	// never drops the event that tells the receiver the turn ended.
+	webhookReservedSlots = 4
+)
+
+// webhookTerminalEvents are never dropped by a full queue.
+var webhookTerminalEvents = map[string]struct{}{
+	"error":          {},
+	"turn_completed": {},
+}
+
+func normalizeWebhookHosts(hosts []string) map[string]struct{} {
+	out := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			out[host] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (s *Server) webhookHostAllowed(host string) bool {
+	_, ok := s.webhookAllowedHosts[strings.ToLower(host)]
+	return ok
+}
+
+// disallowedWebhookIP reports addresses a callback may not reach unless its
+// host is explicitly allowlisted (loopback, private, link-local, etc.).
+func disallowedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast()
+}
+
+// validateWebhookURL rejects callback URLs that are malformed or resolve to
+// internal addresses. The dialer re-checks each connection, so a DNS answer
+// that changes after validation is still refused.
+func (s *Server) validateWebhookURL(ctx context.Context, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if parsed.User != nil {
+		return errors.New("userinfo is not allowed")
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return errors.New("host is required")
+	}
+	if s.webhookHostAllowed(host) {
+		return nil
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("resolve host: %w", err)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if disallowedWebhookIP(ip) {
+			return fmt.Errorf("host resolves to disallowed address %s", ip)
+		}
+	}
+	return nil
+}
+
+func (s *Server) newWebhookClient() *http.Client {
+	guarded := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || disallowedWebhookIP(ip) {
+				return fmt.Errorf("webhook: dial to disallowed address %s", host)
+			}
+			return nil
+		},
+	}
+	plain := &net.Dialer{Timeout: webhookRequestTimeout}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if s.webhookHostAllowed(host) {
+			return plain.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   webhookRequestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+type webhookEvent struct {
+	eventType string
+	data      json.RawMessage
+}
+
+// webhookSink delivers turn events to one callback URL in order. Event never
+// blocks: when the queue is full a non-terminal event is dropped and counted,
+// while terminal events use slots reserved for them. Each delivery reports
+// the number of events dropped so far. Close drains the queue for at most
+// the server's drain timeout, then aborts the in-flight delivery and drops
+// the rest.
+type webhookSink struct {
+	server   *Server
+	url      string
+	threadID string
+	turnID   string
+	queue    chan webhookEvent
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	dropped  atomic.Int64
+}
+
+func (s *Server) newWebhookSink(callbackURL, threadID, turnID string) *webhookSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &webhookSink{
+		server:   s,
+		url:      callbackURL,
+		threadID: threadID,
+		turnID:   turnID,
+		queue:    make(chan webhookEvent, webhookQueueSize),
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go sink.run()
+	return sink
+}
+
+// Event queues one event for delivery. Non-terminal events are dropped once
+// only the reserved slots are left.
+func (w *webhookSink) Event(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("webhook: marshal payload: %w", err)
+	}
+	if _, terminal := webhookTerminalEvents[eventType]; !terminal && len(w.queue) >= cap(w.queue)-webhookReservedSlots {
+		w.dropped.Add(1)
+		return nil
+	}
+	select {
+	case w.queue <- webhookEvent{eventType: eventType, data: data}:
+	default:
+		w.dropped.Add(1)
+	}
+	return nil
+}
+
+// Close flushes queued events and stops the sender. If the receiver has not
+// caught up within the drain timeout, pending deliveries are abandoned.
+func (w *webhookSink) Close() {
+	close(w.queue)
+	timer := time.NewTimer(w.server.webhookDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+}
+
+func (w *webhookSink) run() {
+	defer close(w.done)
+	defer func() {
+		if dropped := w.dropped.Load(); dropped > 0 {
+			w.server.logger.Warn("webhook.events_dropped",
+				"threadId", w.threadID,
+				"turnId", w.turnID,
+				"dropped", dropped,
+			)
+		}
+	}()
+	seq := 0
+	for event := range w.queue {
+		if w.ctx.Err() != nil {
+			w.dropped.Add(1)
+			continue
+		}
+		seq++
+		if err := w.deliver(seq, event); err != nil {
+			w.server.logger.Warn("webhook.delivery_failed",
+				"threadId", w.threadID,
+				"turnId", w.turnID,
+				"event", event.eventType,
+				"seq", seq,
+				"reason", err.Error(),
+			)
+		}
+	}
+}
+
+func (w *webhookSink) deliver(seq int, event webhookEvent) error {
+	envelope := map[string]any{
+		"event":    event.eventType,
+		"seq":      seq,
+		"threadId": w.threadID,
+		"turnId":   w.turnID,
+		"data":     event.data,
+	}
+	if dropped := w.dropped.Load(); dropped > 0 {
+		envelope["droppedEvents"] = dropped
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	// All attempts for one event share a deadline so a receiver that keeps
+	// timing out cannot hold the queue for attempts x request timeout.
+	ctx, cancel := context.WithTimeout(w.ctx, webhookDeliveryTimeout)
+	defer cancel()
+
+	backoff := w.server.webhookRetryBackoff
+	var lastErr error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		retry, err := w.post(ctx, event.eventType, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == webhookMaxAttempts {
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (after %d attempts: %v)", ctx.Err(), attempt, lastErr)
+		}
+		backoff *= 2
+	}
+	return lastErr
+}
+
+// post sends one signed delivery and reports whether a failure is retryable.
+func (w *webhookSink) post(ctx context.Context, eventType string, body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ngent-Event", eventType)
+	req.Header.Set("X-Ngent-Timestamp", timestamp)
+	req.Header.Set("X-Ngent-Signature", "sha256="+signWebhookBody(w.server.webhookSecret, timestamp, body))
+
+	resp, err := w.server.webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("callback returned status %d", resp.StatusCode)
+}
+
+// signWebhookBody returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func signWebhookBody(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -11,16 +11,23 @@ import (
 var (
 	acpDebugEnabled atomic.Bool
 	acpDebugLogger  atomic.Pointer[Logger]
+	// acpLogger receives ACP warnings whether or not debug tracing is on.
+	acpLogger atomic.Pointer[Logger]
 )
 
+// acpLogLineLimit caps how much of a raw stdout line is copied into a log.
+const acpLogLineLimit = 256
+
 var (
 	bearerTokenPattern    = regexp.MustCompile(`(?i)\bbearer\s+[^\s]+`)
 	openAIKeyPattern      = regexp.MustCompile(`\bsk-[A-Za-z0-9_-]+\b`)
 	sensitiveQueryPattern = regexp.MustCompile(`(?i)([?&](?:access[_-]?token|auth[_-]?token|api[_-]?key|token|secret|password)=)[^&\s]+`)
 )
 
-// ConfigureACPDebug toggles verbose ACP tracing on the shared logger.
+// ConfigureACPDebug sets the shared logger for ACP warnings and toggles
+// verbose ACP tracing on it.
 func ConfigureACPDebug(logger *Logger, enabled bool) {
+	acpLogger.Store(logger)
 	if !enabled {
 		acpDebugEnabled.Store(false)
 		acpDebugLogger.Store(nil)
@@ -28,6 +35,7 @@ func ConfigureACPDebug(logger *Logger, enabled bool) {
 	}
 	if logger == nil {
 		logger = NewLogger(LevelDebug)
+		acpLogger.Store(logger)
 	}
 	acpDebugLogger.Store(logger)
 	acpDebugEnabled.Store(true)
@@ -73,6 +81,30 @@ func LogACPMessage(component, direction string, msg any) {
 	logger.Debug("acp.message", attrs...)
 }
 
+// LogACPDecodeError reports an inbound ACP line that could not be decoded.
+// The line is redacted and truncated to acpLogLineLimit bytes.
+func LogACPDecodeError(component string, line []byte, err error) {
+	logger := acpLogger.Load()
+	if logger == nil {
+		return
+	}
+	component = strings.TrimSpace(component)
+	if component == "" {
+		component = "acp"
+	}
+	text := string(line)
+	truncated := len(text) > acpLogLineLimit
+	if truncated {
+		text = strings.ToValidUTF8(text[:acpLogLineLimit], "")
+	}
+	logger.Warn("acp.decode_failed",
+		"component", component,
+		"reason", redactString(err.Error()),
+		"line", redactString(text),
+		"truncated", truncated,
+	)
+}
+
 func normalizeLogValue(value any) any {
 	switch v := value.(type) {
 	case nil:
@@ -2,6 +2,7 @@ package observability
 
 import (
 	"bytes"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -64,6 +65,28 @@ func TestLogACPMessageDisabledDoesNotEmit(t *testing.T) {
 	}
 }
 
+func TestLogACPDecodeErrorTruncatesAndRedactsLine(t *testing.T) {
+	var buf bytes.Buffer
+	ConfigureACPDebug(NewLoggerWithWriter(&buf, LevelInfo), false)
+	t.Cleanup(func() {
+		ConfigureACPDebug(nil, false)
+	})
+
+	line := []byte(`{"token":"Bearer secret-token","pad":"` + strings.Repeat("x", 2*acpLogLineLimit) + `"`)
+	LogACPDecodeError("acp-test", line, errors.New("unexpected end of JSON input"))
+
+	got := strings.TrimSpace(buf.String())
+	if !strings.Contains(got, "acp.decode_failed") || !strings.Contains(got, "truncated=true") {
+		t.Fatalf("log output = %q, want truncated acp.decode_failed entry", got)
+	}
+	if strings.Contains(got, "secret-token") {
+		t.Fatalf("log output leaked bearer token: %q", got)
+	}
+	if strings.Contains(got, strings.Repeat("x", acpLogLineLimit)) {
+		t.Fatalf("log output was not truncated: %q", got)
+	}
+}
+
 func TestLogACPMessageSanitizesSensitiveFields(t *testing.T) {
 	var buf bytes.Buffer
 	logger := NewLoggerWithWriter(&buf, LevelDebug)
@@ -3,6 +3,7 @@ package runtime
 import (
 	"context"
 	"errors"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -80,7 +81,42 @@ func (c *TurnController) Activate(threadID, sessionID, turnID string, cancel con
 func (c *TurnController) ActivateThreadExclusive(threadID, turnID string, cancel context.CancelFunc) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.activateThreadExclusiveLocked(threadID, turnID, cancel)
+}
+
+// ActivateThreadExclusiveWait is ActivateThreadExclusive, but while the
+// thread is busy it waits up to wait (or until ctx is done) for the running
+// turns to be released before giving up with ErrActiveTurnExists.
+func (c *TurnController) ActivateThreadExclusiveWait(ctx context.Context, threadID, turnID string, cancel context.CancelFunc, wait time.Duration) error {
+	if wait <= 0 {
+		return c.ActivateThreadExclusive(threadID, turnID, cancel)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	waitCtx, stop := context.WithTimeout(ctx, wait)
+	defer stop()
+	// Wake the waiter when the wait ends; taking mu first guarantees the
+	// broadcast cannot slip in between the check below and cond.Wait.
+	stopWake := context.AfterFunc(waitCtx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stopWake()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		err := c.activateThreadExclusiveLocked(threadID, turnID, cancel)
+		if !errors.Is(err, ErrActiveTurnExists) || waitCtx.Err() != nil {
+			return err
+		}
+		c.cond.Wait()
+	}
+}
 
+func (c *TurnController) activateThreadExclusiveLocked(threadID, turnID string, cancel context.CancelFunc) error {
 	if _, exists := c.threadGuards[threadID]; exists {
 		return ErrActiveTurnExists
 	}
@@ -187,6 +223,25 @@ func (c *TurnController) Cancel(turnID string) error {
 	return nil
 }
 
+// TurnIDForThread returns one cancellable active turn on a thread. When several
+// sessions on the thread are running, the lowest turn ID is returned so the
+// choice is deterministic.
+func (c *TurnController) TurnIDForThread(threadID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := ""
+	for turnID, entry := range c.byTurn {
+		if entry.threadID != threadID || entry.cancel == nil {
+			continue
+		}
+		if found == "" || turnID < found {
+			found = turnID
+		}
+	}
+	return found, found != ""
+}
+
 // IsThreadActive reports whether a thread has an active turn.
 func (c *TurnController) IsThreadActive(threadID string) bool {
 	c.mu.Lock()
@@ -215,6 +270,18 @@ func (c *TurnController) ActiveCount() int {
 	return len(c.byTurn)
 }
 
+// ActiveTurnIDs returns the ids of all active turns, sorted.
+func (c *TurnController) ActiveTurnIDs() []string {
+	c.mu.Lock()
+	ids := make([]string, 0, len(c.byTurn))
+	for turnID := range c.byTurn {
+		ids = append(ids, turnID)
+	}
+	c.mu.Unlock()
+	slices.Sort(ids)
+	return ids
+}
+
 // CancelAll requests cancellation for all active turns.
 func (c *TurnController) CancelAll() int {
 	c.mu.Lock()
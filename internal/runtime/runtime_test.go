@@ -52,6 +52,43 @@ func TestTurnControllerActivateCancelRelease(t *testing.T) {
 	}
 }
 
+func TestTurnControllerTurnIDForThread(t *testing.T) {
+	controller := NewTurnController()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok := controller.TurnIDForThread("th-1"); ok {
+		t.Fatalf("TurnIDForThread() on idle thread should report no turn")
+	}
+	if err := controller.Activate("th-1", "ses-2", "tu-2", cancel); err != nil {
+		t.Fatalf("Activate(tu-2) unexpected error: %v", err)
+	}
+	if err := controller.Activate("th-1", "ses-1", "tu-1", cancel); err != nil {
+		t.Fatalf("Activate(tu-1) unexpected error: %v", err)
+	}
+	if err := controller.Activate("th-2", "ses-1", "tu-0", cancel); err != nil {
+		t.Fatalf("Activate(tu-0) unexpected error: %v", err)
+	}
+
+	if got, ok := controller.TurnIDForThread("th-1"); !ok || got != "tu-1" {
+		t.Fatalf("TurnIDForThread(th-1) = %q, %v, want tu-1, true", got, ok)
+	}
+
+	controller.Release("th-1", "ses-1", "tu-1")
+	controller.Release("th-1", "ses-2", "tu-2")
+	if _, ok := controller.TurnIDForThread("th-1"); ok {
+		t.Fatalf("TurnIDForThread() after release should report no turn")
+	}
+
+	if err := controller.ActivateThreadExclusive("th-1", "guard-1", nil); err != nil {
+		t.Fatalf("ActivateThreadExclusive() unexpected error: %v", err)
+	}
+	if _, ok := controller.TurnIDForThread("th-1"); ok {
+		t.Fatalf("TurnIDForThread() should skip guards without a cancel func")
+	}
+}
+
 func TestTurnControllerWaitForIdleAndCancelAll(t *testing.T) {
 	controller := NewTurnController()
 
@@ -63,6 +100,9 @@ func TestTurnControllerWaitForIdleAndCancelAll(t *testing.T) {
 	if got := controller.ActiveCount(); got != 1 {
 		t.Fatalf("ActiveCount() = %d, want 1", got)
 	}
+	if got := controller.ActiveTurnIDs(); len(got) != 1 || got[0] != "tu-1" {
+		t.Fatalf("ActiveTurnIDs() = %v, want [tu-1]", got)
+	}
 
 	waitCtx, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer waitCancel()
@@ -127,3 +167,32 @@ func TestTurnControllerActivateThreadExclusive(t *testing.T) {
 		t.Fatalf("thread should be inactive after releasing exclusive guard")
 	}
 }
+
+func TestTurnControllerActivateThreadExclusiveWait(t *testing.T) {
+	controller := NewTurnController()
+
+	if err := controller.Activate("th-1", "ses-1", "tu-1", nil); err != nil {
+		t.Fatalf("Activate() unexpected error: %v", err)
+	}
+
+	startedAt := time.Now()
+	err := controller.ActivateThreadExclusiveWait(context.Background(), "th-1", "guard-1", nil, 50*time.Millisecond)
+	if !errors.Is(err, ErrActiveTurnExists) {
+		t.Fatalf("ActivateThreadExclusiveWait() on busy thread error = %v, want %v", err, ErrActiveTurnExists)
+	}
+	if elapsed := time.Since(startedAt); elapsed < 50*time.Millisecond {
+		t.Fatalf("ActivateThreadExclusiveWait() gave up after %s, want >= 50ms", elapsed)
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		controller.Release("th-1", "ses-1", "tu-1")
+	}()
+	if err := controller.ActivateThreadExclusiveWait(context.Background(), "th-1", "guard-1", nil, 5*time.Second); err != nil {
+		t.Fatalf("ActivateThreadExclusiveWait() after release error = %v, want nil", err)
+	}
+	if !controller.IsThreadActive("th-1") {
+		t.Fatalf("thread should be active while exclusive guard is held")
+	}
+	controller.ReleaseThreadExclusive("th-1", "guard-1")
+}
@@ -5,16 +5,66 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// Options controls when buffered SSE frames are flushed. The zero value
+// flushes after every event.
+type Options struct {
+	// FlushEvery flushes once this many events have been written since the
+	// last flush. Values <= 1 flush every event unless FlushInterval is set.
+	FlushEvery int
+	// FlushInterval flushes buffered events at most this long after the first
+	// unflushed event was written.
+	FlushInterval time.Duration
+	// ImmediateEvents are event types that always flush right away, such as
+	// terminal events or events the client must answer.
+	ImmediateEvents []string
+	// EventNames renames event types on the wire. Lookups, including
+	// ImmediateEvents, use the name passed to Event; unlisted types are
+	// written unchanged.
+	EventNames map[string]string
+}
+
+func (o Options) batching() bool {
+	return o.FlushEvery > 1 || o.FlushInterval > 0
+}
+
 // Writer wraps http.ResponseWriter to emit SSE frames.
 type Writer struct {
 	w       http.ResponseWriter
 	flusher http.Flusher
+
+	opts      Options
+	immediate map[string]struct{}
+
+	mu      sync.Mutex
+	pending int
+	timer   *time.Timer
+	closed  bool
+	written int64
+	// err is the first write or flush failure. Once set, every later Event
+	// returns it so callers stop streaming into a dead connection.
+	err error
 }
 
-// NewWriter prepares response headers and returns an SSE writer.
+// flushErrorer is implemented by response writers that report flush
+// failures (net/http's response since Go 1.20).
+type flushErrorer interface {
+	FlushError() error
+}
+
+// NewWriter prepares response headers and returns an SSE writer that flushes
+// after every event.
 func NewWriter(w http.ResponseWriter) (*Writer, error) {
+	return NewWriterWithOptions(w, Options{})
+}
+
+// NewWriterWithOptions prepares response headers and returns an SSE writer
+// using the given flush policy. Callers that enable batching must call Close
+// before the handler returns.
+func NewWriterWithOptions(w http.ResponseWriter, opts Options) (*Writer, error) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return nil, errors.New("sse: response writer does not support flushing")
@@ -26,22 +76,133 @@ func NewWriter(w http.ResponseWriter) (*Writer, error) {
 	headers.Set("Connection", "keep-alive")
 	headers.Set("X-Accel-Buffering", "no")
 
-	return &Writer{w: w, flusher: flusher}, nil
+	// Streams outlive any server-wide WriteTimeout, so lift the connection
+	// write deadline. Writers that cannot set deadlines are left as-is.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	immediate := make(map[string]struct{}, len(opts.ImmediateEvents))
+	for _, eventType := range opts.ImmediateEvents {
+		immediate[eventType] = struct{}{}
+	}
+	return &Writer{w: w, flusher: flusher, opts: opts, immediate: immediate}, nil
 }
 
-// Event writes one SSE event and flushes it.
+// Event writes one SSE event and flushes it according to the flush policy.
 func (sw *Writer) Event(eventType string, payload any) error {
 	encoded, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("sse: marshal payload: %w", err)
 	}
 
-	if _, err := fmt.Fprintf(sw.w, "event: %s\n", eventType); err != nil {
-		return fmt.Errorf("sse: write event field: %w", err)
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.err != nil {
+		return sw.err
+	}
+	wireName := eventType
+	if renamed, ok := sw.opts.EventNames[eventType]; ok {
+		wireName = renamed
+	}
+	n, err := fmt.Fprintf(sw.w, "event: %s\n", wireName)
+	sw.written += int64(n)
+	if err != nil {
+		sw.err = fmt.Errorf("sse: write event field: %w", err)
+		return sw.err
+	}
+	n, err = fmt.Fprintf(sw.w, "data: %s\n\n", encoded)
+	sw.written += int64(n)
+	if err != nil {
+		sw.err = fmt.Errorf("sse: write data field: %w", err)
+		return sw.err
+	}
+	sw.pending++
+
+	if !sw.opts.batching() {
+		return sw.flushLocked()
+	}
+	if _, ok := sw.immediate[eventType]; ok {
+		return sw.flushLocked()
+	}
+	if sw.opts.FlushEvery > 1 && sw.pending >= sw.opts.FlushEvery {
+		return sw.flushLocked()
+	}
+	if sw.opts.FlushInterval > 0 && sw.timer == nil {
+		sw.timer = time.AfterFunc(sw.opts.FlushInterval, sw.flushFromTimer)
+	}
+	return nil
+}
+
+// Flush writes out any buffered events.
+func (sw *Writer) Flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.pending > 0 {
+		_ = sw.flushLocked()
+	}
+}
+
+// BytesWritten reports how many bytes of events were written so far.
+func (sw *Writer) BytesWritten() int64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.written
+}
+
+// Err returns the first write or flush failure, if any.
+func (sw *Writer) Err() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.err
+}
+
+// Close flushes buffered events and stops the flush timer. The writer must
+// not be used after Close.
+func (sw *Writer) Close() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return
+	}
+	if sw.pending > 0 {
+		_ = sw.flushLocked()
 	}
-	if _, err := fmt.Fprintf(sw.w, "data: %s\n\n", encoded); err != nil {
-		return fmt.Errorf("sse: write data field: %w", err)
+	sw.stopTimerLocked()
+	sw.closed = true
+}
+
+func (sw *Writer) flushFromTimer() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.timer = nil
+	if sw.closed || sw.pending == 0 {
+		return
+	}
+	_ = sw.flushLocked()
+}
+
+// flushLocked flushes buffered frames and records a flush failure as the
+// writer's sticky error.
+func (sw *Writer) flushLocked() error {
+	sw.pending = 0
+	sw.stopTimerLocked()
+	if sw.err != nil {
+		return sw.err
+	}
+	if fe, ok := sw.w.(flushErrorer); ok {
+		if err := fe.FlushError(); err != nil {
+			sw.err = fmt.Errorf("sse: flush: %w", err)
+			return sw.err
+		}
+		return nil
 	}
 	sw.flusher.Flush()
 	return nil
 }
+
+func (sw *Writer) stopTimerLocked() {
+	if sw.timer != nil {
+		sw.timer.Stop()
+		sw.timer = nil
+	}
+}
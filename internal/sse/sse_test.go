@@ -0,0 +1,253 @@
+package sse
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	flushes atomic.Int32
+}
+
+func newCountingRecorder() *countingRecorder {
+	return &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+func (r *countingRecorder) Flush() {
+	r.flushes.Add(1)
+	r.ResponseRecorder.Flush()
+}
+
+func TestWriterDefaultFlushesEveryEvent(t *testing.T) {
+	rec := newCountingRecorder()
+	sw, err := NewWriter(rec)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sw.Event("message_delta", map[string]any{"delta": "x"}); err != nil {
+			t.Fatalf("Event() error = %v", err)
+		}
+	}
+	if got := rec.flushes.Load(); got != 3 {
+		t.Fatalf("flush count = %d, want 3", got)
+	}
+}
+
+func TestWriterBatchingNeverDelaysImmediateEvents(t *testing.T) {
+	rec := newCountingRecorder()
+	sw, err := NewWriterWithOptions(rec, Options{
+		FlushEvery:      100,
+		FlushInterval:   time.Hour,
+		ImmediateEvents: []string{"turn_completed", "error", "permission_required"},
+	})
+	if err != nil {
+		t.Fatalf("NewWriterWithOptions() error = %v", err)
+	}
+	defer sw.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := sw.Event("message_delta", map[string]any{"delta": "x"}); err != nil {
+			t.Fatalf("Event() error = %v", err)
+		}
+	}
+	if got := rec.flushes.Load(); got != 0 {
+		t.Fatalf("flush count after deltas = %d, want 0", got)
+	}
+
+	for i, eventType := range []string{"permission_required", "error", "turn_completed"} {
+		if err := sw.Event(eventType, map[string]any{}); err != nil {
+			t.Fatalf("Event(%s) error = %v", eventType, err)
+		}
+		if got := rec.flushes.Load(); got != int32(i+1) {
+			t.Fatalf("flush count after %s = %d, want %d", eventType, got, i+1)
+		}
+	}
+	if body := rec.Body.String(); !strings.HasSuffix(body, "event: turn_completed\ndata: {}\n\n") {
+		t.Fatalf("body does not end with turn_completed frame: %q", body)
+	}
+}
+
+func TestWriterBatchingFlushesOnCountIntervalAndClose(t *testing.T) {
+	rec := newCountingRecorder()
+	sw, err := NewWriterWithOptions(rec, Options{FlushEvery: 2, FlushInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWriterWithOptions() error = %v", err)
+	}
+
+	_ = sw.Event("message_delta", map[string]any{"delta": "a"})
+	_ = sw.Event("message_delta", map[string]any{"delta": "b"})
+	if got := rec.flushes.Load(); got != 1 {
+		t.Fatalf("flush count after 2 events = %d, want 1", got)
+	}
+
+	_ = sw.Event("message_delta", map[string]any{"delta": "c"})
+	deadline := time.Now().Add(2 * time.Second)
+	for rec.flushes.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := rec.flushes.Load(); got != 2 {
+		t.Fatalf("flush count after interval = %d, want 2", got)
+	}
+
+	_ = sw.Event("message_delta", map[string]any{"delta": "d"})
+	sw.Close()
+	if got := rec.flushes.Load(); got != 3 {
+		t.Fatalf("flush count after Close = %d, want 3", got)
+	}
+}
+
+// brokenWriter fails writes once broken is set and reports flush failures
+// through FlushError like net/http's response.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	broken   bool
+	flushErr error
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if w.broken {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *brokenWriter) FlushError() error {
+	return w.flushErr
+}
+
+func TestWriterErrorIsStickyAfterWriteFailure(t *testing.T) {
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+	sw, err := NewWriter(w)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if err := sw.Event("message_delta", map[string]any{"delta": "a"}); err != nil {
+		t.Fatalf("Event() before failure error = %v", err)
+	}
+
+	w.broken = true
+	if err := sw.Event("message_delta", map[string]any{"delta": "b"}); err == nil {
+		t.Fatalf("Event() on broken connection error = nil, want non-nil")
+	}
+	w.broken = false
+	if err := sw.Event("message_delta", map[string]any{"delta": "c"}); err == nil {
+		t.Fatalf("Event() after earlier failure error = nil, want sticky error")
+	}
+	if sw.Err() == nil {
+		t.Fatalf("Err() = nil after write failure")
+	}
+}
+
+func TestWriterReportsFlushFailure(t *testing.T) {
+	flushErr := errors.New("client gone")
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), flushErr: flushErr}
+	sw, err := NewWriter(w)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if err := sw.Event("message_delta", map[string]any{"delta": "a"}); !errors.Is(err, flushErr) {
+		t.Fatalf("Event() error = %v, want flush failure", err)
+	}
+	if err := sw.Event("message_delta", map[string]any{"delta": "b"}); !errors.Is(err, flushErr) {
+		t.Fatalf("second Event() error = %v, want sticky flush failure", err)
+	}
+}
+
+func TestWriterOutlivesServerWriteTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		sw, err := NewWriter(w)
+		if err != nil {
+			t.Errorf("NewWriter() error = %v", err)
+			return
+		}
+		_ = sw.Event("first", map[string]any{"n": 1})
+		time.Sleep(300 * time.Millisecond)
+		_ = sw.Event("second", map[string]any{"n": 2})
+	}))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	if got := strings.Join(events, ","); got != "first,second" {
+		t.Fatalf("events = %q, want %q (scan err %v)", got, "first,second", scanner.Err())
+	}
+}
+
+func BenchmarkWriterEvent(b *testing.B) {
+	payload := map[string]any{"turnId": "tu_bench", "delta": "hello world"}
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{name: "every_event", opts: Options{}},
+		{name: "every_16", opts: Options{FlushEvery: 16, FlushInterval: 50 * time.Millisecond}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			rec := newCountingRecorder()
+			sw, err := NewWriterWithOptions(rec, tc.opts)
+			if err != nil {
+				b.Fatalf("NewWriterWithOptions() error = %v", err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if i%4096 == 0 {
+					rec.Body.Reset()
+				}
+				if err := sw.Event("message_delta", payload); err != nil {
+					b.Fatalf("Event() error = %v", err)
+				}
+			}
+			sw.Close()
+			b.ReportMetric(float64(rec.flushes.Load())/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+func TestWriterRenamesEventsOnTheWire(t *testing.T) {
+	rec := newCountingRecorder()
+	sw, err := NewWriterWithOptions(rec, Options{
+		FlushEvery:      10,
+		ImmediateEvents: []string{"turn_completed"},
+		EventNames:      map[string]string{"turn_completed": "turn.completed"},
+	})
+	if err != nil {
+		t.Fatalf("NewWriterWithOptions() error = %v", err)
+	}
+	if err := sw.Event("message_delta", map[string]any{"delta": "x"}); err != nil {
+		t.Fatalf("Event() error = %v", err)
+	}
+	if err := sw.Event("turn_completed", map[string]any{}); err != nil {
+		t.Fatalf("Event() error = %v", err)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "event: message_delta\n") || !strings.Contains(body, "event: turn.completed\n") {
+		t.Fatalf("body = %q, want message_delta unchanged and turn_completed renamed", body)
+	}
+	if strings.Contains(body, "event: turn_completed\n") {
+		t.Fatalf("body = %q, want no canonical turn_completed", body)
+	}
+	if got := rec.flushes.Load(); got != 1 {
+		t.Fatalf("flush count = %d, want 1 (renamed immediate event still flushes)", got)
+	}
+}
@@ -199,4 +199,125 @@ var migrations = []migration{
 			`DROP TABLE IF EXISTS clients;`,
 		},
 	},
+	{
+		version: 13,
+		name:    "turns_add_token_usage",
+		sql: []string{
+			`ALTER TABLE turns ADD COLUMN prompt_tokens INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE turns ADD COLUMN completion_tokens INTEGER NOT NULL DEFAULT 0;`,
+		},
+	},
+	{
+		version: 14,
+		name:    "create_thread_tags",
+		sql: []string{
+			`CREATE TABLE IF NOT EXISTS thread_tags (
+				thread_id TEXT NOT NULL,
+				tag TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				PRIMARY KEY (thread_id, tag),
+				FOREIGN KEY (thread_id) REFERENCES threads(thread_id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_thread_tags_tag ON thread_tags(tag);`,
+		},
+	},
+	{
+		version: 15,
+		name:    "threads_add_agent_updated_index",
+		sql: []string{
+			`CREATE INDEX IF NOT EXISTS idx_threads_agent_updated ON threads(agent_id, updated_at DESC);`,
+		},
+	},
+	{
+		version: 16,
+		name:    "turns_add_prompt_text",
+		sql: []string{
+			`ALTER TABLE turns ADD COLUMN prompt_text TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version: 17,
+		name:    "threads_add_last_activity_at",
+		sql: []string{
+			`ALTER TABLE threads ADD COLUMN last_activity_at TEXT NOT NULL DEFAULT '';`,
+			`UPDATE threads SET last_activity_at = COALESCE(
+				(SELECT MAX(COALESCE(completed_at, created_at)) FROM turns WHERE turns.thread_id = threads.thread_id),
+				updated_at
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_threads_last_activity ON threads(last_activity_at DESC);`,
+		},
+	},
+	{
+		version: 18,
+		name:    "threads_add_turns_since_compact",
+		sql: []string{
+			`ALTER TABLE threads ADD COLUMN turns_since_compact INTEGER NOT NULL DEFAULT 0;`,
+			`UPDATE threads SET turns_since_compact = (
+				SELECT COUNT(*) FROM turns
+				WHERE turns.thread_id = threads.thread_id
+					AND turns.is_internal = 0
+					AND turns.completed_at IS NOT NULL
+					AND turns.created_at > COALESCE(
+						(SELECT MAX(c.created_at) FROM turns c WHERE c.thread_id = threads.thread_id AND c.is_internal = 1),
+						''
+					)
+			);`,
+		},
+	},
+	{
+		version: 19,
+		name:    "turns_add_raw_stop_reason",
+		sql: []string{
+			`ALTER TABLE turns ADD COLUMN raw_stop_reason TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version: 20,
+		name:    "threads_add_options_locked",
+		sql: []string{
+			`ALTER TABLE threads ADD COLUMN options_locked INTEGER NOT NULL DEFAULT 0;`,
+		},
+	},
+	{
+		version: 21,
+		name:    "create_client_usage",
+		sql: []string{
+			`CREATE TABLE IF NOT EXISTS client_usage (
+				client_id TEXT PRIMARY KEY,
+				stored_bytes INTEGER NOT NULL DEFAULT 0,
+				updated_at TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version: 22,
+		name:    "create_client_records",
+		sql: []string{
+			`CREATE TABLE IF NOT EXISTS client_records (
+				client_id TEXT PRIMARY KEY,
+				display_name TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NOT NULL DEFAULT '',
+				metadata_json TEXT NOT NULL DEFAULT '{}',
+				created_at TEXT NOT NULL,
+				last_seen_at TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version: 23,
+		name:    "turns_add_events_compacted",
+		sql: []string{
+			`ALTER TABLE turns ADD COLUMN events_compacted INTEGER NOT NULL DEFAULT 0;`,
+		},
+	},
+	{
+		version: 24,
+		name:    "turns_add_client_stored_bytes",
+		sql: []string{
+			`ALTER TABLE turns ADD COLUMN client_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE turns ADD COLUMN stored_bytes INTEGER NOT NULL DEFAULT 0;`,
+			`CREATE INDEX IF NOT EXISTS idx_turns_client_stored_bytes ON turns(client_id, stored_bytes);`,
+			`DROP TABLE IF EXISTS client_usage;`,
+		},
+	},
 }
@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -15,6 +19,23 @@ import (
 var (
 	// ErrNotFound indicates the requested record does not exist.
 	ErrNotFound = errors.New("storage: not found")
+	// ErrTooLarge indicates a value exceeds the store's configured size limit.
+	ErrTooLarge = errors.New("storage: value too large")
+	// ErrLocked indicates the thread's agent options were locked at creation.
+	ErrLocked = errors.New("storage: thread agent options are locked")
+)
+
+const (
+	// DefaultMaxTitleBytes is the default limit for threads.title.
+	DefaultMaxTitleBytes = 4 << 10
+	// DefaultMaxSummaryBytes is the default limit for threads.summary.
+	DefaultMaxSummaryBytes = 1 << 20
+	// DefaultMigrationLockTimeout is how long New waits for another process
+	// that is migrating the same database file.
+	DefaultMigrationLockTimeout = 30 * time.Second
+
+	migrationLockRetryInterval = 50 * time.Millisecond
+	migrationRetryBackoff      = time.Second
 )
 
 // DefaultAgentConfigCatalogModelID is the synthetic model key used for the
@@ -26,8 +47,38 @@ type Store struct {
 	path string
 	db   *sql.DB
 	now  func() time.Time
+
+	maxTitleBytes        int
+	maxSummaryBytes      int
+	migrationLockTimeout time.Duration
+	migrationTimeout     time.Duration
+	migrationRetries     int
+	migrationBackoff     time.Duration
+	// beforeMigration runs inside each migration's transaction; tests use
+	// it to stall a migration step.
+	beforeMigration func(ctx context.Context, version int) error
+
+	// eventTails caches the newest event per turn so AppendEvent can skip
+	// the lookup query. Entries are only read and written inside a
+	// transaction, which holds the single connection, so the cache always
+	// matches committed rows.
+	eventTailsMu sync.Mutex
+	eventTails   map[string]eventTail
+}
+
+// eventTail is the newest persisted event of one turn.
+type eventTail struct {
+	eventID   int64
+	seq       int
+	eventType string
+	dataJSON  string
+	createdAt string
 }
 
+// maxCachedEventTails bounds the tail cache; turns beyond it fall back to
+// querying the last event on every append.
+const maxCachedEventTails = 4096
+
 // Thread stores one persisted thread row.
 type Thread struct {
 	ThreadID         string
@@ -36,8 +87,19 @@ type Thread struct {
 	Title            string
 	AgentOptionsJSON string
 	Summary          string
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	// Tags is sorted ascending; GetThread, ListThreads, and ListThreadsByTag fill it.
+	Tags      []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// LastActivityAt is bumped when a turn is created or finalized; thread
+	// lists are ordered by it.
+	LastActivityAt time.Time
+	// TurnsSinceCompact counts finalized non-internal turns since the summary
+	// was last updated.
+	TurnsSinceCompact int
+	// OptionsLocked makes UpdateThreadAgentOptions fail with ErrLocked; it
+	// can only be set at creation.
+	OptionsLocked bool
 }
 
 // CreateThreadParams contains input for CreateThread.
@@ -48,6 +110,7 @@ type CreateThreadParams struct {
 	Title            string
 	AgentOptionsJSON string
 	Summary          string
+	OptionsLocked    bool
 }
 
 // AgentConfigCatalog stores one persisted agent/model config-options snapshot.
@@ -65,6 +128,26 @@ type UpsertAgentConfigCatalogParams struct {
 	ConfigOptionsJSON string
 }
 
+// ClientRecord stores optional metadata about one X-Client-ID caller.
+type ClientRecord struct {
+	ClientID    string
+	DisplayName string
+	// UserAgent is captured from the client's first recorded request.
+	UserAgent    string
+	MetadataJSON string
+	CreatedAt    time.Time
+	LastSeenAt   time.Time
+}
+
+// RecordClientParams contains input for RecordClient. Empty DisplayName and
+// MetadataJSON keep the stored values.
+type RecordClientParams struct {
+	ClientID     string
+	DisplayName  string
+	UserAgent    string
+	MetadataJSON string
+}
+
 // AgentSlashCommands stores one persisted agent slash-command snapshot.
 type AgentSlashCommands struct {
 	AgentID      string
@@ -122,8 +205,19 @@ type Turn struct {
 	Status       string
 	StopReason   string
 	ErrorMessage string
-	CreatedAt    time.Time
-	CompletedAt  *time.Time
+	// RawStopReason is the stop reason exactly as the agent reported it. It
+	// is only recorded when raw stop reason persistence is enabled.
+	RawStopReason string
+	// PromptText is the exact injected prompt sent to the agent. It is only
+	// recorded when prompt persistence is enabled and is empty otherwise.
+	// Turn listings leave it empty; use GetTurn or ListTurnPromptsByThread.
+	PromptText string
+	// PromptTokens and CompletionTokens hold provider-reported usage; both
+	// are zero when the provider did not report any.
+	PromptTokens     int64
+	CompletionTokens int64
+	CreatedAt        time.Time
+	CompletedAt      *time.Time
 }
 
 // TurnAttachment stores one persisted uploaded attachment row.
@@ -144,6 +238,11 @@ type CreateTurnParams struct {
 	RequestText string
 	Status      string
 	IsInternal  bool
+	// PromptText optionally records the injected prompt sent to the agent.
+	PromptText string
+	// ClientID optionally records the X-Client-ID that started the turn, so
+	// its stored bytes count toward that client's usage.
+	ClientID string
 }
 
 // CreateTurnAttachmentParams contains input for CreateTurnAttachments.
@@ -158,11 +257,14 @@ type CreateTurnAttachmentParams struct {
 
 // FinalizeTurnParams contains fields used to close a turn.
 type FinalizeTurnParams struct {
-	TurnID       string
-	ResponseText string
-	Status       string
-	StopReason   string
-	ErrorMessage string
+	TurnID           string
+	ResponseText     string
+	Status           string
+	StopReason       string
+	RawStopReason    string
+	ErrorMessage     string
+	PromptTokens     int64
+	CompletionTokens int64
 }
 
 // Event stores one persisted turn event row.
@@ -175,8 +277,70 @@ type Event struct {
 	CreatedAt time.Time
 }
 
+// Option customizes a Store created by New.
+type Option func(*Store)
+
+// WithClock sets the time source used for every persisted timestamp. A nil
+// now keeps the default time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		if now != nil {
+			s.now = now
+		}
+	}
+}
+
+// WithMaxTitleBytes overrides DefaultMaxTitleBytes. Values <= 0 are ignored.
+func WithMaxTitleBytes(limit int) Option {
+	return func(s *Store) {
+		if limit > 0 {
+			s.maxTitleBytes = limit
+		}
+	}
+}
+
+// WithMaxSummaryBytes overrides DefaultMaxSummaryBytes. Values <= 0 are
+// ignored.
+func WithMaxSummaryBytes(limit int) Option {
+	return func(s *Store) {
+		if limit > 0 {
+			s.maxSummaryBytes = limit
+		}
+	}
+}
+
+// WithMigrationLockTimeout overrides DefaultMigrationLockTimeout. Values <= 0
+// are ignored.
+func WithMigrationLockTimeout(timeout time.Duration) Option {
+	return func(s *Store) {
+		if timeout > 0 {
+			s.migrationLockTimeout = timeout
+		}
+	}
+}
+
+// WithMigrationTimeout bounds each attempt of the startup migrations in New.
+// Values <= 0, the default, let migrations run without a deadline.
+func WithMigrationTimeout(timeout time.Duration) Option {
+	return func(s *Store) {
+		if timeout > 0 {
+			s.migrationTimeout = timeout
+		}
+	}
+}
+
+// WithMigrationRetries lets New retry failed startup migrations up to
+// retries more times. Values <= 0, the default, fail on the first error.
+func WithMigrationRetries(retries int) Option {
+	return func(s *Store) {
+		if retries > 0 {
+			s.migrationRetries = retries
+		}
+	}
+}
+
 // New opens the SQLite database and applies idempotent migrations.
-func New(path string) (*Store, error) {
+func New(path string, opts ...Option) (*Store, error) {
 	path = strings.TrimSpace(path)
 	if path == "" {
 		return nil, errors.New("storage: empty database path")
@@ -193,6 +357,16 @@ func New(path string) (*Store, error) {
 		path: path,
 		db:   db,
 		now:  time.Now,
+
+		maxTitleBytes:        DefaultMaxTitleBytes,
+		maxSummaryBytes:      DefaultMaxSummaryBytes,
+		migrationLockTimeout: DefaultMigrationLockTimeout,
+		migrationBackoff:     migrationRetryBackoff,
+
+		eventTails: make(map[string]eventTail),
+	}
+	for _, opt := range opts {
+		opt(store)
 	}
 
 	if err := store.configure(context.Background()); err != nil {
@@ -200,7 +374,7 @@ func New(path string) (*Store, error) {
 		return nil, err
 	}
 
-	if err := store.Migrate(context.Background()); err != nil {
+	if err := store.migrateWithRetry(context.Background()); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
@@ -208,6 +382,105 @@ func New(path string) (*Store, error) {
 	return store, nil
 }
 
+// OpenReadOnly opens an existing database for inspection, such as
+// IntegrityCheck, without creating it, applying migrations or changing its
+// journal mode. Writes through the returned Store fail.
+func OpenReadOnly(path string) (*Store, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, errors.New("storage: empty database path")
+	}
+
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?mode=ro"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("storage: open sqlite read-only: %w", err)
+	}
+
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(context.Background(), `PRAGMA busy_timeout = 5000;`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("storage: open sqlite read-only: %w", err)
+	}
+
+	return &Store{
+		path: path,
+		db:   db,
+		now:  time.Now,
+
+		maxTitleBytes:   DefaultMaxTitleBytes,
+		maxSummaryBytes: DefaultMaxSummaryBytes,
+
+		eventTails: make(map[string]eventTail),
+	}, nil
+}
+
+// migrateWithRetry runs Migrate for New, giving each attempt its own
+// migrationTimeout and retrying up to migrationRetries times. Applied
+// migrations are recorded one by one, so a retry resumes where the failed
+// attempt stopped.
+func (s *Store) migrateWithRetry(ctx context.Context) error {
+	attempts := s.migrationRetries + 1
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.migrationBackoff):
+			}
+		}
+		err = s.migrateOnce(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	if attempts > 1 {
+		return fmt.Errorf("storage: migrations failed after %d attempts: %w", attempts, err)
+	}
+	return err
+}
+
+func (s *Store) migrateOnce(ctx context.Context) error {
+	if s.migrationTimeout <= 0 {
+		return s.Migrate(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, s.migrationTimeout)
+	defer cancel()
+	err := s.Migrate(attemptCtx)
+	if err != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("storage: migrations did not finish within %s: %w", s.migrationTimeout, err)
+	}
+	return err
+}
+
+// checkSize rejects value when it is longer than limit bytes.
+func checkSize(field, value string, limit int) error {
+	if limit > 0 && len(value) > limit {
+		return fmt.Errorf("storage: %s is %d bytes, limit %d: %w", field, len(value), limit, ErrTooLarge)
+	}
+	return nil
+}
+
+// DatedPath returns path with the local calendar day of t inserted before the
+// extension, e.g. "ngent.db" -> "ngent-2026-02-28.db".
+func DatedPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.Format("2006-01-02") + ext
+}
+
+// Path returns the database path the store was opened with.
+func (s *Store) Path() string {
+	if s == nil {
+		return ""
+	}
+	return s.path
+}
+
 // Close closes the underlying database handle.
 func (s *Store) Close() error {
 	if s == nil || s.db == nil {
@@ -216,6 +489,76 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// Ping verifies that the database handle is usable by running SELECT 1.
+func (s *Store) Ping(ctx context.Context) error {
+	if s == nil || s.db == nil {
+		return errors.New("storage: ping: store is not open")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var one int
+	if err := s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("storage: ping: %w", err)
+	}
+	return nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and PRAGMA foreign_key_check and
+// returns one line per problem found. An empty result means the database is
+// healthy; err is only set when the checks themselves could not run.
+func (s *Store) IntegrityCheck(ctx context.Context) ([]string, error) {
+	if s == nil || s.db == nil {
+		return nil, errors.New("storage: integrity check: store is not open")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var problems []string
+	rows, err := s.db.QueryContext(ctx, `PRAGMA integrity_check;`)
+	if err != nil {
+		return nil, fmt.Errorf("storage: integrity check: %w", err)
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("storage: scan integrity check: %w", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, fmt.Errorf("storage: integrity check rows: %w", err)
+	}
+	_ = rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, `PRAGMA foreign_key_check;`)
+	if err != nil {
+		return nil, fmt.Errorf("storage: foreign key check: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			table  string
+			rowID  sql.NullInt64
+			parent string
+			fkID   int
+		)
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return nil, fmt.Errorf("storage: scan foreign key check: %w", err)
+		}
+		problems = append(problems, fmt.Sprintf("foreign key violation: %s rowid %d references missing %s row", table, rowID.Int64, parent))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("storage: foreign key check rows: %w", err)
+	}
+	return problems, nil
+}
+
 // Migrate applies all pending migrations and records versions in schema_migrations.
 func (s *Store) Migrate(ctx context.Context) error {
 	if ctx == nil {
@@ -259,6 +602,96 @@ func (s *Store) UpsertClient(ctx context.Context, clientID string) error {
 	return nil
 }
 
+// RecordClient creates the client record on first sight and afterwards bumps
+// last_seen_at, replacing the display name and metadata when provided.
+func (s *Store) RecordClient(ctx context.Context, params RecordClientParams) error {
+	clientID := strings.TrimSpace(params.ClientID)
+	if clientID == "" {
+		return errors.New("storage: clientID is required")
+	}
+	metadataJSON := strings.TrimSpace(params.MetadataJSON)
+	now := formatTime(s.now())
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO client_records (
+			client_id,
+			display_name,
+			user_agent,
+			metadata_json,
+			created_at,
+			last_seen_at
+		) VALUES (?, ?, ?, CASE WHEN ? = '' THEN '{}' ELSE ? END, ?, ?)
+		ON CONFLICT(client_id) DO UPDATE SET
+			display_name = CASE WHEN excluded.display_name = '' THEN display_name ELSE excluded.display_name END,
+			metadata_json = CASE WHEN ? = '' THEN metadata_json ELSE excluded.metadata_json END,
+			last_seen_at = excluded.last_seen_at;
+	`,
+		clientID,
+		strings.TrimSpace(params.DisplayName),
+		strings.TrimSpace(params.UserAgent),
+		metadataJSON, metadataJSON,
+		now, now,
+		metadataJSON,
+	); err != nil {
+		return fmt.Errorf("storage: record client: %w", err)
+	}
+	return nil
+}
+
+// GetClientRecord returns the stored record of clientID or ErrNotFound.
+func (s *Store) GetClientRecord(ctx context.Context, clientID string) (ClientRecord, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT
+			client_id,
+			display_name,
+			user_agent,
+			metadata_json,
+			created_at,
+			last_seen_at
+		FROM client_records
+		WHERE client_id = ?;
+	`, strings.TrimSpace(clientID))
+
+	var (
+		record       ClientRecord
+		createdAtDB  string
+		lastSeenAtDB string
+	)
+	if err := row.Scan(&record.ClientID, &record.DisplayName, &record.UserAgent, &record.MetadataJSON, &createdAtDB, &lastSeenAtDB); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ClientRecord{}, ErrNotFound
+		}
+		return ClientRecord{}, fmt.Errorf("storage: get client record: %w", err)
+	}
+	var err error
+	if record.CreatedAt, err = parseTime(createdAtDB); err != nil {
+		return ClientRecord{}, fmt.Errorf("storage: parse client_records.created_at: %w", err)
+	}
+	if record.LastSeenAt, err = parseTime(lastSeenAtDB); err != nil {
+		return ClientRecord{}, fmt.Errorf("storage: parse client_records.last_seen_at: %w", err)
+	}
+	return record, nil
+}
+
+// GetClientStoredBytes returns the request plus response text bytes of the
+// finalized turns clientID started that are still stored, 0 when there are
+// none. Deleting threads or turns lowers the total.
+func (s *Store) GetClientStoredBytes(ctx context.Context, clientID string) (int64, error) {
+	clientID = strings.TrimSpace(clientID)
+	if clientID == "" {
+		return 0, nil
+	}
+	var storedBytes int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(stored_bytes), 0)
+		FROM turns
+		WHERE client_id = ?;
+	`, clientID).Scan(&storedBytes)
+	if err != nil {
+		return 0, fmt.Errorf("storage: get client stored bytes: %w", err)
+	}
+	return storedBytes, nil
+}
+
 // CreateThread inserts one thread row.
 func (s *Store) CreateThread(ctx context.Context, params CreateThreadParams) (Thread, error) {
 	if strings.TrimSpace(params.ThreadID) == "" {
@@ -273,6 +706,12 @@ func (s *Store) CreateThread(ctx context.Context, params CreateThreadParams) (Th
 	if strings.TrimSpace(params.AgentOptionsJSON) == "" {
 		params.AgentOptionsJSON = "{}"
 	}
+	if err := checkSize("thread title", params.Title, s.maxTitleBytes); err != nil {
+		return Thread{}, err
+	}
+	if err := checkSize("thread summary", params.Summary, s.maxSummaryBytes); err != nil {
+		return Thread{}, err
+	}
 
 	now := s.now().UTC()
 	nowText := formatTime(now)
@@ -286,8 +725,10 @@ func (s *Store) CreateThread(ctx context.Context, params CreateThreadParams) (Th
 			agent_options_json,
 			summary,
 			created_at,
-			updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+			updated_at,
+			last_activity_at,
+			options_locked
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`,
 		params.ThreadID,
 		params.AgentID,
@@ -297,6 +738,8 @@ func (s *Store) CreateThread(ctx context.Context, params CreateThreadParams) (Th
 		params.Summary,
 		nowText,
 		nowText,
+		nowText,
+		boolToSQLiteInt(params.OptionsLocked),
 	); err != nil {
 		return Thread{}, fmt.Errorf("storage: create thread: %w", err)
 	}
@@ -310,6 +753,8 @@ func (s *Store) CreateThread(ctx context.Context, params CreateThreadParams) (Th
 		Summary:          params.Summary,
 		CreatedAt:        now,
 		UpdatedAt:        now,
+		LastActivityAt:   now,
+		OptionsLocked:    params.OptionsLocked,
 	}, nil
 }
 
@@ -324,15 +769,19 @@ func (s *Store) GetThread(ctx context.Context, threadID string) (Thread, error)
 			agent_options_json,
 			summary,
 			created_at,
-			updated_at
+			updated_at,
+			last_activity_at,
+			turns_since_compact,
+			options_locked
 		FROM threads
 		WHERE thread_id = ?;
 	`, threadID)
 
 	var (
-		thread      Thread
-		createdAtDB string
-		updatedAtDB string
+		thread           Thread
+		createdAtDB      string
+		updatedAtDB      string
+		lastActivityAtDB string
 	)
 	if err := row.Scan(
 		&thread.ThreadID,
@@ -343,6 +792,9 @@ func (s *Store) GetThread(ctx context.Context, threadID string) (Thread, error)
 		&thread.Summary,
 		&createdAtDB,
 		&updatedAtDB,
+		&lastActivityAtDB,
+		&thread.TurnsSinceCompact,
+		&thread.OptionsLocked,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Thread{}, ErrNotFound
@@ -359,8 +811,20 @@ func (s *Store) GetThread(ctx context.Context, threadID string) (Thread, error)
 		return Thread{}, fmt.Errorf("storage: parse thread.updated_at: %w", err)
 	}
 
+	lastActivityAt, err := parseActivityTime(lastActivityAtDB, updatedAt)
+	if err != nil {
+		return Thread{}, fmt.Errorf("storage: parse thread.last_activity_at: %w", err)
+	}
+
 	thread.CreatedAt = createdAt
 	thread.UpdatedAt = updatedAt
+	thread.LastActivityAt = lastActivityAt
+
+	tags, err := s.ListThreadTags(ctx, thread.ThreadID)
+	if err != nil {
+		return Thread{}, err
+	}
+	thread.Tags = tags
 	return thread, nil
 }
 
@@ -408,6 +872,13 @@ func (s *Store) DeleteThread(ctx context.Context, threadID string) error {
 		return fmt.Errorf("storage: delete thread turns: %w", err)
 	}
 
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM thread_tags
+		WHERE thread_id = ?;
+	`, threadID); err != nil {
+		return fmt.Errorf("storage: delete thread tags: %w", err)
+	}
+
 	result, err := tx.ExecContext(ctx, `
 		DELETE FROM threads
 		WHERE thread_id = ?;
@@ -424,23 +895,31 @@ func (s *Store) DeleteThread(ctx context.Context, threadID string) error {
 		return ErrNotFound
 	}
 
+	// Turn ids of the thread are not tracked here; dropping the whole cache
+	// is cheap because it re-seeds on the next append.
+	s.forgetAllEventTails()
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("storage: commit delete thread tx: %w", err)
 	}
 	return nil
 }
 
-// UpdateThreadSummary updates one thread summary and updates updated_at timestamp.
+// UpdateThreadSummary updates one thread summary and updates updated_at
+// timestamp. It resets turns_since_compact.
 func (s *Store) UpdateThreadSummary(ctx context.Context, threadID, summary string) error {
 	if strings.TrimSpace(threadID) == "" {
 		return errors.New("storage: threadID is required")
 	}
+	if err := checkSize("thread summary", summary, s.maxSummaryBytes); err != nil {
+		return err
+	}
 
 	result, err := s.db.ExecContext(ctx, `
 		UPDATE threads
 		SET
 			summary = ?,
-			updated_at = ?
+			updated_at = ?,
+			turns_since_compact = 0
 		WHERE thread_id = ?;
 	`, summary, formatTime(s.now()), threadID)
 	if err != nil {
@@ -462,6 +941,9 @@ func (s *Store) UpdateThreadTitle(ctx context.Context, threadID, title string) e
 	if strings.TrimSpace(threadID) == "" {
 		return errors.New("storage: threadID is required")
 	}
+	if err := checkSize("thread title", title, s.maxTitleBytes); err != nil {
+		return err
+	}
 
 	result, err := s.db.ExecContext(ctx, `
 		UPDATE threads
@@ -484,8 +966,21 @@ func (s *Store) UpdateThreadTitle(ctx context.Context, threadID, title string) e
 	return nil
 }
 
-// UpdateThreadAgentOptions updates one thread agent options and updates updated_at timestamp.
+// UpdateThreadAgentOptions replaces one thread's agent options on behalf of
+// a client. It fails with ErrLocked when the thread was created with
+// OptionsLocked.
 func (s *Store) UpdateThreadAgentOptions(ctx context.Context, threadID, agentOptionsJSON string) error {
+	return s.updateThreadAgentOptions(ctx, threadID, agentOptionsJSON, true)
+}
+
+// UpdateThreadAgentState replaces one thread's agent options for state the
+// server maintains itself, such as the bound session or the last config
+// snapshot. It ignores OptionsLocked.
+func (s *Store) UpdateThreadAgentState(ctx context.Context, threadID, agentOptionsJSON string) error {
+	return s.updateThreadAgentOptions(ctx, threadID, agentOptionsJSON, false)
+}
+
+func (s *Store) updateThreadAgentOptions(ctx context.Context, threadID, agentOptionsJSON string, honorLock bool) error {
 	if strings.TrimSpace(threadID) == "" {
 		return errors.New("storage: threadID is required")
 	}
@@ -498,8 +993,8 @@ func (s *Store) UpdateThreadAgentOptions(ctx context.Context, threadID, agentOpt
 		SET
 			agent_options_json = ?,
 			updated_at = ?
-		WHERE thread_id = ?;
-	`, agentOptionsJSON, formatTime(s.now()), threadID)
+		WHERE thread_id = ? AND (? = 0 OR options_locked = 0);
+	`, agentOptionsJSON, formatTime(s.now()), threadID, boolToSQLiteInt(honorLock))
 	if err != nil {
 		return fmt.Errorf("storage: update thread agent options: %w", err)
 	}
@@ -508,10 +1003,17 @@ func (s *Store) UpdateThreadAgentOptions(ctx context.Context, threadID, agentOpt
 	if err != nil {
 		return fmt.Errorf("storage: update thread agent options rows affected: %w", err)
 	}
-	if affected == 0 {
-		return ErrNotFound
+	if affected > 0 {
+		return nil
 	}
-	return nil
+	if honorLock {
+		var locked bool
+		err := s.db.QueryRowContext(ctx, `SELECT options_locked FROM threads WHERE thread_id = ?;`, threadID).Scan(&locked)
+		if err == nil && locked {
+			return ErrLocked
+		}
+	}
+	return ErrNotFound
 }
 
 // UpsertAgentConfigCatalog stores one agent/model config-options snapshot.
@@ -892,9 +1394,13 @@ func (s *Store) UpsertSessionConfigCache(
 	return nil
 }
 
-// ListThreads returns all persisted threads across clients.
-func (s *Store) ListThreads(ctx context.Context) ([]Thread, error) {
-	rows, err := s.db.QueryContext(ctx, `
+// ListThreads returns persisted threads across clients, most recently active
+// first. limit <= 0 returns all threads.
+func (s *Store) ListThreads(ctx context.Context, limit int) ([]Thread, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.queryThreads(ctx, `
 		SELECT
 			thread_id,
 			agent_id,
@@ -903,10 +1409,77 @@ func (s *Store) ListThreads(ctx context.Context) ([]Thread, error) {
 			agent_options_json,
 			summary,
 			created_at,
-			updated_at
+			updated_at,
+			last_activity_at,
+			turns_since_compact,
+			options_locked
 		FROM threads
-		ORDER BY created_at DESC;
-	`)
+		ORDER BY last_activity_at DESC, created_at DESC
+		LIMIT ?;
+	`, limit)
+}
+
+// ListThreadsByTag returns threads carrying tag ordered by last_activity_at
+// desc, newest created first on ties.
+// limit <= 0 returns all matching threads.
+func (s *Store) ListThreadsByTag(ctx context.Context, tag string, limit int) ([]Thread, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.queryThreads(ctx, `
+		SELECT
+			t.thread_id,
+			t.agent_id,
+			t.cwd,
+			t.title,
+			t.agent_options_json,
+			t.summary,
+			t.created_at,
+			t.updated_at,
+			t.last_activity_at,
+			t.turns_since_compact,
+			t.options_locked
+		FROM threads t
+		JOIN thread_tags tt ON tt.thread_id = t.thread_id
+		WHERE tt.tag = ?
+		ORDER BY t.last_activity_at DESC, t.created_at DESC
+		LIMIT ?;
+	`, tag, limit)
+}
+
+// ListThreadsByAgent returns one page of threads using agentID ordered by
+// updated_at desc. offset skips that many threads; limit <= 0 returns all
+// remaining threads.
+func (s *Store) ListThreadsByAgent(ctx context.Context, agentID string, limit, offset int) ([]Thread, error) {
+	agentID = strings.TrimSpace(agentID)
+	if agentID == "" {
+		return nil, errors.New("storage: agentID is required")
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	return s.queryThreads(ctx, `
+		SELECT
+			thread_id,
+			agent_id,
+			cwd,
+			title,
+			agent_options_json,
+			summary,
+			created_at,
+			updated_at,
+			last_activity_at,
+			turns_since_compact,
+			options_locked
+		FROM threads
+		WHERE agent_id = ?
+		ORDER BY updated_at DESC, thread_id DESC
+		LIMIT ? OFFSET ?;
+	`, agentID, limit, max(offset, 0))
+}
+
+func (s *Store) queryThreads(ctx context.Context, query string, args ...any) ([]Thread, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("storage: list threads: %w", err)
 	}
@@ -915,9 +1488,10 @@ func (s *Store) ListThreads(ctx context.Context) ([]Thread, error) {
 	threads := make([]Thread, 0)
 	for rows.Next() {
 		var (
-			thread      Thread
-			createdAtDB string
-			updatedAtDB string
+			thread           Thread
+			createdAtDB      string
+			updatedAtDB      string
+			lastActivityAtDB string
 		)
 		if err := rows.Scan(
 			&thread.ThreadID,
@@ -928,6 +1502,9 @@ func (s *Store) ListThreads(ctx context.Context) ([]Thread, error) {
 			&thread.Summary,
 			&createdAtDB,
 			&updatedAtDB,
+			&lastActivityAtDB,
+			&thread.TurnsSinceCompact,
+			&thread.OptionsLocked,
 		); err != nil {
 			return nil, fmt.Errorf("storage: scan thread: %w", err)
 		}
@@ -941,34 +1518,169 @@ func (s *Store) ListThreads(ctx context.Context) ([]Thread, error) {
 			return nil, fmt.Errorf("storage: parse thread.updated_at: %w", err)
 		}
 
+		lastActivityAt, err := parseActivityTime(lastActivityAtDB, updatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("storage: parse thread.last_activity_at: %w", err)
+		}
+
 		thread.CreatedAt = createdAt
 		thread.UpdatedAt = updatedAt
+		thread.LastActivityAt = lastActivityAt
 		threads = append(threads, thread)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("storage: list threads rows: %w", err)
 	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("storage: close thread rows: %w", err)
+	}
 
+	if err := s.attachThreadTags(ctx, threads); err != nil {
+		return nil, err
+	}
 	return threads, nil
 }
 
-// CreateTurn inserts a new turn row.
-func (s *Store) CreateTurn(ctx context.Context, params CreateTurnParams) (Turn, error) {
-	if strings.TrimSpace(params.TurnID) == "" {
-		return Turn{}, errors.New("storage: turnID is required")
+// AddThreadTag attaches one tag to a thread. Adding an existing tag is a
+// no-op. Returns ErrNotFound if the thread does not exist.
+func (s *Store) AddThreadTag(ctx context.Context, threadID, tag string) error {
+	threadID = strings.TrimSpace(threadID)
+	if threadID == "" {
+		return errors.New("storage: threadID is required")
 	}
-	if strings.TrimSpace(params.ThreadID) == "" {
-		return Turn{}, errors.New("storage: threadID is required")
+	if strings.TrimSpace(tag) == "" {
+		return errors.New("storage: tag is required")
 	}
-	if strings.TrimSpace(params.Status) == "" {
-		params.Status = "running"
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO thread_tags (thread_id, tag, created_at)
+		SELECT thread_id, ?, ?
+		FROM threads
+		WHERE thread_id = ?;
+	`, tag, formatTime(s.now().UTC()), threadID)
+	if err != nil {
+		return fmt.Errorf("storage: add thread tag: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("storage: add thread tag rows affected: %w", err)
+	}
+	if affected == 0 {
+		if _, err := s.GetThread(ctx, threadID); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	now := s.now().UTC()
+// RemoveThreadTag detaches one tag from a thread. Returns ErrNotFound if the
+// thread does not carry the tag.
+func (s *Store) RemoveThreadTag(ctx context.Context, threadID, tag string) error {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM thread_tags
+		WHERE thread_id = ? AND tag = ?;
+	`, threadID, tag)
+	if err != nil {
+		return fmt.Errorf("storage: remove thread tag: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("storage: remove thread tag rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListThreadTags returns one thread's tags sorted ascending.
+func (s *Store) ListThreadTags(ctx context.Context, threadID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT tag
+		FROM thread_tags
+		WHERE thread_id = ?
+		ORDER BY tag ASC;
+	`, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("storage: list thread tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("storage: scan thread tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("storage: list thread tags rows: %w", err)
+	}
+	return tags, nil
+}
+
+func (s *Store) attachThreadTags(ctx context.Context, threads []Thread) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT thread_id, tag
+		FROM thread_tags
+		ORDER BY thread_id ASC, tag ASC;
+	`)
+	if err != nil {
+		return fmt.Errorf("storage: list all thread tags: %w", err)
+	}
+	defer rows.Close()
+
+	byThread := make(map[string][]string)
+	for rows.Next() {
+		var threadID, tag string
+		if err := rows.Scan(&threadID, &tag); err != nil {
+			return fmt.Errorf("storage: scan thread tag: %w", err)
+		}
+		byThread[threadID] = append(byThread[threadID], tag)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("storage: list all thread tags rows: %w", err)
+	}
+
+	for i := range threads {
+		tags := byThread[threads[i].ThreadID]
+		if tags == nil {
+			tags = []string{}
+		}
+		threads[i].Tags = tags
+	}
+	return nil
+}
+
+// CreateTurn inserts a new turn row.
+func (s *Store) CreateTurn(ctx context.Context, params CreateTurnParams) (Turn, error) {
+	if strings.TrimSpace(params.TurnID) == "" {
+		return Turn{}, errors.New("storage: turnID is required")
+	}
+	if strings.TrimSpace(params.ThreadID) == "" {
+		return Turn{}, errors.New("storage: threadID is required")
+	}
+	if strings.TrimSpace(params.Status) == "" {
+		params.Status = "running"
+	}
+
+	now := s.now().UTC()
 	nowText := formatTime(now)
 
-	if _, err := s.db.ExecContext(ctx, `
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Turn{}, fmt.Errorf("storage: begin create turn tx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `
 		INSERT INTO turns (
 			turn_id,
 			thread_id,
@@ -978,9 +1690,11 @@ func (s *Store) CreateTurn(ctx context.Context, params CreateTurnParams) (Turn,
 			status,
 			stop_reason,
 			error_message,
+			prompt_text,
+			client_id,
 			created_at,
 			completed_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL);
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL);
 	`,
 		params.TurnID,
 		params.ThreadID,
@@ -990,10 +1704,18 @@ func (s *Store) CreateTurn(ctx context.Context, params CreateTurnParams) (Turn,
 		params.Status,
 		"",
 		"",
+		params.PromptText,
+		strings.TrimSpace(params.ClientID),
 		nowText,
 	); err != nil {
 		return Turn{}, fmt.Errorf("storage: create turn: %w", err)
 	}
+	if err := touchThreadActivity(ctx, tx, params.ThreadID, nowText); err != nil {
+		return Turn{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Turn{}, fmt.Errorf("storage: commit create turn tx: %w", err)
+	}
 
 	return Turn{
 		TurnID:       params.TurnID,
@@ -1004,6 +1726,7 @@ func (s *Store) CreateTurn(ctx context.Context, params CreateTurnParams) (Turn,
 		Status:       params.Status,
 		StopReason:   "",
 		ErrorMessage: "",
+		PromptText:   params.PromptText,
 		CreatedAt:    now,
 		CompletedAt:  nil,
 	}, nil
@@ -1078,7 +1801,11 @@ func (s *Store) GetTurn(ctx context.Context, turnID string) (Turn, error) {
 			is_internal,
 			status,
 			stop_reason,
+			raw_stop_reason,
 			error_message,
+			prompt_text,
+			prompt_tokens,
+			completion_tokens,
 			created_at,
 			completed_at
 		FROM turns
@@ -1099,7 +1826,11 @@ func (s *Store) GetTurn(ctx context.Context, turnID string) (Turn, error) {
 		&isInternalRaw,
 		&turn.Status,
 		&turn.StopReason,
+		&turn.RawStopReason,
 		&turn.ErrorMessage,
+		&turn.PromptText,
+		&turn.PromptTokens,
+		&turn.CompletionTokens,
 		&createdAtDB,
 		&completedAtRaw,
 	); err != nil {
@@ -1168,24 +1899,91 @@ func (s *Store) GetTurnAttachment(ctx context.Context, attachmentID string) (Tur
 	return attachment, nil
 }
 
+const turnSelectColumns = `
+	turn_id,
+	thread_id,
+	request_text,
+	response_text,
+	is_internal,
+	status,
+	stop_reason,
+	raw_stop_reason,
+	error_message,
+	prompt_tokens,
+	completion_tokens,
+	created_at,
+	completed_at`
+
 // ListTurnsByThread returns all turns for one thread.
 func (s *Store) ListTurnsByThread(ctx context.Context, threadID string) ([]Turn, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT
-			turn_id,
-			thread_id,
-			request_text,
-			response_text,
-			is_internal,
-			status,
-			stop_reason,
-			error_message,
-			created_at,
-			completed_at
+	return s.queryTurns(ctx, `
+		SELECT`+turnSelectColumns+`
 		FROM turns
 		WHERE thread_id = ?
 		ORDER BY created_at ASC;
 	`, threadID)
+}
+
+// ListRecentTurnsByThread returns the newest limit turns of one thread in
+// chronological order, skipping internal turns unless includeInternal is
+// set. Unlike ListTurnsByThread it reads only the rows it returns.
+func (s *Store) ListRecentTurnsByThread(ctx context.Context, threadID string, limit int, includeInternal bool) ([]Turn, error) {
+	if limit <= 0 {
+		return []Turn{}, nil
+	}
+	turns, err := s.queryTurns(ctx, `
+		SELECT`+turnSelectColumns+`
+		FROM turns
+		WHERE thread_id = ? AND (? OR is_internal = 0)
+		ORDER BY created_at DESC
+		LIMIT ?;
+	`, threadID, boolToSQLiteInt(includeInternal), limit)
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(turns)
+	return turns, nil
+}
+
+// CountTurnsByThread counts the turns of one thread, skipping internal turns
+// unless includeInternal is set.
+func (s *Store) CountTurnsByThread(ctx context.Context, threadID string, includeInternal bool) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM turns
+		WHERE thread_id = ? AND (? OR is_internal = 0);
+	`, threadID, boolToSQLiteInt(includeInternal)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("storage: count turns: %w", err)
+	}
+	return count, nil
+}
+
+// CountThreads counts all persisted threads.
+func (s *Store) CountThreads(ctx context.Context) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM threads;`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("storage: count threads: %w", err)
+	}
+	return count, nil
+}
+
+// CountTurns counts the turns of all threads, skipping internal turns unless
+// includeInternal is set.
+func (s *Store) CountTurns(ctx context.Context, includeInternal bool) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM turns
+		WHERE ? OR is_internal = 0;
+	`, boolToSQLiteInt(includeInternal)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("storage: count turns: %w", err)
+	}
+	return count, nil
+}
+
+func (s *Store) queryTurns(ctx context.Context, query string, args ...any) ([]Turn, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("storage: list turns: %w", err)
 	}
@@ -1207,7 +2005,10 @@ func (s *Store) ListTurnsByThread(ctx context.Context, threadID string) ([]Turn,
 			&isInternalRaw,
 			&turn.Status,
 			&turn.StopReason,
+			&turn.RawStopReason,
 			&turn.ErrorMessage,
+			&turn.PromptTokens,
+			&turn.CompletionTokens,
 			&createdAtDB,
 			&completedAtRaw,
 		); err != nil {
@@ -1237,6 +2038,33 @@ func (s *Store) ListTurnsByThread(ctx context.Context, threadID string) ([]Turn,
 	return turns, nil
 }
 
+// ListTurnPromptsByThread returns the recorded prompt_text of one thread's
+// turns keyed by turn id. Turns without a recorded prompt are omitted.
+func (s *Store) ListTurnPromptsByThread(ctx context.Context, threadID string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT turn_id, prompt_text
+		FROM turns
+		WHERE thread_id = ? AND prompt_text <> '';
+	`, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("storage: list turn prompts: %w", err)
+	}
+	defer rows.Close()
+
+	prompts := make(map[string]string)
+	for rows.Next() {
+		var turnID, prompt string
+		if err := rows.Scan(&turnID, &prompt); err != nil {
+			return nil, fmt.Errorf("storage: scan turn prompt: %w", err)
+		}
+		prompts[turnID] = prompt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("storage: list turn prompts rows: %w", err)
+	}
+	return prompts, nil
+}
+
 // ListEventsByTurn returns all events for one turn ordered by sequence.
 func (s *Store) ListEventsByTurn(ctx context.Context, turnID string) ([]Event, error) {
 	rows, err := s.db.QueryContext(ctx, `
@@ -1306,26 +2134,13 @@ func (s *Store) AppendEvent(ctx context.Context, turnID, eventType, dataJSON str
 		_ = tx.Rollback()
 	}()
 
-	var (
-		lastEventID       int64
-		lastSeq           int
-		lastType          string
-		lastDataJSON      string
-		lastCreatedAtText string
-	)
-	lastEventErr := tx.QueryRowContext(ctx, `
-		SELECT event_id, seq, type, data_json, created_at
-		FROM events
-		WHERE turn_id = ?
-		ORDER BY seq DESC
-		LIMIT 1;
-	`, turnID).Scan(&lastEventID, &lastSeq, &lastType, &lastDataJSON, &lastCreatedAtText)
-	if lastEventErr != nil && !errors.Is(lastEventErr, sql.ErrNoRows) {
-		return Event{}, fmt.Errorf("storage: read last event: %w", lastEventErr)
+	last, hasLast, err := s.lastEventTail(ctx, tx, turnID)
+	if err != nil {
+		return Event{}, err
 	}
 
-	if lastEventErr == nil && shouldMergeDeltaEvent(lastType, eventType) {
-		mergedDataJSON, merged, mergeErr := mergeDeltaEventJSON(turnID, lastDataJSON, dataJSON)
+	if hasLast && shouldMergeDeltaEvent(last.eventType, eventType) {
+		mergedDataJSON, merged, mergeErr := mergeDeltaEventJSON(turnID, last.dataJSON, dataJSON)
 		if mergeErr != nil {
 			return Event{}, fmt.Errorf("storage: merge delta event: %w", mergeErr)
 		}
@@ -1334,28 +2149,32 @@ func (s *Store) AppendEvent(ctx context.Context, turnID, eventType, dataJSON str
 				UPDATE events
 				SET data_json = ?
 				WHERE event_id = ?;
-			`, mergedDataJSON, lastEventID); err != nil {
+			`, mergedDataJSON, last.eventID); err != nil {
+				s.forgetEventTail(turnID)
 				return Event{}, fmt.Errorf("storage: update merged event: %w", err)
 			}
+			last.dataJSON = mergedDataJSON
+			s.rememberEventTail(turnID, last)
 			if err := tx.Commit(); err != nil {
+				s.forgetEventTail(turnID)
 				return Event{}, fmt.Errorf("storage: commit merged event tx: %w", err)
 			}
-			createdAt, err := parseTime(lastCreatedAtText)
+			createdAt, err := parseTime(last.createdAt)
 			if err != nil {
 				return Event{}, fmt.Errorf("storage: parse merged event.created_at: %w", err)
 			}
 			return Event{
-				EventID:   lastEventID,
+				EventID:   last.eventID,
 				TurnID:    turnID,
-				Seq:       lastSeq,
-				Type:      lastType,
+				Seq:       last.seq,
+				Type:      last.eventType,
 				DataJSON:  mergedDataJSON,
 				CreatedAt: createdAt,
 			}, nil
 		}
 	}
 
-	nextSeq := lastSeq + 1
+	nextSeq := last.seq + 1
 	now := s.now().UTC()
 	nowText := formatTime(now)
 
@@ -1364,15 +2183,27 @@ func (s *Store) AppendEvent(ctx context.Context, turnID, eventType, dataJSON str
 		VALUES (?, ?, ?, ?, ?);
 	`, turnID, nextSeq, eventType, dataJSON, nowText)
 	if err != nil {
+		// The unique (turn_id, seq) index rejected a stale cached seq; the
+		// next append re-reads the tail from storage.
+		s.forgetEventTail(turnID)
 		return Event{}, fmt.Errorf("storage: append event: %w", err)
 	}
 
 	eventID, err := result.LastInsertId()
 	if err != nil {
+		s.forgetEventTail(turnID)
 		return Event{}, fmt.Errorf("storage: read event id: %w", err)
 	}
 
+	s.rememberEventTail(turnID, eventTail{
+		eventID:   eventID,
+		seq:       nextSeq,
+		eventType: eventType,
+		dataJSON:  dataJSON,
+		createdAt: nowText,
+	})
 	if err := tx.Commit(); err != nil {
+		s.forgetEventTail(turnID)
 		return Event{}, fmt.Errorf("storage: commit append event tx: %w", err)
 	}
 
@@ -1386,6 +2217,53 @@ func (s *Store) AppendEvent(ctx context.Context, turnID, eventType, dataJSON str
 	}, nil
 }
 
+// lastEventTail returns the newest event of turnID, from the cache when
+// possible and otherwise from storage (seeding the cache).
+func (s *Store) lastEventTail(ctx context.Context, tx *sql.Tx, turnID string) (eventTail, bool, error) {
+	s.eventTailsMu.Lock()
+	tail, ok := s.eventTails[turnID]
+	s.eventTailsMu.Unlock()
+	if ok {
+		return tail, true, nil
+	}
+
+	err := tx.QueryRowContext(ctx, `
+		SELECT event_id, seq, type, data_json, created_at
+		FROM events
+		WHERE turn_id = ?
+		ORDER BY seq DESC
+		LIMIT 1;
+	`, turnID).Scan(&tail.eventID, &tail.seq, &tail.eventType, &tail.dataJSON, &tail.createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return eventTail{}, false, nil
+	}
+	if err != nil {
+		return eventTail{}, false, fmt.Errorf("storage: read last event: %w", err)
+	}
+	return tail, true, nil
+}
+
+func (s *Store) rememberEventTail(turnID string, tail eventTail) {
+	s.eventTailsMu.Lock()
+	defer s.eventTailsMu.Unlock()
+	if _, ok := s.eventTails[turnID]; !ok && len(s.eventTails) >= maxCachedEventTails {
+		return
+	}
+	s.eventTails[turnID] = tail
+}
+
+func (s *Store) forgetEventTail(turnID string) {
+	s.eventTailsMu.Lock()
+	delete(s.eventTails, turnID)
+	s.eventTailsMu.Unlock()
+}
+
+func (s *Store) forgetAllEventTails() {
+	s.eventTailsMu.Lock()
+	clear(s.eventTails)
+	s.eventTailsMu.Unlock()
+}
+
 func shouldMergeDeltaEvent(lastType, nextType string) bool {
 	if lastType != nextType {
 		return false
@@ -1416,6 +2294,16 @@ func mergeDeltaEventJSON(turnID, currentDataJSON, nextDataJSON string) (string,
 	if !sameTurnIDForDeltaPayload(turnID, currentPayload) || !sameTurnIDForDeltaPayload(turnID, nextPayload) {
 		return "", false, nil
 	}
+	// Deltas carrying a timing offset keep their own rows; merging would
+	// lose every offset but the first.
+	if hasDeltaOffset(currentPayload) || hasDeltaOffset(nextPayload) {
+		return "", false, nil
+	}
+	// The merged row keeps the first payload's metadata, so only deltas
+	// with the same contentType and lang may share it.
+	if !sameDeltaMetadata(currentPayload, nextPayload) {
+		return "", false, nil
+	}
 
 	currentPayload["delta"] = currentDelta + nextDelta
 	mergedJSON, err := json.Marshal(currentPayload)
@@ -1425,6 +2313,22 @@ func mergeDeltaEventJSON(turnID, currentDataJSON, nextDataJSON string) (string,
 	return string(mergedJSON), true, nil
 }
 
+func hasDeltaOffset(payload map[string]any) bool {
+	_, ok := payload["offsetMs"]
+	return ok
+}
+
+func sameDeltaMetadata(current, next map[string]any) bool {
+	for _, key := range []string{"contentType", "lang"} {
+		currentValue, currentOK := current[key].(string)
+		nextValue, nextOK := next[key].(string)
+		if currentOK != nextOK || currentValue != nextValue {
+			return false
+		}
+	}
+	return true
+}
+
 func sameTurnIDForDeltaPayload(turnID string, payload map[string]any) bool {
 	value, ok := payload["turnId"]
 	if !ok {
@@ -1437,6 +2341,165 @@ func sameTurnIDForDeltaPayload(turnID string, payload map[string]any) bool {
 	return strings.TrimSpace(valueText) == strings.TrimSpace(turnID)
 }
 
+// CompactTurnEvents merges each run of adjacent message_delta events of up
+// to limit turns completed before completedBefore into one message_delta
+// holding the run's text. The merged event keeps the seq of the run's first
+// delta and all other events are left untouched, so event order is kept and
+// seq may have gaps. Deltas split by another event, or that cannot be merged
+// (timing offsets, differing contentType/lang), stay separate. Every selected
+// turn is marked as compacted so later calls move past it. It returns how
+// many turns had events merged.
+func (s *Store) CompactTurnEvents(ctx context.Context, completedBefore time.Time, limit int) (int, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	cutoff := completedBefore.UTC()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT turns.turn_id, turns.completed_at
+		FROM turns
+		WHERE turns.completed_at IS NOT NULL
+			AND turns.completed_at <= ?
+			AND turns.events_compacted = 0
+		ORDER BY turns.completed_at ASC
+		LIMIT ?;
+	`, formatTime(cutoff), limit)
+	if err != nil {
+		return 0, fmt.Errorf("storage: list compactable turns: %w", err)
+	}
+	turnIDs := make([]string, 0)
+	for rows.Next() {
+		var turnID, completedAtText string
+		if err := rows.Scan(&turnID, &completedAtText); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("storage: scan compactable turn: %w", err)
+		}
+		// RFC3339Nano text only sorts to the second; re-check precisely.
+		completedAt, err := parseTime(completedAtText)
+		if err != nil || completedAt.After(cutoff) {
+			continue
+		}
+		turnIDs = append(turnIDs, turnID)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return 0, fmt.Errorf("storage: compactable turns rows: %w", err)
+	}
+	_ = rows.Close()
+
+	compacted := 0
+	for _, turnID := range turnIDs {
+		ok, err := s.compactTurnDeltaEvents(ctx, turnID)
+		if err != nil {
+			return compacted, err
+		}
+		if ok {
+			compacted++
+		}
+	}
+	return compacted, nil
+}
+
+// deltaRun is a run of adjacent message_delta events being merged.
+type deltaRun struct {
+	eventIDs   []int64
+	mergedJSON string
+}
+
+func (s *Store) compactTurnDeltaEvents(ctx context.Context, turnID string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("storage: begin compact events tx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT event_id, type, data_json
+		FROM events
+		WHERE turn_id = ?
+		ORDER BY seq ASC;
+	`, turnID)
+	if err != nil {
+		return false, fmt.Errorf("storage: list turn events: %w", err)
+	}
+	var (
+		runs    []deltaRun
+		current deltaRun
+	)
+	endRun := func() {
+		if len(current.eventIDs) > 1 {
+			runs = append(runs, current)
+		}
+		current = deltaRun{}
+	}
+	for rows.Next() {
+		var (
+			eventID   int64
+			eventType string
+			dataJSON  string
+		)
+		if err := rows.Scan(&eventID, &eventType, &dataJSON); err != nil {
+			_ = rows.Close()
+			return false, fmt.Errorf("storage: scan turn event: %w", err)
+		}
+		if eventType != "message_delta" {
+			endRun()
+			continue
+		}
+		if len(current.eventIDs) > 0 {
+			next, merged, err := mergeDeltaEventJSON(turnID, current.mergedJSON, dataJSON)
+			if err != nil {
+				_ = rows.Close()
+				return false, fmt.Errorf("storage: merge delta event: %w", err)
+			}
+			if merged {
+				current.mergedJSON = next
+				current.eventIDs = append(current.eventIDs, eventID)
+				continue
+			}
+			endRun()
+		}
+		current = deltaRun{eventIDs: []int64{eventID}, mergedJSON: dataJSON}
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return false, fmt.Errorf("storage: turn events rows: %w", err)
+	}
+	_ = rows.Close()
+	endRun()
+
+	for _, run := range runs {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE events
+			SET data_json = ?
+			WHERE event_id = ?;
+		`, run.mergedJSON, run.eventIDs[0]); err != nil {
+			return false, fmt.Errorf("storage: update compacted event: %w", err)
+		}
+		for _, eventID := range run.eventIDs[1:] {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE event_id = ?;`, eventID); err != nil {
+				return false, fmt.Errorf("storage: delete compacted event: %w", err)
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE turns
+		SET events_compacted = 1
+		WHERE turn_id = ?;
+	`, turnID); err != nil {
+		return false, fmt.Errorf("storage: mark turn compacted: %w", err)
+	}
+	if len(runs) > 0 {
+		s.forgetEventTail(turnID)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("storage: commit compact events tx: %w", err)
+	}
+	return len(runs) > 0, nil
+}
+
 // FinalizeTurn updates terminal turn fields and sets completed_at.
 func (s *Store) FinalizeTurn(ctx context.Context, params FinalizeTurnParams) error {
 	if strings.TrimSpace(params.TurnID) == "" {
@@ -1446,21 +2509,38 @@ func (s *Store) FinalizeTurn(ctx context.Context, params FinalizeTurnParams) err
 		return errors.New("storage: status is required")
 	}
 
-	result, err := s.db.ExecContext(ctx, `
+	nowText := formatTime(s.now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("storage: begin finalize turn tx: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.ExecContext(ctx, `
 		UPDATE turns
 		SET
 			response_text = ?,
 			status = ?,
 			stop_reason = ?,
+			raw_stop_reason = ?,
 			error_message = ?,
+			prompt_tokens = ?,
+			completion_tokens = ?,
+			stored_bytes = length(CAST(request_text AS BLOB)) + ?,
 			completed_at = ?
 		WHERE turn_id = ?;
 	`,
 		params.ResponseText,
 		params.Status,
 		params.StopReason,
+		params.RawStopReason,
 		params.ErrorMessage,
-		formatTime(s.now()),
+		params.PromptTokens,
+		params.CompletionTokens,
+		len(params.ResponseText),
+		nowText,
 		params.TurnID,
 	)
 	if err != nil {
@@ -1475,6 +2555,42 @@ func (s *Store) FinalizeTurn(ctx context.Context, params FinalizeTurnParams) err
 		return ErrNotFound
 	}
 
+	var (
+		threadID   string
+		isInternal int
+	)
+	if err := tx.QueryRowContext(ctx, `SELECT thread_id, is_internal FROM turns WHERE turn_id = ?;`, params.TurnID).Scan(&threadID, &isInternal); err != nil {
+		return fmt.Errorf("storage: finalize turn thread lookup: %w", err)
+	}
+	if err := touchThreadActivity(ctx, tx, threadID, nowText); err != nil {
+		return err
+	}
+	if isInternal == 0 {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE threads
+			SET turns_since_compact = turns_since_compact + 1
+			WHERE thread_id = ?;
+		`, threadID); err != nil {
+			return fmt.Errorf("storage: bump thread turns_since_compact: %w", err)
+		}
+	}
+	// Finished turns rarely get more events; a late append re-seeds.
+	s.forgetEventTail(params.TurnID)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("storage: commit finalize turn tx: %w", err)
+	}
+	return nil
+}
+
+// touchThreadActivity bumps threads.last_activity_at inside tx.
+func touchThreadActivity(ctx context.Context, tx *sql.Tx, threadID, nowText string) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE threads
+		SET last_activity_at = ?
+		WHERE thread_id = ?;
+	`, nowText, threadID); err != nil {
+		return fmt.Errorf("storage: update thread activity: %w", err)
+	}
 	return nil
 }
 
@@ -1491,6 +2607,40 @@ func (s *Store) configure(ctx context.Context) error {
 	return nil
 }
 
+// SchemaVersion returns the highest applied migration version, or 0 when no
+// migration has been recorded.
+func (s *Store) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0)
+		FROM schema_migrations;
+	`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("storage: query schema version: %w", err)
+	}
+	return version, nil
+}
+
+// AppliedMigrationCount returns how many migrations schema_migrations records.
+func (s *Store) AppliedMigrationCount(ctx context.Context) (int, error) {
+	var count int
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM schema_migrations;
+	`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("storage: count schema migrations: %w", err)
+	}
+	return count, nil
+}
+
+// LatestSchemaVersion returns the highest migration version this build ships.
+func LatestSchemaVersion() int {
+	latest := 0
+	for _, m := range migrations {
+		latest = max(latest, m.version)
+	}
+	return latest
+}
+
 func (s *Store) migrationApplied(ctx context.Context, version int) (bool, error) {
 	var exists int
 	err := s.db.QueryRowContext(ctx, `
@@ -1507,43 +2657,98 @@ func (s *Store) migrationApplied(ctx context.Context, version int) (bool, error)
 	return true, nil
 }
 
+// applyMigration applies one migration under a write lock taken with BEGIN
+// IMMEDIATE, so processes sharing the database file migrate one at a time.
+// A migration another process applied while this one waited is skipped.
 func (s *Store) applyMigration(ctx context.Context, m migration) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("storage: acquire connection for migration %d: %w", m.version, err)
+	}
+	defer conn.Close()
+
 	if m.disableForeignKeys {
-		if _, err := s.db.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
 			return fmt.Errorf("storage: disable foreign_keys for migration %d: %w", m.version, err)
 		}
 		defer func() {
-			_, _ = s.db.ExecContext(context.Background(), `PRAGMA foreign_keys = ON;`)
+			_, _ = conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON;`)
 		}()
 	}
 
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("storage: begin migration %d: %w", m.version, err)
+	if err := s.beginImmediate(ctx, conn); err != nil {
+		return fmt.Errorf("storage: lock for migration %d: %w", m.version, err)
 	}
+	committed := false
 	defer func() {
-		_ = tx.Rollback()
+		if !committed {
+			_, _ = conn.ExecContext(context.Background(), `ROLLBACK;`)
+		}
 	}()
 
+	var applied int
+	if err := conn.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM schema_migrations
+		WHERE version = ?;
+	`, m.version).Scan(&applied); err != nil {
+		return fmt.Errorf("storage: query schema_migrations: %w", err)
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	if s.beforeMigration != nil {
+		if err := s.beforeMigration(ctx, m.version); err != nil {
+			return fmt.Errorf("storage: migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
 	for _, stmt := range m.sql {
-		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
 			return fmt.Errorf("storage: migration %d (%s): %w", m.version, m.name, err)
 		}
 	}
 
-	if _, err := tx.ExecContext(ctx, `
+	if _, err := conn.ExecContext(ctx, `
 		INSERT INTO schema_migrations (version, name, applied_at)
 		VALUES (?, ?, ?);
 	`, m.version, m.name, formatTime(s.now())); err != nil {
 		return fmt.Errorf("storage: record migration %d: %w", m.version, err)
 	}
 
-	if err := tx.Commit(); err != nil {
+	if _, err := conn.ExecContext(ctx, `COMMIT;`); err != nil {
 		return fmt.Errorf("storage: commit migration %d: %w", m.version, err)
 	}
+	committed = true
 	return nil
 }
 
+// beginImmediate starts a write transaction on conn, retrying while another
+// process holds the write lock for up to migrationLockTimeout.
+func (s *Store) beginImmediate(ctx context.Context, conn *sql.Conn) error {
+	deadline := time.Now().Add(s.migrationLockTimeout)
+	for {
+		_, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE;`)
+		if err == nil {
+			return nil
+		}
+		if !isSQLiteBusy(err) || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationLockRetryInterval):
+		}
+	}
+}
+
+// isSQLiteBusy reports whether err is SQLite's "database is locked" error.
+func isSQLiteBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+}
+
 func formatTime(t time.Time) string {
 	return t.UTC().Format(time.RFC3339Nano)
 }
@@ -1552,6 +2757,15 @@ func parseTime(raw string) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, raw)
 }
 
+// parseActivityTime parses threads.last_activity_at, falling back to
+// fallback for rows written without it.
+func parseActivityTime(raw string, fallback time.Time) (time.Time, error) {
+	if strings.TrimSpace(raw) == "" {
+		return fallback, nil
+	}
+	return parseTime(raw)
+}
+
 func upsertAgentConfigCatalogTx(
 	ctx context.Context,
 	tx *sql.Tx,
@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -47,6 +50,104 @@ func TestMigrateIdempotent(t *testing.T) {
 	}
 }
 
+func TestConcurrentNewMigratesOnce(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "hub.db")
+
+	const openers = 4
+	stores := make([]*Store, openers)
+	errs := make([]error, openers)
+	var wg sync.WaitGroup
+	for i := range openers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stores[i], errs[i] = New(dbPath)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent New() #%d: %v", i, err)
+		}
+		defer stores[i].Close()
+	}
+	if got, want := countRows(t, stores[0].db, "schema_migrations"), len(migrations); got != want {
+		t.Fatalf("schema_migrations rows = %d, want %d", got, want)
+	}
+}
+
+func TestNewRetriesSlowMigrationsWithTimeout(t *testing.T) {
+	// The timeout is generous so that only the stalled migration can hit it;
+	// real migrations finish well within it even on a slow -race run.
+	const migrationTimeout = 2 * time.Second
+
+	stallMigration := func(t *testing.T, stallVersion int, stalls *int) Option {
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		return func(s *Store) {
+			s.migrationBackoff = time.Millisecond
+			s.beforeMigration = func(ctx context.Context, version int) error {
+				if version != stallVersion || *stalls == 0 {
+					return nil
+				}
+				*stalls--
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-release:
+					return errors.New("stall released before timeout")
+				}
+			}
+		}
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		stalls := 1
+		store, err := New(filepath.Join(t.TempDir(), "hub.db"),
+			WithMigrationTimeout(migrationTimeout),
+			WithMigrationRetries(1),
+			stallMigration(t, 3, &stalls),
+		)
+		if err != nil {
+			t.Fatalf("New() error = %v, want retry to succeed", err)
+		}
+		defer store.Close()
+		if stalls != 0 {
+			t.Fatalf("remaining stalls = %d, want 0", stalls)
+		}
+		if got, want := countRows(t, store.db, "schema_migrations"), len(migrations); got != want {
+			t.Fatalf("schema_migrations rows = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		stalls := 2
+		startedAt := time.Now()
+		_, err := New(filepath.Join(t.TempDir(), "hub.db"),
+			WithMigrationTimeout(migrationTimeout),
+			WithMigrationRetries(1),
+			stallMigration(t, 3, &stalls),
+		)
+		if err == nil {
+			t.Fatal("New() error = nil, want migration timeout")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("New() error = %v, want context.DeadlineExceeded", err)
+		}
+		msg := err.Error()
+		if !strings.Contains(msg, "after 2 attempts") || !strings.Contains(msg, "did not finish within 2s") {
+			t.Fatalf("New() error = %q, want attempt count and timeout", msg)
+		}
+		if !strings.Contains(msg, "migration 3 (") {
+			t.Fatalf("New() error = %q, want the stalled migration to be the one that timed out", msg)
+		}
+		if elapsed := time.Since(startedAt); elapsed > 4*migrationTimeout {
+			t.Fatalf("New() took %s, want it bounded by the migration timeout", elapsed)
+		}
+	})
+}
+
 func TestMigrateRenamesLegacyDefaultAgentConfigCatalogModelID(t *testing.T) {
 	ctx := context.Background()
 	dbPath := filepath.Join(t.TempDir(), "hub.db")
@@ -109,8 +210,11 @@ func TestMigrateDropsThreadClientIDAndClientsTable(t *testing.T) {
 		t.Fatalf("create schema_migrations: %v", err)
 	}
 	for _, m := range migrations {
-		if m.version >= 12 {
-			break
+		// Run migration 12 against this hand-built legacy schema, plus later
+		// migrations that only create tables or alter threads; the schema has
+		// only a bare turns table, so turn column migrations stay skipped.
+		if m.version == 12 || m.version == 14 || m.version == 17 || m.version == 18 || m.version == 20 || m.version == 21 || m.version == 22 {
+			continue
 		}
 		if _, err := db.ExecContext(ctx, `
 			INSERT INTO schema_migrations (version, name, applied_at)
@@ -144,6 +248,17 @@ func TestMigrateDropsThreadClientIDAndClientsTable(t *testing.T) {
 	`); err != nil {
 		t.Fatalf("create legacy threads: %v", err)
 	}
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE turns (
+			turn_id TEXT PRIMARY KEY,
+			thread_id TEXT NOT NULL,
+			is_internal INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL,
+			completed_at TEXT
+		);
+	`); err != nil {
+		t.Fatalf("create legacy turns: %v", err)
+	}
 	if _, err := db.ExecContext(ctx, `CREATE INDEX idx_threads_client_id ON threads(client_id);`); err != nil {
 		t.Fatalf("create legacy idx_threads_client_id: %v", err)
 	}
@@ -197,6 +312,9 @@ func TestMigrateDropsThreadClientIDAndClientsTable(t *testing.T) {
 	if got, want := thread.CWD, "/tmp/legacy"; got != want {
 		t.Fatalf("thread.CWD = %q, want %q", got, want)
 	}
+	if !thread.LastActivityAt.Equal(thread.UpdatedAt) {
+		t.Fatalf("thread.LastActivityAt = %s, want backfilled updated_at %s", thread.LastActivityAt, thread.UpdatedAt)
+	}
 }
 
 func TestCreateListGetThread(t *testing.T) {
@@ -252,7 +370,7 @@ func TestCreateListGetThread(t *testing.T) {
 		t.Fatalf("GetThread cwd = %q, want %q", gotThread.CWD, threadOne.CWD)
 	}
 
-	threads, err := store.ListThreads(ctx)
+	threads, err := store.ListThreads(ctx, 0)
 	if err != nil {
 		t.Fatalf("ListThreads(): %v", err)
 	}
@@ -399,6 +517,121 @@ func TestDeleteThreadCascadeData(t *testing.T) {
 	}
 }
 
+func TestForeignKeysRejectOrphanRows(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	var enabled int
+	if err := store.db.QueryRowContext(ctx, `PRAGMA foreign_keys;`).Scan(&enabled); err != nil {
+		t.Fatalf("PRAGMA foreign_keys: %v", err)
+	}
+	if enabled != 1 {
+		t.Fatalf("foreign_keys = %d, want 1", enabled)
+	}
+
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-orphan",
+		ThreadID:    "th-missing",
+		RequestText: "hello",
+		Status:      "running",
+	}); err == nil {
+		t.Fatalf("CreateTurn() for missing thread error = nil, want FK violation")
+	}
+	if _, err := store.AppendEvent(ctx, "tu-missing", "turn_started", `{}`); err == nil {
+		t.Fatalf("AppendEvent() for missing turn error = nil, want FK violation")
+	}
+	if err := store.CreateTurnAttachments(ctx, []CreateTurnAttachmentParams{{
+		AttachmentID: "att-orphan",
+		TurnID:       "tu-missing",
+		Name:         "orphan.txt",
+		MimeType:     "text/plain",
+		Size:         1,
+		FilePath:     "/tmp/ngent/attachments/text/att-orphan.txt",
+	}}); err == nil {
+		t.Fatalf("CreateTurnAttachments() for missing turn error = nil, want FK violation")
+	}
+
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-parent",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-parent",
+		Title:            "parent",
+		AgentOptionsJSON: "{}",
+	}); err != nil {
+		t.Fatalf("CreateThread(): %v", err)
+	}
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-child",
+		ThreadID:    "th-parent",
+		RequestText: "hello",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn(): %v", err)
+	}
+	// Bypassing DeleteThread must not leave the turn orphaned.
+	if _, err := store.db.ExecContext(ctx, `DELETE FROM threads WHERE thread_id = ?`, "th-parent"); err == nil {
+		t.Fatalf("raw thread delete with child turns error = nil, want FK violation")
+	}
+	if got := countRows(t, store.db, "turns"); got != 1 {
+		t.Fatalf("turns rows = %d, want 1", got)
+	}
+}
+
+func TestDeleteThreadKeepsOtherThreadsAndLeavesNoOrphans(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	for _, threadID := range []string{"th-gone", "th-kept"} {
+		if _, err := store.CreateThread(ctx, CreateThreadParams{
+			ThreadID:         threadID,
+			AgentID:          "codex",
+			CWD:              "/tmp/" + threadID,
+			Title:            threadID,
+			AgentOptionsJSON: "{}",
+		}); err != nil {
+			t.Fatalf("CreateThread(%s): %v", threadID, err)
+		}
+		turnID := "tu-" + threadID
+		if _, err := store.CreateTurn(ctx, CreateTurnParams{
+			TurnID:      turnID,
+			ThreadID:    threadID,
+			RequestText: "hello",
+			Status:      "running",
+		}); err != nil {
+			t.Fatalf("CreateTurn(%s): %v", turnID, err)
+		}
+		if _, err := store.AppendEvent(ctx, turnID, "turn_started", `{}`); err != nil {
+			t.Fatalf("AppendEvent(%s): %v", turnID, err)
+		}
+	}
+
+	if err := store.DeleteThread(ctx, "th-gone"); err != nil {
+		t.Fatalf("DeleteThread(): %v", err)
+	}
+
+	if _, err := store.GetTurn(ctx, "tu-th-kept"); err != nil {
+		t.Fatalf("GetTurn(kept) after sibling delete: %v", err)
+	}
+	if got := countRows(t, store.db, "events"); got != 1 {
+		t.Fatalf("events rows = %d, want 1", got)
+	}
+
+	rows, err := store.db.QueryContext(ctx, `PRAGMA foreign_key_check;`)
+	if err != nil {
+		t.Fatalf("PRAGMA foreign_key_check: %v", err)
+	}
+	defer rows.Close()
+	if rows.Next() {
+		t.Fatalf("foreign_key_check reported violations after DeleteThread")
+	}
+}
+
 func TestDeleteThreadNotFound(t *testing.T) {
 	ctx := context.Background()
 	store := newTestStore(t)
@@ -412,6 +645,112 @@ func TestDeleteThreadNotFound(t *testing.T) {
 	}
 }
 
+func TestDatedPath(t *testing.T) {
+	day := time.Date(2026, 2, 28, 10, 0, 0, 0, time.UTC)
+	if got, want := DatedPath("/data/ngent.db", day), "/data/ngent-2026-02-28.db"; got != want {
+		t.Fatalf("DatedPath() = %q, want %q", got, want)
+	}
+	if got, want := DatedPath("/data/ngent", day), "/data/ngent-2026-02-28"; got != want {
+		t.Fatalf("DatedPath(no ext) = %q, want %q", got, want)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Ping(ctx); err != nil {
+		t.Fatalf("Ping() open store: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if err := store.Ping(ctx); err == nil {
+		t.Fatalf("Ping() closed store err = nil, want error")
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	problems, err := store.IntegrityCheck(ctx)
+	if err != nil {
+		t.Fatalf("IntegrityCheck() healthy store: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("IntegrityCheck() healthy store problems = %v, want none", problems)
+	}
+
+	if _, err := store.db.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+		t.Fatalf("disable foreign_keys: %v", err)
+	}
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-orphan",
+		ThreadID:    "th-missing",
+		RequestText: "hi",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn(orphan): %v", err)
+	}
+	problems, err = store.IntegrityCheck(ctx)
+	if err != nil {
+		t.Fatalf("IntegrityCheck() orphan turn: %v", err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "turns") {
+		t.Fatalf("IntegrityCheck() orphan turn problems = %v, want one turns violation", problems)
+	}
+}
+
+func TestOpenReadOnlySkipsMigrations(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "data dir", "hub.db")
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+
+	if _, err := OpenReadOnly(dbPath); err == nil {
+		t.Fatal("OpenReadOnly() missing database error = nil, want error")
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("OpenReadOnly() created %q (stat err = %v)", dbPath, err)
+	}
+
+	seed, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() seed open: %v", err)
+	}
+	latest := LatestSchemaVersion()
+	if _, err := seed.db.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, latest); err != nil {
+		t.Fatalf("delete latest migration row: %v", err)
+	}
+	if err := seed.Close(); err != nil {
+		t.Fatalf("Close() seed: %v", err)
+	}
+
+	store, err := OpenReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(): %v", err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	problems, err := store.IntegrityCheck(ctx)
+	if err != nil {
+		t.Fatalf("IntegrityCheck(): %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("IntegrityCheck() problems = %v, want none", problems)
+	}
+	if got, err := store.SchemaVersion(ctx); err != nil || got >= latest {
+		t.Fatalf("SchemaVersion() = %d, %v, want below %d (migrations not applied)", got, err, latest)
+	}
+	if err := store.RecordClient(ctx, RecordClientParams{ClientID: "client-ro"}); err == nil {
+		t.Fatal("RecordClient() on read-only store error = nil, want error")
+	}
+}
+
 func TestCreateTurnAppendEventFinalizeTurn(t *testing.T) {
 	ctx := context.Background()
 	store := newTestStore(t)
@@ -447,6 +786,7 @@ func TestCreateTurnAppendEventFinalizeTurn(t *testing.T) {
 		ThreadID:    "th-turn",
 		RequestText: "hello",
 		Status:      "running",
+		PromptText:  "[Summary]\nnone\n\nhello",
 	})
 	if err != nil {
 		t.Fatalf("CreateTurn(): %v", err)
@@ -459,6 +799,23 @@ func TestCreateTurnAppendEventFinalizeTurn(t *testing.T) {
 	if createdTurn.IsInternal {
 		t.Fatalf("GetTurn(tu-1).IsInternal = true, want false")
 	}
+	if createdTurn.PromptText != "[Summary]\nnone\n\nhello" {
+		t.Fatalf("GetTurn(tu-1).PromptText = %q, want persisted prompt", createdTurn.PromptText)
+	}
+	listed, err := store.ListTurnsByThread(ctx, "th-turn")
+	if err != nil {
+		t.Fatalf("ListTurnsByThread(): %v", err)
+	}
+	if len(listed) != 1 || listed[0].PromptText != "" {
+		t.Fatalf("ListTurnsByThread() = %+v, want one turn without prompt_text", listed)
+	}
+	prompts, err := store.ListTurnPromptsByThread(ctx, "th-turn")
+	if err != nil {
+		t.Fatalf("ListTurnPromptsByThread(): %v", err)
+	}
+	if len(prompts) != 1 || prompts["tu-1"] != "[Summary]\nnone\n\nhello" {
+		t.Fatalf("ListTurnPromptsByThread() = %v, want tu-1 prompt", prompts)
+	}
 
 	e1, err := store.AppendEvent(ctx, "tu-1", "turn.started", `{"step":1}`)
 	if err != nil {
@@ -488,6 +845,10 @@ func TestCreateTurnAppendEventFinalizeTurn(t *testing.T) {
 		Status:       "completed",
 		StopReason:   "eot",
 		ErrorMessage: "",
+
+		RawStopReason:    "max_tokens",
+		PromptTokens:     120,
+		CompletionTokens: 45,
 	}); err != nil {
 		t.Fatalf("FinalizeTurn(): %v", err)
 	}
@@ -505,6 +866,17 @@ func TestCreateTurnAppendEventFinalizeTurn(t *testing.T) {
 	if completedAt == "" {
 		t.Fatalf("turn completed_at is empty, want non-empty")
 	}
+
+	finalTurn, err := store.GetTurn(ctx, "tu-1")
+	if err != nil {
+		t.Fatalf("GetTurn(tu-1) after finalize: %v", err)
+	}
+	if finalTurn.PromptTokens != 120 || finalTurn.CompletionTokens != 45 {
+		t.Fatalf("turn tokens = (%d,%d), want (120,45)", finalTurn.PromptTokens, finalTurn.CompletionTokens)
+	}
+	if finalTurn.RawStopReason != "max_tokens" {
+		t.Fatalf("turn raw_stop_reason = %q, want %q", finalTurn.RawStopReason, "max_tokens")
+	}
 }
 
 func TestAppendEventMergesConsecutiveDeltaRuns(t *testing.T) {
@@ -589,141 +961,927 @@ func TestAppendEventMergesConsecutiveDeltaRuns(t *testing.T) {
 	assertDeltaEventPayload(t, events[0].DataJSON, "tu-merge", "hello")
 	assertDeltaEventPayload(t, events[1].DataJSON, "tu-merge", "think-1")
 	assertDeltaEventPayload(t, events[2].DataJSON, "tu-merge", "!")
+
+	timedFirst, err := store.AppendEvent(ctx, "tu-merge", "message_delta", `{"turnId":"tu-merge","delta":"a","offsetMs":1.5}`)
+	if err != nil {
+		t.Fatalf("AppendEvent(timed message_delta #1): %v", err)
+	}
+	timedSecond, err := store.AppendEvent(ctx, "tu-merge", "message_delta", `{"turnId":"tu-merge","delta":"b","offsetMs":2.5}`)
+	if err != nil {
+		t.Fatalf("AppendEvent(timed message_delta #2): %v", err)
+	}
+	if timedFirst.Seq == fifth.Seq || timedSecond.Seq != timedFirst.Seq+1 {
+		t.Fatalf("timed delta seqs = [%d,%d] after %d, want separate rows", timedFirst.Seq, timedSecond.Seq, fifth.Seq)
+	}
 }
 
-func TestTurnAttachmentsCRUD(t *testing.T) {
+func TestAppendEventKeepsDeltasWithDifferentMetadataApart(t *testing.T) {
 	ctx := context.Background()
 	store := newTestStore(t)
 	defer func() {
 		_ = store.Close()
 	}()
 
-	if err := store.UpsertClient(ctx, "client-attachments"); err != nil {
+	if err := store.UpsertClient(ctx, "client-meta"); err != nil {
 		t.Fatalf("UpsertClient(): %v", err)
 	}
 	if _, err := store.CreateThread(ctx, CreateThreadParams{
-		ThreadID:         "th-attachments",
+		ThreadID:         "th-meta",
 		AgentID:          "codex",
-		CWD:              "/tmp/project-attachments",
-		Title:            "attachments",
+		CWD:              "/tmp/project-meta",
 		AgentOptionsJSON: "{}",
-		Summary:          "",
 	}); err != nil {
 		t.Fatalf("CreateThread(): %v", err)
 	}
 	if _, err := store.CreateTurn(ctx, CreateTurnParams{
-		TurnID:      "tu-attachments",
-		ThreadID:    "th-attachments",
+		TurnID:      "tu-meta",
+		ThreadID:    "th-meta",
 		RequestText: "hello",
 		Status:      "running",
 	}); err != nil {
 		t.Fatalf("CreateTurn(): %v", err)
 	}
 
-	if err := store.CreateTurnAttachments(ctx, []CreateTurnAttachmentParams{{
-		AttachmentID: "att-1",
-		TurnID:       "tu-attachments",
-		Name:         "diagram.png",
-		MimeType:     "image/png",
-		Size:         42,
-		FilePath:     "/tmp/ngent/attachments/images/att-1-diagram.png",
-	}}); err != nil {
-		t.Fatalf("CreateTurnAttachments(): %v", err)
+	for _, dataJSON := range []string{
+		`{"turnId":"tu-meta","delta":"see: "}`,
+		`{"turnId":"tu-meta","delta":"fmt.","contentType":"code","lang":"go"}`,
+		`{"turnId":"tu-meta","delta":"Println()","contentType":"code","lang":"go"}`,
+		`{"turnId":"tu-meta","delta":"print()","contentType":"code","lang":"python"}`,
+		`{"turnId":"tu-meta","delta":" done"}`,
+	} {
+		if _, err := store.AppendEvent(ctx, "tu-meta", "message_delta", dataJSON); err != nil {
+			t.Fatalf("AppendEvent(%s): %v", dataJSON, err)
+		}
 	}
 
-	attachment, err := store.GetTurnAttachment(ctx, "att-1")
+	events, err := store.ListEventsByTurn(ctx, "tu-meta")
 	if err != nil {
-		t.Fatalf("GetTurnAttachment(): %v", err)
-	}
-	if got, want := attachment.TurnID, "tu-attachments"; got != want {
-		t.Fatalf("attachment.turn_id = %q, want %q", got, want)
-	}
-	if got, want := attachment.Name, "diagram.png"; got != want {
-		t.Fatalf("attachment.name = %q, want %q", got, want)
-	}
-	if got, want := attachment.MimeType, "image/png"; got != want {
-		t.Fatalf("attachment.mime_type = %q, want %q", got, want)
-	}
-	if got, want := attachment.Size, int64(42); got != want {
-		t.Fatalf("attachment.size = %d, want %d", got, want)
-	}
-	if got, want := attachment.FilePath, "/tmp/ngent/attachments/images/att-1-diagram.png"; got != want {
-		t.Fatalf("attachment.file_path = %q, want %q", got, want)
-	}
-
-	if err := store.DeleteThread(ctx, "th-attachments"); err != nil {
-		t.Fatalf("DeleteThread(): %v", err)
+		t.Fatalf("ListEventsByTurn(): %v", err)
 	}
-	if _, err := store.GetTurnAttachment(ctx, "att-1"); !errors.Is(err, ErrNotFound) {
-		t.Fatalf("GetTurnAttachment(after delete) err = %v, want ErrNotFound", err)
+	want := []struct {
+		delta, contentType, lang string
+	}{
+		{"see: ", "", ""},
+		{"fmt.Println()", "code", "go"},
+		{"print()", "code", "python"},
+		{" done", "", ""},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("len(events) = %d, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		payload := map[string]any{}
+		if err := json.Unmarshal([]byte(event.DataJSON), &payload); err != nil {
+			t.Fatalf("unmarshal event %d: %v", i, err)
+		}
+		delta, _ := payload["delta"].(string)
+		contentType, _ := payload["contentType"].(string)
+		lang, _ := payload["lang"].(string)
+		if delta != want[i].delta || contentType != want[i].contentType || lang != want[i].lang {
+			t.Fatalf("event %d = %s, want delta=%q contentType=%q lang=%q", i, event.DataJSON, want[i].delta, want[i].contentType, want[i].lang)
+		}
 	}
 }
 
-func TestUpdateThreadSummaryAndInternalTurnFlag(t *testing.T) {
+func TestAppendEventSeqSurvivesTailCacheMiss(t *testing.T) {
 	ctx := context.Background()
 	store := newTestStore(t)
 	defer func() {
 		_ = store.Close()
 	}()
 
-	if err := store.UpsertClient(ctx, "client-c"); err != nil {
+	if err := store.UpsertClient(ctx, "client-tail"); err != nil {
 		t.Fatalf("UpsertClient(): %v", err)
 	}
-	_, err := store.CreateThread(ctx, CreateThreadParams{
-		ThreadID:         "th-summary",
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-tail",
 		AgentID:          "codex",
-		CWD:              "/tmp/project-summary",
-		Title:            "summary-test",
+		CWD:              "/tmp/project-tail",
 		AgentOptionsJSON: "{}",
-		Summary:          "",
-	})
-	if err != nil {
+	}); err != nil {
 		t.Fatalf("CreateThread(): %v", err)
 	}
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-tail",
+		ThreadID:    "th-tail",
+		RequestText: "hello",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn(): %v", err)
+	}
 
-	if err := store.UpdateThreadSummary(ctx, "th-summary", "new summary"); err != nil {
-		t.Fatalf("UpdateThreadSummary(): %v", err)
+	for i := 0; i < 3; i++ {
+		if _, err := store.AppendEvent(ctx, "tu-tail", "turn.delta", fmt.Sprintf(`{"step":%d}`, i)); err != nil {
+			t.Fatalf("AppendEvent #%d: %v", i, err)
+		}
 	}
-	thread, err := store.GetThread(ctx, "th-summary")
-	if err != nil {
-		t.Fatalf("GetThread(th-summary): %v", err)
+	if err := store.FinalizeTurn(ctx, FinalizeTurnParams{TurnID: "tu-tail", Status: "completed"}); err != nil {
+		t.Fatalf("FinalizeTurn(): %v", err)
 	}
-	if thread.Summary != "new summary" {
-		t.Fatalf("thread summary = %q, want %q", thread.Summary, "new summary")
+	if _, ok := store.eventTails["tu-tail"]; ok {
+		t.Fatalf("event tail cache still holds finalized turn")
 	}
 
-	_, err = store.CreateTurn(ctx, CreateTurnParams{
-		TurnID:      "tu-internal",
-		ThreadID:    "th-summary",
-		RequestText: "internal prompt",
-		Status:      "running",
-		IsInternal:  true,
-	})
+	late, err := store.AppendEvent(ctx, "tu-tail", "turn.completed", `{}`)
 	if err != nil {
-		t.Fatalf("CreateTurn(internal): %v", err)
+		t.Fatalf("AppendEvent after finalize: %v", err)
+	}
+	if got, want := late.Seq, 4; got != want {
+		t.Fatalf("late.Seq = %d, want %d", got, want)
 	}
 
-	turn, err := store.GetTurn(ctx, "tu-internal")
+	// A stale cached seq must be rejected by the unique index and recover.
+	store.eventTails["tu-tail"] = eventTail{seq: 2, eventType: "turn.delta"}
+	if _, err := store.AppendEvent(ctx, "tu-tail", "turn.note", `{}`); err == nil {
+		t.Fatalf("AppendEvent with stale tail error = nil, want unique constraint error")
+	}
+	recovered, err := store.AppendEvent(ctx, "tu-tail", "turn.note", `{}`)
 	if err != nil {
-		t.Fatalf("GetTurn(tu-internal): %v", err)
+		t.Fatalf("AppendEvent after stale tail: %v", err)
 	}
-	if !turn.IsInternal {
-		t.Fatalf("GetTurn(tu-internal).IsInternal = false, want true")
+	if got, want := recovered.Seq, 5; got != want {
+		t.Fatalf("recovered.Seq = %d, want %d", got, want)
+	}
+	if got, want := fmt.Sprint(loadEventSeqs(t, store.db, "tu-tail")), "[1 2 3 4 5]"; got != want {
+		t.Fatalf("event seqs = %s, want %s", got, want)
 	}
 }
 
-func TestUpdateThreadAgentOptions(t *testing.T) {
+func BenchmarkAppendEvent(b *testing.B) {
 	ctx := context.Background()
-	store := newTestStore(t)
+	store := newTestStore(b)
 	defer func() {
 		_ = store.Close()
 	}()
 
-	if err := store.UpsertClient(ctx, "client-model"); err != nil {
-		t.Fatalf("UpsertClient(): %v", err)
+	if err := store.UpsertClient(ctx, "client-bench"); err != nil {
+		b.Fatalf("UpsertClient(): %v", err)
 	}
-	_, err := store.CreateThread(ctx, CreateThreadParams{
-		ThreadID:         "th-model",
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-bench",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-bench",
+		AgentOptionsJSON: "{}",
+	}); err != nil {
+		b.Fatalf("CreateThread(): %v", err)
+	}
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-bench",
+		ThreadID:    "th-bench",
+		RequestText: "hello",
+		Status:      "running",
+	}); err != nil {
+		b.Fatalf("CreateTurn(): %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.AppendEvent(ctx, "tu-bench", "tool_call_update", `{"status":"in_progress"}`); err != nil {
+			b.Fatalf("AppendEvent(): %v", err)
+		}
+	}
+}
+
+func TestListRecentTurnsByThread(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	dbPath := filepath.Join(t.TempDir(), "recent.db")
+	store, err := New(dbPath, WithClock(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}))
+	if err != nil {
+		t.Fatalf("New(%q, WithClock): %v", dbPath, err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-recent",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-recent",
+		AgentOptionsJSON: "{}",
+	}); err != nil {
+		t.Fatalf("CreateThread(): %v", err)
+	}
+	for i, internal := range []bool{false, false, true, false, true} {
+		if _, err := store.CreateTurn(ctx, CreateTurnParams{
+			TurnID:      fmt.Sprintf("tu-%d", i),
+			ThreadID:    "th-recent",
+			RequestText: "hello",
+			Status:      "running",
+			IsInternal:  internal,
+		}); err != nil {
+			t.Fatalf("CreateTurn(%d): %v", i, err)
+		}
+	}
+
+	turnIDs := func(turns []Turn) string {
+		ids := make([]string, 0, len(turns))
+		for _, turn := range turns {
+			ids = append(ids, turn.TurnID)
+		}
+		return strings.Join(ids, ",")
+	}
+	for _, tc := range []struct {
+		limit           int
+		includeInternal bool
+		want            string
+	}{
+		{2, false, "tu-1,tu-3"},
+		{10, false, "tu-0,tu-1,tu-3"},
+		{3, true, "tu-2,tu-3,tu-4"},
+		{0, true, ""},
+	} {
+		turns, err := store.ListRecentTurnsByThread(ctx, "th-recent", tc.limit, tc.includeInternal)
+		if err != nil {
+			t.Fatalf("ListRecentTurnsByThread(%d, %v): %v", tc.limit, tc.includeInternal, err)
+		}
+		if got := turnIDs(turns); got != tc.want {
+			t.Fatalf("ListRecentTurnsByThread(%d, %v) = %s, want %s", tc.limit, tc.includeInternal, got, tc.want)
+		}
+	}
+	if got, err := store.CountTurnsByThread(ctx, "th-recent", false); err != nil || got != 3 {
+		t.Fatalf("CountTurnsByThread(false) = %d, %v, want 3, nil", got, err)
+	}
+	if got, err := store.CountTurnsByThread(ctx, "th-recent", true); err != nil || got != 5 {
+		t.Fatalf("CountTurnsByThread(true) = %d, %v, want 5, nil", got, err)
+	}
+	if got, err := store.CountTurns(ctx, false); err != nil || got != 3 {
+		t.Fatalf("CountTurns(false) = %d, %v, want 3, nil", got, err)
+	}
+	if got, err := store.CountThreads(ctx); err != nil || got != 1 {
+		t.Fatalf("CountThreads() = %d, %v, want 1, nil", got, err)
+	}
+}
+
+// BenchmarkRecentTurnsOnLargeThread compares loading a whole 2000-turn
+// thread with reading only the 10 turns a context window needs.
+func BenchmarkRecentTurnsOnLargeThread(b *testing.B) {
+	ctx := context.Background()
+	store := newTestStore(b)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-large",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-large",
+		AgentOptionsJSON: "{}",
+	}); err != nil {
+		b.Fatalf("CreateThread(): %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		if _, err := store.CreateTurn(ctx, CreateTurnParams{
+			TurnID:      fmt.Sprintf("tu-large-%d", i),
+			ThreadID:    "th-large",
+			RequestText: strings.Repeat("request ", 20),
+			Status:      "running",
+		}); err != nil {
+			b.Fatalf("CreateTurn(%d): %v", i, err)
+		}
+	}
+
+	b.Run("ListTurnsByThread", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			turns, err := store.ListTurnsByThread(ctx, "th-large")
+			if err != nil {
+				b.Fatalf("ListTurnsByThread(): %v", err)
+			}
+			_ = turns[len(turns)-10:]
+		}
+	})
+	b.Run("ListRecentTurnsByThread", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.ListRecentTurnsByThread(ctx, "th-large", 10, false); err != nil {
+				b.Fatalf("ListRecentTurnsByThread(): %v", err)
+			}
+		}
+	})
+}
+
+func TestCompactTurnEventsMergesAdjacentDeltasOfOldTerminalTurns(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	dbPath := filepath.Join(t.TempDir(), "compact.db")
+	store, err := New(dbPath, WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("New(%q, WithClock): %v", dbPath, err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-compact",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-compact",
+		AgentOptionsJSON: "{}",
+	}); err != nil {
+		t.Fatalf("CreateThread(): %v", err)
+	}
+	// insertEvent writes a row directly, the way databases written before
+	// AppendEvent merged deltas still hold adjacent delta rows.
+	insertEvent := func(turnID string, seq int, eventType, dataJSON string) {
+		t.Helper()
+		if _, err := store.db.ExecContext(ctx, `
+			INSERT INTO events (turn_id, seq, type, data_json, created_at)
+			VALUES (?, ?, ?, ?, ?);
+		`, turnID, seq, eventType, dataJSON, formatTime(now)); err != nil {
+			t.Fatalf("insert event %s/%d: %v", turnID, seq, err)
+		}
+	}
+	for _, turnID := range []string{"tu-stuck", "tu-done", "tu-live"} {
+		if _, err := store.CreateTurn(ctx, CreateTurnParams{
+			TurnID:      turnID,
+			ThreadID:    "th-compact",
+			RequestText: "hello",
+			Status:      "running",
+		}); err != nil {
+			t.Fatalf("CreateTurn(%s): %v", turnID, err)
+		}
+	}
+	// tu-stuck only has deltas that can never be merged.
+	insertEvent("tu-stuck", 1, "message_delta", `{"turnId":"tu-stuck","delta":"a","offsetMs":1}`)
+	insertEvent("tu-stuck", 2, "message_delta", `{"turnId":"tu-stuck","delta":"b","offsetMs":2}`)
+	for _, turnID := range []string{"tu-done", "tu-live"} {
+		for _, event := range []struct{ typ, data string }{
+			{"message_delta", `{"turnId":"` + turnID + `","delta":"hel"}`},
+			{"tool_call", `{"turnId":"` + turnID + `","toolCallId":"call-1"}`},
+			{"message_delta", `{"turnId":"` + turnID + `","delta":"lo"}`},
+			{"permission_required", `{"turnId":"` + turnID + `","permissionId":"perm-1"}`},
+			{"message_delta", `{"turnId":"` + turnID + `","delta":"!"}`},
+		} {
+			if _, err := store.AppendEvent(ctx, turnID, event.typ, event.data); err != nil {
+				t.Fatalf("AppendEvent(%s, %s): %v", turnID, event.typ, err)
+			}
+		}
+	}
+	insertEvent("tu-done", 6, "message_delta", `{"turnId":"tu-done","delta":" wor"}`)
+	insertEvent("tu-done", 7, "message_delta", `{"turnId":"tu-done","delta":"ld"}`)
+	insertEvent("tu-done", 8, "message_delta", `{"turnId":"tu-done","delta":"?","offsetMs":9}`)
+	for _, turnID := range []string{"tu-stuck", "tu-done"} {
+		if err := store.FinalizeTurn(ctx, FinalizeTurnParams{
+			TurnID:       turnID,
+			ResponseText: "hello! world?",
+			Status:       "completed",
+			StopReason:   "end_turn",
+		}); err != nil {
+			t.Fatalf("FinalizeTurn(%s): %v", turnID, err)
+		}
+	}
+	if _, err := store.db.ExecContext(ctx, `UPDATE turns SET completed_at = ? WHERE turn_id = 'tu-stuck';`, formatTime(now.Add(-time.Minute))); err != nil {
+		t.Fatalf("backdate tu-stuck: %v", err)
+	}
+
+	compacted, err := store.CompactTurnEvents(ctx, now.Add(-2*time.Minute), 0)
+	if err != nil {
+		t.Fatalf("CompactTurnEvents(before completion): %v", err)
+	}
+	if compacted != 0 {
+		t.Fatalf("CompactTurnEvents(before completion) = %d, want 0", compacted)
+	}
+
+	// The oldest turn cannot be compacted; it must not block the next one.
+	compacted, err = store.CompactTurnEvents(ctx, now, 1)
+	if err != nil {
+		t.Fatalf("CompactTurnEvents(stuck): %v", err)
+	}
+	if compacted != 0 {
+		t.Fatalf("CompactTurnEvents(stuck) = %d, want 0", compacted)
+	}
+	compacted, err = store.CompactTurnEvents(ctx, now, 1)
+	if err != nil {
+		t.Fatalf("CompactTurnEvents(): %v", err)
+	}
+	if compacted != 1 {
+		t.Fatalf("CompactTurnEvents() = %d, want 1", compacted)
+	}
+
+	events, err := store.ListEventsByTurn(ctx, "tu-done")
+	if err != nil {
+		t.Fatalf("ListEventsByTurn(tu-done): %v", err)
+	}
+	wantEvents := []struct {
+		seq  int
+		typ  string
+		data string
+	}{
+		{1, "message_delta", `{"turnId":"tu-done","delta":"hel"}`},
+		{2, "tool_call", `{"turnId":"tu-done","toolCallId":"call-1"}`},
+		{3, "message_delta", `{"turnId":"tu-done","delta":"lo"}`},
+		{4, "permission_required", `{"turnId":"tu-done","permissionId":"perm-1"}`},
+		{5, "message_delta", `{"delta":"! world","turnId":"tu-done"}`},
+		{8, "message_delta", `{"turnId":"tu-done","delta":"?","offsetMs":9}`},
+	}
+	if got, want := len(events), len(wantEvents); got != want {
+		t.Fatalf("len(events) = %d, want %d", got, want)
+	}
+	for i, want := range wantEvents {
+		if events[i].Seq != want.seq || events[i].Type != want.typ || events[i].DataJSON != want.data {
+			t.Fatalf("events[%d] = (%d, %s, %s), want (%d, %s, %s)",
+				i, events[i].Seq, events[i].Type, events[i].DataJSON, want.seq, want.typ, want.data)
+		}
+	}
+
+	stuckEvents, err := store.ListEventsByTurn(ctx, "tu-stuck")
+	if err != nil {
+		t.Fatalf("ListEventsByTurn(tu-stuck): %v", err)
+	}
+	if got, want := len(stuckEvents), 2; got != want {
+		t.Fatalf("unmergeable turn events = %d, want %d", got, want)
+	}
+	liveEvents, err := store.ListEventsByTurn(ctx, "tu-live")
+	if err != nil {
+		t.Fatalf("ListEventsByTurn(tu-live): %v", err)
+	}
+	if got, want := len(liveEvents), 5; got != want {
+		t.Fatalf("running turn events = %d, want %d", got, want)
+	}
+
+	compacted, err = store.CompactTurnEvents(ctx, now.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("CompactTurnEvents(again): %v", err)
+	}
+	if compacted != 0 {
+		t.Fatalf("CompactTurnEvents(again) = %d, want 0", compacted)
+	}
+}
+
+func TestTurnAttachmentsCRUD(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if err := store.UpsertClient(ctx, "client-attachments"); err != nil {
+		t.Fatalf("UpsertClient(): %v", err)
+	}
+	if _, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-attachments",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-attachments",
+		Title:            "attachments",
+		AgentOptionsJSON: "{}",
+		Summary:          "",
+	}); err != nil {
+		t.Fatalf("CreateThread(): %v", err)
+	}
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-attachments",
+		ThreadID:    "th-attachments",
+		RequestText: "hello",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn(): %v", err)
+	}
+
+	if err := store.CreateTurnAttachments(ctx, []CreateTurnAttachmentParams{{
+		AttachmentID: "att-1",
+		TurnID:       "tu-attachments",
+		Name:         "diagram.png",
+		MimeType:     "image/png",
+		Size:         42,
+		FilePath:     "/tmp/ngent/attachments/images/att-1-diagram.png",
+	}}); err != nil {
+		t.Fatalf("CreateTurnAttachments(): %v", err)
+	}
+
+	attachment, err := store.GetTurnAttachment(ctx, "att-1")
+	if err != nil {
+		t.Fatalf("GetTurnAttachment(): %v", err)
+	}
+	if got, want := attachment.TurnID, "tu-attachments"; got != want {
+		t.Fatalf("attachment.turn_id = %q, want %q", got, want)
+	}
+	if got, want := attachment.Name, "diagram.png"; got != want {
+		t.Fatalf("attachment.name = %q, want %q", got, want)
+	}
+	if got, want := attachment.MimeType, "image/png"; got != want {
+		t.Fatalf("attachment.mime_type = %q, want %q", got, want)
+	}
+	if got, want := attachment.Size, int64(42); got != want {
+		t.Fatalf("attachment.size = %d, want %d", got, want)
+	}
+	if got, want := attachment.FilePath, "/tmp/ngent/attachments/images/att-1-diagram.png"; got != want {
+		t.Fatalf("attachment.file_path = %q, want %q", got, want)
+	}
+
+	if err := store.DeleteThread(ctx, "th-attachments"); err != nil {
+		t.Fatalf("DeleteThread(): %v", err)
+	}
+	if _, err := store.GetTurnAttachment(ctx, "att-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTurnAttachment(after delete) err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSchemaVersionReportsLatestAppliedMigration(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("SchemaVersion: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion = %d, want %d", version, LatestSchemaVersion())
+	}
+	applied, err := store.AppliedMigrationCount(ctx)
+	if err != nil {
+		t.Fatalf("AppliedMigrationCount: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("AppliedMigrationCount = %d, want %d", applied, len(migrations))
+	}
+}
+
+func TestThreadTitleAndSummarySizeLimits(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "limits.db")
+	store, err := New(dbPath, WithMaxTitleBytes(8), WithMaxSummaryBytes(16))
+	if err != nil {
+		t.Fatalf("New(%q): %v", dbPath, err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	params := CreateThreadParams{
+		ThreadID:         "th-limits",
+		AgentID:          "codex",
+		CWD:              "/tmp/limits",
+		Title:            "too long title",
+		AgentOptionsJSON: "{}",
+	}
+	if _, err := store.CreateThread(ctx, params); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("CreateThread(long title) err = %v, want ErrTooLarge", err)
+	}
+	params.Title = "ok"
+	if _, err := store.CreateThread(ctx, params); err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+
+	if err := store.UpdateThreadTitle(ctx, "th-limits", "exactly8"); err != nil {
+		t.Fatalf("UpdateThreadTitle(at limit): %v", err)
+	}
+	if err := store.UpdateThreadTitle(ctx, "th-limits", "nine byte"); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("UpdateThreadTitle(over limit) err = %v, want ErrTooLarge", err)
+	}
+	if err := store.UpdateThreadSummary(ctx, "th-limits", strings.Repeat("s", 17)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("UpdateThreadSummary(over limit) err = %v, want ErrTooLarge", err)
+	}
+	if err := store.UpdateThreadSummary(ctx, "th-limits", strings.Repeat("s", 16)); err != nil {
+		t.Fatalf("UpdateThreadSummary(at limit): %v", err)
+	}
+
+	thread, err := store.GetThread(ctx, "th-limits")
+	if err != nil {
+		t.Fatalf("GetThread: %v", err)
+	}
+	if thread.Title != "exactly8" {
+		t.Fatalf("title = %q, want unchanged %q", thread.Title, "exactly8")
+	}
+}
+
+func TestWithClockControlsPersistedTimestamps(t *testing.T) {
+	ctx := context.Background()
+	fixed := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	dbPath := filepath.Join(t.TempDir(), "clock.db")
+	store, err := New(dbPath, WithClock(func() time.Time { return fixed }))
+	if err != nil {
+		t.Fatalf("New(%q, WithClock): %v", dbPath, err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	thread, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-clock",
+		AgentID:          "codex",
+		CWD:              "/tmp/clock",
+		AgentOptionsJSON: "{}",
+	})
+	if err != nil {
+		t.Fatalf("CreateThread: %v", err)
+	}
+	if !thread.CreatedAt.Equal(fixed) || !thread.UpdatedAt.Equal(fixed) {
+		t.Fatalf("thread timestamps = %v/%v, want %v", thread.CreatedAt, thread.UpdatedAt, fixed)
+	}
+
+	stored, err := store.GetThread(ctx, "th-clock")
+	if err != nil {
+		t.Fatalf("GetThread: %v", err)
+	}
+	if !stored.CreatedAt.Equal(fixed) {
+		t.Fatalf("stored created_at = %v, want %v", stored.CreatedAt, fixed)
+	}
+}
+
+func TestListThreadsOrdersByLastActivity(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	base := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	counter := 0
+	store.now = func() time.Time {
+		counter++
+		return base.Add(time.Duration(counter) * time.Second)
+	}
+
+	for _, threadID := range []string{"th-old", "th-new"} {
+		if _, err := store.CreateThread(ctx, CreateThreadParams{
+			ThreadID:         threadID,
+			AgentID:          "codex",
+			CWD:              "/tmp/" + threadID,
+			AgentOptionsJSON: "{}",
+		}); err != nil {
+			t.Fatalf("CreateThread(%s): %v", threadID, err)
+		}
+	}
+
+	listOrder := func() string {
+		t.Helper()
+		threads, err := store.ListThreads(ctx, 0)
+		if err != nil {
+			t.Fatalf("ListThreads(): %v", err)
+		}
+		ids := make([]string, 0, len(threads))
+		for _, thread := range threads {
+			ids = append(ids, thread.ThreadID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := listOrder(); got != "th-new,th-old" {
+		t.Fatalf("initial order = %q, want %q", got, "th-new,th-old")
+	}
+
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{TurnID: "tu-1", ThreadID: "th-old", RequestText: "hi"}); err != nil {
+		t.Fatalf("CreateTurn(): %v", err)
+	}
+	if got := listOrder(); got != "th-old,th-new" {
+		t.Fatalf("order after turn = %q, want %q", got, "th-old,th-new")
+	}
+	createdActivity, err := store.GetThread(ctx, "th-old")
+	if err != nil {
+		t.Fatalf("GetThread(th-old): %v", err)
+	}
+
+	if err := store.FinalizeTurn(ctx, FinalizeTurnParams{TurnID: "tu-1", Status: "completed", StopReason: "end_turn"}); err != nil {
+		t.Fatalf("FinalizeTurn(): %v", err)
+	}
+	finalized, err := store.GetThread(ctx, "th-old")
+	if err != nil {
+		t.Fatalf("GetThread(th-old): %v", err)
+	}
+	if !finalized.LastActivityAt.After(createdActivity.LastActivityAt) {
+		t.Fatalf("LastActivityAt after finalize = %s, want after %s", finalized.LastActivityAt, createdActivity.LastActivityAt)
+	}
+	if !finalized.UpdatedAt.Equal(finalized.CreatedAt) {
+		t.Fatalf("UpdatedAt = %s, want unchanged %s", finalized.UpdatedAt, finalized.CreatedAt)
+	}
+}
+
+func TestListThreadsByAgentPaginatesByUpdatedAt(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	for _, tc := range []struct{ threadID, agentID string }{
+		{"th-1", "codex"},
+		{"th-2", "codex"},
+		{"th-other", "gemini"},
+		{"th-3", "codex"},
+	} {
+		if _, err := store.CreateThread(ctx, CreateThreadParams{
+			ThreadID:         tc.threadID,
+			AgentID:          tc.agentID,
+			CWD:              "/tmp/" + tc.threadID,
+			AgentOptionsJSON: "{}",
+		}); err != nil {
+			t.Fatalf("CreateThread(%s): %v", tc.threadID, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := store.UpdateThreadTitle(ctx, "th-1", "touched"); err != nil {
+		t.Fatalf("UpdateThreadTitle(th-1): %v", err)
+	}
+
+	threadIDs := func(threads []Thread) string {
+		ids := make([]string, 0, len(threads))
+		for _, thread := range threads {
+			ids = append(ids, thread.ThreadID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	firstPage, err := store.ListThreadsByAgent(ctx, "codex", 2, 0)
+	if err != nil {
+		t.Fatalf("ListThreadsByAgent(page 1): %v", err)
+	}
+	if got := threadIDs(firstPage); got != "th-1,th-3" {
+		t.Fatalf("page 1 = %q, want %q", got, "th-1,th-3")
+	}
+	secondPage, err := store.ListThreadsByAgent(ctx, "codex", 2, 2)
+	if err != nil {
+		t.Fatalf("ListThreadsByAgent(page 2): %v", err)
+	}
+	if got := threadIDs(secondPage); got != "th-2" {
+		t.Fatalf("page 2 = %q, want %q", got, "th-2")
+	}
+	all, err := store.ListThreadsByAgent(ctx, "codex", 0, 0)
+	if err != nil {
+		t.Fatalf("ListThreadsByAgent(all): %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("all codex threads len = %d, want 3", len(all))
+	}
+	if _, err := store.ListThreadsByAgent(ctx, " ", 10, 0); err == nil {
+		t.Fatalf("ListThreadsByAgent(empty agent) expected error")
+	}
+}
+
+func TestThreadTagsCRUD(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	for _, threadID := range []string{"th-a", "th-b"} {
+		if _, err := store.CreateThread(ctx, CreateThreadParams{
+			ThreadID:         threadID,
+			AgentID:          "codex",
+			CWD:              "/tmp/" + threadID,
+			AgentOptionsJSON: "{}",
+		}); err != nil {
+			t.Fatalf("CreateThread(%s): %v", threadID, err)
+		}
+	}
+
+	for _, tc := range []struct{ threadID, tag string }{
+		{"th-a", "work"},
+		{"th-a", "bug"},
+		{"th-a", "work"},
+		{"th-b", "work"},
+	} {
+		if err := store.AddThreadTag(ctx, tc.threadID, tc.tag); err != nil {
+			t.Fatalf("AddThreadTag(%s, %s): %v", tc.threadID, tc.tag, err)
+		}
+	}
+	if err := store.AddThreadTag(ctx, "th-missing", "work"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("AddThreadTag(missing thread) err = %v, want ErrNotFound", err)
+	}
+
+	thread, err := store.GetThread(ctx, "th-a")
+	if err != nil {
+		t.Fatalf("GetThread(th-a): %v", err)
+	}
+	if got := strings.Join(thread.Tags, ","); got != "bug,work" {
+		t.Fatalf("th-a tags = %q, want %q", got, "bug,work")
+	}
+
+	tagged, err := store.ListThreadsByTag(ctx, "work", 0)
+	if err != nil {
+		t.Fatalf("ListThreadsByTag(work): %v", err)
+	}
+	if len(tagged) != 2 {
+		t.Fatalf("ListThreadsByTag(work) len = %d, want 2", len(tagged))
+	}
+
+	if err := store.RemoveThreadTag(ctx, "th-a", "work"); err != nil {
+		t.Fatalf("RemoveThreadTag(): %v", err)
+	}
+	if err := store.RemoveThreadTag(ctx, "th-a", "work"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RemoveThreadTag(again) err = %v, want ErrNotFound", err)
+	}
+
+	all, err := store.ListThreads(ctx, 0)
+	if err != nil {
+		t.Fatalf("ListThreads(): %v", err)
+	}
+	for _, item := range all {
+		want := map[string]string{"th-a": "bug", "th-b": "work"}[item.ThreadID]
+		if got := strings.Join(item.Tags, ","); got != want {
+			t.Fatalf("ListThreads %s tags = %q, want %q", item.ThreadID, got, want)
+		}
+	}
+
+	if err := store.DeleteThread(ctx, "th-b"); err != nil {
+		t.Fatalf("DeleteThread(th-b): %v", err)
+	}
+	if got := countRows(t, store.db, "thread_tags"); got != 1 {
+		t.Fatalf("thread_tags rows after delete = %d, want 1", got)
+	}
+}
+
+func TestUpdateThreadSummaryAndInternalTurnFlag(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if err := store.UpsertClient(ctx, "client-c"); err != nil {
+		t.Fatalf("UpsertClient(): %v", err)
+	}
+	_, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-summary",
+		AgentID:          "codex",
+		CWD:              "/tmp/project-summary",
+		Title:            "summary-test",
+		AgentOptionsJSON: "{}",
+		Summary:          "",
+	})
+	if err != nil {
+		t.Fatalf("CreateThread(): %v", err)
+	}
+
+	if err := store.UpdateThreadSummary(ctx, "th-summary", "new summary"); err != nil {
+		t.Fatalf("UpdateThreadSummary(): %v", err)
+	}
+	thread, err := store.GetThread(ctx, "th-summary")
+	if err != nil {
+		t.Fatalf("GetThread(th-summary): %v", err)
+	}
+	if thread.Summary != "new summary" {
+		t.Fatalf("thread summary = %q, want %q", thread.Summary, "new summary")
+	}
+
+	_, err = store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-internal",
+		ThreadID:    "th-summary",
+		RequestText: "internal prompt",
+		Status:      "running",
+		IsInternal:  true,
+	})
+	if err != nil {
+		t.Fatalf("CreateTurn(internal): %v", err)
+	}
+
+	turn, err := store.GetTurn(ctx, "tu-internal")
+	if err != nil {
+		t.Fatalf("GetTurn(tu-internal): %v", err)
+	}
+	if !turn.IsInternal {
+		t.Fatalf("GetTurn(tu-internal).IsInternal = false, want true")
+	}
+
+	if _, err := store.CreateTurn(ctx, CreateTurnParams{
+		TurnID:      "tu-user",
+		ThreadID:    "th-summary",
+		RequestText: "user prompt",
+		Status:      "running",
+	}); err != nil {
+		t.Fatalf("CreateTurn(user): %v", err)
+	}
+	for _, turnID := range []string{"tu-internal", "tu-user"} {
+		if err := store.FinalizeTurn(ctx, FinalizeTurnParams{TurnID: turnID, Status: "completed"}); err != nil {
+			t.Fatalf("FinalizeTurn(%s): %v", turnID, err)
+		}
+	}
+	thread, err = store.GetThread(ctx, "th-summary")
+	if err != nil {
+		t.Fatalf("GetThread(th-summary) after turns: %v", err)
+	}
+	if got, want := thread.TurnsSinceCompact, 1; got != want {
+		t.Fatalf("TurnsSinceCompact = %d, want %d (internal turns do not count)", got, want)
+	}
+
+	if err := store.UpdateThreadSummary(ctx, "th-summary", "newer summary"); err != nil {
+		t.Fatalf("UpdateThreadSummary(newer): %v", err)
+	}
+	thread, err = store.GetThread(ctx, "th-summary")
+	if err != nil {
+		t.Fatalf("GetThread(th-summary) after summary: %v", err)
+	}
+	if thread.TurnsSinceCompact != 0 {
+		t.Fatalf("TurnsSinceCompact after UpdateThreadSummary = %d, want 0", thread.TurnsSinceCompact)
+	}
+}
+
+func TestUpdateThreadAgentOptions(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if err := store.UpsertClient(ctx, "client-model"); err != nil {
+		t.Fatalf("UpsertClient(): %v", err)
+	}
+	_, err := store.CreateThread(ctx, CreateThreadParams{
+		ThreadID:         "th-model",
 		AgentID:          "codex",
 		CWD:              "/tmp/project-model",
 		Title:            "model-test",
@@ -751,6 +1909,157 @@ func TestUpdateThreadAgentOptions(t *testing.T) {
 	}
 }
 
+func TestUpdateThreadAgentOptionsRespectsLock(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	for _, params := range []CreateThreadParams{
+		{ThreadID: "th-locked", AgentID: "codex", CWD: "/tmp/locked", AgentOptionsJSON: `{"modelId":"gpt-5"}`, OptionsLocked: true},
+		{ThreadID: "th-open", AgentID: "codex", CWD: "/tmp/open", AgentOptionsJSON: `{"modelId":"gpt-5"}`},
+	} {
+		if _, err := store.CreateThread(ctx, params); err != nil {
+			t.Fatalf("CreateThread(%s): %v", params.ThreadID, err)
+		}
+	}
+
+	if err := store.UpdateThreadAgentOptions(ctx, "th-locked", `{"modelId":"o3"}`); !errors.Is(err, ErrLocked) {
+		t.Fatalf("UpdateThreadAgentOptions(locked) err = %v, want ErrLocked", err)
+	}
+	if err := store.UpdateThreadAgentOptions(ctx, "th-open", `{"modelId":"o3"}`); err != nil {
+		t.Fatalf("UpdateThreadAgentOptions(open): %v", err)
+	}
+	// Server-maintained state such as the bound session ignores the lock.
+	if err := store.UpdateThreadAgentState(ctx, "th-locked", `{"modelId":"gpt-5","sessionId":"s-1"}`); err != nil {
+		t.Fatalf("UpdateThreadAgentState(locked): %v", err)
+	}
+	if err := store.UpdateThreadAgentState(ctx, "missing-thread", `{}`); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateThreadAgentState(missing) err = %v, want ErrNotFound", err)
+	}
+
+	locked, err := store.GetThread(ctx, "th-locked")
+	if err != nil {
+		t.Fatalf("GetThread(th-locked): %v", err)
+	}
+	if !locked.OptionsLocked || locked.AgentOptionsJSON != `{"modelId":"gpt-5","sessionId":"s-1"}` {
+		t.Fatalf("locked thread = %+v, want locked with state update only", locked)
+	}
+	threads, err := store.ListThreads(ctx, 0)
+	if err != nil {
+		t.Fatalf("ListThreads(): %v", err)
+	}
+	for _, thread := range threads {
+		if thread.OptionsLocked != (thread.ThreadID == "th-locked") {
+			t.Fatalf("thread %s OptionsLocked = %v", thread.ThreadID, thread.OptionsLocked)
+		}
+	}
+}
+
+func TestClientStoredBytes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if got, err := store.GetClientStoredBytes(ctx, "client-a"); err != nil || got != 0 {
+		t.Fatalf("GetClientStoredBytes(new) = %d, %v, want 0, nil", got, err)
+	}
+	for _, threadID := range []string{"th-1", "th-2"} {
+		if _, err := store.CreateThread(ctx, CreateThreadParams{
+			ThreadID:         threadID,
+			AgentID:          "codex",
+			CWD:              "/tmp/project-a",
+			AgentOptionsJSON: "{}",
+		}); err != nil {
+			t.Fatalf("CreateThread(%s): %v", threadID, err)
+		}
+	}
+	for _, turn := range []struct {
+		turnID, threadID, clientID, request, response string
+	}{
+		{"tu-1", "th-1", "client-a", "héllo", "world"},
+		{"tu-2", "th-2", "client-a", "again", "answer"},
+		{"tu-3", "th-1", "client-b", "other", "reply"},
+		{"tu-4", "th-1", "", "internal", "summary"},
+	} {
+		if _, err := store.CreateTurn(ctx, CreateTurnParams{
+			TurnID:      turn.turnID,
+			ThreadID:    turn.threadID,
+			RequestText: turn.request,
+			ClientID:    turn.clientID,
+		}); err != nil {
+			t.Fatalf("CreateTurn(%s): %v", turn.turnID, err)
+		}
+		if err := store.FinalizeTurn(ctx, FinalizeTurnParams{
+			TurnID:       turn.turnID,
+			ResponseText: turn.response,
+			Status:       "completed",
+		}); err != nil {
+			t.Fatalf("FinalizeTurn(%s): %v", turn.turnID, err)
+		}
+	}
+
+	// Bytes, not runes: "héllo" is six bytes.
+	if got, err := store.GetClientStoredBytes(ctx, "client-a"); err != nil || got != 6+5+5+6 {
+		t.Fatalf("GetClientStoredBytes(client-a) = %d, %v, want 22, nil", got, err)
+	}
+	if err := store.DeleteThread(ctx, "th-2"); err != nil {
+		t.Fatalf("DeleteThread(th-2): %v", err)
+	}
+	if got, err := store.GetClientStoredBytes(ctx, "client-a"); err != nil || got != 11 {
+		t.Fatalf("GetClientStoredBytes(client-a) after delete = %d, %v, want 11, nil", got, err)
+	}
+	if got, err := store.GetClientStoredBytes(ctx, " "); err != nil || got != 0 {
+		t.Fatalf("GetClientStoredBytes(blank) = %d, %v, want 0, nil", got, err)
+	}
+}
+
+func TestRecordClient(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer func() {
+		_ = store.Close()
+	}()
+
+	if _, err := store.GetClientRecord(ctx, "client-a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetClientRecord(missing) err = %v, want ErrNotFound", err)
+	}
+	if err := store.RecordClient(ctx, RecordClientParams{ClientID: "client-a", DisplayName: "Laptop", UserAgent: "ua/1", MetadataJSON: `{"team":"core"}`}); err != nil {
+		t.Fatalf("RecordClient(first): %v", err)
+	}
+	// Later requests keep the first user agent and, without new values, the
+	// stored name and metadata.
+	if err := store.RecordClient(ctx, RecordClientParams{ClientID: "client-a", UserAgent: "ua/2"}); err != nil {
+		t.Fatalf("RecordClient(second): %v", err)
+	}
+	record, err := store.GetClientRecord(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("GetClientRecord: %v", err)
+	}
+	if record.DisplayName != "Laptop" || record.UserAgent != "ua/1" || record.MetadataJSON != `{"team":"core"}` {
+		t.Fatalf("record = %+v, want first name, user agent, and metadata", record)
+	}
+	if record.CreatedAt.IsZero() || record.LastSeenAt.Before(record.CreatedAt) {
+		t.Fatalf("record timestamps = %v / %v", record.CreatedAt, record.LastSeenAt)
+	}
+
+	if err := store.RecordClient(ctx, RecordClientParams{ClientID: "client-a", DisplayName: "Desktop", MetadataJSON: `{"team":"web"}`}); err != nil {
+		t.Fatalf("RecordClient(update): %v", err)
+	}
+	if record, err = store.GetClientRecord(ctx, "client-a"); err != nil || record.DisplayName != "Desktop" || record.MetadataJSON != `{"team":"web"}` {
+		t.Fatalf("record after update = %+v, %v", record, err)
+	}
+	if err := store.RecordClient(ctx, RecordClientParams{ClientID: "client-b"}); err != nil {
+		t.Fatalf("RecordClient(client-b): %v", err)
+	}
+	if record, err = store.GetClientRecord(ctx, "client-b"); err != nil || record.MetadataJSON != "{}" {
+		t.Fatalf("client-b record = %+v, %v, want empty metadata object", record, err)
+	}
+}
+
 func TestUpdateThreadTitle(t *testing.T) {
 	ctx := context.Background()
 	store := newTestStore(t)
@@ -1055,7 +2364,7 @@ func TestAgentSlashCommandsCRUD(t *testing.T) {
 	}
 }
 
-func newTestStore(t *testing.T) *Store {
+func newTestStore(t testing.TB) *Store {
 	t.Helper()
 
 	dbPath := filepath.Join(t.TempDir(), "hub.db")
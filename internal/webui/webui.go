@@ -10,26 +10,71 @@ import (
 //go:embed web/dist
 var staticFiles embed.FS
 
+// DefaultSecurityHeaders are set on every web UI response. The policy fits
+// the SPA as built: its own scripts and styles (plus inline style
+// attributes), images from data:/blob: URLs, and API calls and attachment
+// images from any http(s) origin. The last part is a tradeoff: the Server
+// URL setting points the UI at an API origin only the browser knows, so
+// connect-src and img-src cannot name it. Scripts stay same-origin.
+func DefaultSecurityHeaders() map[string]string {
+	return map[string]string{
+		"Content-Security-Policy": "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+			"img-src 'self' data: blob: http: https:; font-src 'self' data:; connect-src 'self' http: https:; " +
+			"object-src 'none'; " +
+			"base-uri 'self'; form-action 'self'; frame-ancestors 'none'",
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "no-referrer",
+		"Permissions-Policy":     "camera=(), microphone=(), geolocation=()",
+	}
+}
+
 // Handler returns an http.Handler that serves the embedded frontend SPA.
 // Files that exist in web/dist are served directly (JS, CSS, images, etc.).
 // All other paths return index.html to support client-side routing.
+// Responses carry DefaultSecurityHeaders.
 func Handler() http.Handler {
+	return HandlerWithHeaders(nil)
+}
+
+// HandlerWithHeaders is Handler with overrides merged over
+// DefaultSecurityHeaders. An override with an empty value drops that
+// default header.
+func HandlerWithHeaders(overrides map[string]string) http.Handler {
 	distFS, err := fs.Sub(staticFiles, "web/dist")
 	if err != nil {
 		panic("webui: sub embed FS: " + err.Error())
 	}
+	headers := DefaultSecurityHeaders()
+	for name, value := range overrides {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			delete(headers, name)
+			continue
+		}
+		headers[name] = value
+	}
 	return &spaHandler{
 		fs:         distFS,
 		fileServer: http.FileServer(http.FS(distFS)),
+		headers:    headers,
 	}
 }
 
 type spaHandler struct {
 	fs         fs.FS
 	fileServer http.Handler
+	headers    map[string]string
 }
 
 func (h *spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for name, value := range h.headers {
+		w.Header().Set(name, value)
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/")
 	if path == "" {
 		path = "index.html"
@@ -84,3 +84,54 @@ func TestHandlerSPAFallback(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlerSetsSecurityHeaders(t *testing.T) {
+	h := webui.Handler()
+
+	for _, p := range []string{"/", "/threads/abc-123", "/favicon.svg"} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		for name, want := range webui.DefaultSecurityHeaders() {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("GET %s header %s = %q, want %q", p, name, got, want)
+			}
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	csp := w.Header().Get("Content-Security-Policy")
+	// The Server URL setting may point the UI at another API origin.
+	for _, want := range []string{"script-src 'self';", "connect-src 'self' http: https:;", "img-src 'self' data: blob: http: https:;"} {
+		if !strings.Contains(csp, want) {
+			t.Fatalf("GET / Content-Security-Policy = %q, want %q", csp, want)
+		}
+	}
+}
+
+func TestHandlerWithHeadersOverridesDefaults(t *testing.T) {
+	h := webui.HandlerWithHeaders(map[string]string{
+		"content-security-policy": "default-src 'none'",
+		"X-Frame-Options":         "",
+		"X-Custom":                "1",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Content-Security-Policy"); got != "default-src 'none'" {
+		t.Fatalf("Content-Security-Policy = %q, want override", got)
+	}
+	if _, ok := w.Header()["X-Frame-Options"]; ok {
+		t.Fatalf("X-Frame-Options = %q, want header removed", w.Header().Get("X-Frame-Options"))
+	}
+	if got := w.Header().Get("X-Custom"); got != "1" {
+		t.Fatalf("X-Custom = %q, want 1", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("X-Content-Type-Options = %q, want default nosniff", got)
+	}
+}